@@ -3,11 +3,13 @@ package main
 
 import (
 	"context"
+	"errors"
 	"log"
 	"os"
 	"os/signal"
 	"syscall"
 
+	"github.com/gokrazy/rsync"
 	"github.com/gokrazy/rsync/rsynccmd"
 )
 
@@ -20,6 +22,16 @@ func main() {
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	if _, err := cmd.Run(ctx); err != nil {
+		var ee *rsync.ExitError
+		if errors.As(err, &ee) {
+			log.Print(err)
+			os.Exit(ee.Code)
+		}
+		if errors.Is(err, context.Canceled) && ctx.Err() != nil {
+			// Interrupted by SIGINT or SIGTERM.
+			log.Print(err)
+			os.Exit(rsync.RERR_SIGNAL)
+		}
 		log.Fatal(err)
 	}
 }
@@ -15,8 +15,101 @@ const (
 	XMIT_HAS_IDEV_DATA       = (1 << 9)
 	XMIT_SAME_DEV            = (1 << 10)
 	XMIT_RDEV_MINOR_IS_SMALL = (1 << 11)
+
+	// The names of the extended flags as of rsync 3.x, some of which depend
+	// on the protocol version:
+
+	XMIT_NO_CONTENT_DIR     = (1 << 8)  /* protocols >= 30 (directory) */
+	XMIT_HLINKED            = (1 << 9)  /* non-directory */
+	XMIT_SAME_DEV_pre30     = (1 << 10) /* protocols 28 - 29 */
+	XMIT_USER_NAME_FOLLOWS  = (1 << 10) /* protocols >= 30 */
+	XMIT_RDEV_MINOR_8_pre30 = (1 << 11) /* protocols 28 - 29 */
+	XMIT_GROUP_NAME_FOLLOWS = (1 << 11) /* protocols >= 30 */
+	XMIT_HLINK_FIRST        = (1 << 12) /* protocols >= 30 */
+	XMIT_IO_ERROR_ENDLIST   = (1 << 12) /* protocols >= 31 (w/XMIT_EXTENDED_FLAGS) */
+	XMIT_MOD_NSEC           = (1 << 13) /* protocols >= 31 */
+)
+
+// Flags of the ACLs in the file list (with --acls), and of their named
+// entries, which are sent along with the permissions.
+//
+// rsync/acls.c
+const (
+	XMIT_USER_OBJ  = (1 << 0)
+	XMIT_GROUP_OBJ = (1 << 1)
+	XMIT_MASK_OBJ  = (1 << 2)
+	XMIT_OTHER_OBJ = (1 << 3)
+	XMIT_NAME_LIST = (1 << 4)
+
+	XFLAG_NAME_FOLLOWS = 0x0001
+	XFLAG_NAME_IS_USER = 0x0002
+)
+
+// Compatibility flags, exchanged by protocol 30 and newer.
+//
+// rsync.h
+const (
+	CF_INC_RECURSE         = (1 << 0)
+	CF_SYMLINK_TIMES       = (1 << 1)
+	CF_SYMLINK_ICONV       = (1 << 2)
+	CF_SAFE_FLIST          = (1 << 3)
+	CF_AVOID_XATTR_OPTIM   = (1 << 4)
+	CF_CHKSUM_SEED_FIX     = (1 << 5)
+	CF_INPLACE_PARTIAL_DIR = (1 << 6)
+	CF_VARINT_FLIST_FLAGS  = (1 << 7)
+	CF_ID0_NAMES           = (1 << 8)
+)
+
+// Item flags, which protocol 29 and newer send along with each file list index.
+//
+// rsync.h
+const (
+	ITEM_REPORT_ATIME       = (1 << 0)
+	ITEM_REPORT_CHANGE      = (1 << 1)
+	ITEM_REPORT_SIZE        = (1 << 2) /* regular files only */
+	ITEM_REPORT_TIMEFAIL    = (1 << 2) /* symlinks only */
+	ITEM_REPORT_TIME        = (1 << 3)
+	ITEM_REPORT_PERMS       = (1 << 4)
+	ITEM_REPORT_OWNER       = (1 << 5)
+	ITEM_REPORT_GROUP       = (1 << 6)
+	ITEM_REPORT_ACL         = (1 << 7)
+	ITEM_REPORT_XATTR       = (1 << 8)
+	ITEM_REPORT_CRTIME      = (1 << 10)
+	ITEM_BASIS_TYPE_FOLLOWS = (1 << 11)
+	ITEM_XNAME_FOLLOWS      = (1 << 12)
+	ITEM_IS_NEW             = (1 << 13)
+	ITEM_LOCAL_CHANGE       = (1 << 14)
+	ITEM_TRANSFER           = (1 << 15)
+)
+
+// Special file list indexes.
+//
+// rsync.h
+const (
+	NDX_DONE         = -1
+	NDX_FLIST_EOF    = -2
+	NDX_DEL_STATS    = -3
+	NDX_FLIST_OFFSET = -101
 )
 
+// Basis file types, which follow the item flags if ITEM_BASIS_TYPE_FOLLOWS is
+// set. Values below FNAMECMP_FNAME refer to a --compare-dest (or similar)
+// directory.
+//
+// rsync.h
+const (
+	FNAMECMP_BASIS_DIR_LOW  = 0x00
+	FNAMECMP_BASIS_DIR_HIGH = 0x7F
+	FNAMECMP_FNAME          = 0x80
+	FNAMECMP_PARTIAL_DIR    = 0x81
+	FNAMECMP_BACKUP         = 0x82
+	FNAMECMP_FUZZY          = 0x83
+)
+
+// SYMLINK_PREFIX is prepended to the targets of received symlinks with
+// --munge-links, which makes them unusable (rsync.h).
+const SYMLINK_PREFIX = "/rsyncd-munged/"
+
 // as per /usr/include/bits/stat.h:
 const (
 	S_IFMT   = 0o0170000 // bits determining the file type
@@ -29,8 +122,11 @@ const (
 	S_IFSOCK = 0o0140000 // Socket
 )
 
-// ProtocolVersion defines the currently implemented rsync protocol
-// version. Protocol version 27 seems to be the safest bet for wide
-// compatibility: version 27 was introduced by rsync 2.6.0 (released 2004), and
-// is supported by openrsync and rsyn.
-const ProtocolVersion = 27
+// ProtocolVersion defines the newest implemented rsync protocol version.
+// Protocol version 31 was introduced by rsync 3.1.0 (released 2013).
+const ProtocolVersion = 31
+
+// MinProtocolVersion defines the oldest supported rsync protocol version,
+// which we fall back to when talking to older peers. Version 27 was introduced
+// by rsync 2.6.0 (released 2004), and is supported by openrsync and rsyn.
+const MinProtocolVersion = 27
@@ -0,0 +1,57 @@
+package rsync
+
+import "fmt"
+
+// Exit codes, as documented in the EXIT VALUES section of rsync(1).
+//
+// rsync/errcode.h
+const (
+	RERR_OK          = 0
+	RERR_SYNTAX      = 1 // syntax or usage error
+	RERR_PROTOCOL    = 2 // protocol incompatibility
+	RERR_FILESELECT  = 3 // errors selecting input/output files, dirs
+	RERR_UNSUPPORTED = 4 // requested action not supported
+	RERR_STARTCLIENT = 5 // error starting client-server protocol
+
+	RERR_SOCKETIO   = 10 // error in socket IO
+	RERR_FILEIO     = 11 // error in file IO
+	RERR_STREAMIO   = 12 // error in rsync protocol data stream
+	RERR_MESSAGEIO  = 13 // errors with program diagnostics
+	RERR_IPC        = 14 // error in IPC code
+	RERR_CRASHED    = 15 // sibling crashed
+	RERR_TERMINATED = 16 // sibling terminated abnormally
+
+	RERR_SIGNAL1   = 19 // status returned when sent SIGUSR1
+	RERR_SIGNAL    = 20 // status returned when sent SIGINT, SIGTERM, SIGHUP
+	RERR_WAITCHILD = 21 // some error returned by waitpid()
+	RERR_MALLOC    = 22 // error allocating core memory buffers
+	RERR_PARTIAL   = 23 // partial transfer
+	RERR_VANISHED  = 24 // file(s) vanished on sender side
+	RERR_DEL_LIMIT = 25 // skipped some deletes due to --max-delete
+
+	RERR_TIMEOUT    = 30 // timeout in data send/receive
+	RERR_CONTIMEOUT = 35 // timeout waiting for daemon connection
+)
+
+// I/O error flags, which the sender transmits after the file list and in
+// MSG_IO_ERROR messages.
+//
+// rsync/rsync.h
+const (
+	IOERR_GENERAL   = (1 << 0) // For backward compatibility, this must == 1
+	IOERR_VANISHED  = (1 << 1)
+	IOERR_DEL_LIMIT = (1 << 2)
+)
+
+// ExitError is returned by a transfer which completed, but should result in
+// a non-zero exit code, like tridge rsync’s exit_cleanup.
+type ExitError struct {
+	Code int // one of the RERR_* constants
+	Err  error
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("%v (code %d)", e.Err, e.Code)
+}
+
+func (e *ExitError) Unwrap() error { return e.Err }
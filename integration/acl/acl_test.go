@@ -0,0 +1,240 @@
+package acl_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gokrazy/rsync"
+	"github.com/gokrazy/rsync/internal/rsynccommon"
+	"github.com/gokrazy/rsync/internal/rsynctest"
+	"github.com/gokrazy/rsync/internal/xattr"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMain(m *testing.M) {
+	rsynctest.CommandMain(m)
+}
+
+func file(t *testing.T, fn string) xattr.File {
+	t.Helper()
+	root, err := os.OpenRoot(filepath.Dir(fn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { root.Close() })
+	return xattr.InRoot(root, filepath.Base(fn))
+}
+
+func setACL(t *testing.T, fn, attr string, acl *rsynccommon.ACL) error {
+	t.Helper()
+	return file(t, fn).Set(attr, acl.PosixACL())
+}
+
+func removeACL(t *testing.T, fn, attr string) {
+	t.Helper()
+	if err := file(t, fn).Remove(attr); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// acls returns the access and default ACL of fn (empty if there is none).
+func acls(t *testing.T, fn string) map[string]string {
+	t.Helper()
+	result := make(map[string]string)
+	for _, attr := range []string{rsynccommon.ACLAccessXattr, rsynccommon.ACLDefaultXattr} {
+		value, err := file(t, fn).Get(attr)
+		if errors.Is(err, xattr.ErrNoAttr) {
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		result[attr] = string(value)
+	}
+	return result
+}
+
+// accessACL is an access ACL with a named user and group, whose mask grants
+// read and write permission.
+var accessACL = &rsynccommon.ACL{
+	UserObj:  6,
+	GroupObj: 4,
+	MaskObj:  6,
+	OtherObj: 4,
+	Names: []rsynccommon.ACLName{
+		{ID: 12345, Access: 6, IsUser: true},
+		{ID: 23456, Access: 4},
+	},
+}
+
+// defaultACL is a default ACL which grants a named group access to new files.
+var defaultACL = &rsynccommon.ACL{
+	UserObj:  7,
+	GroupObj: 5,
+	MaskObj:  7,
+	OtherObj: 5,
+	Names: []rsynccommon.ACLName{
+		{ID: 23456, Access: 7},
+	},
+}
+
+func TestACLs(t *testing.T) {
+	t.Parallel()
+
+	for _, mode := range rsynctest.Modes {
+		t.Run(mode, func(t *testing.T) {
+			t.Parallel()
+
+			source := filepath.Join(t.TempDir(), "source")
+			rsynctest.WriteFiles(t, source, map[string]string{
+				"a.txt": "a",
+				"b.txt": "b",
+				"c.txt": "c",
+			})
+			if err := setACL(t, filepath.Join(source, "a.txt"), rsynccommon.ACLAccessXattr, accessACL); err != nil {
+				if errors.Is(err, errors.ErrUnsupported) {
+					t.Skipf("ACLs not supported: %v", err)
+				}
+				t.Fatal(err)
+			}
+			// Same ACL as a.txt, which is sent by reference.
+			if err := setACL(t, filepath.Join(source, "c.txt"), rsynccommon.ACLAccessXattr, accessACL); err != nil {
+				t.Fatal(err)
+			}
+			// The files in sub inherit the default ACL.
+			if err := os.Mkdir(filepath.Join(source, "sub"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := setACL(t, filepath.Join(source, "sub"), rsynccommon.ACLDefaultXattr, defaultACL); err != nil {
+				t.Fatal(err)
+			}
+			rsynctest.WriteFiles(t, source, map[string]string{"sub/d.txt": "d"})
+			var fns []string
+			for _, name := range []string{"a.txt", "b.txt", "c.txt", "sub/d.txt", "sub", "."} {
+				fns = append(fns, filepath.Join(source, name))
+			}
+			rsynctest.Chtimes(t, rsynctest.GosPublicRelease, fns...)
+			if err := os.Symlink("a.txt", filepath.Join(source, "link")); err != nil {
+				t.Fatal(err)
+			}
+
+			dest := filepath.Join(t.TempDir(), "dest")
+			if err := os.Mkdir(dest, 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			check := func(t *testing.T) {
+				t.Helper()
+				for _, name := range []string{"a.txt", "b.txt", "c.txt", "sub", "sub/d.txt"} {
+					want := acls(t, filepath.Join(source, name))
+					got := acls(t, filepath.Join(dest, name))
+					if diff := cmp.Diff(want, got); diff != "" {
+						t.Errorf("%s: unexpected ACLs: diff (-want +got):\n%s", name, diff)
+					}
+					wantSt, err := os.Stat(filepath.Join(source, name))
+					if err != nil {
+						t.Fatal(err)
+					}
+					gotSt, err := os.Stat(filepath.Join(dest, name))
+					if err != nil {
+						t.Fatal(err)
+					}
+					if want, got := wantSt.Mode(), gotSt.Mode(); want != got {
+						t.Errorf("%s: unexpected mode: got %v, want %v", name, got, want)
+					}
+				}
+			}
+
+			rsynctest.TransferOutput(t, mode, source, dest, "-aA")
+			check(t)
+
+			// Remove the ACL of a.txt (but not c.txt, which shares it), add
+			// one to b.txt, and remove the default ACL of the destination
+			// directory.
+			removeACL(t, filepath.Join(source, "a.txt"), rsynccommon.ACLAccessXattr)
+			if err := os.Chmod(filepath.Join(source, "a.txt"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chmod(filepath.Join(dest, "a.txt"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := setACL(t, filepath.Join(source, "b.txt"), rsynccommon.ACLAccessXattr, accessACL.WithPerms(0644)); err != nil {
+				t.Fatal(err)
+			}
+			removeACL(t, filepath.Join(dest, "sub"), rsynccommon.ACLDefaultXattr)
+
+			got := rsynctest.TransferOutput(t, mode, source, dest, "-aA", "-i")
+			want := []string{
+				".f.......a. a.txt",
+				".f.......a. b.txt",
+				".d.......a. sub/",
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("unexpected output: diff (-want +got):\n%s", diff)
+			}
+			check(t)
+		})
+	}
+}
+
+func TestACLsPartial(t *testing.T) {
+	t.Parallel()
+
+	// tmpfs stores ACLs which are too large for a single ext4 block, so
+	// setting them in the destination fails with ENOSPC.
+	large := &rsynccommon.ACL{
+		UserObj:  6,
+		GroupObj: 4,
+		MaskObj:  6,
+		OtherObj: 4,
+	}
+	for id := range uint32(1024) {
+		large.Names = append(large.Names, rsynccommon.ACLName{ID: 10000 + id, Access: 4, IsUser: true})
+	}
+
+	for _, mode := range rsynctest.Modes {
+		t.Run(mode, func(t *testing.T) {
+			t.Parallel()
+
+			tmp, err := os.MkdirTemp("/dev/shm", "rsync-acl-")
+			if err != nil {
+				t.Skipf("no tmpfs: %v", err)
+			}
+			t.Cleanup(func() { os.RemoveAll(tmp) })
+			source := filepath.Join(tmp, "source")
+			rsynctest.WriteFiles(t, source, map[string]string{
+				"a.txt": "a",
+				"b.txt": "b",
+			})
+			if err := setACL(t, filepath.Join(source, "a.txt"), rsynccommon.ACLAccessXattr, large); err != nil {
+				if errors.Is(err, errors.ErrUnsupported) {
+					t.Skipf("ACLs not supported: %v", err)
+				}
+				t.Fatal(err)
+			}
+
+			dest := filepath.Join(t.TempDir(), "dest")
+			rsynctest.WriteFiles(t, dest, map[string]string{"probe": ""})
+			if err := setACL(t, filepath.Join(dest, "probe"), rsynccommon.ACLAccessXattr, large); err == nil {
+				t.Skip("the destination file system stores large ACLs")
+			}
+			if err := os.Remove(filepath.Join(dest, "probe")); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = rsynctest.Transfer(t, mode, source, dest, "-aA")
+			var ee *rsync.ExitError
+			if !errors.As(err, &ee) {
+				t.Fatalf("unexpected error: got %v, want an ExitError", err)
+			}
+			if got, want := ee.Code, rsync.RERR_PARTIAL; got != want {
+				t.Errorf("unexpected exit code: got %d, want %d", got, want)
+			}
+			// The file data is transferred regardless.
+			rsynctest.CheckFile(t, filepath.Join(dest, "a.txt"), []byte("a"))
+			rsynctest.CheckFile(t, filepath.Join(dest, "b.txt"), []byte("b"))
+		})
+	}
+}
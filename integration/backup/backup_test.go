@@ -0,0 +1,142 @@
+package backup_test
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gokrazy/rsync/internal/rsynctest"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMain(m *testing.M) {
+	rsynctest.CommandMain(m)
+}
+
+func TestBackupSuffix(t *testing.T) {
+	t.Parallel()
+
+	for _, mode := range rsynctest.RemoteModes {
+		t.Run(mode, func(t *testing.T) {
+			t.Parallel()
+
+			source := filepath.Join(t.TempDir(), "source")
+			rsynctest.WriteFiles(t, source, map[string]string{
+				"config":         "new config",
+				"dir/unchanged":  "unchanged",
+				"dir/nested.cfg": "new nested",
+			})
+
+			dest := filepath.Join(t.TempDir(), "dest")
+			rsynctest.WriteFiles(t, dest, map[string]string{
+				"config":         "old",
+				"dir/unchanged":  "unchanged",
+				"dir/nested.cfg": "old nested",
+				"dir/extra":      "extraneous",
+				"config~":        "older backup",
+			})
+			// Make dir/unchanged identical (including its modification
+			// time), so that the transfer skips it and does not back it up.
+			if _, err := rsynctest.RunUnrestricted(t, "gokr-rsync", "-a", filepath.Join(source, "dir/unchanged"), filepath.Join(dest, "dir/")); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := rsynctest.Transfer(t, mode, source, dest, "-a", "--backup", "--delete"); err != nil {
+				t.Fatal(err)
+			}
+			want := map[string]string{
+				"config":          "new config",
+				"config~":         "old",
+				"dir/unchanged":   "unchanged",
+				"dir/nested.cfg":  "new nested",
+				"dir/nested.cfg~": "old nested",
+				"dir/extra~":      "extraneous",
+			}
+			if diff := cmp.Diff(want, rsynctest.ReadFiles(t, dest)); diff != "" {
+				t.Errorf("unexpected destination: diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestBackupDir(t *testing.T) {
+	t.Parallel()
+
+	for _, mode := range rsynctest.RemoteModes {
+		t.Run(mode, func(t *testing.T) {
+			t.Parallel()
+
+			source := filepath.Join(t.TempDir(), "source")
+			rsynctest.WriteFiles(t, source, map[string]string{
+				"config":         "new config",
+				"dir/nested.cfg": "new nested",
+			})
+
+			dest := filepath.Join(t.TempDir(), "dest")
+			rsynctest.WriteFiles(t, dest, map[string]string{
+				"config":         "old",
+				"dir/nested.cfg": "old nested",
+				"dir/sub/extra":  "extraneous",
+			})
+
+			if _, err := rsynctest.Transfer(t, mode, source, dest, "-a", "--backup-dir=backups/1", "--suffix=.bak", "--delete"); err != nil {
+				t.Fatal(err)
+			}
+			want := map[string]string{
+				"config":                       "new config",
+				"dir/nested.cfg":               "new nested",
+				"backups/1/config.bak":         "old",
+				"backups/1/dir/nested.cfg.bak": "old nested",
+				"backups/1/dir/sub/extra.bak":  "extraneous",
+			}
+			if diff := cmp.Diff(want, rsynctest.ReadFiles(t, dest)); diff != "" {
+				t.Errorf("unexpected destination: diff (-want +got):\n%s", diff)
+			}
+
+			// A second backup replaces the first one.
+			rsynctest.WriteFiles(t, source, map[string]string{"config": "newer config"})
+			if _, err := rsynctest.Transfer(t, mode, source, dest, "-a", "--backup-dir=backups/1", "--suffix=.bak", "--delete"); err != nil {
+				t.Fatal(err)
+			}
+			want["config"] = "newer config"
+			want["backups/1/config.bak"] = "new config"
+			if diff := cmp.Diff(want, rsynctest.ReadFiles(t, dest)); diff != "" {
+				t.Errorf("unexpected destination: diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestBackupDirOutsideDest(t *testing.T) {
+	t.Parallel()
+
+	source := filepath.Join(t.TempDir(), "source")
+	rsynctest.WriteFiles(t, source, map[string]string{"config": "new config"})
+	dest := filepath.Join(t.TempDir(), "dest")
+	rsynctest.WriteFiles(t, dest, map[string]string{"config": "old"})
+
+	for _, backupDir := range []string{"../backups", t.TempDir()} {
+		_, err := rsynctest.RunUnrestricted(t, "gokr-rsync", "-a", "--backup-dir="+backupDir, source+"/", dest)
+		if err == nil {
+			t.Fatalf("--backup-dir=%s unexpectedly succeeded", backupDir)
+		}
+		if want := "is not within the destination"; !strings.Contains(err.Error(), want) {
+			t.Errorf("unexpected error: got %v, want %q", err, want)
+		}
+	}
+	if diff := cmp.Diff(map[string]string{"config": "old"}, rsynctest.ReadFiles(t, dest)); diff != "" {
+		t.Errorf("unexpected destination: diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestSuffixWithSlash(t *testing.T) {
+	t.Parallel()
+
+	_, err := rsynctest.RunUnrestricted(t, "gokr-rsync", "-a", "--backup", "--suffix=/old", t.TempDir()+"/", t.TempDir())
+	if err == nil {
+		t.Fatal("--suffix with a slash unexpectedly succeeded")
+	}
+	if want := "--suffix cannot contain slashes"; !strings.Contains(err.Error(), want) {
+		t.Errorf("unexpected error: got %v, want %q", err, want)
+	}
+}
@@ -0,0 +1,117 @@
+package bwlimit_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gokrazy/rsync/internal/rsynctest"
+	"github.com/gokrazy/rsync/rsyncd"
+)
+
+func TestMain(m *testing.M) {
+	rsynctest.CommandMain(m)
+}
+
+// size is the size of the transferred file: half a second worth of data at
+// --bwlimit=1m.
+const size = 512 * 1024
+
+// minDuration is the minimum duration of transferring size bytes at
+// --bwlimit=1m: tridge rsync only sleeps once the bandwidth limit was
+// exceeded by 1/10th of a second.
+const minDuration = 300 * time.Millisecond
+
+// setup creates a source directory containing a file of random (that is,
+// incompressible) content and an empty destination directory.
+func setup(t *testing.T) (source, dest string, content []byte) {
+	t.Helper()
+	content = rsynctest.RandomBytes(1, size)
+	source = filepath.Join(t.TempDir(), "source")
+	dest = filepath.Join(t.TempDir(), "dest")
+	rsynctest.WriteFiles(t, source, map[string]string{"file": string(content)})
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		t.Fatal(err)
+	}
+	return source, dest, content
+}
+
+func TestBwLimit(t *testing.T) {
+	t.Parallel()
+
+	for _, mode := range rsynctest.Modes {
+		t.Run(mode, func(t *testing.T) {
+			t.Parallel()
+			source, dest, content := setup(t)
+			src, dst := rsynctest.TransferArgs(t, mode, source, dest)
+			start := time.Now()
+			if _, err := rsynctest.RunUnrestricted(t, "gokr-rsync", "-a", "--bwlimit=1m", src, dst); err != nil {
+				t.Fatal(err)
+			}
+			if elapsed := time.Since(start); elapsed < minDuration {
+				t.Errorf("transfer took %v, want at least %v", elapsed, minDuration)
+			}
+			rsynctest.CheckFile(t, filepath.Join(dest, "file"), content)
+		})
+	}
+}
+
+func TestModuleBwLimit(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		name string
+		args []string
+	}{
+		{"default", nil},
+		// The client cannot raise the limit of the module.
+		{"raise", []string{"--bwlimit=1g"}},
+		{"no-bwlimit", []string{"--no-bwlimit"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			source, dest, content := setup(t)
+			mods := rsynctest.InteropModule(source)
+			mods[0].BwLimit = "1m"
+			srv := rsynctest.New(t, mods)
+			args := append([]string{"gokr-rsync", "-a"}, tt.args...)
+			args = append(args, "rsync://localhost:"+srv.Port+"/interop/", dest)
+			start := time.Now()
+			if _, err := rsynctest.RunUnrestricted(t, args...); err != nil {
+				t.Fatal(err)
+			}
+			if elapsed := time.Since(start); elapsed < minDuration {
+				t.Errorf("transfer took %v, want at least %v", elapsed, minDuration)
+			}
+			rsynctest.CheckFile(t, filepath.Join(dest, "file"), content)
+		})
+	}
+}
+
+func TestBwLimitOptions(t *testing.T) {
+	t.Parallel()
+
+	source, dest, _ := setup(t)
+	for _, tt := range []struct {
+		arg     string
+		wantErr string
+	}{
+		{"--bwlimit=100b", "--bwlimit value is too small: 100b (min=512)"},
+		{"--bwlimit=fast", "--bwlimit value is invalid: fast"},
+	} {
+		t.Run(tt.arg, func(t *testing.T) {
+			_, err := rsynctest.RunUnrestricted(t, "gokr-rsync", "-a", tt.arg, source+"/", dest)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("unexpected error: got %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	mods := rsynctest.InteropModule(source)
+	mods[0].BwLimit = "fast"
+	if _, err := rsyncd.NewServer(mods, rsyncd.DontRestrict()); err == nil || !strings.Contains(err.Error(), `module "interop": --bwlimit value is invalid: fast`) {
+		t.Fatalf("NewServer: unexpected error: got %v", err)
+	}
+}
@@ -0,0 +1,162 @@
+package checksum_test
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gokrazy/rsync/internal/rsynctest"
+)
+
+func TestMain(m *testing.M) {
+	rsynctest.CommandMain(m)
+}
+
+// largeContent returns content which spans multiple checksum blocks.
+func largeContent(modified bool) []byte {
+	var buf bytes.Buffer
+	for line := 0; buf.Len() < 512*1024; line++ {
+		if modified && line == 5000 {
+			buf.WriteString("modified in the middle\n")
+		}
+		fmt.Fprintf(&buf, "line %d of a file synced with every checksum algorithm\n", line)
+	}
+	return buf.Bytes()
+}
+
+func writeLarge(t *testing.T, fn string, modified bool) {
+	t.Helper()
+	rsynctest.WriteFiles(t, filepath.Dir(fn), map[string]string{filepath.Base(fn): string(largeContent(modified))})
+}
+
+func verifyLarge(t *testing.T, fn string, modified bool) {
+	t.Helper()
+	got, err := os.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := largeContent(modified); !bytes.Equal(got, want) {
+		t.Errorf("%s: content differs (got %d bytes, want %d bytes)", fn, len(got), len(want))
+	}
+}
+
+var choices = []string{
+	"", // negotiated
+	"auto",
+	"md4",
+	"md5",
+	"xxh64",
+	"xxhash",
+	"xxh3",
+	"xxh128",
+	"xxh128,md5",
+	"md4,xxh3",
+}
+
+func TestChecksumChoiceDaemonSender(t *testing.T) {
+	t.Parallel()
+
+	for _, choice := range choices {
+		t.Run("choice="+choice, func(t *testing.T) {
+			t.Parallel()
+
+			source := t.TempDir()
+			writeLarge(t, filepath.Join(source, "large"), false)
+
+			// start a server to sync from
+			srv := rsynctest.New(t, rsynctest.InteropModule(source))
+
+			dest := t.TempDir()
+			args := []string{"gokr-rsync", "-a"}
+			if choice != "" {
+				args = append(args, "--checksum-choice="+choice)
+			}
+			args = append(args,
+				"rsync://localhost:"+srv.Port+"/interop/",
+				dest)
+			if _, err := rsynctest.RunUnrestricted(t, args...); err != nil {
+				t.Fatal(err)
+			}
+			verifyLarge(t, filepath.Join(dest, "large"), false)
+
+			// The modified file is transferred as a delta, which exercises
+			// the block checksums.
+			writeLarge(t, filepath.Join(source, "large"), true)
+			if _, err := rsynctest.RunUnrestricted(t, args...); err != nil {
+				t.Fatal(err)
+			}
+			verifyLarge(t, filepath.Join(dest, "large"), true)
+
+			// Verify the whole-file checksums.
+			if _, err := rsynctest.RunUnrestricted(t, append([]string{"gokr-rsync", "-c"}, args[1:]...)...); err != nil {
+				t.Fatal(err)
+			}
+			verifyLarge(t, filepath.Join(dest, "large"), true)
+		})
+	}
+}
+
+func TestChecksumChoiceClientSender(t *testing.T) {
+	t.Parallel()
+
+	for _, choice := range choices {
+		t.Run("choice="+choice, func(t *testing.T) {
+			t.Parallel()
+
+			source := t.TempDir()
+			writeLarge(t, filepath.Join(source, "large"), false)
+
+			// start a server to sync to
+			dest := t.TempDir()
+			srv := rsynctest.New(t, rsynctest.WritableInteropModule(dest))
+
+			args := []string{"gokr-rsync", "-a", "-z"}
+			if choice != "" {
+				args = append(args, "--checksum-choice="+choice)
+			}
+			args = append(args,
+				source+"/",
+				"rsync://localhost:"+srv.Port+"/interop/")
+			if _, err := rsynctest.RunUnrestricted(t, args...); err != nil {
+				t.Fatal(err)
+			}
+			verifyLarge(t, filepath.Join(dest, "large"), false)
+
+			writeLarge(t, filepath.Join(source, "large"), true)
+			if _, err := rsynctest.RunUnrestricted(t, args...); err != nil {
+				t.Fatal(err)
+			}
+			verifyLarge(t, filepath.Join(dest, "large"), true)
+		})
+	}
+}
+
+func TestChecksumChoiceLocal(t *testing.T) {
+	t.Parallel()
+
+	source := t.TempDir()
+	writeLarge(t, filepath.Join(source, "large"), false)
+	dest := t.TempDir()
+	args := []string{"gokr-rsync", "-a", "--cc=xxh3", source + "/", dest}
+	if _, err := rsynctest.RunUnrestricted(t, args...); err != nil {
+		t.Fatal(err)
+	}
+	verifyLarge(t, filepath.Join(dest, "large"), false)
+}
+
+func TestChecksumChoiceUnknown(t *testing.T) {
+	t.Parallel()
+
+	source := t.TempDir()
+	dest := t.TempDir()
+	_, err := rsynctest.RunUnrestricted(t, "gokr-rsync", "-a", "--checksum-choice=sha1", source+"/", dest)
+	if err == nil {
+		t.Fatal("syncing with --checksum-choice=sha1 unexpectedly succeeded")
+	}
+	if want := "unknown checksum name: sha1"; !strings.Contains(err.Error(), want) {
+		t.Errorf("unexpected error: got %v, want %q", err, want)
+	}
+}
@@ -0,0 +1,168 @@
+package chmod_test
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gokrazy/rsync/internal/rsynctest"
+	"github.com/gokrazy/rsync/rsyncd"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMain(m *testing.M) {
+	rsynctest.CommandMain(m)
+}
+
+// setup creates a source directory with sloppy permissions.
+func setup(t *testing.T) string {
+	t.Helper()
+	source := filepath.Join(t.TempDir(), "source")
+	if err := os.MkdirAll(filepath.Join(source, "sub"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	for fn, perm := range map[string]fs.FileMode{
+		"sub/data": 0600,
+		"tool":     0700,
+		"readme":   0444,
+	} {
+		if err := os.WriteFile(filepath.Join(source, fn), []byte(fn), perm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("readme", filepath.Join(source, "link")); err != nil {
+		t.Fatal(err)
+	}
+	return source
+}
+
+// perms returns the permissions of the files in dest.
+func perms(t *testing.T, dest string) map[string]fs.FileMode {
+	t.Helper()
+	result := make(map[string]fs.FileMode)
+	for _, fn := range []string{"sub", "sub/data", "tool", "readme"} {
+		st, err := os.Stat(filepath.Join(dest, fn))
+		if err != nil {
+			t.Fatal(err)
+		}
+		result[fn] = st.Mode().Perm()
+	}
+	st, err := os.Lstat(filepath.Join(dest, "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode().Type() != fs.ModeSymlink {
+		t.Errorf("link: unexpected type %v", st.Mode().Type())
+	}
+	return result
+}
+
+func TestChmod(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		chmod string
+		want  map[string]fs.FileMode
+	}{
+		{
+			chmod: "D755,F644,ug+w",
+			want: map[string]fs.FileMode{
+				"sub":      0775,
+				"sub/data": 0664,
+				"tool":     0664,
+				"readme":   0664,
+			},
+		},
+
+		{
+			chmod: "a+rX",
+			want: map[string]fs.FileMode{
+				"sub":      0755,
+				"sub/data": 0644,
+				"tool":     0755,
+				"readme":   0444,
+			},
+		},
+
+		{
+			chmod: "Fo=,Dg=rx",
+			want: map[string]fs.FileMode{
+				"sub":      0750,
+				"sub/data": 0600,
+				"tool":     0700,
+				"readme":   0440,
+			},
+		},
+	} {
+		for _, mode := range rsynctest.Modes {
+			t.Run(tt.chmod+"/"+mode, func(t *testing.T) {
+				t.Parallel()
+
+				source := setup(t)
+				dest := filepath.Join(t.TempDir(), "dest")
+				if _, err := rsynctest.Transfer(t, mode, source, dest, "-a", "--chmod="+tt.chmod); err != nil {
+					t.Fatal(err)
+				}
+				if diff := cmp.Diff(tt.want, perms(t, dest)); diff != "" {
+					t.Errorf("unexpected permissions: diff (-want +got):\n%s", diff)
+				}
+			})
+		}
+	}
+}
+
+func TestModuleChmod(t *testing.T) {
+	t.Parallel()
+
+	want := map[string]fs.FileMode{
+		"sub":      0755,
+		"sub/data": 0644,
+		"tool":     0644,
+		"readme":   0644,
+	}
+
+	t.Run("outgoing", func(t *testing.T) {
+		t.Parallel()
+
+		source := setup(t)
+		dest := filepath.Join(t.TempDir(), "dest")
+		srv := rsynctest.New(t, []rsyncd.Module{
+			{
+				Name:          "interop",
+				Path:          source,
+				OutgoingChmod: "D755,F644",
+				// Does not apply to files sent from the module.
+				IncomingChmod: "a-rwx",
+			},
+		})
+		if _, err := rsynctest.RunUnrestricted(t, "gokr-rsync", "-a", "rsync://localhost:"+srv.Port+"/interop/", dest+"/"); err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(want, perms(t, dest)); diff != "" {
+			t.Errorf("unexpected permissions: diff (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("incoming", func(t *testing.T) {
+		t.Parallel()
+
+		source := setup(t)
+		root := t.TempDir()
+		srv := rsynctest.New(t, []rsyncd.Module{
+			{
+				Name:          "interop",
+				Path:          root,
+				Writable:      true,
+				IncomingChmod: "D755,F644",
+				OutgoingChmod: "a-rwx",
+			},
+		})
+		if _, err := rsynctest.RunUnrestricted(t, "gokr-rsync", "-a", source+"/", "rsync://localhost:"+srv.Port+"/interop/dest/"); err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(want, perms(t, filepath.Join(root, "dest"))); diff != "" {
+			t.Errorf("unexpected permissions: diff (-want +got):\n%s", diff)
+		}
+	})
+}
@@ -0,0 +1,257 @@
+package compress_test
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gokrazy/rsync/internal/rsynctest"
+	"github.com/gokrazy/rsync/internal/testlogger"
+)
+
+func TestMain(m *testing.M) {
+	rsynctest.CommandMain(m)
+}
+
+var words = strings.Fields("gokrazy rsync sender receiver generator token block checksum deflate inflate module daemon archive protocol")
+
+// text returns n bytes of compressible (but not trivially compressible) text.
+func text(seed uint64, n int) []byte {
+	rnd := rand.New(rand.NewPCG(seed, seed))
+	var buf bytes.Buffer
+	for line := 0; buf.Len() < n; line++ {
+		fmt.Fprintf(&buf, "%d:", line)
+		for range 8 {
+			buf.WriteString(" " + words[rnd.IntN(len(words))])
+		}
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()[:n]
+}
+
+// modify returns a modified copy of b, which (when synced on top of b) is
+// transferred as a mix of matched blocks and literal data: some bytes are
+// inserted at the start, a large region (bigger than the sender’s chunk size)
+// is replaced in the middle, a region is deleted and data is appended.
+func modify(b []byte) []byte {
+	var mod []byte
+	mod = append(mod, "inserted at the start\n"...)
+	mod = append(mod, b[:100*1024]...)
+	mod = append(mod, text(2, 300*1024)...)
+	mod = append(mod, b[400*1024:500*1024]...)
+	// b[500*1024:600*1024] is deleted
+	mod = append(mod, b[600*1024:]...)
+	mod = append(mod, "appended at the end\n"...)
+	return mod
+}
+
+func verifyFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		got, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != content {
+			t.Errorf("%s: content differs (got %d bytes, want %d bytes)", name, len(got), len(content))
+		}
+	}
+}
+
+func sourceFiles() (initial, modified map[string]string) {
+	large := text(1, 1024*1024)
+	initial = map[string]string{
+		"large.txt": string(large),
+		"large.gz":  string(large), // matched by the default --skip-compress list
+		"small.txt": "hello world\n",
+		"empty.txt": "",
+	}
+	modified = map[string]string{
+		"large.txt": string(modify(large)),
+		"large.gz":  string(modify(large)),
+		"small.txt": "hello compressed world\n",
+		"empty.txt": "",
+	}
+	return initial, modified
+}
+
+var compressArgs = []struct {
+	name string
+	args []string
+}{
+	{"Default", []string{"-az"}},
+	{"Level1", []string{"-a", "--compress-level=1"}},
+	{"Level9", []string{"-az", "--zl=9"}},
+	{"Level0", []string{"-az", "--compress-level=0"}},
+	{"SkipCompress", []string{"-az", "--skip-compress=txt/[gG][zZ]"}},
+	{"NoCompress", []string{"-az", "--no-compress"}},
+}
+
+func TestCompressDaemonSender(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range compressArgs {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			initial, modified := sourceFiles()
+			source := filepath.Join(t.TempDir(), "source")
+			rsynctest.WriteFiles(t, source, initial)
+
+			// start a server to sync from
+			srv := rsynctest.New(t, rsynctest.InteropModule(source))
+
+			dest := filepath.Join(t.TempDir(), "dest")
+			args := append([]string{"gokr-rsync"}, tt.args...)
+			args = append(args, "rsync://localhost:"+srv.Port+"/interop/", dest)
+			if _, err := rsynctest.RunUnrestricted(t, args...); err != nil {
+				t.Fatal(err)
+			}
+			verifyFiles(t, dest, initial)
+
+			// Sync the modified files, which are sent as a mix of matched
+			// blocks and literal data.
+			rsynctest.WriteFiles(t, source, modified)
+			if _, err := rsynctest.RunUnrestricted(t, args...); err != nil {
+				t.Fatal(err)
+			}
+			verifyFiles(t, dest, modified)
+		})
+	}
+}
+
+func TestCompressClientSender(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range compressArgs {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			initial, modified := sourceFiles()
+			source := filepath.Join(t.TempDir(), "source")
+			rsynctest.WriteFiles(t, source, initial)
+
+			// start a server to sync to
+			dest := filepath.Join(t.TempDir(), "dest")
+			srv := rsynctest.New(t, rsynctest.WritableInteropModule(dest))
+
+			args := append([]string{"gokr-rsync"}, tt.args...)
+			args = append(args, source+"/", "rsync://localhost:"+srv.Port+"/interop/")
+			if _, err := rsynctest.RunUnrestricted(t, args...); err != nil {
+				t.Fatal(err)
+			}
+			verifyFiles(t, dest, initial)
+
+			rsynctest.WriteFiles(t, source, modified)
+			if _, err := rsynctest.RunUnrestricted(t, args...); err != nil {
+				t.Fatal(err)
+			}
+			verifyFiles(t, dest, modified)
+		})
+	}
+}
+
+// TestCompressReducesTraffic verifies that compression is actually in effect,
+// and that files matched by --skip-compress are not compressed.
+func TestCompressReducesTraffic(t *testing.T) {
+	t.Parallel()
+
+	large := text(1, 1024*1024)
+
+	for _, tt := range []struct {
+		name       string
+		fn         string
+		args       []string
+		compressed bool
+	}{
+		{"Uncompressed", "large.txt", []string{"-a"}, false},
+		{"Compressed", "large.txt", []string{"-az"}, true},
+		{"SkipCompressDefault", "large.gz", []string{"-az"}, false},
+		{"SkipCompress", "large.txt", []string{"-az", "--skip-compress=TXT"}, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			source := filepath.Join(t.TempDir(), "source")
+			rsynctest.WriteFiles(t, source, map[string]string{tt.fn: string(large)})
+
+			// start a server to sync from
+			srv := rsynctest.New(t, rsynctest.InteropModule(source))
+
+			dest := filepath.Join(t.TempDir(), "dest")
+			args := append([]string{"gokr-rsync"}, tt.args...)
+			args = append(args, "rsync://localhost:"+srv.Port+"/interop/", dest)
+			stats, err := rsynctest.RunUnrestricted(t, args...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			verifyFiles(t, dest, map[string]string{tt.fn: string(large)})
+
+			// The stats are sent by the server (sender).
+			if got, limit := stats.Written, int64(len(large)/2); (got < limit) != tt.compressed {
+				t.Errorf("server wrote %d bytes for a %d byte file, compressed = %v", got, len(large), tt.compressed)
+			}
+		})
+	}
+}
+
+func TestCompressInterop(t *testing.T) {
+	t.Parallel()
+
+	rsyncBin := rsynctest.TridgeOrGTFO(t, "compression interoperability")
+
+	tridge := func(t *testing.T, args ...string) {
+		t.Helper()
+		rsync := exec.Command(rsyncBin, args...)
+		rsync.Stdout = testlogger.New(t)
+		rsync.Stderr = testlogger.New(t)
+		if err := rsync.Run(); err != nil {
+			t.Fatalf("%v: %v", rsync.Args, err)
+		}
+	}
+
+	t.Run("DaemonSender", func(t *testing.T) {
+		t.Parallel()
+
+		initial, modified := sourceFiles()
+		source := filepath.Join(t.TempDir(), "source")
+		rsynctest.WriteFiles(t, source, initial)
+
+		// start a server to sync from
+		srv := rsynctest.New(t, rsynctest.InteropModule(source))
+
+		dest := filepath.Join(t.TempDir(), "dest")
+		args := []string{"-az", "--port=" + srv.Port, "rsync://localhost/interop/", dest}
+		tridge(t, args...)
+		verifyFiles(t, dest, initial)
+
+		rsynctest.WriteFiles(t, source, modified)
+		tridge(t, args...)
+		verifyFiles(t, dest, modified)
+	})
+
+	t.Run("DaemonReceiver", func(t *testing.T) {
+		t.Parallel()
+
+		initial, modified := sourceFiles()
+		source := filepath.Join(t.TempDir(), "source")
+		rsynctest.WriteFiles(t, source, initial)
+
+		// start a server to sync to
+		dest := filepath.Join(t.TempDir(), "dest")
+		srv := rsynctest.New(t, rsynctest.WritableInteropModule(dest))
+
+		args := []string{"-az", "--port=" + srv.Port, source + "/", "rsync://localhost/interop/"}
+		tridge(t, args...)
+		verifyFiles(t, dest, initial)
+
+		rsynctest.WriteFiles(t, source, modified)
+		tridge(t, args...)
+		verifyFiles(t, dest, modified)
+	})
+}
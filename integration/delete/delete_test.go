@@ -0,0 +1,294 @@
+package delete_test
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/gokrazy/rsync"
+	"github.com/gokrazy/rsync/internal/rsynctest"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMain(m *testing.M) {
+	rsynctest.CommandMain(m)
+}
+
+// baseNames returns the files with their base name as content.
+func baseNames(files ...string) map[string]string {
+	result := make(map[string]string)
+	for _, fn := range files {
+		result[fn] = path.Base(fn)
+	}
+	return result
+}
+
+var sourceFiles = []string{
+	"top.txt",
+	"dir/a.txt",
+	"dir/sub/b.txt",
+	"other/c.txt",
+}
+
+// extraFiles are extraneous files in the destination, some of which are in
+// directories that do not exist in the source.
+var extraFiles = []string{
+	"extra.txt",
+	"dir/extra.txt",
+	"dir/sub/extra.txt",
+	"dir/gone/deep/extra.txt",
+	"gone/extra.txt",
+}
+
+func TestDeleteTiming(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		name string
+		args []string
+	}{
+		{"delete", []string{"--delete"}},
+		{"delete-protocol29", []string{"--delete", "--protocol=29"}},
+		{"delete-before", []string{"--delete-before"}},
+		{"delete-during", []string{"--delete-during"}},
+		{"delete-during-no-inc", []string{"--delete-during", "--no-inc-recursive"}},
+		{"delete-delay", []string{"--delete-delay"}},
+		{"delete-after", []string{"--delete-after"}},
+		{"del", []string{"--del"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			source := filepath.Join(t.TempDir(), "source")
+			rsynctest.WriteFiles(t, source, baseNames(sourceFiles...))
+
+			// start a server to sync from
+			srv := rsynctest.New(t, rsynctest.InteropModule(source))
+
+			dest := filepath.Join(t.TempDir(), "dest")
+			rsynctest.WriteFiles(t, dest, baseNames(extraFiles...))
+
+			args := append([]string{"gokr-rsync", "-a"}, tt.args...)
+			args = append(args, "rsync://localhost:"+srv.Port+"/interop/", dest)
+			if _, err := rsynctest.RunUnrestricted(t, args...); err != nil {
+				t.Fatal(err)
+			}
+			want := slices.Sorted(slices.Values(sourceFiles))
+			if diff := cmp.Diff(want, rsynctest.ListFiles(t, dest)); diff != "" {
+				t.Errorf("unexpected files: diff (-want +got):\n%s", diff)
+			}
+			if _, err := os.Stat(filepath.Join(dest, "gone")); !os.IsNotExist(err) {
+				t.Errorf("directory gone unexpectedly still exists: %v", err)
+			}
+		})
+	}
+}
+
+func TestDeleteTopDir(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		name string
+		args []string
+	}{
+		{"incremental", nil},
+		{"no-inc-recursive", []string{"--no-inc-recursive"}},
+		{"protocol29", []string{"--protocol=29"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			source := filepath.Join(t.TempDir(), "source")
+			rsynctest.WriteFiles(t, source, baseNames(sourceFiles...))
+
+			// start a server to sync from
+			srv := rsynctest.New(t, rsynctest.InteropModule(source))
+
+			// Without a trailing slash, dir is the top-level directory of
+			// the transfer: deletion must not touch its siblings.
+			dest := filepath.Join(t.TempDir(), "dest")
+			rsynctest.WriteFiles(t, dest, baseNames(extraFiles...))
+
+			args := append([]string{"gokr-rsync", "-a", "--delete"}, tt.args...)
+			args = append(args, "rsync://localhost:"+srv.Port+"/interop/dir", dest)
+			if _, err := rsynctest.RunUnrestricted(t, args...); err != nil {
+				t.Fatal(err)
+			}
+			want := []string{
+				"dir/a.txt",
+				"dir/sub/b.txt",
+				"extra.txt",
+				"gone/extra.txt",
+			}
+			if diff := cmp.Diff(want, rsynctest.ListFiles(t, dest)); diff != "" {
+				t.Errorf("unexpected files: diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestDeleteDirs(t *testing.T) {
+	t.Parallel()
+
+	source := filepath.Join(t.TempDir(), "source")
+	rsynctest.WriteFiles(t, source, baseNames(sourceFiles...))
+
+	// start a server to sync from
+	srv := rsynctest.New(t, rsynctest.InteropModule(source))
+
+	// With --dirs instead of --recursive, only the top-level directory is a
+	// content dir, so only its extraneous files are deleted.
+	dest := filepath.Join(t.TempDir(), "dest")
+	rsynctest.WriteFiles(t, dest, baseNames(extraFiles...))
+	if _, err := rsynctest.RunUnrestricted(t, "gokr-rsync", "-lptgoD", "--dirs", "--delete", "rsync://localhost:"+srv.Port+"/interop/", dest); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"dir/extra.txt",
+		"dir/gone/deep/extra.txt",
+		"dir/sub/extra.txt",
+		"top.txt",
+	}
+	if diff := cmp.Diff(want, rsynctest.ListFiles(t, dest)); diff != "" {
+		t.Errorf("unexpected files: diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestDeleteWithoutRecursion(t *testing.T) {
+	t.Parallel()
+
+	source := t.TempDir()
+	dest := t.TempDir()
+	_, err := rsynctest.RunUnrestricted(t, "gokr-rsync", "--delete", source+"/", dest)
+	if err == nil {
+		t.Fatal("--delete without -r unexpectedly succeeded")
+	}
+	if want := "--delete does not work without --recursive"; !strings.Contains(err.Error(), want) {
+		t.Errorf("unexpected error: got %v, want %q", err, want)
+	}
+
+	_, err = rsynctest.RunUnrestricted(t, "gokr-rsync", "-r", "--delete-before", "--delete-after", source+"/", dest)
+	if err == nil {
+		t.Fatal("combining --delete-before and --delete-after unexpectedly succeeded")
+	}
+	if want := "You may not combine multiple --delete-WHEN options."; !strings.Contains(err.Error(), want) {
+		t.Errorf("unexpected error: got %v, want %q", err, want)
+	}
+}
+
+func TestDeleteExcluded(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		name string
+		push bool
+	}{
+		{"pull", false},
+		{"push", true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			source := filepath.Join(t.TempDir(), "source")
+			rsynctest.WriteFiles(t, source, baseNames("main.c", "main.o"))
+
+			dest := filepath.Join(t.TempDir(), "dest")
+			rsynctest.WriteFiles(t, dest, baseNames("extra.txt", "old.o", "lib/util.o"))
+
+			var src, dst string
+			if tt.push {
+				// start a server to sync to
+				srv := rsynctest.New(t, rsynctest.WritableInteropModule(dest))
+				src, dst = source+"/", "rsync://localhost:"+srv.Port+"/interop/"
+			} else {
+				// start a server to sync from
+				srv := rsynctest.New(t, rsynctest.InteropModule(source))
+				src, dst = "rsync://localhost:"+srv.Port+"/interop/", dest
+			}
+
+			// Excluded files are protected from deletion…
+			if _, err := rsynctest.RunUnrestricted(t, "gokr-rsync", "-a", "--delete", "--exclude=*.o", src, dst); err != nil {
+				t.Fatal(err)
+			}
+			want := []string{"lib/util.o", "main.c", "old.o"}
+			if diff := cmp.Diff(want, rsynctest.ListFiles(t, dest)); diff != "" {
+				t.Errorf("unexpected files: diff (-want +got):\n%s", diff)
+			}
+
+			// …unless --delete-excluded is specified.
+			if _, err := rsynctest.RunUnrestricted(t, "gokr-rsync", "-a", "--delete-excluded", "--exclude=*.o", src, dst); err != nil {
+				t.Fatal(err)
+			}
+			want = []string{"main.c"}
+			if diff := cmp.Diff(want, rsynctest.ListFiles(t, dest)); diff != "" {
+				t.Errorf("unexpected files: diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestMaxDelete(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		name string
+		push bool
+	}{
+		{"pull", false},
+		{"push", true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			source := filepath.Join(t.TempDir(), "source")
+			rsynctest.WriteFiles(t, source, baseNames("keep.txt"))
+
+			dest := filepath.Join(t.TempDir(), "dest")
+			rsynctest.WriteFiles(t, dest, baseNames("extra1.txt", "extra2.txt", "extra3.txt"))
+
+			var src, dst string
+			if tt.push {
+				// start a server to sync to
+				srv := rsynctest.New(t, rsynctest.WritableInteropModule(dest))
+				src, dst = source+"/", "rsync://localhost:"+srv.Port+"/interop/"
+			} else {
+				// start a server to sync from
+				srv := rsynctest.New(t, rsynctest.InteropModule(source))
+				src, dst = "rsync://localhost:"+srv.Port+"/interop/", dest
+			}
+
+			_, err := rsynctest.RunUnrestricted(t, "gokr-rsync", "-a", "--delete", "--max-delete=1", src, dst)
+			var ee *rsync.ExitError
+			if !errors.As(err, &ee) {
+				t.Fatalf("unexpected error: got %v, want an ExitError", err)
+			}
+			if got, want := ee.Code, rsync.RERR_DEL_LIMIT; got != want {
+				t.Errorf("unexpected exit code: got %d, want %d", got, want)
+			}
+			if got, want := len(rsynctest.ListFiles(t, dest)), 3; got != want {
+				t.Errorf("unexpected number of files: got %d, want %d (keep.txt and two extra files)", got, want)
+			}
+
+			// --max-delete=0 does not delete at all.
+			_, err = rsynctest.RunUnrestricted(t, "gokr-rsync", "-a", "--delete", "--max-delete=0", src, dst)
+			if !errors.As(err, &ee) {
+				t.Fatalf("unexpected error: got %v, want an ExitError", err)
+			}
+			if got, want := len(rsynctest.ListFiles(t, dest)), 3; got != want {
+				t.Errorf("unexpected number of files: got %d, want %d", got, want)
+			}
+
+			// Without the limit, all extraneous files are deleted.
+			if _, err := rsynctest.RunUnrestricted(t, "gokr-rsync", "-a", "--delete", src, dst); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff([]string{"keep.txt"}, rsynctest.ListFiles(t, dest)); diff != "" {
+				t.Errorf("unexpected files: diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
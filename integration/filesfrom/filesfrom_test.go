@@ -0,0 +1,285 @@
+package filesfrom_test
+
+import (
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"testing"
+	"testing/fstest"
+
+	"github.com/gokrazy/rsync/internal/rsynctest"
+	"github.com/gokrazy/rsync/rsyncd"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMain(m *testing.M) {
+	rsynctest.CommandMain(m)
+}
+
+var sourceFiles = []string{
+	"README",
+	"main.c",
+	"lib/util.c",
+	"lib/util.h",
+	"lib/test/util_test.c",
+	"doc/a.txt",
+	"doc/b.txt",
+}
+
+func createSourceFiles(t *testing.T) string {
+	t.Helper()
+	source := filepath.Join(t.TempDir(), "source")
+	files := make(map[string]string)
+	for _, fn := range sourceFiles {
+		files[fn] = filepath.Base(fn)
+	}
+	rsynctest.WriteFiles(t, source, files)
+	return source
+}
+
+// listFiles returns the names of all files and directories below dir.
+// Directory names end in a slash.
+func listFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	var files []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == dir {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			rel += "/"
+		}
+		files = append(files, rel)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+	return files
+}
+
+// The list contains comments, empty lines, an absolute name and a name
+// which tries to escape the transfer directory.
+const fileList = "# files to back up\nREADME\n\n/lib/util.c\n../doc\n; end\n"
+
+// Without --recursive (-a does not imply it with --files-from), only the
+// listed names and their implied directories are transferred.
+var wantNonRecursive = []string{
+	"README",
+	"doc/",
+	"lib/",
+	"lib/util.c",
+}
+
+var wantRecursive = []string{
+	"README",
+	"doc/",
+	"doc/a.txt",
+	"doc/b.txt",
+	"lib/",
+	"lib/util.c",
+}
+
+func TestFilesFromDaemonSender(t *testing.T) {
+	t.Parallel()
+
+	source := createSourceFiles(t)
+
+	// start a server to sync from
+	srv := rsynctest.New(t, rsynctest.InteropModule(source))
+
+	list := filepath.Join(t.TempDir(), "list")
+	rsynctest.WriteFiles(t, filepath.Dir(list), map[string]string{"list": fileList})
+
+	for _, tt := range []struct {
+		name string
+		args []string
+		want []string
+	}{
+		{
+			name: "archive",
+			args: []string{"-a"},
+			want: wantNonRecursive,
+		},
+		{
+			name: "recursive",
+			args: []string{"-a", "-r"},
+			want: wantRecursive,
+		},
+		{
+			// Protocols < 31 forward the list without multiplexing.
+			name: "protocol30",
+			args: []string{"-a", "-r", "--protocol=30"},
+			want: wantRecursive,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			dest := filepath.Join(t.TempDir(), "dest")
+			args := append([]string{"gokr-rsync"}, tt.args...)
+			args = append(args,
+				"--files-from="+list,
+				"rsync://localhost:"+srv.Port+"/interop/",
+				dest)
+			if _, err := rsynctest.RunUnrestricted(t, args...); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.want, listFiles(t, dest)); diff != "" {
+				t.Errorf("unexpected files: diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestFilesFromDaemonSenderSubdir(t *testing.T) {
+	t.Parallel()
+
+	source := createSourceFiles(t)
+
+	// start a server to sync from
+	srv := rsynctest.New(t, rsynctest.InteropModule(source))
+
+	list := filepath.Join(t.TempDir(), "list")
+	rsynctest.WriteFiles(t, filepath.Dir(list), map[string]string{"list": "util.c\ntest/util_test.c\n"})
+
+	dest := filepath.Join(t.TempDir(), "dest")
+	if _, err := rsynctest.RunUnrestricted(t, "gokr-rsync", "-a",
+		"--files-from="+list,
+		"rsync://localhost:"+srv.Port+"/interop/lib",
+		dest); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"test/",
+		"test/util_test.c",
+		"util.c",
+	}
+	if diff := cmp.Diff(want, listFiles(t, dest)); diff != "" {
+		t.Errorf("unexpected files: diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestFilesFromClientSender(t *testing.T) {
+	t.Parallel()
+
+	source := createSourceFiles(t)
+
+	list := filepath.Join(t.TempDir(), "list")
+	rsynctest.WriteFiles(t, filepath.Dir(list), map[string]string{
+		"list": "README\x00lib/util.c\x00doc\x00",
+	})
+
+	// start a server to sync to
+	dest := filepath.Join(t.TempDir(), "dest")
+	srv := rsynctest.New(t, rsynctest.WritableInteropModule(dest))
+
+	if _, err := rsynctest.RunUnrestricted(t, "gokr-rsync", "-a", "--from0",
+		"--files-from="+list,
+		source,
+		"rsync://localhost:"+srv.Port+"/interop/"); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(wantNonRecursive, listFiles(t, dest)); diff != "" {
+		t.Errorf("unexpected files: diff (-want +got):\n%s", diff)
+	}
+}
+
+// TestFilesFromRemote verifies that a --files-from list stored on the remote
+// side (--files-from=:list) is read relative to the module.
+func TestFilesFromRemote(t *testing.T) {
+	t.Parallel()
+
+	t.Run("DaemonSender", func(t *testing.T) {
+		t.Parallel()
+
+		source := createSourceFiles(t)
+		rsynctest.WriteFiles(t, source, map[string]string{"list": fileList})
+
+		// start a server to sync from
+		srv := rsynctest.New(t, rsynctest.InteropModule(source))
+
+		dest := filepath.Join(t.TempDir(), "dest")
+		if _, err := rsynctest.RunUnrestricted(t, "gokr-rsync", "-a", "-r",
+			"--files-from=:/list",
+			"rsync://localhost:"+srv.Port+"/interop/",
+			dest); err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(wantRecursive, listFiles(t, dest)); diff != "" {
+			t.Errorf("unexpected files: diff (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("ClientSender", func(t *testing.T) {
+		t.Parallel()
+
+		source := createSourceFiles(t)
+
+		// start a server to sync to
+		dest := filepath.Join(t.TempDir(), "dest")
+		rsynctest.WriteFiles(t, dest, map[string]string{"list": fileList})
+		srv := rsynctest.New(t, rsynctest.WritableInteropModule(dest))
+
+		if _, err := rsynctest.RunUnrestricted(t, "gokr-rsync", "-a",
+			"--files-from=:list",
+			source+"/",
+			"rsync://localhost:"+srv.Port+"/interop/"); err != nil {
+			t.Fatal(err)
+		}
+		want := append([]string{}, wantNonRecursive...)
+		want = append(want, "list")
+		sort.Strings(want)
+		if diff := cmp.Diff(want, listFiles(t, dest)); diff != "" {
+			t.Errorf("unexpected files: diff (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func TestFilesFromFS(t *testing.T) {
+	t.Parallel()
+
+	memfs := fstest.MapFS{
+		"sub/hello.txt": &fstest.MapFile{
+			Data:    []byte("world"),
+			Mode:    0o644,
+			ModTime: rsynctest.GosPublicRelease,
+		},
+		"sub/dir/bye.txt": &fstest.MapFile{
+			Data:    []byte("moon"),
+			Mode:    0o644,
+			ModTime: rsynctest.GosPublicRelease,
+		},
+		"sub/dir/skipped.txt": &fstest.MapFile{
+			Data:    []byte("skipped"),
+			Mode:    0o644,
+			ModTime: rsynctest.GosPublicRelease,
+		},
+	}
+	srv := rsynctest.NewInMemory(t, rsyncd.Module{
+		Name: "memfs",
+		FS:   memfs,
+	}, rsynctest.DontRestrict())
+
+	list := filepath.Join(t.TempDir(), "list")
+	rsynctest.WriteFiles(t, filepath.Dir(list), map[string]string{"list": "sub/dir/bye.txt\n"})
+
+	dest := filepath.Join(t.TempDir(), "dest")
+	srv.RunClient(t, []string{"-r", "--files-from=" + list}, []string{dest + "/"})
+	want := []string{
+		"sub/",
+		"sub/dir/",
+		"sub/dir/bye.txt",
+	}
+	if diff := cmp.Diff(want, listFiles(t, dest)); diff != "" {
+		t.Errorf("unexpected files: diff (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,450 @@
+package filter_test
+
+import (
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gokrazy/rsync/internal/rsynctest"
+	"github.com/gokrazy/rsync/internal/testlogger"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMain(m *testing.M) {
+	rsynctest.CommandMain(m)
+}
+
+var sourceFiles = []string{
+	"README",
+	"main.c",
+	"main.o",
+	"build/out.o",
+	"build/log/build.log",
+	"lib/util.c",
+	"lib/util.o",
+	"lib/build/lib.a",
+	"lib/test/util_test.c",
+	"doc/a.txt",
+	"doc/b.txt",
+	"doc/c.md",
+	"src/build", // a file, not a directory
+}
+
+func createSourceFiles(t *testing.T) string {
+	t.Helper()
+	source := filepath.Join(t.TempDir(), "source")
+	files := make(map[string]string)
+	for _, fn := range sourceFiles {
+		files[fn] = filepath.Base(fn)
+	}
+	rsynctest.WriteFiles(t, source, files)
+	return source
+}
+
+var filterTests = []struct {
+	name  string
+	rules []string
+	want  []string
+}{
+	{
+		name:  "star",
+		rules: []string{"- *.o"},
+		want: []string{
+			"README",
+			"build/log/build.log",
+			"doc/a.txt",
+			"doc/b.txt",
+			"doc/c.md",
+			"lib/build/lib.a",
+			"lib/test/util_test.c",
+			"lib/util.c",
+			"main.c",
+			"src/build",
+		},
+	},
+
+	{
+		name:  "question",
+		rules: []string{"- ?.txt"},
+		want: []string{
+			"README",
+			"build/log/build.log",
+			"build/out.o",
+			"doc/c.md",
+			"lib/build/lib.a",
+			"lib/test/util_test.c",
+			"lib/util.c",
+			"lib/util.o",
+			"main.c",
+			"main.o",
+			"src/build",
+		},
+	},
+
+	{
+		name:  "class",
+		rules: []string{"- [ab].txt"},
+		want: []string{
+			"README",
+			"build/log/build.log",
+			"build/out.o",
+			"doc/c.md",
+			"lib/build/lib.a",
+			"lib/test/util_test.c",
+			"lib/util.c",
+			"lib/util.o",
+			"main.c",
+			"main.o",
+			"src/build",
+		},
+	},
+
+	{
+		name:  "anchored",
+		rules: []string{"- /build"},
+		want: []string{
+			"README",
+			"doc/a.txt",
+			"doc/b.txt",
+			"doc/c.md",
+			"lib/build/lib.a",
+			"lib/test/util_test.c",
+			"lib/util.c",
+			"lib/util.o",
+			"main.c",
+			"main.o",
+			"src/build",
+		},
+	},
+
+	{
+		name:  "directory",
+		rules: []string{"- build/"},
+		want: []string{
+			"README",
+			"doc/a.txt",
+			"doc/b.txt",
+			"doc/c.md",
+			"lib/test/util_test.c",
+			"lib/util.c",
+			"lib/util.o",
+			"main.c",
+			"main.o",
+			"src/build",
+		},
+	},
+
+	{
+		name:  "doublestar",
+		rules: []string{"- lib/**.c"},
+		want: []string{
+			"README",
+			"build/log/build.log",
+			"build/out.o",
+			"doc/a.txt",
+			"doc/b.txt",
+			"doc/c.md",
+			"lib/build/lib.a",
+			"lib/util.o",
+			"main.c",
+			"main.o",
+			"src/build",
+		},
+	},
+
+	{
+		name:  "include",
+		rules: []string{"+ */", "+ *.c", "- *"},
+		want: []string{
+			"lib/test/util_test.c",
+			"lib/util.c",
+			"main.c",
+		},
+	},
+
+	{
+		name:  "firstmatch",
+		rules: []string{"+ util.o", "- *.o"},
+		want: []string{
+			"README",
+			"build/log/build.log",
+			"doc/a.txt",
+			"doc/b.txt",
+			"doc/c.md",
+			"lib/build/lib.a",
+			"lib/test/util_test.c",
+			"lib/util.c",
+			"lib/util.o",
+			"main.c",
+			"src/build",
+		},
+	},
+}
+
+func filterArgs(rules []string) []string {
+	var args []string
+	for _, rule := range rules {
+		args = append(args, "-f", rule)
+	}
+	return args
+}
+
+func TestFilterGokrazy(t *testing.T) {
+	t.Parallel()
+
+	source := createSourceFiles(t)
+
+	// start a server to sync from
+	srv := rsynctest.New(t, rsynctest.InteropModule(source))
+
+	for _, tt := range filterTests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			dest := filepath.Join(t.TempDir(), "dest")
+			args := append([]string{"gokr-rsync", "-r"}, filterArgs(tt.rules)...)
+			args = append(args, "rsync://localhost:"+srv.Port+"/interop/", dest)
+			if _, err := rsynctest.RunUnrestricted(t, args...); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.want, rsynctest.ListFiles(t, dest)); diff != "" {
+				t.Errorf("unexpected files: diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+// TestFilterGokrazyClientSender verifies that filter rules are also applied
+// when the client is the sender (no filter list is exchanged in that case).
+func TestFilterGokrazyClientSender(t *testing.T) {
+	t.Parallel()
+
+	source := createSourceFiles(t)
+
+	tt := filterTests[len(filterTests)-1]
+	dest := filepath.Join(t.TempDir(), "dest")
+	args := append([]string{"gokr-rsync", "-r"}, filterArgs(tt.rules)...)
+	args = append(args, source+"/", dest)
+	if _, err := rsynctest.RunUnrestricted(t, args...); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(tt.want, rsynctest.ListFiles(t, dest)); diff != "" {
+		t.Errorf("unexpected files: diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestFilterTridge(t *testing.T) {
+	t.Parallel()
+
+	rsyncBin := rsynctest.TridgeOrGTFO(t, "compares filter rule semantics with tridge rsync")
+
+	source := createSourceFiles(t)
+
+	// start a server to sync from
+	srv := rsynctest.New(t, rsynctest.InteropModule(source))
+
+	for _, tt := range filterTests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			run := func(src, dest string) []string {
+				args := append([]string{"-r"}, filterArgs(tt.rules)...)
+				rsync := exec.Command(rsyncBin, append(args, src, dest)...)
+				rsync.Stdout = testlogger.New(t)
+				rsync.Stderr = testlogger.New(t)
+				if err := rsync.Run(); err != nil {
+					t.Fatalf("%v: %v", rsync.Args, err)
+				}
+				return rsynctest.ListFiles(t, dest)
+			}
+
+			// tridge rsync as sender: verify our expectations
+			tridge := run(source+"/", filepath.Join(t.TempDir(), "dest"))
+			if diff := cmp.Diff(tt.want, tridge); diff != "" {
+				t.Errorf("tridge rsync: unexpected files: diff (-want +got):\n%s", diff)
+			}
+
+			// gokr-rsync daemon as sender
+			gokr := run("rsync://localhost:"+srv.Port+"/interop/", filepath.Join(t.TempDir(), "dest"))
+			if diff := cmp.Diff(tridge, gokr); diff != "" {
+				t.Errorf("gokr-rsync: files differ from tridge rsync [%s]: diff (-tridge +gokr):\n%s", strings.Join(tt.rules, ", "), diff)
+			}
+		})
+	}
+}
+
+// TestFilterDirMerge verifies that -F reads per-directory .rsync-filter
+// files on the sending side.
+func TestFilterDirMerge(t *testing.T) {
+	t.Parallel()
+
+	source := createSourceFiles(t)
+	rsynctest.WriteFiles(t, source, map[string]string{
+		".rsync-filter":     "- *.o\n- /README\n",
+		"lib/.rsync-filter": "+ util.o\n- /build/\n",
+		"doc/.rsync-filter": "- *.txt\n",
+	})
+
+	// start a server to sync to
+	dest := filepath.Join(t.TempDir(), "dest")
+	srv := rsynctest.New(t, rsynctest.WritableInteropModule(dest))
+
+	if _, err := rsynctest.RunUnrestricted(t, "gokr-rsync", "-r", "-F", "-F", source+"/", "rsync://localhost:"+srv.Port+"/interop/"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"build/log/build.log",
+		"doc/c.md",
+		"lib/test/util_test.c",
+		"lib/util.c",
+		"lib/util.o",
+		"main.c",
+		"src/build",
+	}
+	if diff := cmp.Diff(want, rsynctest.ListFiles(t, dest)); diff != "" {
+		t.Errorf("unexpected files: diff (-want +got):\n%s", diff)
+	}
+}
+
+// TestFilterMerge verifies that merge files and the modern rule syntax are
+// handled by the client and sent to the server.
+func TestFilterMerge(t *testing.T) {
+	t.Parallel()
+
+	source := createSourceFiles(t)
+
+	// start a server to sync from
+	srv := rsynctest.New(t, rsynctest.InteropModule(source))
+
+	rules := filepath.Join(t.TempDir(), "rules")
+	rsynctest.WriteFiles(t, filepath.Dir(rules), map[string]string{
+		"rules": "# build output\ninclude util.o\nexclude *.o\n",
+	})
+
+	dest := filepath.Join(t.TempDir(), "dest")
+	if _, err := rsynctest.RunUnrestricted(t, "gokr-rsync", "-r",
+		"--filter=merge "+rules,
+		"--filter=hide *.a",
+		"--filter=exclude_doc/",
+		"rsync://localhost:"+srv.Port+"/interop/", dest); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"README",
+		"build/log/build.log",
+		"lib/test/util_test.c",
+		"lib/util.c",
+		"lib/util.o",
+		"main.c",
+		"src/build",
+	}
+	if diff := cmp.Diff(want, rsynctest.ListFiles(t, dest)); diff != "" {
+		t.Errorf("unexpected files: diff (-want +got):\n%s", diff)
+	}
+}
+
+// TestFilterFromFiles verifies that --include-from and --exclude-from read
+// one rule per line (with the "+ " and "- " prefixes only) and that --from0
+// switches to NUL-terminated rules.
+func TestFilterFromFiles(t *testing.T) {
+	t.Parallel()
+
+	source := createSourceFiles(t)
+
+	// start a server to sync from
+	srv := rsynctest.New(t, rsynctest.InteropModule(source))
+
+	tmp := t.TempDir()
+	rsynctest.WriteFiles(t, tmp, map[string]string{
+		"include":  "# keep util.o\nutil.o\n",
+		"exclude":  "*.o\n; the doc directory\ndoc/\n- *.a\n",
+		"exclude0": "*.o\x00doc/\x00*.a\x00",
+	})
+	want := []string{
+		"README",
+		"build/log/build.log",
+		"lib/test/util_test.c",
+		"lib/util.c",
+		"lib/util.o",
+		"main.c",
+		"src/build",
+	}
+
+	for _, tt := range []struct {
+		name string
+		args []string
+	}{
+		{
+			name: "lines",
+			args: []string{
+				"--include-from=" + filepath.Join(tmp, "include"),
+				"--exclude-from=" + filepath.Join(tmp, "exclude"),
+			},
+		},
+		{
+			name: "from0",
+			args: []string{
+				"--from0",
+				"--include=util.o",
+				"--exclude-from=" + filepath.Join(tmp, "exclude0"),
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			dest := filepath.Join(t.TempDir(), "dest")
+			args := append([]string{"gokr-rsync", "-r"}, tt.args...)
+			args = append(args, "rsync://localhost:"+srv.Port+"/interop/", dest)
+			if _, err := rsynctest.RunUnrestricted(t, args...); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(want, rsynctest.ListFiles(t, dest)); diff != "" {
+				t.Errorf("unexpected files: diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+// TestFilterDelete verifies that filter rules protect files in the
+// destination from being deleted.
+func TestFilterDelete(t *testing.T) {
+	t.Parallel()
+
+	source := filepath.Join(t.TempDir(), "source")
+	rsynctest.WriteFiles(t, source, map[string]string{
+		"main.c": "main.c",
+		"main.o": "main.o",
+	})
+
+	// start a server to sync from
+	srv := rsynctest.New(t, rsynctest.InteropModule(source))
+
+	dest := filepath.Join(t.TempDir(), "dest")
+	rsynctest.WriteFiles(t, dest, map[string]string{
+		"extra.txt":      "",
+		"keep.log":       "",
+		"stale/x.o":      "",
+		"stale/sub/y.o":  "",
+		"stale2/x.o":     "",
+		"stale2/old.log": "",
+	})
+
+	if _, err := rsynctest.RunUnrestricted(t, "gokr-rsync", "-r", "--delete",
+		"--filter=protect *.log",
+		"--filter=-p *.o",
+		"rsync://localhost:"+srv.Port+"/interop/", dest); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"keep.log",
+		"main.c",
+		// stale2 cannot be deleted because it contains a protected file,
+		// the perishable rule does not protect stale2/x.o.
+		"stale2/old.log",
+	}
+	if diff := cmp.Diff(want, rsynctest.ListFiles(t, dest)); diff != "" {
+		t.Errorf("unexpected files: diff (-want +got):\n%s", diff)
+	}
+}
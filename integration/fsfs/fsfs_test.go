@@ -4,10 +4,12 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"testing/fstest"
 
 	"github.com/gokrazy/rsync/internal/rsynctest"
+	"github.com/gokrazy/rsync/internal/xattr"
 	"github.com/gokrazy/rsync/rsyncd"
 	"github.com/google/go-cmp/cmp"
 )
@@ -169,3 +171,71 @@ func TestMapFSLargeFile(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+// xattrMapFS is a MapFS which provides extended attributes (see
+// sender.XattrFS).
+type xattrMapFS struct {
+	fstest.MapFS
+	xattrs map[string]map[string][]byte
+}
+
+func (fsys xattrMapFS) Xattrs(name string) (map[string][]byte, error) {
+	return fsys.xattrs[name], nil
+}
+
+func TestXattrFS(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	dest := filepath.Join(tmp, "dest")
+	if err := os.WriteFile(filepath.Join(tmp, "probe"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	root, err := os.OpenRoot(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.Close()
+	if err := xattr.InRoot(root, "probe").Set("user.probe", []byte("1")); err != nil {
+		t.Skipf("extended attributes not supported: %v", err)
+	}
+
+	large := []byte(strings.Repeat("large value ", 8))
+	memfs := xattrMapFS{
+		MapFS: fstest.MapFS{
+			"hello.txt": &fstest.MapFile{
+				Data:    []byte("world"),
+				Mode:    0o644,
+				ModTime: rsynctest.GosPublicRelease,
+			},
+		},
+		xattrs: map[string]map[string][]byte{
+			"hello.txt": {
+				"user.small": []byte("hello"),
+				"user.large": large,
+			},
+		},
+	}
+
+	srv := rsynctest.NewInMemory(t, rsyncd.Module{
+		Name: "memfs",
+		FS:   memfs,
+	})
+	srv.RunClient(t, []string{"-aX"}, []string{dest + "/"})
+
+	x := xattr.InRoot(root, "dest/hello.txt")
+	for name, want := range memfs.xattrs["hello.txt"] {
+		got, err := x.Get(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("%s: unexpected value: diff (-want +got):\n%s", name, diff)
+		}
+	}
+
+	// Restore write permission so that t.TempDir() cleanup succeeds
+	if err := os.Chmod(dest, 0755); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,159 @@
+package fuzzy_test
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gokrazy/rsync/internal/rsynctest"
+)
+
+func TestMain(m *testing.M) {
+	rsynctest.CommandMain(m)
+}
+
+const size = 1024 * 1024
+
+// setup creates the source directory with the release app-1.2.4.tar, and
+// the previous release app-1.2.3.tar in the directory old within root.
+// Other files in old are less similar.
+func setup(t *testing.T, old string) (source, root string, content []byte) {
+	t.Helper()
+	previous := rsynctest.RandomBytes(1, size)
+	content = append(append(bytes.Clone(previous[:size/2]), rsynctest.RandomBytes(2, 3000)...), previous[size/2+3000:]...)
+
+	source = filepath.Join(t.TempDir(), "source")
+	rsynctest.WriteFiles(t, source, map[string]string{"sub/app-1.2.4.tar": string(content)})
+
+	root = t.TempDir()
+	dir := filepath.Join(root, old, "sub")
+	rsynctest.WriteFiles(t, dir, map[string]string{
+		"app-1.2.3.tar": string(previous),
+		"app-1.2.3.zip": string(rsynctest.RandomBytes(3, size)),
+		"other.tar":     string(rsynctest.RandomBytes(4, size)),
+	})
+	rsynctest.Chtimes(t, rsynctest.GosPublicRelease,
+		filepath.Join(dir, "app-1.2.3.tar"),
+		filepath.Join(dir, "app-1.2.3.zip"),
+		filepath.Join(dir, "other.tar"))
+	return source, root, content
+}
+
+func TestFuzzy(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		name string
+		args []string
+		// fuzzy is set if the previous release is the basis file.
+		fuzzy bool
+	}{
+		{"no-fuzzy", nil, false},
+		{"fuzzy", []string{"--fuzzy"}, true},
+		{"fuzzy-inplace", []string{"-y", "--inplace"}, true},
+	} {
+		for _, mode := range rsynctest.RemoteModes {
+			t.Run(tt.name+"-"+mode, func(t *testing.T) {
+				t.Parallel()
+
+				source, root, content := setup(t, "dest")
+				stats, err := rsynctest.Transfer(t, mode, source, filepath.Join(root, "dest"), append([]string{"-a"}, tt.args...)...)
+				if err != nil {
+					t.Fatal(err)
+				}
+				rsynctest.CheckFile(t, filepath.Join(root, "dest", "sub", "app-1.2.4.tar"), content)
+				// The basis file is left untouched.
+				rsynctest.CheckFile(t, filepath.Join(root, "dest", "sub", "app-1.2.3.tar"), rsynctest.RandomBytes(1, size))
+				if tt.fuzzy {
+					if max := int64(size / 10); stats.Written > max {
+						t.Errorf("sender wrote %d bytes, want at most %d", stats.Written, max)
+					}
+				} else {
+					if min := int64(size); stats.Written < min {
+						t.Errorf("sender wrote %d bytes, want at least %d", stats.Written, min)
+					}
+				}
+			})
+		}
+	}
+}
+
+// TestFuzzySizeModTime verifies that a file with the same size and
+// modification time is preferred over a similarly named file.
+func TestFuzzySizeModTime(t *testing.T) {
+	t.Parallel()
+
+	for _, mode := range rsynctest.RemoteModes {
+		t.Run(mode, func(t *testing.T) {
+			t.Parallel()
+
+			source, root, _ := setup(t, "dest")
+			// The other files in dest/sub have the same modification time,
+			// but a different size.
+			content := rsynctest.RandomBytes(5, size+1)
+			rsynctest.WriteFiles(t, source, map[string]string{"sub/renamed.bin": string(content)})
+			rsynctest.WriteFiles(t, root, map[string]string{"dest/sub/original.dat": string(content)})
+			rsynctest.Chtimes(t, rsynctest.GosPublicRelease,
+				filepath.Join(source, "sub", "renamed.bin"),
+				filepath.Join(root, "dest", "sub", "original.dat"))
+
+			stats, err := rsynctest.Transfer(t, mode, source, filepath.Join(root, "dest"), "-a", "-y")
+			if err != nil {
+				t.Fatal(err)
+			}
+			rsynctest.CheckFile(t, filepath.Join(root, "dest", "sub", "renamed.bin"), content)
+			if max := int64(size / 5); stats.Written > max {
+				t.Errorf("sender wrote %d bytes, want at most %d", stats.Written, max)
+			}
+		})
+	}
+}
+
+// TestFuzzyBasisDirs verifies that -yy looks for a fuzzy basis file in the
+// alternate basis directories, too.
+func TestFuzzyBasisDirs(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		name  string
+		args  []string
+		fuzzy bool
+	}{
+		{"y", []string{"-y", "--compare-dest=../prev"}, false},
+		{"yy", []string{"-yy", "--compare-dest=../prev"}, true},
+		{"yy-link-dest", []string{"-yy", "--link-dest=../missing", "--link-dest=../prev"}, true},
+	} {
+		for _, mode := range rsynctest.RemoteModes {
+			t.Run(tt.name+"-"+mode, func(t *testing.T) {
+				t.Parallel()
+
+				source, root, content := setup(t, "prev")
+				stats, err := rsynctest.Transfer(t, mode, source, filepath.Join(root, "dest"), append([]string{"-a"}, tt.args...)...)
+				if err != nil {
+					t.Fatal(err)
+				}
+				rsynctest.CheckFile(t, filepath.Join(root, "dest", "sub", "app-1.2.4.tar"), content)
+				if got, max := stats.Written, int64(size/10); tt.fuzzy && got > max {
+					t.Errorf("sender wrote %d bytes, want at most %d", got, max)
+				}
+				if got, min := stats.Written, int64(size); !tt.fuzzy && got < min {
+					t.Errorf("sender wrote %d bytes, want at least %d", got, min)
+				}
+			})
+		}
+	}
+}
+
+func TestFuzzyProtocol(t *testing.T) {
+	t.Parallel()
+
+	source, root, _ := setup(t, "dest")
+	_, err := rsynctest.Transfer(t, rsynctest.Pull, source, filepath.Join(root, "dest"), "-a", "--fuzzy", "--protocol=28")
+	if err == nil {
+		t.Fatal("transfer unexpectedly succeeded")
+	}
+	if want := "--fuzzy requires protocol 29 or higher"; !strings.Contains(err.Error(), want) {
+		t.Errorf("unexpected error: got %v, want %q", err, want)
+	}
+}
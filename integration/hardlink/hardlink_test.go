@@ -0,0 +1,136 @@
+package hardlink_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gokrazy/rsync/internal/rsynctest"
+)
+
+func TestMain(m *testing.M) {
+	rsynctest.CommandMain(m)
+}
+
+// createSource creates a directory with two groups of hard-linked files and
+// one file which is not hard-linked.
+func createSource(t *testing.T) string {
+	t.Helper()
+	source := filepath.Join(t.TempDir(), "source")
+	for _, dir := range []string{"bin", "sbin"} {
+		if err := os.MkdirAll(filepath.Join(source, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, fn := range []string{"bin/busybox", "bin/single"} {
+		if err := os.WriteFile(filepath.Join(source, fn), []byte(fn), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, link := range []struct{ oldname, newname string }{
+		{"bin/busybox", "bin/ls"},
+		{"bin/busybox", "sbin/init"},
+		{"bin/single", "bin/single-link"},
+	} {
+		if err := os.Link(filepath.Join(source, link.oldname), filepath.Join(source, link.newname)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return source
+}
+
+func sameFile(t *testing.T, a, b string) bool {
+	t.Helper()
+	stA, err := os.Stat(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stB, err := os.Stat(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return os.SameFile(stA, stB)
+}
+
+func verifyLinks(t *testing.T, dest string) {
+	t.Helper()
+	for _, fn := range []string{"bin/ls", "sbin/init"} {
+		if !sameFile(t, filepath.Join(dest, "bin/busybox"), filepath.Join(dest, fn)) {
+			t.Errorf("%s is not a hard link to bin/busybox", fn)
+		}
+		b, err := os.ReadFile(filepath.Join(dest, fn))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := string(b), "bin/busybox"; got != want {
+			t.Errorf("%s: unexpected content: got %q, want %q", fn, got, want)
+		}
+	}
+	if !sameFile(t, filepath.Join(dest, "bin/single"), filepath.Join(dest, "bin/single-link")) {
+		t.Errorf("bin/single-link is not a hard link to bin/single")
+	}
+	if sameFile(t, filepath.Join(dest, "bin/busybox"), filepath.Join(dest, "bin/single")) {
+		t.Errorf("bin/single is unexpectedly a hard link to bin/busybox")
+	}
+}
+
+func TestHardLinksDaemonSender(t *testing.T) {
+	t.Parallel()
+
+	source := createSource(t)
+
+	// start a server to sync from
+	srv := rsynctest.New(t, rsynctest.InteropModule(source))
+
+	dest := filepath.Join(t.TempDir(), "dest")
+	if _, err := rsynctest.RunUnrestricted(t, "gokr-rsync", "-aH", "rsync://localhost:"+srv.Port+"/interop/", dest); err != nil {
+		t.Fatal(err)
+	}
+	verifyLinks(t, dest)
+
+	// Break up a hard link in the destination, a second sync needs to
+	// restore it.
+	ls := filepath.Join(dest, "bin/ls")
+	if err := os.Remove(ls); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(ls, []byte("bin/busybox"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rsynctest.RunUnrestricted(t, "gokr-rsync", "-aH", "rsync://localhost:"+srv.Port+"/interop/", dest); err != nil {
+		t.Fatal(err)
+	}
+	verifyLinks(t, dest)
+}
+
+func TestHardLinksClientSender(t *testing.T) {
+	t.Parallel()
+
+	source := createSource(t)
+
+	// start a server to sync to
+	dest := filepath.Join(t.TempDir(), "dest")
+	srv := rsynctest.New(t, rsynctest.WritableInteropModule(dest))
+
+	if _, err := rsynctest.RunUnrestricted(t, "gokr-rsync", "-aH", source+"/", "rsync://localhost:"+srv.Port+"/interop/"); err != nil {
+		t.Fatal(err)
+	}
+	verifyLinks(t, dest)
+}
+
+func TestHardLinksNotPreserved(t *testing.T) {
+	t.Parallel()
+
+	source := createSource(t)
+
+	// start a server to sync from
+	srv := rsynctest.New(t, rsynctest.InteropModule(source))
+
+	dest := filepath.Join(t.TempDir(), "dest")
+	if _, err := rsynctest.RunUnrestricted(t, "gokr-rsync", "-a", "rsync://localhost:"+srv.Port+"/interop/", dest); err != nil {
+		t.Fatal(err)
+	}
+	if sameFile(t, filepath.Join(dest, "bin/busybox"), filepath.Join(dest, "bin/ls")) {
+		t.Errorf("bin/ls is unexpectedly a hard link without -H")
+	}
+}
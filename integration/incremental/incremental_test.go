@@ -0,0 +1,214 @@
+package incremental_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gokrazy/rsync/internal/rsynctest"
+	"github.com/gokrazy/rsync/internal/testlogger"
+)
+
+func TestMain(m *testing.M) {
+	rsynctest.CommandMain(m)
+}
+
+// createSource creates a tree with more directories and files than the
+// sender keeps in flight (so that it sends many extra file lists in between
+// transferring files), empty directories, hard links across directories and
+// a read-only directory.
+func createSource(t *testing.T) string {
+	t.Helper()
+	source := filepath.Join(t.TempDir(), "source")
+	files := make(map[string]string)
+	for i := range 30 {
+		for j := range 5 {
+			dir := fmt.Sprintf("dir%02d/sub%d", i, j)
+			if j == 4 {
+				// leave empty
+				if err := os.MkdirAll(filepath.Join(source, dir), 0755); err != nil {
+					t.Fatal(err)
+				}
+				continue
+			}
+			for k := range 10 {
+				fn := fmt.Sprintf("%s/file%d", dir, k)
+				files[fn] = fn
+			}
+		}
+	}
+	rsynctest.WriteFiles(t, source, files)
+	if err := os.Link(filepath.Join(source, "dir00/sub0/file0"), filepath.Join(source, "dir29/sub3/hlink")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(source, "dir00/sub0/file0"), filepath.Join(source, "dir00/hlink")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../dir00/sub0/file0", filepath.Join(source, "dir01/symlink")); err != nil {
+		t.Fatal(err)
+	}
+	ro := filepath.Join(source, "dir02/readonly")
+	rsynctest.WriteFiles(t, ro, map[string]string{"file": "in read-only directory"})
+	if err := os.Chmod(ro, 0555); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chmod(ro, 0755) })
+	return source
+}
+
+func verifyDest(t *testing.T, source, dest string) {
+	t.Helper()
+	var files int
+	err := filepath.Walk(source, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(source, path)
+		if err != nil {
+			return err
+		}
+		st, err := os.Lstat(filepath.Join(dest, rel))
+		if err != nil {
+			return err
+		}
+		if got, want := st.Mode(), info.Mode(); got != want {
+			t.Errorf("%s: unexpected mode: got %v, want %v", rel, got, want)
+		}
+		if info.Mode().IsRegular() {
+			files++
+			got, err := os.ReadFile(filepath.Join(dest, rel))
+			if err != nil {
+				return err
+			}
+			want, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("%s: content differs", rel)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files < 1000 {
+		t.Fatalf("BUG: only %d files in the source", files)
+	}
+	target, err := os.Readlink(filepath.Join(dest, "dir01/symlink"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "../dir00/sub0/file0"; target != want {
+		t.Errorf("symlink: unexpected target: got %q, want %q", target, want)
+	}
+	for _, fn := range []string{"dir29/sub3/hlink", "dir00/hlink"} {
+		stA, err := os.Stat(filepath.Join(dest, "dir00/sub0/file0"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		stB, err := os.Stat(filepath.Join(dest, fn))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !os.SameFile(stA, stB) {
+			t.Errorf("%s is not a hard link to dir00/sub0/file0", fn)
+		}
+	}
+}
+
+func TestIncrementalDaemonSender(t *testing.T) {
+	t.Parallel()
+
+	source := createSource(t)
+
+	// start a server to sync from
+	srv := rsynctest.New(t, rsynctest.InteropModule(source))
+
+	dest := filepath.Join(t.TempDir(), "dest")
+	t.Cleanup(func() { os.Chmod(filepath.Join(dest, "dir02/readonly"), 0755) })
+	var stdout strings.Builder
+	cmd := rsynctest.UnrestrictedCommand(t, "gokr-rsync", "-aH", "--progress", "rsync://localhost:"+srv.Port+"/interop/", dest)
+	cmd.Stdout = io.MultiWriter(&stdout, testlogger.New(t))
+	if _, err := cmd.Run(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	if want := "receiving incremental file list"; !strings.Contains(stdout.String(), want) {
+		t.Errorf("output does not contain %q", want)
+	}
+	verifyDest(t, source, dest)
+
+	// A second sync finds everything up to date.
+	if _, err := rsynctest.RunUnrestricted(t, "gokr-rsync", "-aH", "rsync://localhost:"+srv.Port+"/interop/", dest); err != nil {
+		t.Fatal(err)
+	}
+	verifyDest(t, source, dest)
+}
+
+func TestIncrementalDaemonSenderNoDotDir(t *testing.T) {
+	t.Parallel()
+
+	source := createSource(t)
+
+	// start a server to sync from
+	srv := rsynctest.New(t, rsynctest.InteropModule(source))
+
+	// Without a trailing slash, the initial file list only contains dir05,
+	// its contents follow in an extra file list.
+	dest := filepath.Join(t.TempDir(), "dest")
+	if _, err := rsynctest.RunUnrestricted(t, "gokr-rsync", "-a", "rsync://localhost:"+srv.Port+"/interop/dir05", dest); err != nil {
+		t.Fatal(err)
+	}
+	for i := range 4 {
+		fn := filepath.Join(dest, "dir05", fmt.Sprintf("sub%d", i), "file9")
+		if _, err := os.Stat(fn); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestIncrementalClientSender(t *testing.T) {
+	t.Parallel()
+
+	source := createSource(t)
+
+	// start a server to sync to
+	dest := filepath.Join(t.TempDir(), "dest")
+	t.Cleanup(func() { os.Chmod(filepath.Join(dest, "dir02/readonly"), 0755) })
+	srv := rsynctest.New(t, rsynctest.WritableInteropModule(dest))
+
+	if _, err := rsynctest.RunUnrestricted(t, "gokr-rsync", "-aH", source+"/", "rsync://localhost:"+srv.Port+"/interop/"); err != nil {
+		t.Fatal(err)
+	}
+	verifyDest(t, source, dest)
+}
+
+func TestNoIncremental(t *testing.T) {
+	t.Parallel()
+
+	source := createSource(t)
+
+	// start a server to sync from
+	srv := rsynctest.New(t, rsynctest.InteropModule(source))
+
+	dest := filepath.Join(t.TempDir(), "dest")
+	t.Cleanup(func() { os.Chmod(filepath.Join(dest, "dir02/readonly"), 0755) })
+	var stdout strings.Builder
+	cmd := rsynctest.UnrestrictedCommand(t, "gokr-rsync", "-aH", "--progress", "--no-inc-recursive", "rsync://localhost:"+srv.Port+"/interop/", dest)
+	cmd.Stdout = io.MultiWriter(&stdout, testlogger.New(t))
+	if _, err := cmd.Run(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	if want := "receiving file list"; !strings.Contains(stdout.String(), want) {
+		t.Errorf("output does not contain %q", want)
+	}
+	if strings.Contains(stdout.String(), "incremental") {
+		t.Errorf("output unexpectedly mentions an incremental file list")
+	}
+	verifyDest(t, source, dest)
+}
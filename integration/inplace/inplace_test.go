@@ -0,0 +1,203 @@
+package inplace_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gokrazy/rsync/internal/rsynctest"
+)
+
+func TestMain(m *testing.M) {
+	rsynctest.CommandMain(m)
+}
+
+// setup creates source/file and dest/file, and a hard link dest/link to
+// dest/file, which only reflects changes made in place.
+func setup(t *testing.T, oldContent, newContent []byte) (source, dest string) {
+	t.Helper()
+	source = filepath.Join(t.TempDir(), "source")
+	rsynctest.WriteFiles(t, source, map[string]string{"file": string(newContent)})
+	dest = filepath.Join(t.TempDir(), "dest")
+	rsynctest.WriteFiles(t, dest, map[string]string{"file": string(oldContent)})
+	if err := os.Link(filepath.Join(dest, "file"), filepath.Join(dest, "link")); err != nil {
+		t.Fatal(err)
+	}
+	return source, dest
+}
+
+const size = 1024 * 1024
+
+func TestInplace(t *testing.T) {
+	t.Parallel()
+
+	old := rsynctest.RandomBytes(1, size)
+	for _, tt := range []struct {
+		name       string
+		newContent []byte
+		// maxWritten is the maximum number of bytes which the sender
+		// writes, or 0 if the data cannot be reused.
+		maxWritten int64
+	}{
+		// Moving blocks towards the start of the file reuses them: the
+		// receiver did not yet overwrite them when reading.
+		{"shift-backward", old[5000:], size / 10},
+		// Moving blocks towards the end of the file cannot reuse them: the
+		// receiver already overwrote them (with the inserted data) when
+		// reading.
+		{"shift-forward", append(rsynctest.RandomBytes(2, 5000), old...), 0},
+		// Blocks in the same spot are not written at all.
+		{"change-middle", append(append(bytes.Clone(old[:size/2]), rsynctest.RandomBytes(3, 3000)...), old[size/2+3000:]...), size / 10},
+		{"truncate", old[:size/2], size / 10},
+	} {
+		for _, mode := range rsynctest.RemoteModes {
+			t.Run(tt.name+"-"+mode, func(t *testing.T) {
+				t.Parallel()
+
+				source, dest := setup(t, old, tt.newContent)
+				// -I makes the transfers independent of modification times.
+				stats, err := rsynctest.Transfer(t, mode, source, dest, "-a", "-I", "--inplace")
+				if err != nil {
+					t.Fatal(err)
+				}
+				rsynctest.CheckFile(t, filepath.Join(dest, "file"), tt.newContent)
+				// The hard link shares the updated file.
+				rsynctest.CheckFile(t, filepath.Join(dest, "link"), tt.newContent)
+				if tt.maxWritten > 0 && stats.Written > tt.maxWritten {
+					t.Errorf("sender wrote %d bytes, want at most %d", stats.Written, tt.maxWritten)
+				}
+			})
+		}
+	}
+}
+
+func TestInplaceBackup(t *testing.T) {
+	t.Parallel()
+
+	old := rsynctest.RandomBytes(1, size)
+	newContent := append(rsynctest.RandomBytes(2, 5000), old...)
+	for _, protocol := range []string{"29", "31"} {
+		for _, mode := range rsynctest.RemoteModes {
+			t.Run(mode+"-protocol"+protocol, func(t *testing.T) {
+				t.Parallel()
+
+				source, dest := setup(t, old, newContent)
+				// The backup copy is the basis file, so that blocks can be
+				// moved towards the end of the file.
+				stats, err := rsynctest.Transfer(t, mode, source, dest, "-a", "-I", "--inplace", "--backup", "--protocol="+protocol)
+				if err != nil {
+					t.Fatal(err)
+				}
+				rsynctest.CheckFile(t, filepath.Join(dest, "file"), newContent)
+				rsynctest.CheckFile(t, filepath.Join(dest, "link"), newContent)
+				rsynctest.CheckFile(t, filepath.Join(dest, "file~"), old)
+				if max := int64(size / 10); stats.Written > max {
+					t.Errorf("sender wrote %d bytes, want at most %d", stats.Written, max)
+				}
+			})
+		}
+	}
+}
+
+func TestAppend(t *testing.T) {
+	t.Parallel()
+
+	content := rsynctest.RandomBytes(1, size)
+	for _, mode := range rsynctest.RemoteModes {
+		t.Run(mode, func(t *testing.T) {
+			t.Parallel()
+
+			source, dest := setup(t, content[:size/2], content)
+			rsynctest.WriteFiles(t, source, map[string]string{"shorter": "short"})
+			rsynctest.WriteFiles(t, dest, map[string]string{"shorter": "longer file"})
+
+			stats, err := rsynctest.Transfer(t, mode, source, dest, "-a", "-I", "--append")
+			if err != nil {
+				t.Fatal(err)
+			}
+			rsynctest.CheckFile(t, filepath.Join(dest, "file"), content)
+			rsynctest.CheckFile(t, filepath.Join(dest, "link"), content)
+			// Files which are not shorter than the source are skipped.
+			rsynctest.CheckFile(t, filepath.Join(dest, "shorter"), []byte("longer file"))
+			if max := int64(size/2 + size/10); stats.Written > max {
+				t.Errorf("sender wrote %d bytes, want at most %d", stats.Written, max)
+			}
+		})
+	}
+}
+
+// TestAppendLocal verifies that --append works for local transfers, which
+// imply --whole-file on the client side only.
+func TestAppendLocal(t *testing.T) {
+	t.Parallel()
+
+	content := rsynctest.RandomBytes(1, size)
+	source, dest := setup(t, content[:size/2], content)
+	if _, err := rsynctest.Transfer(t, rsynctest.Local, source, dest, "-a", "--append"); err != nil {
+		t.Fatal(err)
+	}
+	rsynctest.CheckFile(t, filepath.Join(dest, "file"), content)
+	rsynctest.CheckFile(t, filepath.Join(dest, "link"), content)
+}
+
+func TestAppendVerify(t *testing.T) {
+	t.Parallel()
+
+	content := rsynctest.RandomBytes(1, size)
+	// The destination file is not a prefix of the source file.
+	modified := bytes.Clone(content[:size/2])
+	modified[100] ^= 0xff
+
+	for _, tt := range []struct {
+		name string
+		args []string
+		// verify is set if the whole-file checksum covers the data which
+		// the receiver already has: the verification fails, and the file is
+		// sent again without --append.
+		verify bool
+	}{
+		{"append", []string{"--append"}, false},
+		{"append-verify", []string{"--append-verify"}, true},
+		{"append-protocol29", []string{"--append", "--protocol=29"}, true},
+	} {
+		for _, mode := range rsynctest.RemoteModes {
+			t.Run(tt.name+"-"+mode, func(t *testing.T) {
+				t.Parallel()
+
+				source, dest := setup(t, modified, content)
+				if _, err := rsynctest.Transfer(t, mode, source, dest, append([]string{"-a", "-I"}, tt.args...)...); err != nil {
+					t.Fatal(err)
+				}
+				if tt.verify {
+					rsynctest.CheckFile(t, filepath.Join(dest, "file"), content)
+					return
+				}
+				// --append trusts the data which the receiver has.
+				want := append(bytes.Clone(modified), content[size/2:]...)
+				rsynctest.CheckFile(t, filepath.Join(dest, "file"), want)
+			})
+		}
+	}
+}
+
+func TestInplacePartialDir(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		arg  string
+		want string
+	}{
+		{"--inplace", "--inplace cannot be used with --partial-dir"},
+		{"--append", "--append cannot be used with --partial-dir"},
+	} {
+		_, err := rsynctest.RunUnrestricted(t, "gokr-rsync", "-a", tt.arg, "--partial-dir=.partial", t.TempDir()+"/", t.TempDir())
+		if err == nil {
+			t.Fatalf("%s with --partial-dir unexpectedly succeeded", tt.arg)
+		}
+		if !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("unexpected error: got %v, want %q", err, tt.want)
+		}
+	}
+}
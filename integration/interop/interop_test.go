@@ -409,8 +409,7 @@ func TestInteropSubdirExclude(t *testing.T) {
 			append([]string{
 				//		"--debug=all4",
 				"--archive",
-				// TODO: implement support for include rules
-				//"-f", "+ *.o",
+				"-f", "+ *.o",
 				// NOTE: Using -f is the more modern replacement
 				// for using --exclude like so:
 				//"--exclude=dummy",
@@ -491,8 +490,7 @@ func TestInteropSubdirExcludeMultipleNested(t *testing.T) {
 			append([]string{
 				//		"--debug=all4",
 				"--archive",
-				// TODO: implement support for include rules
-				//"-f", "+ *.o",
+				"-f", "+ *.o",
 				// NOTE: Using -f is the more modern replacement
 				// for using --exclude like so:
 				//"--exclude=dummy",
@@ -0,0 +1,210 @@
+package itemize_test
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/gokrazy/rsync/internal/rsynctest"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMain(m *testing.M) {
+	rsynctest.CommandMain(m)
+}
+
+var modes = []struct {
+	name string
+	// op is the %o escape of the logging (client) side.
+	op string
+	// sent is the first character of %i for transferred files: tridge
+	// rsync uses < for files sent to a remote host.
+	sent string
+}{
+	{rsynctest.Local, "send", ">"},
+	{rsynctest.Pull, "recv", ">"},
+	{rsynctest.Push, "send", "<"},
+}
+
+// setup creates the source directory (with a file, a symlink and a
+// subdirectory) and an empty destination directory dest within root.
+func setup(t *testing.T) (source, root string) {
+	t.Helper()
+	source = filepath.Join(t.TempDir(), "source")
+	rsynctest.WriteFiles(t, source, map[string]string{
+		"a.txt":     "a",
+		"sub/b.txt": "b",
+	})
+	if err := os.Symlink("a.txt", filepath.Join(source, "link")); err != nil {
+		t.Fatal(err)
+	}
+	rsynctest.Chtimes(t, rsynctest.GosPublicRelease,
+		filepath.Join(source, "a.txt"),
+		filepath.Join(source, "sub", "b.txt"),
+		filepath.Join(source, "sub"),
+		source)
+
+	root = t.TempDir()
+	// Create the destination directory up front so that its itemization
+	// does not depend on which side creates it.
+	if err := os.Mkdir(filepath.Join(root, "dest"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return source, root
+}
+
+func TestItemizeChanges(t *testing.T) {
+	t.Parallel()
+
+	for _, mode := range modes {
+		t.Run(mode.name, func(t *testing.T) {
+			t.Parallel()
+
+			source, root := setup(t)
+			dest := filepath.Join(root, "dest")
+
+			got := rsynctest.TransferOutput(t, mode.name, source, dest, "-a", "-i")
+			want := []string{
+				".d..t...... ./",
+				mode.sent + "f+++++++++ a.txt",
+				"cL+++++++++ link -> a.txt",
+				"cd+++++++++ sub/",
+				mode.sent + "f+++++++++ sub/b.txt",
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Fatalf("initial sync: unexpected output: diff (-want +got):\n%s", diff)
+			}
+
+			// Nothing changed, so nothing is itemized.
+			got = rsynctest.TransferOutput(t, mode.name, source, dest, "-a", "-i")
+			if diff := cmp.Diff([]string{""}, got); diff != "" {
+				t.Fatalf("unchanged sync: unexpected output: diff (-want +got):\n%s", diff)
+			}
+
+			// -ii itemizes unchanged files, too.
+			got = rsynctest.TransferOutput(t, mode.name, source, dest, "-a", "-ii")
+			want = []string{
+				".d          ./",
+				".f          a.txt",
+				".L          link -> a.txt",
+				".d          sub/",
+				".f          sub/b.txt",
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Fatalf("-ii sync: unexpected output: diff (-want +got):\n%s", diff)
+			}
+
+			rsynctest.WriteFiles(t, source, map[string]string{"a.txt": "changed"})
+			rsynctest.Chtimes(t, rsynctest.GosPublicRelease.Add(time.Hour), filepath.Join(source, "a.txt"))
+			if err := os.Chmod(filepath.Join(source, "sub", "b.txt"), 0600); err != nil {
+				t.Fatal(err)
+			}
+			rsynctest.WriteFiles(t, dest, map[string]string{"stale.txt": "stale"})
+			rsynctest.Chtimes(t, rsynctest.GosPublicRelease, filepath.Join(dest, "stale.txt"), dest)
+
+			got = rsynctest.TransferOutput(t, mode.name, source, dest, "-a", "-i", "--delete")
+			want = []string{
+				"*deleting   stale.txt",
+				mode.sent + "f.st...... a.txt",
+				".f...p..... sub/b.txt",
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Fatalf("changed sync: unexpected output: diff (-want +got):\n%s", diff)
+			}
+			// The deletion modified the destination directory, whose
+			// modification time must have been restored afterwards.
+			st, err := os.Stat(dest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := st.ModTime(), rsynctest.GosPublicRelease; !got.Equal(want) {
+				t.Errorf("dest modification time = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestOutFormat(t *testing.T) {
+	t.Parallel()
+
+	for _, mode := range modes {
+		t.Run(mode.name, func(t *testing.T) {
+			t.Parallel()
+
+			source, root := setup(t)
+			dest := filepath.Join(root, "dest")
+			rsynctest.WriteFiles(t, dest, map[string]string{"stale.txt": "stale"})
+			rsynctest.Chtimes(t, rsynctest.GosPublicRelease, filepath.Join(dest, "stale.txt"), dest)
+
+			got := rsynctest.TransferOutput(t, mode.name, source, dest, "-a",
+				"--delete",
+				"--out-format=%o %n",
+				"--exclude=sub/")
+			want := []string{
+				"del. stale.txt",
+				mode.op + " a.txt",
+				mode.op + " link",
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Fatalf("unexpected output: diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestItemizeHardLinks(t *testing.T) {
+	t.Parallel()
+
+	for _, mode := range modes {
+		t.Run(mode.name, func(t *testing.T) {
+			t.Parallel()
+
+			source, root := setup(t)
+			if err := os.Link(filepath.Join(source, "a.txt"), filepath.Join(source, "a2.txt")); err != nil {
+				t.Fatal(err)
+			}
+			rsynctest.Chtimes(t, rsynctest.GosPublicRelease, source)
+			dest := filepath.Join(root, "dest")
+
+			got := rsynctest.TransferOutput(t, mode.name, source, dest, "-aH", "-i")
+			// Hard links are created (and itemized) once the files they
+			// link to were transferred.
+			want := []string{
+				".d..t...... ./",
+				mode.sent + "f+++++++++ a.txt",
+				"cL+++++++++ link -> a.txt",
+				"cd+++++++++ sub/",
+				mode.sent + "f+++++++++ sub/b.txt",
+				"hf+++++++++ a2.txt => a.txt",
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Fatalf("unexpected output: diff (-want +got):\n%s", diff)
+			}
+			stA, err := os.Stat(filepath.Join(dest, "a.txt"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			stA2, err := os.Stat(filepath.Join(dest, "a2.txt"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !os.SameFile(stA, stA2) {
+				t.Errorf("a2.txt is not hard-linked to a.txt")
+			}
+
+			// -v logs the name of the hard link target, too.
+			if err := os.RemoveAll(dest); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Mkdir(dest, 0755); err != nil {
+				t.Fatal(err)
+			}
+			got = rsynctest.TransferOutput(t, mode.name, source, dest, "-aH", "-v")
+			if !slices.Contains(got, "a2.txt => a.txt") {
+				t.Errorf("unexpected output: got %q, want a line %q", got, "a2.txt => a.txt")
+			}
+		})
+	}
+}
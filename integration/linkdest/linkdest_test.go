@@ -0,0 +1,248 @@
+package linkdest_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gokrazy/rsync/internal/rsyncstats"
+	"github.com/gokrazy/rsync/internal/rsynctest"
+)
+
+func TestMain(m *testing.M) {
+	rsynctest.CommandMain(m)
+}
+
+const size = 1024 * 1024
+
+// setup creates a source directory and the previous snapshot snapshots/prev:
+//
+//   - unchanged and sub/unchanged are identical in both
+//   - changed differs in 3000 bytes in the middle (and in its mtime)
+//   - added only exists in the source
+func setup(t *testing.T) (source, snapshots string) {
+	t.Helper()
+	source = filepath.Join(t.TempDir(), "source")
+	snapshots = filepath.Join(t.TempDir(), "snapshots")
+	prev := filepath.Join(snapshots, "prev")
+	old := rsynctest.RandomBytes(2, size)
+	changed := append(append(bytes.Clone(old[:size/2]), rsynctest.RandomBytes(3, 3000)...), old[size/2+3000:]...)
+	for _, dir := range []string{source, prev} {
+		rsynctest.WriteFiles(t, dir, map[string]string{
+			"unchanged":     string(rsynctest.RandomBytes(1, size)),
+			"sub/unchanged": "unchanged\n",
+		})
+		rsynctest.Chtimes(t, rsynctest.GosPublicRelease,
+			filepath.Join(dir, "unchanged"),
+			filepath.Join(dir, "sub", "unchanged"))
+	}
+	rsynctest.WriteFiles(t, prev, map[string]string{"changed": string(old)})
+	rsynctest.Chtimes(t, rsynctest.GosPublicRelease, filepath.Join(prev, "changed"))
+	rsynctest.WriteFiles(t, source, map[string]string{
+		"changed": string(changed),
+		"added":   "added\n",
+	})
+	return source, snapshots
+}
+
+// checkSame verifies that the destination file name of snapshots/new is (or
+// is not) a hard link to the file of snapshots/prev.
+func checkSame(t *testing.T, snapshots, name string, wantSame bool) {
+	t.Helper()
+	prev, err := os.Stat(filepath.Join(snapshots, "prev", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cur, err := os.Stat(filepath.Join(snapshots, "new", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := os.SameFile(prev, cur); got != wantSame {
+		t.Errorf("%s: hard linked = %v, want %v", name, got, wantSame)
+	}
+}
+
+func checkTransfer(t *testing.T, source, snapshots string, stats *rsyncstats.TransferStats) {
+	t.Helper()
+	for _, name := range []string{"changed", "added"} {
+		want, err := os.ReadFile(filepath.Join(source, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsynctest.CheckFile(t, filepath.Join(snapshots, "new", name), want)
+	}
+	// The file in the basis directory is the basis of the changed file, and
+	// the unchanged files are not transferred.
+	if max := int64(size / 10); stats.Written > max {
+		t.Errorf("sender wrote %d bytes, want at most %d", stats.Written, max)
+	}
+}
+
+func TestLinkDest(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		name    string
+		linkDir string
+	}{
+		{"relative", "../prev"},
+		{"missing-first", "../missing"},
+	} {
+		for _, mode := range rsynctest.RemoteModes {
+			t.Run(tt.name+"-"+mode, func(t *testing.T) {
+				t.Parallel()
+
+				source, snapshots := setup(t)
+				args := []string{"-a", "--link-dest=" + tt.linkDir}
+				if tt.linkDir != "../prev" {
+					// A missing basis directory is skipped.
+					args = append(args, "--link-dest=../prev")
+				}
+				stats, err := rsynctest.Transfer(t, mode, source, filepath.Join(snapshots, "new"), args...)
+				if err != nil {
+					t.Fatal(err)
+				}
+				checkTransfer(t, source, snapshots, stats)
+				checkSame(t, snapshots, "unchanged", true)
+				checkSame(t, snapshots, "sub/unchanged", true)
+				checkSame(t, snapshots, "changed", false)
+			})
+		}
+	}
+}
+
+func TestLinkDestAttributes(t *testing.T) {
+	t.Parallel()
+
+	for _, mode := range rsynctest.RemoteModes {
+		t.Run(mode, func(t *testing.T) {
+			t.Parallel()
+
+			source, snapshots := setup(t)
+			// A file whose content is unchanged, but whose permissions
+			// differ, is copied instead of hard linked.
+			if err := os.Chmod(filepath.Join(source, "unchanged"), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := rsynctest.Transfer(t, mode, source, filepath.Join(snapshots, "new"), "-a", "--link-dest=../prev"); err != nil {
+				t.Fatal(err)
+			}
+			checkSame(t, snapshots, "unchanged", false)
+			checkSame(t, snapshots, "sub/unchanged", true)
+			rsynctest.CheckFile(t, filepath.Join(snapshots, "new", "unchanged"), rsynctest.RandomBytes(1, size))
+			st, err := os.Stat(filepath.Join(snapshots, "new", "unchanged"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := st.Mode().Perm(), os.FileMode(0600); got != want {
+				t.Errorf("unexpected permissions: got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestCompareDest(t *testing.T) {
+	t.Parallel()
+
+	for _, mode := range rsynctest.RemoteModes {
+		t.Run(mode, func(t *testing.T) {
+			t.Parallel()
+
+			source, snapshots := setup(t)
+			stats, err := rsynctest.Transfer(t, mode, source, filepath.Join(snapshots, "new"), "-a", "--compare-dest=../prev")
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkTransfer(t, source, snapshots, stats)
+			// Unchanged files are not created in the destination.
+			for _, name := range []string{"unchanged", "sub/unchanged"} {
+				if _, err := os.Stat(filepath.Join(snapshots, "new", name)); !os.IsNotExist(err) {
+					t.Errorf("%s unexpectedly exists (err = %v)", name, err)
+				}
+			}
+		})
+	}
+}
+
+func TestCopyDest(t *testing.T) {
+	t.Parallel()
+
+	for _, mode := range rsynctest.RemoteModes {
+		t.Run(mode, func(t *testing.T) {
+			t.Parallel()
+
+			source, snapshots := setup(t)
+			stats, err := rsynctest.Transfer(t, mode, source, filepath.Join(snapshots, "new"), "-a", "--copy-dest=../prev")
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkTransfer(t, source, snapshots, stats)
+			// Unchanged files are copied locally.
+			checkSame(t, snapshots, "unchanged", false)
+			rsynctest.CheckFile(t, filepath.Join(snapshots, "new", "unchanged"), rsynctest.RandomBytes(1, size))
+			rsynctest.CheckFile(t, filepath.Join(snapshots, "new", "sub", "unchanged"), []byte("unchanged\n"))
+		})
+	}
+}
+
+func TestLinkDestConfined(t *testing.T) {
+	t.Parallel()
+
+	source, snapshots := setup(t)
+	outside := filepath.Join(t.TempDir(), "outside")
+	rsynctest.WriteFiles(t, outside, map[string]string{"unchanged": string(rsynctest.RandomBytes(1, size))})
+	rsynctest.Chtimes(t, rsynctest.GosPublicRelease, filepath.Join(outside, "unchanged"))
+	if err := os.Symlink(outside, filepath.Join(snapshots, "escape")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, linkDir := range []string{
+		"../../outside",
+		// Symbolic links cannot escape the module either.
+		"../escape",
+	} {
+		// The daemon refuses the transfer (and logs why).
+		if _, err := rsynctest.Transfer(t, rsynctest.Push, source, filepath.Join(snapshots, "new"), "-a", "--link-dest="+linkDir); err == nil {
+			t.Fatalf("--link-dest=%s unexpectedly succeeded", linkDir)
+		}
+		if _, err := os.Stat(filepath.Join(snapshots, "new", "unchanged")); !os.IsNotExist(err) {
+			t.Fatalf("--link-dest=%s: unchanged unexpectedly exists (err = %v)", linkDir, err)
+		}
+	}
+
+	// Absolute directories are relative to the module root.
+	if _, err := rsynctest.Transfer(t, rsynctest.Push, source, filepath.Join(snapshots, "new"), "-a", "--link-dest=/prev"); err != nil {
+		t.Fatal(err)
+	}
+	checkSame(t, snapshots, "unchanged", true)
+}
+
+func TestBasisDirsOptions(t *testing.T) {
+	t.Parallel()
+
+	var tooMany []string
+	for range 21 {
+		tooMany = append(tooMany, "--link-dest=prev")
+	}
+	for _, tt := range []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"too-many", tooMany, "at most 20 --link-dest args may be specified"},
+		{"mixed", []string{"--link-dest=a", "--copy-dest=b"}, "You may not mix --compare-dest, --copy-dest, and --link-dest."},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append([]string{"gokr-rsync", "-a"}, tt.args...)
+			_, err := rsynctest.RunUnrestricted(t, append(args, t.TempDir()+"/", t.TempDir())...)
+			if err == nil {
+				t.Fatal("transfer unexpectedly succeeded")
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("unexpected error: got %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
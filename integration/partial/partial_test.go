@@ -0,0 +1,182 @@
+package partial_test
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gokrazy/rsync/internal/rsyncstats"
+	"github.com/gokrazy/rsync/internal/rsynctest"
+)
+
+func TestMain(m *testing.M) {
+	rsynctest.CommandMain(m)
+}
+
+// interruptingProxy forwards connections to the rsync daemon listening on
+// port, but closes each connection once limit bytes were forwarded in one
+// direction (from the daemon, or with fromClient, from the client), which
+// interrupts the transfer.
+func interruptingProxy(t *testing.T, port string, limit int64, fromClient bool) string {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				backend, err := net.Dial("tcp", "localhost:"+port)
+				if err != nil {
+					return
+				}
+				defer backend.Close()
+				if fromClient {
+					go io.Copy(conn, backend)
+					io.CopyN(backend, conn, limit)
+				} else {
+					go io.Copy(backend, conn)
+					io.CopyN(conn, backend, limit)
+				}
+			}()
+		}
+	}()
+	_, proxyPort, err := net.SplitHostPort(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return proxyPort
+}
+
+const largeSize = 8 * 1024 * 1024
+
+// writeLarge writes a file which is large enough to be interrupted during its
+// transfer, and whose content does not compress.
+func writeLarge(t *testing.T, fn string) []byte {
+	t.Helper()
+	content := rsynctest.RandomBytes(1, largeSize)
+	rsynctest.WriteFiles(t, filepath.Dir(fn), map[string]string{filepath.Base(fn): string(content)})
+	return content
+}
+
+// waitForFile returns the content of fn once it exists: the receiving daemon
+// might still be cleaning up when the client returns.
+func waitForFile(t *testing.T, fn string) ([]byte, error) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		b, err := os.ReadFile(fn)
+		if err == nil || !os.IsNotExist(err) || time.Now().After(deadline) {
+			return b, err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPartial(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		name string
+		push bool
+		args []string
+		// partial is the name of the partial file, relative to the
+		// destination, or empty if no partial file should be kept.
+		partial string
+	}{
+		{"pull", false, []string{"--partial"}, "dir/large"},
+		{"pull-partial-dir", false, []string{"--partial-dir=.rsync-partial"}, "dir/.rsync-partial/large"},
+		{"pull-progress", false, []string{"-P"}, "dir/large"},
+		{"pull-discard", false, nil, ""},
+		{"push", true, []string{"--partial"}, "dir/large"},
+		{"push-partial-dir", true, []string{"--partial-dir=.rsync-partial"}, "dir/.rsync-partial/large"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			source := filepath.Join(t.TempDir(), "source")
+			content := writeLarge(t, filepath.Join(source, "dir", "large"))
+
+			dest := filepath.Join(t.TempDir(), "dest")
+			if err := os.MkdirAll(dest, 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			var srv *rsynctest.TestServer
+			if tt.push {
+				// start a server to sync to
+				srv = rsynctest.New(t, rsynctest.WritableInteropModule(dest))
+			} else {
+				// start a server to sync from
+				srv = rsynctest.New(t, rsynctest.InteropModule(source))
+			}
+			transfer := func(port string) (*rsyncstats.TransferStats, error) {
+				args := append([]string{"gokr-rsync", "-a"}, tt.args...)
+				if tt.push {
+					args = append(args, source+"/", "rsync://localhost:"+port+"/interop/")
+				} else {
+					args = append(args, "rsync://localhost:"+port+"/interop/", dest)
+				}
+				return rsynctest.RunUnrestricted(t, args...)
+			}
+
+			proxyPort := interruptingProxy(t, srv.Port, largeSize/4, tt.push)
+			if _, err := transfer(proxyPort); err == nil {
+				t.Fatal("interrupted transfer unexpectedly succeeded")
+			}
+
+			var partialSize int
+			if tt.partial == "" {
+				// Give a (wrongly) kept partial file time to appear.
+				time.Sleep(100 * time.Millisecond)
+				if _, err := os.Stat(filepath.Join(dest, "dir", "large")); !os.IsNotExist(err) {
+					t.Fatalf("partial file unexpectedly kept: %v", err)
+				}
+			} else {
+				partial, err := waitForFile(t, filepath.Join(dest, tt.partial))
+				if err != nil {
+					t.Fatal(err)
+				}
+				partialSize = len(partial)
+				if partialSize == 0 || partialSize >= largeSize {
+					t.Fatalf("unexpected partial file size: got %d, want between 0 and %d", partialSize, largeSize)
+				}
+				if !bytes.Equal(partial, content[:partialSize]) {
+					t.Fatalf("partial file is not a prefix of the source file")
+				}
+			}
+
+			// The next transfer resumes where the interrupted one stopped.
+			stats, err := transfer(srv.Port)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := os.ReadFile(filepath.Join(dest, "dir", "large"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, content) {
+				t.Fatalf("destination file differs from the source file")
+			}
+			if _, err := os.Stat(filepath.Join(dest, "dir", ".rsync-partial")); !os.IsNotExist(err) {
+				t.Errorf("partial directory unexpectedly still exists: %v", err)
+			}
+			if partialSize > 0 {
+				// Only the remainder needs to be transferred. Like in tridge
+				// rsync, the stats are those of the sender in both directions.
+				if max := int64(largeSize - partialSize/2); stats.Written > max {
+					t.Errorf("transferred %d bytes, want at most %d (partial file has %d bytes)", stats.Written, max, partialSize)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,246 @@
+package protocol_test
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gokrazy/rsync"
+	"github.com/gokrazy/rsync/internal/rsynctest"
+)
+
+func TestMain(m *testing.M) {
+	rsynctest.CommandMain(m)
+}
+
+// largeContent returns content which spans multiple checksum blocks.
+func largeContent(modified bool) []byte {
+	var buf bytes.Buffer
+	for line := 0; buf.Len() < 512*1024; line++ {
+		if modified && line == 5000 {
+			buf.WriteString("modified in the middle\n")
+		}
+		fmt.Fprintf(&buf, "line %d of a file synced with every protocol version\n", line)
+	}
+	return buf.Bytes()
+}
+
+func writeSource(t *testing.T, source string, modified bool) {
+	t.Helper()
+	rsynctest.WriteFiles(t, source, map[string]string{
+		"large":       string(largeContent(modified)),
+		"dir/small":   "small file",
+		"dir/hlinked": "hard linked file",
+	})
+	link := filepath.Join(source, "hlink")
+	if _, err := os.Lstat(link); os.IsNotExist(err) {
+		if err := os.Link(filepath.Join(source, "dir/hlinked"), link); err != nil {
+			t.Fatal(err)
+		}
+	}
+	symlink := filepath.Join(source, "symlink")
+	if _, err := os.Lstat(symlink); os.IsNotExist(err) {
+		if err := os.Symlink("dir/small", symlink); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func verifyDest(t *testing.T, dest string, modified bool) {
+	t.Helper()
+	for fn, want := range map[string][]byte{
+		"large":     largeContent(modified),
+		"dir/small": []byte("small file"),
+		"hlink":     []byte("hard linked file"),
+	} {
+		got, err := os.ReadFile(filepath.Join(dest, fn))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: content differs (got %d bytes, want %d bytes)", fn, len(got), len(want))
+		}
+	}
+	target, err := os.Readlink(filepath.Join(dest, "symlink"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "dir/small"; target != want {
+		t.Errorf("symlink: unexpected target: got %q, want %q", target, want)
+	}
+	stA, err := os.Stat(filepath.Join(dest, "dir/hlinked"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stB, err := os.Stat(filepath.Join(dest, "hlink"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(stA, stB) {
+		t.Errorf("hlink is not a hard link to dir/hlinked")
+	}
+}
+
+func protocolVersions() []int {
+	var versions []int
+	for v := rsync.MinProtocolVersion; v <= rsync.ProtocolVersion; v++ {
+		versions = append(versions, v)
+	}
+	return versions
+}
+
+func TestProtocolDaemonSender(t *testing.T) {
+	t.Parallel()
+
+	for _, protocol := range protocolVersions() {
+		t.Run(strconv.Itoa(protocol), func(t *testing.T) {
+			t.Parallel()
+
+			source := filepath.Join(t.TempDir(), "source")
+			writeSource(t, source, false)
+
+			// start a server to sync from
+			srv := rsynctest.New(t, rsynctest.InteropModule(source))
+
+			dest := filepath.Join(t.TempDir(), "dest")
+			args := []string{
+				"gokr-rsync",
+				"-aH",
+				"--protocol=" + strconv.Itoa(protocol),
+				"rsync://localhost:" + srv.Port + "/interop/",
+				dest,
+			}
+			if _, err := rsynctest.RunUnrestricted(t, args...); err != nil {
+				t.Fatal(err)
+			}
+			verifyDest(t, dest, false)
+
+			// The modified file is transferred as a delta, which exercises
+			// the block checksums of the protocol version.
+			writeSource(t, source, true)
+			if _, err := rsynctest.RunUnrestricted(t, args...); err != nil {
+				t.Fatal(err)
+			}
+			verifyDest(t, dest, true)
+
+			// Verify the whole-file checksums of the protocol version.
+			if _, err := rsynctest.RunUnrestricted(t, append([]string{"gokr-rsync", "-c"}, args[1:]...)...); err != nil {
+				t.Fatal(err)
+			}
+			verifyDest(t, dest, true)
+		})
+	}
+}
+
+func TestProtocolClientSender(t *testing.T) {
+	t.Parallel()
+
+	for _, protocol := range protocolVersions() {
+		t.Run(strconv.Itoa(protocol), func(t *testing.T) {
+			t.Parallel()
+
+			source := filepath.Join(t.TempDir(), "source")
+			writeSource(t, source, false)
+
+			// start a server to sync to
+			dest := filepath.Join(t.TempDir(), "dest")
+			srv := rsynctest.New(t, rsynctest.WritableInteropModule(dest))
+
+			args := []string{
+				"gokr-rsync",
+				"-aH",
+				"--protocol=" + strconv.Itoa(protocol),
+				source + "/",
+				"rsync://localhost:" + srv.Port + "/interop/",
+			}
+			if _, err := rsynctest.RunUnrestricted(t, args...); err != nil {
+				t.Fatal(err)
+			}
+			verifyDest(t, dest, false)
+
+			writeSource(t, source, true)
+			if _, err := rsynctest.RunUnrestricted(t, args...); err != nil {
+				t.Fatal(err)
+			}
+			verifyDest(t, dest, true)
+		})
+	}
+}
+
+func TestProtocolUnsupported(t *testing.T) {
+	t.Parallel()
+
+	source := t.TempDir()
+	dest := t.TempDir()
+	_, err := rsynctest.RunUnrestricted(t, "gokr-rsync", "-a", "--protocol=26", source+"/", dest)
+	if err == nil {
+		t.Fatal("syncing with --protocol=26 unexpectedly succeeded")
+	}
+	if want := "--protocol must be between"; !strings.Contains(err.Error(), want) {
+		t.Errorf("unexpected error: got %v, want %q", err, want)
+	}
+}
+
+func TestProtocolModTimeNsec(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		protocol int
+		want     func(time.Time) time.Time
+	}{
+		{30, func(mtime time.Time) time.Time { return mtime.Truncate(time.Second) }},
+		{31, func(mtime time.Time) time.Time { return mtime }},
+	} {
+		t.Run(strconv.Itoa(tt.protocol), func(t *testing.T) {
+			t.Parallel()
+
+			source := filepath.Join(t.TempDir(), "source")
+			rsynctest.WriteFiles(t, source, map[string]string{"dir/file": "nanoseconds"})
+			fn := filepath.Join(source, "dir", "file")
+			mtime := time.Date(2024, 5, 1, 12, 30, 15, 123456789, time.UTC)
+			rsynctest.Chtimes(t, mtime, fn)
+
+			// start a server to sync from
+			srv := rsynctest.New(t, rsynctest.InteropModule(source))
+
+			dest := filepath.Join(t.TempDir(), "dest")
+			args := []string{
+				"gokr-rsync",
+				"-a",
+				"--protocol=" + strconv.Itoa(tt.protocol),
+				"rsync://localhost:" + srv.Port + "/interop/",
+				dest,
+			}
+			verify := func(mtime time.Time) {
+				t.Helper()
+				st, err := os.Stat(filepath.Join(dest, "dir/file"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := st.ModTime(), tt.want(mtime); !got.Equal(want) {
+					t.Errorf("unexpected modification time: got %v, want %v", got, want)
+				}
+			}
+			if _, err := rsynctest.RunUnrestricted(t, args...); err != nil {
+				t.Fatal(err)
+			}
+			verify(mtime)
+
+			// Only change the nanoseconds, which the next sync needs to
+			// pick up if the protocol transmits them.
+			mtime = mtime.Add(-100 * time.Millisecond)
+			if err := os.Chtimes(fn, mtime, mtime); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := rsynctest.RunUnrestricted(t, args...); err != nil {
+				t.Fatal(err)
+			}
+			verify(mtime)
+		})
+	}
+}
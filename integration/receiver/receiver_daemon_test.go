@@ -262,6 +262,9 @@ func TestDaemonReceiverSyncHardLinks(t *testing.T) {
 	bodyPattern := []byte{0xbb}
 	endPattern := []byte{0xee}
 	rsynctest.WriteLargeDataFile(t, source, headPattern, bodyPattern, endPattern)
+	if err := os.Link(filepath.Join(source, "large-data-file"), filepath.Join(source, "large-data-link")); err != nil {
+		t.Fatal(err)
+	}
 
 	// start a server which receives data
 	srv := rsynctest.New(t, rsynctest.WritableInteropModule(dest))
@@ -280,17 +283,24 @@ func TestDaemonReceiverSyncHardLinks(t *testing.T) {
 		// Ensure rsync does not localize decimal separators and fractional
 		// points based on the current locale:
 		"LANG=C.UTF-8")
-	var buf bytes.Buffer
-	rsync.Stdout = &buf
-	rsync.Stderr = &buf
+	rsync.Stdout = testlogger.New(t)
+	rsync.Stderr = testlogger.New(t)
 	if err := rsync.Run(); err != nil {
-		if strings.Contains(buf.String(), "gokr-rsync [receiver]: support for hard links not yet implemented") {
-			return
-		}
 		t.Fatalf("%v: %v", rsync.Args, err)
 	}
 
 	if err := rsynctest.DataFileMatches(destLarge, headPattern, bodyPattern, endPattern); err != nil {
 		t.Fatal(err)
 	}
+	st, err := os.Stat(destLarge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	linkSt, err := os.Stat(filepath.Join(dest, "large-data-link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(st, linkSt) {
+		t.Errorf("large-data-link is not a hard link to large-data-file")
+	}
 }
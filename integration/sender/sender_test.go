@@ -2,6 +2,7 @@ package sender_test
 
 import (
 	"bytes"
+	"errors"
 	"log"
 	"os"
 	"os/exec"
@@ -12,8 +13,10 @@ import (
 	"testing"
 	"time"
 
+	"github.com/gokrazy/rsync"
 	"github.com/gokrazy/rsync/internal/rsynctest"
 	"github.com/gokrazy/rsync/internal/testlogger"
+	"github.com/gokrazy/rsync/rsynccmd"
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/renameio/v2"
 )
@@ -391,7 +394,18 @@ func TestSenderTraversal(t *testing.T) {
 		"rsync://localhost:" + srv.Port + "/interop/../",
 		dest + "/",
 	}
-	rsynctest.Run(t, args...)
+	// The sender reports the name escaping the module as an I/O error.
+	cmd := rsynccmd.Command(args[0], args[1:]...)
+	cmd.Stdout = testlogger.New(t)
+	cmd.Stderr = testlogger.New(t)
+	_, err := cmd.Run(t.Context())
+	var ee *rsync.ExitError
+	if !errors.As(err, &ee) {
+		t.Fatalf("unexpected error: got %v, want an ExitError", err)
+	}
+	if got, want := ee.Code, rsync.RERR_PARTIAL; got != want {
+		t.Errorf("unexpected exit code: got %d, want %d", got, want)
+	}
 
 	passwd := filepath.Join(dest, "passwd")
 
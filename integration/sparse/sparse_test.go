@@ -0,0 +1,123 @@
+package sparse_test
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/gokrazy/rsync/internal/rsynctest"
+)
+
+func TestMain(m *testing.M) {
+	rsynctest.CommandMain(m)
+}
+
+const (
+	size      = 8 * 1024 * 1024
+	dataSize  = 64 * 1024
+	maxSparse = 1024 * 1024 // allocated bytes of a file with holes
+)
+
+// writeSparse writes a file of size bytes which consists of holes, except
+// for data at the start, in the middle and at the end of the file.
+func writeSparse(t *testing.T, fn string) []byte {
+	t.Helper()
+	content := make([]byte, size)
+	copy(content, rsynctest.RandomBytes(1, dataSize))
+	copy(content[size/2:], rsynctest.RandomBytes(2, dataSize))
+	copy(content[size-dataSize:], rsynctest.RandomBytes(3, dataSize))
+
+	if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, off := range []int64{0, size / 2, size - dataSize} {
+		if _, err := f.WriteAt(content[off:off+dataSize], off); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if allocated(t, fn) > maxSparse {
+		t.Skip("file system does not support holes")
+	}
+	return content
+}
+
+// allocated returns the number of bytes which the file system allocated for
+// the file fn.
+func allocated(t *testing.T, fn string) int64 {
+	t.Helper()
+	st, err := os.Stat(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return st.Sys().(*syscall.Stat_t).Blocks * 512
+}
+
+func checkFile(t *testing.T, fn string, want []byte, sparse bool) {
+	t.Helper()
+	rsynctest.CheckFile(t, fn, want)
+	a := allocated(t, fn)
+	if sparse && a > maxSparse {
+		t.Errorf("%s: %d bytes allocated, want at most %d (holes)", fn, a, maxSparse)
+	}
+	if !sparse && a < size {
+		t.Errorf("%s: %d bytes allocated, want at least %d (no holes)", fn, a, size)
+	}
+}
+
+func TestSparse(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		name string
+		args []string
+		// old is the content of the destination file before the transfer
+		// (if any).
+		old    []byte
+		sparse bool
+	}{
+		{"no-sparse", nil, nil, false},
+		{"sparse", []string{"--sparse"}, nil, true},
+		{"sparse-compress", []string{"-S", "--compress"}, nil, true},
+		// The sender matches blocks of the (different) destination file.
+		{"sparse-delta", []string{"-S"}, rsynctest.RandomBytes(4, dataSize), true},
+		// Holes are punched into the existing data of the destination file.
+		{"sparse-inplace", []string{"-S", "--inplace"}, rsynctest.RandomBytes(5, size), true},
+		{"preallocate", []string{"--preallocate"}, nil, false},
+		// Holes are punched into the preallocated space.
+		{"sparse-preallocate", []string{"-S", "--preallocate"}, nil, true},
+	} {
+		for _, mode := range rsynctest.RemoteModes {
+			t.Run(tt.name+"-"+mode, func(t *testing.T) {
+				t.Parallel()
+
+				source := filepath.Join(t.TempDir(), "source")
+				content := writeSparse(t, filepath.Join(source, "image"))
+				dest := filepath.Join(t.TempDir(), "dest")
+				if err := os.MkdirAll(dest, 0755); err != nil {
+					t.Fatal(err)
+				}
+				if tt.old != nil {
+					if err := os.WriteFile(filepath.Join(dest, "image"), tt.old, 0644); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				// -I makes the transfer independent of modification times.
+				args := append([]string{"-a", "-I"}, tt.args...)
+				if _, err := rsynctest.Transfer(t, mode, source, dest, args...); err != nil {
+					t.Fatal(err)
+				}
+				checkFile(t, filepath.Join(dest, "image"), content, tt.sparse)
+			})
+		}
+	}
+}
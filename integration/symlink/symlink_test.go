@@ -0,0 +1,292 @@
+package symlink_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gokrazy/rsync"
+	"github.com/gokrazy/rsync/internal/rsynctest"
+	"github.com/gokrazy/rsync/rsyncd"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMain(m *testing.M) {
+	rsynctest.CommandMain(m)
+}
+
+func symlink(t *testing.T, target, fn string) {
+	t.Helper()
+	if err := os.Symlink(target, fn); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// setup creates a module root containing a file outside of the source
+// directory, and the source directory with safe and unsafe symlinks.
+func setup(t *testing.T) (modRoot, source string) {
+	t.Helper()
+	modRoot = t.TempDir()
+	rsynctest.WriteFiles(t, modRoot, map[string]string{
+		"outside.txt":          "outside",
+		"source/file.txt":      "file",
+		"source/sub/inner.txt": "inner",
+	})
+	source = filepath.Join(modRoot, "source")
+	symlink(t, "file.txt", filepath.Join(source, "safe"))
+	symlink(t, "sub", filepath.Join(source, "dirlink"))
+	symlink(t, "../file.txt", filepath.Join(source, "sub", "up"))
+	symlink(t, "../outside.txt", filepath.Join(source, "unsafe"))
+	return modRoot, source
+}
+
+// tree returns the files in dir: the content of regular files, "dir" for
+// directories and "-> target" for symlinks.
+func tree(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	result := make(map[string]string)
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		switch {
+		case d.IsDir():
+			result[rel] = "dir"
+		case d.Type() == os.ModeSymlink:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			result[rel] = "-> " + target
+		default:
+			b, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			result[rel] = string(b)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestSymlinks(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		name string
+		args []string
+		want map[string]string
+	}{
+		{
+			name: "links",
+			args: []string{"-a"},
+			want: map[string]string{
+				"file.txt":      "file",
+				"safe":          "-> file.txt",
+				"dirlink":       "-> sub",
+				"sub":           "dir",
+				"sub/inner.txt": "inner",
+				"sub/up":        "-> ../file.txt",
+				"unsafe":        "-> ../outside.txt",
+			},
+		},
+
+		{
+			name: "safe-links",
+			args: []string{"-a", "--safe-links"},
+			want: map[string]string{
+				"file.txt":      "file",
+				"safe":          "-> file.txt",
+				"dirlink":       "-> sub",
+				"sub":           "dir",
+				"sub/inner.txt": "inner",
+				"sub/up":        "-> ../file.txt",
+			},
+		},
+
+		{
+			name: "copy-unsafe-links",
+			args: []string{"-a", "--copy-unsafe-links"},
+			want: map[string]string{
+				"file.txt":      "file",
+				"safe":          "-> file.txt",
+				"dirlink":       "-> sub",
+				"sub":           "dir",
+				"sub/inner.txt": "inner",
+				"sub/up":        "-> ../file.txt",
+				"unsafe":        "outside",
+			},
+		},
+
+		{
+			name: "copy-links",
+			args: []string{"-a", "-L"},
+			want: map[string]string{
+				"file.txt":          "file",
+				"safe":              "file",
+				"dirlink":           "dir",
+				"dirlink/inner.txt": "inner",
+				"dirlink/up":        "file",
+				"sub":               "dir",
+				"sub/inner.txt":     "inner",
+				"sub/up":            "file",
+				"unsafe":            "outside",
+			},
+		},
+	} {
+		for _, mode := range []string{"pull", "push"} {
+			for _, incRecurse := range []bool{true, false} {
+				name := tt.name + "/" + mode
+				args := tt.args
+				if !incRecurse {
+					name += "/no-i-r"
+					args = append([]string{"--no-i-r"}, args...)
+				}
+				t.Run(name, func(t *testing.T) {
+					t.Parallel()
+
+					modRoot, source := setup(t)
+					root := t.TempDir()
+					dest := filepath.Join(root, "dest")
+					var src, dst string
+					switch mode {
+					case "pull":
+						// Following unsafe symlinks requires pulling from
+						// a module whose root contains their referents.
+						srv := rsynctest.New(t, rsynctest.InteropModule(modRoot))
+						src = "rsync://localhost:" + srv.Port + "/interop/source/"
+						dst = dest + "/"
+					case "push":
+						// The sending client follows symlinks outside of
+						// the source directory.
+						srv := rsynctest.New(t, rsynctest.WritableInteropModule(root))
+						src = source + "/"
+						dst = "rsync://localhost:" + srv.Port + "/interop/dest/"
+					}
+					if _, err := rsynctest.RunUnrestricted(t, append(append([]string{"gokr-rsync"}, args...), src, dst)...); err != nil {
+						t.Fatal(err)
+					}
+					got := tree(t, dest)
+					if got["source"] == "dir" {
+						// The sender transfers the requested directory
+						// source/ under its name instead of as “.”.
+						delete(got, "source")
+					}
+					if diff := cmp.Diff(tt.want, got); diff != "" {
+						t.Errorf("unexpected destination: diff (-want +got):\n%s", diff)
+					}
+				})
+			}
+		}
+	}
+}
+
+// TestCopyLinksOutsideModule verifies that the sender does not follow
+// symlinks outside of the module root, and reports them as I/O errors.
+func TestCopyLinksOutsideModule(t *testing.T) {
+	t.Parallel()
+
+	_, source := setup(t)
+	srv := rsynctest.New(t, rsynctest.InteropModule(source))
+	dest := t.TempDir()
+	_, err := rsynctest.RunUnrestricted(t, "gokr-rsync", "-a", "--copy-unsafe-links", "rsync://localhost:"+srv.Port+"/interop/", dest+"/")
+	var ee *rsync.ExitError
+	if !errors.As(err, &ee) {
+		t.Fatalf("unexpected error: got %v, want an ExitError", err)
+	}
+	if got, want := ee.Code, rsync.RERR_PARTIAL; got != want {
+		t.Errorf("unexpected exit code: got %d, want %d", got, want)
+	}
+	got := tree(t, dest)
+	if _, ok := got["unsafe"]; ok {
+		t.Errorf("unsafe symlink unexpectedly transferred: %q", got["unsafe"])
+	}
+	if got, want := got["file.txt"], "file"; got != want {
+		t.Errorf("file.txt: got %q, want %q", got, want)
+	}
+}
+
+func TestMungeLinks(t *testing.T) {
+	t.Parallel()
+
+	_, source := setup(t)
+	root := t.TempDir()
+	srv := rsynctest.New(t, []rsyncd.Module{
+		{
+			Name:       "interop",
+			Path:       root,
+			Writable:   true,
+			MungeLinks: true,
+		},
+	})
+	url := "rsync://localhost:" + srv.Port + "/interop/dest/"
+
+	// The module munges the symlinks it receives, making them unusable.
+	if _, err := rsynctest.RunUnrestricted(t, "gokr-rsync", "-a", source+"/", url); err != nil {
+		t.Fatal(err)
+	}
+	got := tree(t, filepath.Join(root, "dest"))
+	for _, name := range []string{"safe", "dirlink", "sub/up", "unsafe"} {
+		if !strings.HasPrefix(got[name], "-> "+rsync.SYMLINK_PREFIX) {
+			t.Errorf("%s: symlink not munged: %q", name, got[name])
+		}
+	}
+
+	// ...and unmunges them when sending them.
+	dest := t.TempDir()
+	if _, err := rsynctest.RunUnrestricted(t, "gokr-rsync", "-a", url, dest+"/"); err != nil {
+		t.Fatal(err)
+	}
+	got = tree(t, dest)
+	// The sender transfers the requested directory dest/ under its name
+	// instead of as “.”.
+	delete(got, "dest")
+	if diff := cmp.Diff(tree(t, source), got); diff != "" {
+		t.Errorf("unexpected destination: diff (-want +got):\n%s", diff)
+	}
+}
+
+// TestCopyLinksLoop verifies that following symlinks to directories which
+// contain them does not recurse forever.
+func TestCopyLinksLoop(t *testing.T) {
+	t.Parallel()
+
+	for _, mode := range rsynctest.Modes {
+		t.Run(mode, func(t *testing.T) {
+			t.Parallel()
+
+			source := filepath.Join(t.TempDir(), "source")
+			rsynctest.WriteFiles(t, source, map[string]string{
+				"file.txt":      "file",
+				"sub/inner.txt": "inner",
+			})
+			symlink(t, ".", filepath.Join(source, "sub", "self"))
+			symlink(t, "..", filepath.Join(source, "sub", "parent"))
+			dest := filepath.Join(t.TempDir(), "dest")
+			if _, err := rsynctest.Transfer(t, mode, source, dest, "-aL"); err != nil {
+				t.Fatal(err)
+			}
+			want := map[string]string{
+				"file.txt":      "file",
+				"sub":           "dir",
+				"sub/inner.txt": "inner",
+			}
+			if diff := cmp.Diff(want, tree(t, dest)); diff != "" {
+				t.Errorf("unexpected destination: diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package timeout_test
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gokrazy/rsync"
+	"github.com/gokrazy/rsync/internal/rsynctest"
+	"github.com/gokrazy/rsync/internal/testlogger"
+	"github.com/gokrazy/rsync/rsyncd"
+)
+
+func TestMain(m *testing.M) {
+	rsynctest.CommandMain(m)
+}
+
+// stallingDaemon starts an rsync daemon which completes the daemon protocol
+// greeting, but then never sends anything.
+func stallingDaemon(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				fmt.Fprintf(conn, "@RSYNCD: %d.0\n", rsync.ProtocolVersion)
+				rd := bufio.NewReader(conn)
+				for _, want := range []string{"@RSYNCD: ", "interop"} {
+					line, err := rd.ReadString('\n')
+					if err != nil || !strings.HasPrefix(line, want) {
+						return
+					}
+				}
+				fmt.Fprintf(conn, "@RSYNCD: OK\n")
+				io.Copy(io.Discard, rd)
+			}()
+		}
+	}()
+	_, port, err := net.SplitHostPort(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return port
+}
+
+func TestTimeout(t *testing.T) {
+	t.Parallel()
+
+	port := stallingDaemon(t)
+	dest := t.TempDir()
+	start := time.Now()
+	_, err := rsynctest.RunUnrestricted(t, "gokr-rsync", "-a", "--timeout=1", "rsync://localhost:"+port+"/interop/", dest)
+	var ee *rsync.ExitError
+	if !errors.As(err, &ee) || ee.Code != rsync.RERR_TIMEOUT {
+		t.Fatalf("unexpected error: got %v, want exit code %d", err, rsync.RERR_TIMEOUT)
+	}
+	if want := "io timeout after 1 seconds -- exiting"; !strings.Contains(err.Error(), want) {
+		t.Errorf("unexpected error: got %v, want %q", err, want)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("timeout took %v, want about 1s", elapsed)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	t.Parallel()
+
+	port := stallingDaemon(t)
+	dest := t.TempDir()
+	ctx, cancel := context.WithTimeout(t.Context(), 500*time.Millisecond)
+	defer cancel()
+	_, err := rsynctest.UnrestrictedCommand(t, "gokr-rsync", "-a", "rsync://localhost:"+port+"/interop/", dest).Run(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("unexpected error: got %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+// rawDaemonClient connects to the rsync daemon at port and starts a transfer
+// with the specified server arguments, but then does not send anything.
+func rawDaemonClient(t *testing.T, port string, args ...string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", "localhost:"+port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	fmt.Fprintf(conn, "@RSYNCD: %d.0\n", rsync.ProtocolVersion)
+	fmt.Fprintf(conn, "interop\n")
+	for _, arg := range args {
+		fmt.Fprintf(conn, "%s\n", arg)
+	}
+	fmt.Fprintf(conn, "\n")
+	return conn
+}
+
+func TestServerTimeout(t *testing.T) {
+	t.Parallel()
+
+	srv := rsynctest.New(t, rsynctest.InteropModule(t.TempDir()))
+	conn := rawDaemonClient(t, srv.Port, "--server", "--sender", "--timeout=1", ".", "interop/")
+	start := time.Now()
+	conn.SetReadDeadline(start.Add(10 * time.Second))
+	if _, err := io.Copy(io.Discard, conn); err != nil {
+		t.Fatalf("server did not close the connection: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+		t.Errorf("server closed the connection after %v, want after the 1s timeout", elapsed)
+	}
+}
+
+func TestServerCancel(t *testing.T) {
+	t.Parallel()
+
+	srv, err := rsyncd.NewServer(rsynctest.InteropModule(t.TempDir()), rsyncd.WithStderr(testlogger.New(t)), rsyncd.DontRestrict())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	go srv.Serve(ctx, ln)
+	_, port, err := net.SplitHostPort(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := rawDaemonClient(t, port, "--server", "--sender", ".", "interop/")
+	time.AfterFunc(200*time.Millisecond, cancel)
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.Copy(io.Discard, conn); err != nil {
+		t.Fatalf("server did not close the connection: %v", err)
+	}
+}
@@ -0,0 +1,208 @@
+package uidmap_test
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/gokrazy/rsync/internal/rsynctest"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMain(m *testing.M) {
+	rsynctest.CommandMain(m)
+}
+
+// owners returns the uid:gid of the files in dir.
+func owners(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := make(map[string]string)
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			t.Fatal(err)
+		}
+		stt := info.Sys().(*syscall.Stat_t)
+		result[e.Name()] = strconv.Itoa(int(stt.Uid)) + ":" + strconv.Itoa(int(stt.Gid))
+	}
+	return result
+}
+
+func TestUidMap(t *testing.T) {
+	t.Parallel()
+
+	if os.Getuid() != 0 {
+		t.Skip("changing ownership requires root")
+	}
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skipf("user nobody not found: %v", err)
+	}
+	nobodyUid, err := strconv.Atoi(nobody.Uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source := t.TempDir()
+	rsynctest.WriteFiles(t, source, map[string]string{
+		"unnamed": "unnamed",
+		"nobody":  "nobody",
+		"root":    "root",
+	})
+	for name, owner := range map[string][2]int{
+		// Ids without a name are transferred as they are.
+		"unnamed": {12345, 23456},
+		"nobody":  {nobodyUid, 23457},
+		"root":    {0, 0},
+	} {
+		if err := os.Lchown(filepath.Join(source, name), owner[0], owner[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct {
+		name string
+		args []string
+		want map[string]string
+	}{
+		{
+			name: "default",
+			want: map[string]string{
+				"unnamed": "12345:23456",
+				"nobody":  nobody.Uid + ":23457",
+				"root":    "0:0",
+			},
+		},
+
+		{
+			name: "numeric-ids",
+			args: []string{"--numeric-ids"},
+			want: map[string]string{
+				"unnamed": "12345:23456",
+				"nobody":  nobody.Uid + ":23457",
+				"root":    "0:0",
+			},
+		},
+
+		{
+			name: "chown",
+			args: []string{"--chown=4321:5432"},
+			want: map[string]string{
+				"unnamed": "4321:5432",
+				"nobody":  "4321:5432",
+				"root":    "4321:5432",
+			},
+		},
+
+		{
+			name: "chown-user",
+			args: []string{"--chown=4321"},
+			want: map[string]string{
+				"unnamed": "4321:23456",
+				"nobody":  "4321:23457",
+				"root":    "4321:0",
+			},
+		},
+
+		{
+			name: "usermap",
+			args: []string{
+				"--usermap=12340-12349:4321,nob?dy:4444",
+				"--groupmap=23456:5432,*:5555",
+			},
+			want: map[string]string{
+				"unnamed": "4321:5432",
+				"nobody":  "4444:5555",
+				"root":    "0:5555",
+			},
+		},
+
+		{
+			name: "usermap-numeric-ids",
+			// Without names, only id rules match.
+			args: []string{
+				"--numeric-ids",
+				"--usermap=12345:4321,nobody:4444",
+			},
+			want: map[string]string{
+				"unnamed": "4321:23456",
+				"nobody":  nobody.Uid + ":23457",
+				"root":    "0:0",
+			},
+		},
+	} {
+		for _, mode := range rsynctest.Modes {
+			for _, incRecurse := range []bool{true, false} {
+				name := tt.name + "/" + mode
+				args := tt.args
+				if !incRecurse {
+					name += "/no-i-r"
+					args = append([]string{"--no-i-r"}, args...)
+				}
+				t.Run(name, func(t *testing.T) {
+					t.Parallel()
+
+					dest := filepath.Join(t.TempDir(), "dest")
+					if err := os.Mkdir(dest, 0755); err != nil {
+						t.Fatal(err)
+					}
+					if _, err := rsynctest.Transfer(t, mode, source, dest, append([]string{"-a"}, args...)...); err != nil {
+						t.Fatal(err)
+					}
+					got := owners(t, dest)
+					if diff := cmp.Diff(tt.want, got); diff != "" {
+						t.Errorf("unexpected owners (uid:gid): diff (-want +got):\n%s", diff)
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestUidMapErrors(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		args    []string
+		wantErr string
+	}{
+		{
+			args:    []string{"--usermap=0:1", "--chown=2"},
+			wantErr: "--chown conflicts with prior --usermap",
+		},
+		{
+			args:    []string{"--chown=:2", "--groupmap=0:1"},
+			wantErr: "--groupmap conflicts with prior --chown",
+		},
+		{
+			args:    []string{"--usermap=foo"},
+			wantErr: "No colon found in --usermap: foo",
+		},
+		{
+			args:    []string{"--groupmap=1-x:2"},
+			wantErr: "Invalid number in --groupmap: 1-x",
+		},
+	} {
+		t.Run(strings.Join(tt.args, " "), func(t *testing.T) {
+			t.Parallel()
+
+			source := t.TempDir()
+			rsynctest.WriteFiles(t, source, map[string]string{"file": ""})
+			srv := rsynctest.New(t, rsynctest.InteropModule(source))
+			args := append([]string{"gokr-rsync", "-a"}, tt.args...)
+			args = append(args, "rsync://localhost:"+srv.Port+"/interop/", t.TempDir()+"/")
+			_, err := rsynctest.RunUnrestricted(t, args...)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("unexpected error: got %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package wholefile_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gokrazy/rsync/internal/rsynctest"
+)
+
+func TestMain(m *testing.M) {
+	rsynctest.CommandMain(m)
+}
+
+const size = 1024 * 1024
+
+// setup creates a source file which differs from the destination file in
+// 3000 bytes in the middle.
+func setup(t *testing.T) (source, dest string, content []byte) {
+	t.Helper()
+	old := rsynctest.RandomBytes(1, size)
+	content = append(append(bytes.Clone(old[:size/2]), rsynctest.RandomBytes(2, 3000)...), old[size/2+3000:]...)
+
+	source = filepath.Join(t.TempDir(), "source")
+	dest = filepath.Join(t.TempDir(), "dest")
+	rsynctest.WriteFiles(t, source, map[string]string{"file": string(content)})
+	rsynctest.WriteFiles(t, dest, map[string]string{"file": string(old)})
+	rsynctest.Chtimes(t, rsynctest.GosPublicRelease, filepath.Join(dest, "file"))
+	return source, dest, content
+}
+
+func TestWholeFile(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		mode      string
+		args      []string
+		wholeFile bool
+	}{
+		{rsynctest.Pull, nil, false},
+		{rsynctest.Pull, []string{"-W"}, true},
+		{rsynctest.Push, nil, false},
+		{rsynctest.Push, []string{"--whole-file"}, true},
+		// --whole-file is the default for local transfers.
+		{rsynctest.Local, nil, true},
+		{rsynctest.Local, []string{"--no-whole-file"}, false},
+		{rsynctest.Local, []string{"--no-W"}, false},
+	} {
+		t.Run(tt.mode+strings.Join(tt.args, ""), func(t *testing.T) {
+			t.Parallel()
+
+			source, dest, content := setup(t)
+			stats, err := rsynctest.Transfer(t, tt.mode, source, dest, append([]string{"-a"}, tt.args...)...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rsynctest.CheckFile(t, filepath.Join(dest, "file"), content)
+			if tt.wholeFile {
+				if min := int64(size); stats.Written < min {
+					t.Errorf("sender wrote %d bytes, want at least %d", stats.Written, min)
+				}
+			} else {
+				if max := int64(size / 10); stats.Written > max {
+					t.Errorf("sender wrote %d bytes, want at most %d", stats.Written, max)
+				}
+			}
+		})
+	}
+}
+
+func TestBlockSize(t *testing.T) {
+	t.Parallel()
+
+	for _, mode := range rsynctest.RemoteModes {
+		t.Run(mode, func(t *testing.T) {
+			t.Parallel()
+
+			// The sender reads the checksums of 1024 blocks of 1024 bytes
+			// by default, but only 128 blocks of 8192 bytes.
+			var read [2]int64
+			for i, args := range [][]string{nil, {"-B", "8k"}} {
+				source, dest, content := setup(t)
+				// Make the file look changed.
+				if err := os.Chtimes(filepath.Join(source, "file"), time.Now(), time.Now()); err != nil {
+					t.Fatal(err)
+				}
+				stats, err := rsynctest.Transfer(t, mode, source, dest, append([]string{"-a"}, args...)...)
+				if err != nil {
+					t.Fatal(err)
+				}
+				rsynctest.CheckFile(t, filepath.Join(dest, "file"), content)
+				if max := int64(size / 10); stats.Written > max {
+					t.Errorf("sender wrote %d bytes, want at most %d", stats.Written, max)
+				}
+				read[i] = stats.Read
+			}
+			if read[1] > read[0]/4 {
+				t.Errorf("sender read %d bytes with --block-size=8k, want at most a quarter of %d bytes", read[1], read[0])
+			}
+		})
+	}
+}
+
+func TestWholeFileOptions(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"append", []string{"--append", "-W"}, "--append cannot be used with --whole-file"},
+		{"block-size", []string{"--block-size=1m"}, "--block-size value is too large: 1m (max=131072)"},
+		{"block-size-invalid", []string{"-B", "1x"}, "--block-size value is invalid: 1x"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append([]string{"gokr-rsync", "-a"}, tt.args...)
+			_, err := rsynctest.RunUnrestricted(t, append(args, t.TempDir()+"/", t.TempDir())...)
+			if err == nil {
+				t.Fatal("transfer unexpectedly succeeded")
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("unexpected error: got %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
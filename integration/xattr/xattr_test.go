@@ -0,0 +1,229 @@
+package xattr_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gokrazy/rsync"
+	"github.com/gokrazy/rsync/internal/rsynctest"
+	"github.com/gokrazy/rsync/internal/xattr"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMain(m *testing.M) {
+	rsynctest.CommandMain(m)
+}
+
+func file(t *testing.T, fn string) xattr.File {
+	t.Helper()
+	root, err := os.OpenRoot(filepath.Dir(fn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { root.Close() })
+	return xattr.InRoot(root, filepath.Base(fn))
+}
+
+func setXattr(t *testing.T, fn, attr, value string) {
+	t.Helper()
+	if err := file(t, fn).Set(attr, []byte(value)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// xattrs returns the user.* extended attributes of fn.
+func xattrs(t *testing.T, fn string) map[string]string {
+	t.Helper()
+	x := file(t, fn)
+	names, err := x.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := make(map[string]string)
+	for _, name := range names {
+		if !strings.HasPrefix(name, "user.") {
+			continue
+		}
+		value, err := x.Get(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result[name] = string(value)
+	}
+	return result
+}
+
+// skipWithoutXattrs skips the test if the file system of dir does not support
+// user extended attributes.
+func skipWithoutXattrs(t *testing.T, dir string) {
+	t.Helper()
+	fn := filepath.Join(dir, "probe")
+	if err := os.WriteFile(fn, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fn)
+	if err := file(t, fn).Set("user.probe", []byte("1")); err != nil {
+		if errors.Is(err, errors.ErrUnsupported) || strings.Contains(err.Error(), "not supported") {
+			t.Skipf("extended attributes not supported: %v", err)
+		}
+		t.Fatal(err)
+	}
+}
+
+func TestXattrs(t *testing.T) {
+	t.Parallel()
+
+	// Values longer than 32 bytes are abbreviated in the file list and
+	// requested by the receiver.
+	large := strings.Repeat("large value ", 8)
+	changed := strings.Repeat("changed value ", 8)
+
+	for _, mode := range rsynctest.Modes {
+		t.Run(mode, func(t *testing.T) {
+			t.Parallel()
+
+			source := filepath.Join(t.TempDir(), "source")
+			if err := os.MkdirAll(source, 0755); err != nil {
+				t.Fatal(err)
+			}
+			skipWithoutXattrs(t, source)
+			rsynctest.WriteFiles(t, source, map[string]string{
+				"a.txt":     "a",
+				"sub/b.txt": "b",
+				"sub/c.txt": "c",
+			})
+			setXattr(t, filepath.Join(source, "a.txt"), "user.small", "hello")
+			setXattr(t, filepath.Join(source, "a.txt"), "user.large", large)
+			// Same list as a.txt, which is sent by reference.
+			setXattr(t, filepath.Join(source, "sub", "b.txt"), "user.small", "hello")
+			setXattr(t, filepath.Join(source, "sub", "b.txt"), "user.large", large)
+			setXattr(t, filepath.Join(source, "sub"), "user.dir", "directory")
+			if err := os.Symlink("a.txt", filepath.Join(source, "link")); err != nil {
+				t.Fatal(err)
+			}
+			var fns []string
+			for _, name := range []string{"a.txt", "sub/b.txt", "sub/c.txt", "sub", "."} {
+				fns = append(fns, filepath.Join(source, name))
+			}
+			rsynctest.Chtimes(t, rsynctest.GosPublicRelease, fns...)
+
+			dest := filepath.Join(t.TempDir(), "dest")
+			if err := os.Mkdir(dest, 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			check := func(t *testing.T) {
+				t.Helper()
+				for _, name := range []string{"a.txt", "sub", "sub/b.txt", "sub/c.txt"} {
+					want := xattrs(t, filepath.Join(source, name))
+					got := xattrs(t, filepath.Join(dest, name))
+					if diff := cmp.Diff(want, got); diff != "" {
+						t.Errorf("%s: unexpected extended attributes: diff (-want +got):\n%s", name, diff)
+					}
+				}
+			}
+
+			rsynctest.TransferOutput(t, mode, source, dest, "-aX")
+			check(t)
+
+			// Change the large value of a.txt (but not b.txt, which no
+			// longer shares the list), remove the small value of
+			// b.txt, add a value to c.txt and an extraneous value to
+			// the destination dir.
+			setXattr(t, filepath.Join(source, "a.txt"), "user.large", changed)
+			if err := file(t, filepath.Join(source, "sub", "b.txt")).Remove("user.small"); err != nil {
+				t.Fatal(err)
+			}
+			setXattr(t, filepath.Join(source, "sub", "c.txt"), "user.new", large)
+			setXattr(t, filepath.Join(dest, "sub"), "user.extraneous", "x")
+
+			got := rsynctest.TransferOutput(t, mode, source, dest, "-aX", "-i")
+			want := []string{
+				".f........x a.txt",
+				".d........x sub/",
+				".f........x sub/b.txt",
+				".f........x sub/c.txt",
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("unexpected output: diff (-want +got):\n%s", diff)
+			}
+			check(t)
+
+			// The file data is transferred along with the extended
+			// attributes, whose unchanged large values are taken from
+			// the destination file.
+			rsynctest.WriteFiles(t, source, map[string]string{"sub/b.txt": "b changed"})
+			rsynctest.TransferOutput(t, mode, source, dest, "-aX")
+			check(t)
+			b, err := os.ReadFile(filepath.Join(dest, "sub", "b.txt"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b, []byte("b changed")) {
+				t.Errorf("sub/b.txt: got %q, want %q", b, "b changed")
+			}
+		})
+	}
+}
+
+func TestXattrsPartial(t *testing.T) {
+	t.Parallel()
+
+	// tmpfs stores values which are too large for a single ext4 block, so
+	// setting them in the destination fails with ENOSPC.
+	large := strings.Repeat("x", 8192)
+
+	for _, mode := range rsynctest.Modes {
+		t.Run(mode, func(t *testing.T) {
+			t.Parallel()
+
+			tmp, err := os.MkdirTemp("/dev/shm", "rsync-xattr-")
+			if err != nil {
+				t.Skipf("no tmpfs: %v", err)
+			}
+			t.Cleanup(func() { os.RemoveAll(tmp) })
+			source := filepath.Join(tmp, "source")
+			if err := os.Mkdir(source, 0755); err != nil {
+				t.Fatal(err)
+			}
+			skipWithoutXattrs(t, source)
+			rsynctest.WriteFiles(t, source, map[string]string{
+				"a.txt": "a",
+				"b.txt": "b",
+			})
+			setXattr(t, filepath.Join(source, "a.txt"), "user.large", large)
+
+			dest := filepath.Join(t.TempDir(), "dest")
+			if err := os.Mkdir(dest, 0755); err != nil {
+				t.Fatal(err)
+			}
+			skipWithoutXattrs(t, dest)
+			probe := filepath.Join(dest, "probe")
+			if err := os.WriteFile(probe, nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := file(t, probe).Set("user.large", []byte(large)); err == nil {
+				t.Skip("the destination file system stores large extended attribute values")
+			}
+			if err := os.Remove(probe); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = rsynctest.Transfer(t, mode, source, dest, "-aX")
+			var ee *rsync.ExitError
+			if !errors.As(err, &ee) {
+				t.Fatalf("unexpected error: got %v, want an ExitError", err)
+			}
+			if got, want := ee.Code, rsync.RERR_PARTIAL; got != want {
+				t.Errorf("unexpected exit code: got %d, want %d", got, want)
+			}
+			// The file data is transferred regardless.
+			rsynctest.CheckFile(t, filepath.Join(dest, "a.txt"), []byte("a"))
+			rsynctest.CheckFile(t, filepath.Join(dest, "b.txt"), []byte("b"))
+		})
+	}
+}
@@ -0,0 +1,981 @@
+// Package filter implements rsync filter rules: include/exclude patterns,
+// merge files and per-directory merge files (see the FILTER RULES section of
+// rsync(1)). The implementation follows rsync/exclude.c.
+package filter
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/gokrazy/rsync/internal/rsyncopts"
+	"github.com/gokrazy/rsync/internal/rsyncwire"
+)
+
+const (
+	filtruleWild = 1 << iota
+	filtruleWild2
+	filtruleWild2Prefix
+	filtruleWild3Suffix
+	filtruleAbsPath
+	filtruleInclude
+	filtruleDirectory
+	filtruleWordSplit
+	filtruleNoInherit
+	filtruleNoPrefixes
+	filtruleMergeFile
+	filtrulePerDirMerge
+	filtruleExcludeSelf
+	filtruleFinishSetup
+	filtruleNegate
+	filtruleCVSIgnore
+	filtruleSenderSide
+	filtruleReceiverSide
+	filtruleClearList
+	filtrulePerishable
+	filtruleXattr
+)
+
+const (
+	filtrulesSides = filtruleSenderSide | filtruleReceiverSide
+
+	filtrulesFromContainer = filtruleAbsPath | filtruleInclude |
+		filtruleDirectory | filtruleNegate | filtrulePerishable
+)
+
+// xflags
+const (
+	xflgFatalErrors = 1 << iota
+	xflgOldPrefixes
+	xflgAnchored2Abs
+)
+
+// name flags
+const (
+	nameIsDir = 1 << iota
+	nameIsXattr
+)
+
+// Side specifies which side of the transfer evaluates the filter rules:
+// sender-side rules (hide, show, or the s modifier) only affect which files
+// are transferred, receiver-side rules (protect, risk, or the r modifier)
+// only affect which files are deleted.
+type Side int
+
+const (
+	SenderSide Side = iota
+	ReceiverSide
+)
+
+// These default ignored items come from the CVS manual, plus a few more.
+//
+// exclude.c:default_cvsignore
+const defaultCVSIgnore = "RCS SCCS CVS CVS.adm RCSLOG cvslog.* tags TAGS" +
+	" .make.state .nse_depinfo *~ #* .#* ,* _$* *$" +
+	" *.old *.bak *.BAK *.orig *.rej .del-*" +
+	" *.a *.olb *.o *.obj *.so *.exe" +
+	" *.Z *.elc *.ln core" +
+	" .svn/ .git/ .hg/ .bzr/"
+
+// OpenFunc opens a merge file.
+type OpenFunc func(name string) (io.ReadCloser, error)
+
+type rule struct {
+	flags    uint32
+	pattern  string
+	slashCnt int
+
+	// mergeList holds the rules read from the per-directory merge files (for
+	// dir-merge rules).
+	mergeList *List
+}
+
+// state is shared between a list and all of its (per-directory) merge lists,
+// like the corresponding global variables in rsync/exclude.c.
+type state struct {
+	// open is used to open merge files and the ~/.cvsignore file. If nil,
+	// merge rules are rejected (e.g. for rules received from the remote side).
+	open OpenFunc
+
+	protocol int32
+
+	// eolNulls makes filter files use NUL bytes (instead of newlines) as
+	// line terminators (--from0).
+	eolNulls bool
+
+	// mergeParents contains all per-directory merge rules
+	// (exclude.c:mergelist_parents).
+	mergeParents []*rule
+
+	// currDir is the absolute path (without leading slash) which the names
+	// passed to Check are relative to (exclude.c:curr_dir). For daemons, the
+	// path is relative to the module root.
+	currDir string
+
+	// dirbuf is the absolute path (without leading slash) of the directory
+	// whose per-directory merge files are currently being read.
+	dirbuf string
+
+	cvsList *List
+
+	// deleteExcluded turns rules without a side into sender-side rules, so
+	// that the receiver deletes excluded files (--delete-excluded).
+	deleteExcluded bool
+}
+
+// List is an ordered list of filter rules. The first matching rule wins.
+type List struct {
+	rules []*rule
+
+	// inherited holds the rules of per-directory merge files in parent
+	// directories. They are checked after rules.
+	inherited []*rule
+
+	st *state
+}
+
+func newList(st *state) *List {
+	return &List{st: st}
+}
+
+// NewList returns an empty filter rule list. Merge files are opened using
+// open. protocol is the negotiated rsync protocol version.
+func NewList(open OpenFunc, protocol int32) *List {
+	return newList(&state{
+		open:     open,
+		protocol: protocol,
+	})
+}
+
+// Len returns the number of rules in the list.
+func (l *List) Len() int {
+	if l == nil {
+		return 0
+	}
+	return len(l.rules)
+}
+
+// SetCurrDir sets the absolute path which the names passed to Check are
+// relative to. This is only relevant for rules with the / modifier.
+func (l *List) SetCurrDir(dir string) {
+	l.st.currDir = cleanAbs(dir)
+}
+
+func cleanAbs(dir string) string {
+	dir = strings.Trim(path.Clean("/"+dir), "/")
+	return dir
+}
+
+// FromOptions parses the filter rules specified on the command line
+// (including the contents of merge files, which are read from the local file
+// system). The file name "-" refers to stdin.
+//
+// options.c:parse_arguments
+func FromOptions(opts *rsyncopts.Options, stdin io.Reader, protocol int32) (*List, error) {
+	l := NewList(func(name string) (io.ReadCloser, error) {
+		if name == "-" {
+			return io.NopCloser(stdin), nil
+		}
+		return os.Open(name)
+	}, protocol)
+	l.st.eolNulls = opts.EOLNulls()
+	l.st.deleteExcluded = opts.DeleteExcluded()
+	for _, fr := range opts.FilterRules() {
+		var template uint32
+		if fr.Include {
+			template |= filtruleInclude
+		}
+		xflags := 0
+		if fr.OldPrefixes {
+			xflags |= xflgOldPrefixes
+		}
+		if fr.File {
+			// --include-from and --exclude-from
+			if err := l.parseFilterFile(fr.Rule, template, xflags|xflgFatalErrors); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err := l.parseFilterStr(fr.Rule, template, xflags); err != nil {
+			return nil, err
+		}
+	}
+	if opts.MakeBackups() && opts.BackupDir() == "" &&
+		opts.DeleteMode() && !opts.DeleteExcluded() && !opts.Server() {
+		// Protect the backups (which are not in the file list) from
+		// deletion.
+		if err := l.parseFilterStr("P *"+opts.BackupSuffix(), 0, 0); err != nil {
+			return nil, err
+		}
+	}
+	if dir := opts.PartialDir(); dir != "" && !path.IsAbs(dir) {
+		// Keep partial files from being sent and protect them from
+		// (untimely) deletion on the receiving side.
+		if err := l.parseFilterStr("-p "+dir+"/", 0, 0); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// Check returns 1 if name is included, -1 if name is excluded and 0 if no
+// rule matched. name is relative to the transfer directory.
+//
+// exclude.c:check_filter
+func (l *List) Check(name string, isDir bool, side Side) int {
+	nameFlags := 0
+	if isDir {
+		nameFlags |= nameIsDir
+	}
+	return l.check(name, nameFlags, side, false)
+}
+
+// Excluded reports whether the specified name is excluded.
+//
+// flist.c:is_excluded
+func (l *List) Excluded(name string, isDir bool, side Side) bool {
+	if l == nil {
+		return false
+	}
+	return l.Check(name, isDir, side) < 0
+}
+
+// ExcludedIgnorePerishable is like Excluded, but ignores perishable rules (p
+// modifier). The receiver uses it when deleting the contents of a directory,
+// so that perishable rules do not prevent the directory deletion.
+func (l *List) ExcludedIgnorePerishable(name string, isDir bool) bool {
+	if l == nil {
+		return false
+	}
+	nameFlags := 0
+	if isDir {
+		nameFlags |= nameIsDir
+	}
+	return l.check(name, nameFlags, ReceiverSide, true) < 0
+}
+
+func (r *rule) appliesTo(side Side) bool {
+	switch r.flags & filtrulesSides {
+	case filtruleSenderSide:
+		return side == SenderSide
+	case filtruleReceiverSide:
+		return side == ReceiverSide
+	}
+	return true
+}
+
+func (l *List) all() []*rule {
+	if len(l.inherited) == 0 {
+		return l.rules
+	}
+	return append(l.rules[:len(l.rules):len(l.rules)], l.inherited...)
+}
+
+// exclude.c:check_filter
+func (l *List) check(name string, nameFlags int, side Side, ignorePerishable bool) int {
+	for _, r := range l.all() {
+		if ignorePerishable && r.flags&filtrulePerishable != 0 {
+			continue
+		}
+		if !r.appliesTo(side) {
+			continue
+		}
+		if r.flags&filtrulePerDirMerge != 0 {
+			if rc := r.mergeList.check(name, nameFlags, side, ignorePerishable); rc != 0 {
+				return rc
+			}
+			continue
+		}
+		if r.flags&filtruleCVSIgnore != 0 {
+			if rc := l.st.cvsList.check(name, nameFlags, side, ignorePerishable); rc != 0 {
+				return rc
+			}
+			continue
+		}
+		if r.matches(name, nameFlags, l.st.currDir) {
+			if r.flags&filtruleInclude != 0 {
+				return 1
+			}
+			return -1
+		}
+	}
+	return 0
+}
+
+// exclude.c:rule_matches
+func (r *rule) matches(fname string, nameFlags int, currDir string) bool {
+	retMatch := r.flags&filtruleNegate == 0
+	name := strings.TrimPrefix(fname, "/")
+	if name == "" {
+		return false
+	}
+
+	if (nameFlags&nameIsXattr != 0) != (r.flags&filtruleXattr != 0) {
+		return false
+	}
+
+	var prefix, suffix string
+	if r.slashCnt == 0 && r.flags&filtruleWild2 == 0 {
+		// If the pattern does not have any slashes AND it does not have a
+		// "**" (which could match a slash), then we just match the name
+		// portion of the path.
+		if idx := strings.LastIndexByte(name, '/'); idx > -1 {
+			name = name[idx+1:]
+		}
+	} else if r.flags&filtruleAbsPath != 0 && !strings.HasPrefix(fname, "/") && currDir != "" {
+		// If we're matching against an absolute-path pattern, we need to
+		// prepend our full path info.
+		prefix = currDir + "/"
+	} else if r.flags&filtruleWild2Prefix != 0 && !strings.HasPrefix(fname, "/") {
+		// Allow "**"+"/" to match at the start of the string.
+		prefix = "/"
+	}
+	if nameFlags&nameIsDir != 0 {
+		// Allow a trailing "/"+"***" to match the directory.
+		if r.flags&filtruleWild3Suffix != 0 {
+			suffix = "/"
+		}
+	} else if r.flags&filtruleDirectory != 0 {
+		return !retMatch
+	}
+
+	pattern := r.pattern
+	anchored := strings.HasPrefix(pattern, "/")
+	if anchored {
+		pattern = pattern[1:]
+	}
+
+	var slashHandling int
+	if !anchored && r.slashCnt > 0 && r.flags&filtruleWild2 == 0 {
+		// A non-anchored match with an infix slash and no "**" needs to
+		// match the last slashCnt+1 name elements.
+		slashHandling = r.slashCnt + 1
+	} else if !anchored && r.flags&filtruleWild2Prefix == 0 && r.flags&filtruleWild2 != 0 {
+		// A non-anchored match with an infix or trailing "**" (but not a
+		// prefixed "**") needs to try matching after every slash.
+		slashHandling = -1
+	} else {
+		// The pattern matches only at the start of the path or name.
+		slashHandling = 0
+	}
+
+	text := prefix + name + suffix
+	if r.flags&filtruleWild != 0 {
+		if wildmatchArray(pattern, text, slashHandling) {
+			return retMatch
+		}
+	} else if prefix != "" || suffix != "" {
+		if litmatchArray(pattern, text, slashHandling) {
+			return retMatch
+		}
+	} else if anchored {
+		if name == pattern {
+			return retMatch
+		}
+	} else {
+		// Match the pattern against a trailing sequence of whole path
+		// elements.
+		if strings.HasSuffix(name, pattern) &&
+			(len(name) == len(pattern) || name[len(name)-len(pattern)-1] == '/') {
+			return retMatch
+		}
+	}
+
+	return !retMatch
+}
+
+// exclude.c:add_rule
+func (l *List) addRule(pat string, r *rule, xflags int) {
+	// Per-directory merge file rules which don't apply to our side are
+	// filtered when checking, see check().
+
+	if len(pat) > 1 && strings.HasSuffix(pat, "/") {
+		pat = strings.TrimSuffix(pat, "/")
+		r.flags |= filtruleDirectory
+	}
+
+	if r.flags&(filtruleAbsPath|filtruleMergeFile) == 0 &&
+		xflags&xflgAnchored2Abs != 0 && strings.HasPrefix(pat, "/") {
+		// Anchored rules in per-directory merge files are relative to the
+		// directory containing the merge file.
+		r.flags |= filtruleAbsPath
+		if l.st.dirbuf != "" {
+			pat = "/" + l.st.dirbuf + pat
+		}
+	}
+
+	r.pattern = pat
+
+	if l.st.deleteExcluded && r.flags&(filtrulesSides|filtruleMergeFile|filtrulePerDirMerge) == 0 {
+		r.flags |= filtruleSenderSide
+	}
+
+	if strings.ContainsAny(r.pattern, "*[?") {
+		r.flags |= filtruleWild
+		if idx := strings.Index(r.pattern, "**"); idx > -1 {
+			r.flags |= filtruleWild2
+			// If the pattern starts with **, note that.
+			if idx == 0 {
+				r.flags |= filtruleWild2Prefix
+			}
+			// If the pattern ends with ***, note that.
+			if strings.HasSuffix(r.pattern, "***") {
+				r.flags |= filtruleWild3Suffix
+			}
+		}
+	}
+
+	if r.flags&filtrulePerDirMerge != 0 {
+		base := path.Base(r.pattern)
+		// If the local merge file was already mentioned, don't add it
+		// again.
+		for _, ex := range l.st.mergeParents {
+			if path.Base(ex.pattern) == base {
+				return
+			}
+		}
+		r.mergeList = newList(l.st)
+		l.st.mergeParents = append(l.st.mergeParents, r)
+	} else {
+		r.slashCnt = strings.Count(r.pattern, "/")
+	}
+
+	l.rules = append(l.rules, r)
+}
+
+func isSpace(ch byte) bool {
+	return ch == ' ' || ('\t' <= ch && ch <= '\r')
+}
+
+// ruleStrcmp checks whether str starts with the specified rule name, followed
+// by a space, an underscore, a comma or the end of the string. It returns the
+// index of the last character which belongs to the rule name.
+//
+// exclude.c:rule_strcmp
+func ruleStrcmp(str, name string) (int, bool) {
+	if !strings.HasPrefix(str, name) {
+		return 0, false
+	}
+	if len(str) == len(name) || isSpace(str[len(name)]) || str[len(name)] == '_' {
+		return len(name) - 1, true
+	}
+	if str[len(name)] == ',' {
+		return len(name), true
+	}
+	return 0, false
+}
+
+var ruleNames = map[byte]struct {
+	name string
+	ch   byte
+}{
+	'c': {"clear", '!'},
+	'd': {"dir-merge", ':'},
+	'e': {"exclude", '-'},
+	'h': {"hide", 'H'},
+	'i': {"include", '+'},
+	'm': {"merge", '.'},
+	'p': {"protect", 'P'},
+	'r': {"risk", 'R'},
+	's': {"show", 'S'},
+}
+
+// parseRuleTok parses the next rule from rulestr and returns the rule, its
+// pattern and the remainder of rulestr. The template specifies the flags
+// which are inherited from the containing merge file (if any).
+//
+// exclude.c:parse_rule_tok
+func parseRuleTok(rulestr string, template uint32, xflags int) (*rule, string, string, error) {
+	s := rulestr
+	if template&filtruleWordSplit != 0 {
+		// Skip over any initial whitespace.
+		for s != "" && isSpace(s[0]) {
+			s = s[1:]
+		}
+		// Update to point to real start of rule.
+		rulestr = s
+	}
+	if s == "" {
+		return nil, "", "", nil
+	}
+
+	// Inherit from the template. Don't inherit filtrulesSides; we check that
+	// later.
+	r := &rule{flags: template & filtrulesFromContainer}
+
+	// Figure out what kind of a filter rule s is pointing at. Note that if
+	// filtruleNoPrefixes is set, the rule is either an include or an exclude
+	// based on the inheritance of the filtruleInclude flag (above).
+	// xflgOldPrefixes indicates a compatibility mode for old include/exclude
+	// patterns where just "+ " and "- " are allowed as optional prefixes.
+	if template&filtruleNoPrefixes != 0 {
+		if s[0] == '!' && template&filtruleCVSIgnore != 0 {
+			r.flags |= filtruleClearList // Tentative!
+		}
+	} else if xflags&xflgOldPrefixes != 0 {
+		if strings.HasPrefix(s, "- ") {
+			r.flags &^= filtruleInclude
+			s = s[2:]
+		} else if strings.HasPrefix(s, "+ ") {
+			r.flags |= filtruleInclude
+			s = s[2:]
+		} else if s[0] == '!' {
+			r.flags |= filtruleClearList // Tentative!
+		}
+	} else {
+		// i is the index of the last character of the rule name or prefix.
+		var ch byte
+		i := 0
+		if rn, ok := ruleNames[s[0]]; ok {
+			idx, ok := ruleStrcmp(s, rn.name)
+			if !ok {
+				return nil, "", "", fmt.Errorf("Unknown filter rule: `%s'", rulestr)
+			}
+			i = idx
+			ch = rn.ch
+		} else {
+			ch = s[0]
+			if len(s) > 1 && s[1] == ',' {
+				i = 1
+			}
+		}
+		prefixSpecifiesSide := false
+		switch ch {
+		case ':':
+			r.flags |= filtrulePerDirMerge | filtruleFinishSetup
+			r.flags |= filtruleMergeFile
+		case '.':
+			r.flags |= filtruleMergeFile
+		case '+':
+			r.flags |= filtruleInclude
+		case '-':
+		case 'S':
+			r.flags |= filtruleInclude
+			r.flags |= filtruleSenderSide
+			prefixSpecifiesSide = true
+		case 'H':
+			r.flags |= filtruleSenderSide
+			prefixSpecifiesSide = true
+		case 'R':
+			r.flags |= filtruleInclude
+			r.flags |= filtruleReceiverSide
+			prefixSpecifiesSide = true
+		case 'P':
+			r.flags |= filtruleReceiverSide
+			prefixSpecifiesSide = true
+		case '!':
+			r.flags |= filtruleClearList
+		default:
+			return nil, "", "", fmt.Errorf("Unknown filter rule: `%s'", rulestr)
+		}
+		for ch != '!' {
+			i++
+			if i >= len(s) || s[i] == ' ' || s[i] == '_' {
+				break
+			}
+			if template&filtruleWordSplit != 0 && isSpace(s[i]) {
+				i--
+				break
+			}
+			invalid := false
+			switch s[i] {
+			case '-':
+				if r.flags&filtruleMergeFile == 0 || r.flags&filtruleNoPrefixes != 0 {
+					invalid = true
+				}
+				r.flags |= filtruleNoPrefixes
+			case '+':
+				if r.flags&filtruleMergeFile == 0 || r.flags&filtruleNoPrefixes != 0 {
+					invalid = true
+				}
+				r.flags |= filtruleNoPrefixes | filtruleInclude
+			case '/':
+				r.flags |= filtruleAbsPath
+			case '!':
+				// Negation really goes with the pattern, so it isn't
+				// useful as a merge-file default.
+				if r.flags&filtruleMergeFile != 0 {
+					invalid = true
+				}
+				r.flags |= filtruleNegate
+			case 'C':
+				if r.flags&filtruleNoPrefixes != 0 || prefixSpecifiesSide {
+					invalid = true
+				}
+				r.flags |= filtruleNoPrefixes | filtruleWordSplit |
+					filtruleNoInherit | filtruleCVSIgnore
+			case 'e':
+				if r.flags&filtruleMergeFile == 0 {
+					invalid = true
+				}
+				r.flags |= filtruleExcludeSelf
+			case 'n':
+				if r.flags&filtruleMergeFile == 0 {
+					invalid = true
+				}
+				r.flags |= filtruleNoInherit
+			case 'p':
+				r.flags |= filtrulePerishable
+			case 'r':
+				if prefixSpecifiesSide {
+					invalid = true
+				}
+				r.flags |= filtruleReceiverSide
+			case 's':
+				if prefixSpecifiesSide {
+					invalid = true
+				}
+				r.flags |= filtruleSenderSide
+			case 'w':
+				if r.flags&filtruleMergeFile == 0 {
+					invalid = true
+				}
+				r.flags |= filtruleWordSplit
+			case 'x':
+				r.flags |= filtruleXattr
+			default:
+				invalid = true
+			}
+			if invalid {
+				return nil, "", "", fmt.Errorf("invalid modifier '%c' at position %d in filter rule: %s", s[i], i, rulestr)
+			}
+		}
+		if i < len(s) {
+			i++
+		}
+		s = s[i:]
+	}
+
+	if template&filtrulesSides != 0 {
+		if r.flags&filtrulesSides != 0 {
+			// The filter and template both specify side(s). This is dodgy
+			// (and won't work right with rsync 2.6.x).
+			return nil, "", "", fmt.Errorf("specifying a side in a rule of a side-specific merge file is not supported: %s", rulestr)
+		}
+		r.flags |= template & filtrulesSides
+	}
+
+	pat := s
+	if template&filtruleWordSplit != 0 {
+		// Token ends at whitespace or the end of the string.
+		if idx := strings.IndexFunc(s, func(r rune) bool {
+			return r < 0x80 && isSpace(byte(r))
+		}); idx > -1 {
+			pat = s[:idx]
+		}
+	}
+
+	if r.flags&filtruleClearList != 0 {
+		if r.flags&filtruleNoPrefixes == 0 &&
+			xflags&xflgOldPrefixes == 0 &&
+			len(pat) > 0 {
+			return nil, "", "", fmt.Errorf("'!' rule has trailing characters: %s", rulestr)
+		}
+		if len(pat) > 1 {
+			r.flags &^= filtruleClearList
+		}
+	} else if len(pat) == 0 && r.flags&filtruleCVSIgnore == 0 {
+		return nil, "", "", fmt.Errorf("unexpected end of filter rule: %s", rulestr)
+	}
+
+	return r, pat, s[len(pat):], nil
+}
+
+// exclude.c:parse_filter_str
+func (l *List) parseFilterStr(rulestr string, template uint32, xflags int) error {
+	for {
+		r, pat, rest, err := parseRuleTok(rulestr, template, xflags)
+		if err != nil {
+			return err
+		}
+		if r == nil {
+			break
+		}
+		rulestr = rest
+
+		if r.flags&filtruleClearList != 0 {
+			l.rules = nil
+			l.inherited = nil
+			continue
+		}
+
+		if r.flags&filtruleMergeFile != 0 {
+			if pat == "" {
+				pat = ".cvsignore"
+			}
+			if r.flags&filtruleExcludeSelf != 0 {
+				// Find the beginning of the basename and add an exclude for
+				// it.
+				l.addRule(path.Base(pat), &rule{}, 0)
+				r.flags &^= filtruleExcludeSelf
+			}
+			if r.flags&filtrulePerDirMerge == 0 {
+				if err := l.parseFilterFile(pat, r.flags, xflgFatalErrors); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+
+		l.addRule(pat, r, xflags)
+
+		if r.flags&filtruleCVSIgnore != 0 && r.flags&filtruleMergeFile == 0 {
+			if err := l.getCVSExcludes(r.flags); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// exclude.c:parse_filter_file
+func (l *List) parseFilterFile(fn string, template uint32, xflags int) error {
+	if fn == "" {
+		return nil
+	}
+	if l.st.open == nil {
+		return fmt.Errorf("merge files are not permitted in this context: %s", fn)
+	}
+	incl := "ex"
+	if template&filtruleInclude != 0 {
+		incl = "in"
+	}
+	f, err := l.st.open(fn)
+	if err != nil {
+		if xflags&xflgFatalErrors != 0 {
+			return fmt.Errorf("failed to open %sclude file %s: %v", incl, fn, err)
+		}
+		return nil
+	}
+	defer f.Close()
+	return l.parseFilterReader(f, template, xflags)
+}
+
+func (l *List) parseFilterReader(r io.Reader, template uint32, xflags int) error {
+	wordSplit := template&filtruleWordSplit != 0
+	eolNulls := l.st.eolNulls
+	br := bufio.NewReader(r)
+	var line []byte
+	for {
+		ch, err := br.ReadByte()
+		if err != nil && err != io.EOF {
+			return err
+		}
+		eof := err == io.EOF
+		eol := ch == '\n' || ch == '\r'
+		if eolNulls {
+			eol = ch == 0
+		}
+		if !eof &&
+			!(wordSplit && isSpace(ch)) &&
+			!eol {
+			line = append(line, ch)
+			continue
+		}
+		// Skip an empty token and (when line parsing) comments.
+		if len(line) > 0 && (wordSplit || (line[0] != ';' && line[0] != '#')) {
+			if err := l.parseFilterStr(string(line), template, xflags); err != nil {
+				return err
+			}
+		}
+		line = line[:0]
+		if eof {
+			return nil
+		}
+	}
+}
+
+// exclude.c:get_cvs_excludes
+func (l *List) getCVSExcludes(flags uint32) error {
+	if l.st.cvsList != nil {
+		return nil
+	}
+	cvsList := newList(l.st)
+	l.st.cvsList = cvsList
+	template := flags
+	if l.st.protocol >= 30 {
+		template |= filtrulePerishable
+	}
+	if err := cvsList.parseFilterStr(defaultCVSIgnore, template, 0); err != nil {
+		return err
+	}
+	if home := os.Getenv("HOME"); home != "" {
+		f, err := os.Open(path.Join(home, ".cvsignore"))
+		if err == nil {
+			defer f.Close()
+			if err := cvsList.parseFilterReader(f, flags, 0); err != nil {
+				return err
+			}
+		}
+	}
+	return cvsList.parseFilterStr(os.Getenv("CVSIGNORE"), flags, 0)
+}
+
+// exclude.c:MAX_RULE_PREFIX
+const maxRulePrefix = 16
+
+// getRulePrefix returns the prefix to transfer r to the remote side, or false
+// if the rule cannot be expressed in the specified protocol version.
+//
+// exclude.c:get_rule_prefix
+func (r *rule) getRulePrefix(protocol int32, amSender bool) (string, bool) {
+	// Protocols before 29 only understand the "- " and "+ " prefixes.
+	legalLen := maxRulePrefix - 1
+	if protocol < 29 {
+		legalLen = 1
+	}
+	var op []byte
+	if r.flags&filtrulePerDirMerge != 0 {
+		if legalLen == 1 {
+			return "", false
+		}
+		op = append(op, ':')
+	} else if r.flags&filtruleInclude != 0 {
+		op = append(op, '+')
+	} else if legalLen != 1 ||
+		((strings.HasPrefix(r.pattern, "-") || strings.HasPrefix(r.pattern, "+")) &&
+			len(r.pattern) > 1 && r.pattern[1] == ' ') {
+		op = append(op, '-')
+	} else {
+		legalLen = 0
+	}
+
+	if r.flags&filtruleAbsPath != 0 {
+		op = append(op, '/')
+	}
+	if r.flags&filtruleNegate != 0 {
+		op = append(op, '!')
+	}
+	if r.flags&filtruleCVSIgnore != 0 {
+		op = append(op, 'C')
+	} else {
+		if r.flags&filtruleNoInherit != 0 {
+			op = append(op, 'n')
+		}
+		if r.flags&filtruleWordSplit != 0 {
+			op = append(op, 'w')
+		}
+		if r.flags&filtruleNoPrefixes != 0 {
+			if r.flags&filtruleInclude != 0 {
+				op = append(op, '+')
+			} else {
+				op = append(op, '-')
+			}
+		}
+	}
+	if r.flags&filtruleExcludeSelf != 0 {
+		op = append(op, 'e')
+	}
+	if r.flags&filtruleXattr != 0 {
+		op = append(op, 'x')
+	}
+	if r.flags&filtruleSenderSide != 0 && protocol >= 29 {
+		op = append(op, 's')
+	}
+	if r.flags&filtruleReceiverSide != 0 && protocol >= 29 {
+		op = append(op, 'r')
+	}
+	if r.flags&filtrulePerishable != 0 {
+		if protocol >= 30 {
+			op = append(op, 'p')
+		} else if amSender {
+			return "", false
+		}
+	}
+	if len(op) > legalLen {
+		return "", false
+	}
+	if legalLen > 0 {
+		op = append(op, ' ')
+	}
+	return string(op), true
+}
+
+// Send transmits the rules which are relevant for the remote side, followed
+// by the end-of-list marker.
+//
+// exclude.c:send_filter_list
+func (l *List) Send(c *rsyncwire.Conn, amSender bool) error {
+	if err := l.sendRules(c, amSender); err != nil {
+		return err
+	}
+	const exclusionListEnd = 0
+	return c.WriteInt32(exclusionListEnd)
+}
+
+// exclude.c:send_rules
+func (l *List) sendRules(c *rsyncwire.Conn, amSender bool) error {
+	for _, r := range l.rules {
+		// Rules which only apply to our side are not sent.
+		switch r.flags & filtrulesSides {
+		case filtruleSenderSide:
+			if amSender {
+				continue
+			}
+		case filtruleReceiverSide:
+			if !amSender {
+				continue
+			}
+		}
+		if r.flags&filtruleCVSIgnore != 0 && r.flags&filtruleMergeFile == 0 {
+			if amSender || l.st.protocol < 29 {
+				if err := l.st.cvsList.sendRules(c, amSender); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		prefix, ok := r.getRulePrefix(l.st.protocol, amSender)
+		if !ok {
+			return fmt.Errorf("filter rules are too modern for remote rsync.")
+		}
+		line := prefix + r.pattern
+		if r.flags&filtruleDirectory != 0 {
+			line += "/"
+		}
+		if line == "" {
+			continue
+		}
+		if err := c.WriteInt32(int32(len(line))); err != nil {
+			return err
+		}
+		if err := c.WriteString(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RecvFilterList reads the filter rules sent by the remote side. Merge rules
+// are rejected (the client expands them before sending), per-directory merge
+// files are read while walking, see Scope.
+//
+// exclude.c:recv_filter_list
+func RecvFilterList(c *rsyncwire.Conn, protocol int32) (*List, error) {
+	l := NewList(nil, protocol)
+	xflags := 0
+	if protocol < 29 {
+		xflags = xflgOldPrefixes
+	}
+	const exclusionListEnd = 0
+	for {
+		length, err := c.ReadInt32()
+		if err != nil {
+			return nil, err
+		}
+		if length == exclusionListEnd {
+			break
+		}
+		line := make([]byte, length)
+		if _, err := io.ReadFull(c.Reader, line); err != nil {
+			return nil, err
+		}
+		if err := l.parseFilterStr(string(line), 0, xflags); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
@@ -0,0 +1,495 @@
+package filter
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/gokrazy/rsync/internal/rsyncwire"
+)
+
+func parseRules(rules ...string) (*List, error) {
+	l := NewList(nil, 27)
+	for _, rule := range rules {
+		if err := l.parseFilterStr(rule, 0, 0); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// Test cases taken from rsync/wildtest.txt
+func TestWildmatch(t *testing.T) {
+	for _, tt := range []struct {
+		pattern string
+		text    string
+		want    bool
+	}{
+		// Basic wildmatch features
+		{"foo", "foo", true},
+		{"foo", "bar", false},
+		{"???", "foo", true},
+		{"??", "foo", false},
+		{"*", "foo", true},
+		{"f*", "foo", true},
+		{"*f", "foo", false},
+		{"*foo*", "foo", true},
+		{"*ob*a*r*", "foobar", true},
+		{"*ab", "aaaaaaabababab", true},
+		{`foo\*`, "foo*", true},
+		{`foo\*bar`, "foobar", false},
+		{`f\\oo`, `f\oo`, true},
+		{"*[al]?", "ball", true},
+		{"[ten]", "ten", false},
+		{"**[!te]", "ten", true},
+		{"**[!ten]", "ten", false},
+		{"t[a-g]n", "ten", true},
+		{"t[!a-g]n", "ten", false},
+		{"t[!a-g]n", "ton", true},
+		{"t[^a-g]n", "ton", true},
+		{"a[]]b", "a]b", true},
+		{"a[]-]b", "a-b", true},
+		{"a[]-]b", "a]b", true},
+		{"a[]-]b", "aab", false},
+		{"a[]a-]b", "aab", true},
+		{"]", "]", true},
+
+		// Extended slash-matching features
+		{"foo*bar", "foo/baz/bar", false},
+		{"foo**bar", "foo/baz/bar", true},
+		{"foo?bar", "foo/bar", false},
+		{"foo[/]bar", "foo/bar", false},
+		{"f[^eiu][^eiu][^eiu][^eiu][^eiu]r", "foo/bar", false},
+		{"f[^eiu][^eiu][^eiu][^eiu][^eiu]r", "foo-bar", true},
+		{"**/foo", "foo", false},
+		{"**/foo", "/foo", true},
+		{"**/foo", "bar/baz/foo", true},
+		{"*/foo", "bar/baz/foo", false},
+		{"**/bar*", "foo/bar/baz", false},
+		{"**/bar/*", "deep/foo/bar/baz", true},
+		{"**/bar/*", "deep/foo/bar/baz/", false},
+		{"**/bar/**", "deep/foo/bar/baz/", true},
+		{"**/bar/*", "deep/foo/bar", false},
+		{"**/bar/**", "deep/foo/bar/", true},
+		{"**/bar**", "foo/bar/baz", true},
+		{"*/bar/**", "foo/bar/baz/x", true},
+		{"*/bar/**", "deep/foo/bar/baz/x", false},
+		{"**/bar/*/*", "deep/foo/bar/baz/x", true},
+
+		// Character class tests
+		{"[[:alpha:]][[:digit:]][[:upper:]]", "a1B", true},
+		{"[[:digit:][:upper:][:space:]]", "a", false},
+		{"[[:digit:][:upper:][:space:]]", "A", true},
+		{"[[:digit:][:upper:][:space:]]", "1", true},
+		{"[[:digit:][:upper:][:spaci:]]", "1", false},
+		{"[[:digit:][:upper:][:space:]]", " ", true},
+		{"[[:digit:][:upper:][:space:]]", ".", false},
+		{"[[:digit:][:punct:][:space:]]", ".", true},
+		{"[[:xdigit:]]", "5", true},
+		{"[[:xdigit:]]", "f", true},
+		{"[[:xdigit:]]", "D", true},
+		{"[a-c[:digit:]x-z]", "5", true},
+		{"[a-c[:digit:]x-z]", "b", true},
+		{"[a-c[:digit:]x-z]", "y", true},
+		{"[a-c[:digit:]x-z]", "q", false},
+
+		// Additional tests, including some malformed wildmats
+		{`[\\-^]`, "]", true},
+		{`[\\-^]`, "[", false},
+		{`[\-_]`, "-", true},
+		{`[\]]`, "]", true},
+		{`[\]]`, `\]`, false},
+		{`[\]]`, `\`, false},
+		{"a[]b", "ab", false},
+		{"a[]b", "a[]b", false},
+		{"ab[", "ab[", false},
+		{"[!", "ab", false},
+		{"[-", "ab", false},
+		{"[-]", "-", true},
+		{"[a-", "-", false},
+		{"[!a-", "-", false},
+		{"[--A]", "-", true},
+		{"[--A]", "5", true},
+		{"[ --]", " ", true},
+		{"[ --]", "$", true},
+		{"[ --]", "-", true},
+		{"[ --]", "0", false},
+		{"[---]", "-", true},
+		{"[------]", "-", true},
+		{"[a-e-n]", "j", false},
+		{"[a-e-n]", "-", true},
+		{"[!------]", "a", true},
+		{"[]-a]", "[", false},
+		{"[]-a]", "^", true},
+		{"[!]-a]", "^", false},
+		{"[!]-a]", "[", true},
+		{"[a^bc]", "^", true},
+		{"[a-]b]", "-b]", true},
+		{`[\]`, `\`, false},
+		{`[\\]`, `\`, true},
+		{`[!\\]`, `\`, false},
+		{`[A-\\]`, "G", true},
+		{"b*a", "aaabbb", false},
+		{"*ba*", "aabcaa", false},
+		{"[,]", ",", true},
+		{`[\\,]`, ",", true},
+		{`[\\,]`, `\`, true},
+		{"[,-.]", "-", true},
+		{"[,-.]", "+", false},
+		{"[,-.]", "-.]", false},
+		{`[\1-\3]`, "2", true},
+		{`[\1-\3]`, "3", true},
+		{`[\1-\3]`, "4", false},
+		{`[[-\]]`, `\`, true},
+		{`[[-\]]`, "[", true},
+		{`[[-\]]`, "]", true},
+		{`[[-\]]`, "-", false},
+
+		// Test recursion and the abort code
+		{"-*-*-*-*-*-*-12-*-*-*-m-*-*-*", "-adobe-courier-bold-o-normal--12-120-75-75-m-70-iso8859-1", true},
+		{"-*-*-*-*-*-*-12-*-*-*-m-*-*-*", "-adobe-courier-bold-o-normal--12-120-75-75-X-70-iso8859-1", false},
+		{"-*-*-*-*-*-*-12-*-*-*-m-*-*-*", "-adobe-courier-bold-o-normal--12-120-75-75-/-70-iso8859-1", false},
+		{"/*/*/*/*/*/*/12/*/*/*/m/*/*/*", "/adobe/courier/bold/o/normal//12/120/75/75/m/70/iso8859/1", true},
+		{"/*/*/*/*/*/*/12/*/*/*/m/*/*/*", "/adobe/courier/bold/o/normal//12/120/75/75/X/70/iso8859/1", false},
+		{"**/*a*b*g*n*t", "abcd/abcdefg/abcdefghijk/abcdefghijklmnop.txt", true},
+		{"**/*a*b*g*n*t", "abcd/abcdefg/abcdefghijk/abcdefghijklmnop.txtz", false},
+	} {
+		t.Run(tt.pattern+" "+tt.text, func(t *testing.T) {
+			if got := dowild(tt.pattern, tt.text) == wmMatch; got != tt.want {
+				t.Errorf("dowild(%q, %q) = %v, want %v", tt.pattern, tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+// See integration/filter for a test which compares with tridge rsync.
+func TestFilterRuleMatches(t *testing.T) {
+	for _, tt := range []struct {
+		rule  string
+		name  string
+		isDir bool
+		want  bool
+	}{
+		// Patterns without a slash match the last path element.
+		{"- foo", "foo", false, true},
+		{"- foo", "a/b/foo", false, true},
+		{"- foo", "a/foo/b", false, false},
+		{"- foo", "afoo", false, false},
+		{"- *.o", "main.o", false, true},
+		{"- *.o", "lib/util.o", false, true},
+		{"- *.o", "lib.o/util.c", false, false},
+		{"- ?.c", "a.c", false, true},
+		{"- ?.c", "ab.c", false, false},
+		{"- [ab].c", "b.c", false, true},
+		{"- [!ab].c", "b.c", false, false},
+
+		// Patterns with a slash match the trailing path elements.
+		{"- b/foo", "a/b/foo", false, true},
+		{"- b/foo", "a/xb/foo", false, false},
+		{"- b/*.c", "a/b/x.c", false, true},
+		{"- b/*.c", "b/x.c", false, true},
+		{"- b/*.c", "a/c/x.c", false, false},
+
+		// A leading slash anchors the pattern at the transfer root.
+		{"- /foo", "foo", false, true},
+		{"- /foo", "a/foo", false, false},
+		{"- /a/*.c", "a/x.c", false, true},
+		{"- /a/*.c", "b/a/x.c", false, false},
+		{"- /*.c", "x.c", false, true},
+		{"- /*.c", "a/x.c", false, false},
+
+		// A trailing slash only matches directories.
+		{"- build/", "build", true, true},
+		{"- build/", "build", false, false},
+		{"- build/", "src/build", true, true},
+		{"- /build/", "src/build", true, false},
+
+		// ** matches across slashes.
+		{"- **/foo", "foo", false, true},
+		{"- **/foo", "a/b/foo", false, true},
+		{"- a/**/c", "a/b/c", false, true},
+		{"- a/**/c", "a/b/b/c", false, true},
+		{"- a/**/c", "x/a/b/c", false, true},
+		{"- /a/**/c", "x/a/b/c", false, false},
+		{"- a**", "abc/def", false, true},
+		{"- a**", "x/abc/def", false, true},
+		{"- /a**", "x/abc/def", false, false},
+
+		// A trailing /*** matches the directory and everything in it.
+		{"- dir/***", "dir", true, true},
+		{"- dir/***", "dir/a", false, true},
+		{"- dir/***", "dir/a/b", false, true},
+		{"- dir/***", "dir", false, false},
+		{"- dir/**", "dir", true, false},
+		{"- dir/**", "dir/a/b", false, true},
+	} {
+		t.Run(tt.rule+" "+tt.name, func(t *testing.T) {
+			l, err := parseRules(tt.rule)
+			if err != nil {
+				t.Fatal(err)
+			}
+			nameFlags := 0
+			if tt.isDir {
+				nameFlags |= nameIsDir
+			}
+			if got := l.rules[0].matches(tt.name, nameFlags, ""); got != tt.want {
+				t.Errorf("%q.matches(%q, isDir=%v) = %v, want %v", tt.rule, tt.name, tt.isDir, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckFilterFirstMatchWins(t *testing.T) {
+	for _, tt := range []struct {
+		rules []string
+		name  string
+		isDir bool
+		want  bool // excluded?
+	}{
+		{[]string{"+ *.c", "- *"}, "main.c", false, false},
+		{[]string{"+ *.c", "- *"}, "main.o", false, true},
+		{[]string{"- *", "+ *.c"}, "main.c", false, true},
+		{[]string{"+ */", "+ *.c", "- *"}, "src", true, false},
+		{[]string{"+ */", "+ *.c", "- *"}, "src/x.h", false, true},
+		{[]string{"- *.o", "!"}, "main.o", false, false},
+		{[]string{"- *.o", "!", "- *.c"}, "main.c", false, true},
+		{nil, "main.o", false, false},
+	} {
+		t.Run(strings.Join(tt.rules, ",")+" "+tt.name, func(t *testing.T) {
+			l, err := parseRules(tt.rules...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := l.Excluded(tt.name, tt.isDir, SenderSide); got != tt.want {
+				t.Errorf("Excluded(%q, isDir=%v) = %v, want %v", tt.name, tt.isDir, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRuleTok(t *testing.T) {
+	const perDirMerge = filtrulePerDirMerge | filtruleMergeFile | filtruleFinishSetup
+	const cvs = filtruleCVSIgnore | filtruleNoPrefixes | filtruleWordSplit | filtruleNoInherit
+	for _, tt := range []struct {
+		rule        string
+		wantFlags   uint32
+		wantPattern string
+	}{
+		{"- foo", 0, "foo"},
+		{"exclude foo", 0, "foo"},
+		{"exclude_foo", 0, "foo"},
+		{"+ foo", filtruleInclude, "foo"},
+		{"include foo", filtruleInclude, "foo"},
+		{"- foo bar", 0, "foo bar"},
+		{"-/ /abs", filtruleAbsPath, "/abs"},
+		{"-! foo", filtruleNegate, "foo"},
+		{"-,p foo", filtrulePerishable, "foo"},
+		{"exclude,s foo", filtruleSenderSide, "foo"},
+		{"-sr foo", filtruleSenderSide | filtruleReceiverSide, "foo"},
+		{"-x user.*", filtruleXattr, "user.*"},
+		{"H foo", filtruleSenderSide, "foo"},
+		{"hide foo", filtruleSenderSide, "foo"},
+		{"S foo", filtruleInclude | filtruleSenderSide, "foo"},
+		{"show foo", filtruleInclude | filtruleSenderSide, "foo"},
+		{"P foo", filtruleReceiverSide, "foo"},
+		{"protect foo", filtruleReceiverSide, "foo"},
+		{"R foo", filtruleInclude | filtruleReceiverSide, "foo"},
+		{"risk foo", filtruleInclude | filtruleReceiverSide, "foo"},
+		{". rules", filtruleMergeFile, "rules"},
+		{"merge,+ rules", filtruleMergeFile | filtruleNoPrefixes | filtruleInclude, "rules"},
+		{": .filt", perDirMerge, ".filt"},
+		{"dir-merge,- .filt", perDirMerge | filtruleNoPrefixes, ".filt"},
+		{":nwe .filt", perDirMerge | filtruleNoInherit | filtruleWordSplit | filtruleExcludeSelf, ".filt"},
+		{":C", perDirMerge | cvs, ""},
+		{"-C", cvs, ""},
+		{"!", filtruleClearList, ""},
+		{"clear", filtruleClearList, ""},
+	} {
+		t.Run(tt.rule, func(t *testing.T) {
+			r, pat, rest, err := parseRuleTok(tt.rule, 0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.flags != tt.wantFlags {
+				t.Errorf("parseRuleTok(%q): flags = %#x, want %#x", tt.rule, r.flags, tt.wantFlags)
+			}
+			if pat != tt.wantPattern {
+				t.Errorf("parseRuleTok(%q): pattern = %q, want %q", tt.rule, pat, tt.wantPattern)
+			}
+			if rest != "" {
+				t.Errorf("parseRuleTok(%q): rest = %q, want empty", tt.rule, rest)
+			}
+		})
+	}
+}
+
+func TestParseRuleTokErrors(t *testing.T) {
+	for _, rule := range []string{
+		"-foo",
+		"- ",
+		"-",
+		"! foo",
+		"xfoo",
+		"excludefoo",
+		"-e foo",  // e is only valid for merge rules
+		"H,s foo", // side was already specified
+		".! foo",  // ! is not valid for merge rules
+		":C- .filt",
+	} {
+		t.Run(rule, func(t *testing.T) {
+			if _, _, _, err := parseRuleTok(rule, 0, 0); err == nil {
+				t.Errorf("parseRuleTok(%q) unexpectedly succeeded", rule)
+			}
+		})
+	}
+}
+
+func TestOldPrefixes(t *testing.T) {
+	for _, tt := range []struct {
+		rule    string
+		include bool
+		name    string
+		want    int
+	}{
+		{"- foo", false, "foo", -1},
+		{"+ foo", false, "foo", 1},
+		{"foo", false, "foo", -1},
+		{"foo", true, "foo", 1},
+		{"- foo", true, "foo", -1},
+		{"exclude foo", false, "exclude foo", -1},
+		{"!foo", false, "!foo", -1},
+	} {
+		t.Run(tt.rule, func(t *testing.T) {
+			var template uint32
+			if tt.include {
+				template |= filtruleInclude
+			}
+			l := NewList(nil, 27)
+			if err := l.parseFilterStr(tt.rule, template, xflgOldPrefixes); err != nil {
+				t.Fatal(err)
+			}
+			if got := l.Check(tt.name, false, SenderSide); got != tt.want {
+				t.Errorf("Check(%q) = %d, want %d", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSides(t *testing.T) {
+	l, err := parseRules(
+		"hide hidden",
+		"protect protected",
+		"-p perishable",
+		"- both",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name string
+		side Side
+		want bool
+	}{
+		{"hidden", SenderSide, true},
+		{"hidden", ReceiverSide, false},
+		{"protected", SenderSide, false},
+		{"protected", ReceiverSide, true},
+		{"both", SenderSide, true},
+		{"both", ReceiverSide, true},
+		{"perishable", ReceiverSide, true},
+	} {
+		if got := l.Excluded(tt.name, false, tt.side); got != tt.want {
+			t.Errorf("Excluded(%q, side=%v) = %v, want %v", tt.name, tt.side, got, tt.want)
+		}
+	}
+	if l.ExcludedIgnorePerishable("perishable", false) {
+		t.Errorf("ExcludedIgnorePerishable(perishable) = true, want false")
+	}
+	if !l.ExcludedIgnorePerishable("protected", false) {
+		t.Errorf("ExcludedIgnorePerishable(protected) = false, want true")
+	}
+}
+
+func TestMerge(t *testing.T) {
+	fsys := fstest.MapFS{
+		"rules": {Data: []byte("# comment\n; comment\n\n+ keep.o\n- *.o\r\n")},
+		"words": {Data: []byte("a b\n  c\n")},
+	}
+	open := func(name string) (io.ReadCloser, error) { return fsys.Open(name) }
+	for _, tt := range []struct {
+		rule  string
+		name  string
+		want  int
+		isDir bool
+	}{
+		{"merge rules", "keep.o", 1, false},
+		{"merge rules", "main.o", -1, false},
+		{"merge rules", "comment", 0, false},
+		{". rules", "main.o", -1, false},
+		{".w- words", "a", -1, false},
+		{".w- words", "c", -1, false},
+		{".w+ words", "b", 1, false},
+		{".e rules", "rules", -1, false},
+		{".- rules", "+ keep.o", -1, false},
+	} {
+		t.Run(tt.rule+" "+tt.name, func(t *testing.T) {
+			l := NewList(open, 27)
+			if err := l.parseFilterStr(tt.rule, 0, 0); err != nil {
+				t.Fatal(err)
+			}
+			if got := l.Check(tt.name, tt.isDir, SenderSide); got != tt.want {
+				t.Errorf("Check(%q) = %d, want %d", tt.name, got, tt.want)
+			}
+		})
+	}
+
+	l := NewList(open, 27)
+	if err := l.parseFilterStr("merge nonexistent", 0, 0); err == nil {
+		t.Errorf("merge of a nonexistent file unexpectedly succeeded")
+	}
+	if err := NewList(nil, 27).parseFilterStr("merge rules", 0, 0); err == nil {
+		t.Errorf("merge without open func unexpectedly succeeded")
+	}
+}
+
+func TestSendRecv(t *testing.T) {
+	l, err := parseRules(
+		"- *.o",
+		"+ /keep/",
+		"hide secret",
+		"protect precious",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := l.Send(&rsyncwire.Conn{Writer: &buf}, false /* amSender */); err != nil {
+		t.Fatal(err)
+	}
+	r, err := RecvFilterList(&rsyncwire.Conn{Reader: &buf}, 27)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, r := range r.rules {
+		prefix, _ := r.getRulePrefix(30, false)
+		got = append(got, prefix+r.pattern)
+	}
+	// The protect rule only applies to the receiving side (that is us), so it
+	// is not sent. Protocol 27 has no way to express the sender side.
+	want := []string{"- *.o", "+ /keep", "- secret"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("received rules = %q, want %q", got, want)
+	}
+
+	// Modifiers and dir-merge rules cannot be expressed in protocol 27.
+	if neg, _ := parseRules("-! negated"); neg.Send(&rsyncwire.Conn{Writer: io.Discard}, false) == nil {
+		t.Errorf("Send(negated, protocol 27) unexpectedly succeeded")
+	}
+	if dm, _ := parseRules(": .filt"); dm.Send(&rsyncwire.Conn{Writer: io.Discard}, false) == nil {
+		t.Errorf("Send(dir-merge, protocol 27) unexpectedly succeeded")
+	}
+}
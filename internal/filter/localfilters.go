@@ -0,0 +1,261 @@
+package filter
+
+import (
+	"path"
+	"strings"
+)
+
+// Scope keeps track of the per-directory merge files (dir-merge rules) while
+// walking a directory tree in lexical order, e.g. using fs.WalkDir.
+type Scope struct {
+	l *List
+
+	// open opens names relative to the root of the walked file system.
+	open OpenFunc
+
+	// absRoot is the absolute path (without leading slash) of the root of
+	// the walked file system. For daemons, the path is relative to the
+	// module root.
+	absRoot string
+
+	stack []localState
+}
+
+type savedList struct {
+	rules     []*rule
+	inherited []*rule
+}
+
+// exclude.c:local_filter_state
+type localState struct {
+	dir          string
+	mergeParents int
+	lists        []savedList
+}
+
+// NewScope returns a Scope for walking a file system whose root is located
+// at absRoot. Names passed to Check are relative to currDir.
+func (l *List) NewScope(open OpenFunc, absRoot, currDir string) *Scope {
+	if l == nil {
+		return &Scope{}
+	}
+	l.SetCurrDir(currDir)
+	return &Scope{
+		l:       l,
+		open:    open,
+		absRoot: cleanAbs(absRoot),
+	}
+}
+
+// Visit must be called for every path of the walk (before EnterDir). It
+// drops the rules of the per-directory merge files of all directories which
+// path is not contained in.
+func (s *Scope) Visit(fsPath string) {
+	for len(s.stack) > 0 {
+		dir := s.stack[len(s.stack)-1].dir
+		if dir == "." || strings.HasPrefix(fsPath, dir+"/") {
+			return
+		}
+		s.pop()
+	}
+}
+
+// ChangeDir makes the per-directory merge files of fsDir and all of its parent
+// directories apply, for checking names within fsDir. Unlike Visit and
+// EnterDir, ChangeDir does not require the directories to be visited in
+// lexical order.
+//
+// exclude.c:change_local_filter_dir
+func (s *Scope) ChangeDir(fsDir string) error {
+	if s.l == nil {
+		return nil
+	}
+	for len(s.stack) > 0 {
+		dir := s.stack[len(s.stack)-1].dir
+		if dir == "." || dir == fsDir || strings.HasPrefix(fsDir, dir+"/") {
+			break
+		}
+		s.pop()
+	}
+	// Enter all directories from the innermost entered directory (if any)
+	// down to fsDir.
+	var missing []string
+	for d := fsDir; ; d = path.Dir(d) {
+		if len(s.stack) > 0 && s.stack[len(s.stack)-1].dir == d {
+			break
+		}
+		missing = append(missing, d)
+		if d == "." {
+			break
+		}
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		if err := s.EnterDir(missing[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close drops the rules of all per-directory merge files.
+func (s *Scope) Close() {
+	for len(s.stack) > 0 {
+		s.pop()
+	}
+}
+
+// EnterDir reads the per-directory merge files of the specified directory.
+// The rules apply to all names within the directory until the walk leaves
+// the directory (see Visit).
+//
+// exclude.c:push_local_filters
+func (s *Scope) EnterDir(fsDir string) error {
+	if s.l == nil {
+		return nil
+	}
+	st := s.l.st
+	dirbuf := cleanAbs(path.Join(s.absRoot, fsDir))
+	st.dirbuf = dirbuf
+	defer func() { st.dirbuf = "" }()
+
+	push := localState{
+		dir:          fsDir,
+		mergeParents: len(st.mergeParents),
+	}
+	for _, mp := range st.mergeParents {
+		push.lists = append(push.lists, savedList{
+			rules:     mp.mergeList.rules,
+			inherited: mp.mergeList.inherited,
+		})
+	}
+	s.stack = append(s.stack, push)
+
+	// Note: parsing might add to st.mergeParents, so keep this loop separate
+	// from the above loop.
+	for i := 0; i < len(st.mergeParents); i++ {
+		mp := st.mergeParents[i]
+		ml := mp.mergeList
+
+		if mp.flags&filtruleNoInherit != 0 {
+			// Disallow inheritance of parent rules.
+			ml.rules = nil
+			ml.inherited = nil
+		}
+		ml.inherit()
+
+		if mp.flags&filtruleFinishSetup != 0 {
+			mp.flags &^= filtruleFinishSetup
+			if err := s.setupMergeFile(mp); err != nil {
+				return err
+			}
+			st.dirbuf = dirbuf
+		}
+
+		if err := s.parseMergeFile(ml, path.Join(fsDir, mp.pattern), mp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exclude.c:pop_local_filters
+func (s *Scope) pop() {
+	pop := s.stack[len(s.stack)-1]
+	s.stack = s.stack[:len(s.stack)-1]
+	st := s.l.st
+	// Drop the merge parents which were added in this directory.
+	st.mergeParents = st.mergeParents[:pop.mergeParents]
+	for i, saved := range pop.lists {
+		ml := st.mergeParents[i].mergeList
+		ml.rules = saved.rules
+		ml.inherited = saved.inherited
+	}
+}
+
+// inherit turns all rules into inherited rules, so that rules which are read
+// next take precedence.
+func (l *List) inherit() {
+	l.inherited = l.all()
+	l.rules = nil
+}
+
+// parseMergeFile reads the per-directory merge file fsName (if it exists)
+// into ml.
+func (s *Scope) parseMergeFile(ml *List, fsName string, mp *rule) error {
+	f, err := s.open(fsName)
+	if err != nil {
+		return nil // per-directory merge files are optional
+	}
+	defer f.Close()
+	return ml.parseFilterReader(f, mp.flags, xflgAnchored2Abs)
+}
+
+// fsPath returns the path relative to the root of the walked file system
+// for the specified absolute path (without leading slash).
+func (s *Scope) fsPath(abs string) (string, bool) {
+	if s.absRoot == "" {
+		if abs == "" {
+			return ".", true
+		}
+		return abs, true
+	}
+	if abs == s.absRoot {
+		return ".", true
+	}
+	if rest, ok := strings.CutPrefix(abs, s.absRoot+"/"); ok {
+		return rest, true
+	}
+	return "", false
+}
+
+// setupMergeFile handles per-directory merge file names which contain a
+// slash (like "/.rsync-filter", as added by -F): the merge files of the
+// specified directory and all of its subdirectories leading up to the
+// current directory are read, too.
+//
+// exclude.c:setup_merge_file
+func (s *Scope) setupMergeFile(mp *rule) error {
+	if !strings.Contains(mp.pattern, "/") {
+		return nil
+	}
+	st := s.l.st
+	dir, base := path.Split(mp.pattern)
+	mp.pattern = base
+	var x string
+	if strings.HasPrefix(dir, "/") {
+		x = cleanAbs(dir)
+	} else {
+		x = cleanAbs(path.Join(st.dirbuf, dir))
+	}
+	// This ensures that the specified dir is a parent of the transfer.
+	dirbuf := st.dirbuf
+	if x != "" && x != dirbuf && !strings.HasPrefix(dirbuf, x+"/") {
+		return nil
+	}
+
+	ml := mp.mergeList
+	for d := x; d != dirbuf; {
+		st.dirbuf = d
+		// TODO: read the merge files of parent directories outside of the
+		// walked file system.
+		if fsDir, ok := s.fsPath(d); ok {
+			if err := s.parseMergeFile(ml, path.Join(fsDir, base), mp); err != nil {
+				return err
+			}
+		}
+		if mp.flags&filtruleNoInherit != 0 {
+			ml.rules = nil
+			ml.inherited = nil
+		}
+		ml.inherit()
+
+		rest := strings.TrimPrefix(strings.TrimPrefix(dirbuf, d), "/")
+		next, _, _ := strings.Cut(rest, "/")
+		if d == "" {
+			d = next
+		} else {
+			d = d + "/" + next
+		}
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package filter
+
+import (
+	"io"
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// walk returns the names of all files below root which are not excluded,
+// similar to how the sender builds its file list.
+func walk(t *testing.T, fsys fs.FS, l *List, absRoot, root string) []string {
+	t.Helper()
+	open := func(name string) (io.ReadCloser, error) { return fsys.Open(name) }
+	s := l.NewScope(open, absRoot, absRoot)
+	defer s.Close()
+	var files []string
+	err := fs.WalkDir(fsys, root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		s.Visit(path)
+		if path != root && l.Excluded(path, d.IsDir(), SenderSide) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return s.EnterDir(path)
+		}
+		files = append(files, path)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestDirMerge(t *testing.T) {
+	fsys := fstest.MapFS{
+		".rsync-filter":         {Data: []byte("- *.tmp\n- /top-only\n")},
+		"top-only":              {},
+		"x.tmp":                 {},
+		"a/.rsync-filter":       {Data: []byte("+ keep.tmp\n- /b\n")},
+		"a/top-only":            {},
+		"a/keep.tmp":            {},
+		"a/other.tmp":           {},
+		"a/b/f":                 {},
+		"a/c/keep.tmp":          {},
+		"b/f":                   {},
+		"c/keep.tmp":            {},
+		"n/.rsync-filter":       {Data: []byte(": .nofilter\n")},
+		"n/.nofilter":           {Data: []byte("- n1\n")},
+		"n/n1":                  {},
+		"n/n2":                  {},
+		"n/sub/n1":              {},
+		"n/sub/.nofilter":       {Data: []byte("- n2\n")},
+		"n/sub/n2":              {},
+		"n/sub/x.tmp":           {},
+		"inherit/.rsync-filter": {Data: []byte(":n .noinherit\n")},
+		"inherit/.noinherit":    {Data: []byte("- i1\n")},
+		"inherit/i1":            {},
+		"inherit/sub/i1":        {},
+	}
+
+	l, err := parseRules(": /.rsync-filter", "- .rsync-filter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := walk(t, fsys, l, "", ".")
+	want := []string{
+		"a/c/keep.tmp",
+		"a/keep.tmp",
+		"a/top-only",
+		"b/f",
+		"inherit/.noinherit",
+		"inherit/sub/i1",
+		"n/.nofilter",
+		"n/n2",
+		"n/sub/.nofilter",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("unexpected files:\ngot:  %q\nwant: %q", got, want)
+	}
+
+	// All per-directory rules are dropped when the walk is done.
+	if got := l.Check("x.tmp", false, SenderSide); got != 0 {
+		t.Errorf("Check(x.tmp) after walk = %d, want 0", got)
+	}
+}
+
+func TestDirMergeParents(t *testing.T) {
+	fsys := fstest.MapFS{
+		".rsync-filter":       {Data: []byte("- *.bak\n- /proj/anchored\n")},
+		"proj/.rsync-filter":  {Data: []byte("- *.tmp\n")},
+		"proj/x.bak":          {},
+		"proj/x.tmp":          {},
+		"proj/x.c":            {},
+		"proj/anchored":       {},
+		"proj/sub/anchored":   {},
+		"other/.rsync-filter": {Data: []byte("- *.c\n")},
+	}
+
+	l, err := parseRules("dir-merge /.rsync-filter", "- .rsync-filter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := walk(t, fsys, l, "home/user", "proj")
+	want := []string{
+		"proj/sub/anchored",
+		"proj/x.c",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("unexpected files:\ngot:  %q\nwant: %q", got, want)
+	}
+}
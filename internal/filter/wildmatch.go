@@ -0,0 +1,280 @@
+package filter
+
+import "strings"
+
+// Return values of dowild, see rsync/lib/wildmatch.c.
+const (
+	wmAbortToStarStar = -2
+	wmAbortAll        = -1
+	wmNoMatch         = 0
+	wmMatch           = 1
+)
+
+// byteAt returns s[i], or 0 (the C string terminator) if i is out of range.
+func byteAt(s string, i int) byte {
+	if i < len(s) {
+		return s[i]
+	}
+	return 0
+}
+
+// isClass reports whether ch belongs to the POSIX character class name (in
+// the C locale), and whether name is a known class at all.
+func isClass(name string, ch byte) (matched, known bool) {
+	isUpper := 'A' <= ch && ch <= 'Z'
+	isLower := 'a' <= ch && ch <= 'z'
+	isDigit := '0' <= ch && ch <= '9'
+	isAlpha := isUpper || isLower
+	isGraph := ch > ' ' && ch < 0x7f
+	switch name {
+	case "alnum":
+		return isAlpha || isDigit, true
+	case "alpha":
+		return isAlpha, true
+	case "blank":
+		return ch == ' ' || ch == '\t', true
+	case "cntrl":
+		return ch < ' ' || ch == 0x7f, true
+	case "digit":
+		return isDigit, true
+	case "graph":
+		return isGraph, true
+	case "lower":
+		return isLower, true
+	case "print":
+		return isGraph || ch == ' ', true
+	case "punct":
+		return isGraph && !isAlpha && !isDigit, true
+	case "space":
+		return ch == ' ' || ('\t' <= ch && ch <= '\r'), true
+	case "upper":
+		return isUpper, true
+	case "xdigit":
+		return isDigit || ('a' <= ch && ch <= 'f') || ('A' <= ch && ch <= 'F'), true
+	}
+	return false, false
+}
+
+// Match pattern p against text, where:
+//
+// '*' matches any sequence of characters except for a slash,
+// '**' matches any sequence of characters including slashes,
+// '?' matches any character except for a slash,
+// '[...]' matches a character class (negated with '!' or '^'),
+// '\' escapes the next character.
+//
+// rsync/lib/wildmatch.c:dowild
+func dowild(p, text string) int {
+	pi, ti := 0, 0
+	for ; pi < len(p); pi, ti = pi+1, ti+1 {
+		pCh := p[pi]
+		tCh := byteAt(text, ti)
+		if tCh == 0 && pCh != '*' {
+			return wmAbortAll
+		}
+		switch pCh {
+		case '\\':
+			// Literal match with following character. Note that the test
+			// below handles the end-of-pattern failure case.
+			pi++
+			if tCh != byteAt(p, pi) {
+				return wmNoMatch
+			}
+
+		default:
+			if tCh != pCh {
+				return wmNoMatch
+			}
+
+		case '?':
+			// Match anything but '/'.
+			if tCh == '/' {
+				return wmNoMatch
+			}
+
+		case '*':
+			pi++
+			special := false
+			if byteAt(p, pi) == '*' {
+				for byteAt(p, pi) == '*' {
+					pi++
+				}
+				special = true
+			}
+			if pi == len(p) {
+				// Trailing "**" matches everything. Trailing "*" matches
+				// only if there are no more slash characters.
+				if !special && strings.IndexByte(text[ti:], '/') > -1 {
+					return wmNoMatch
+				}
+				return wmMatch
+			}
+			for ; ti < len(text); ti++ {
+				matched := dowild(p[pi:], text[ti:])
+				if matched != wmNoMatch {
+					if !special || matched != wmAbortToStarStar {
+						return matched
+					}
+				} else if !special && text[ti] == '/' {
+					return wmAbortToStarStar
+				}
+			}
+			return wmAbortAll
+
+		case '[':
+			pi++
+			pCh = byteAt(p, pi)
+			if pCh == '^' {
+				pCh = '!'
+			}
+			// Inverted character class?
+			special := pCh == '!'
+			if special {
+				pi++
+				pCh = byteAt(p, pi)
+			}
+			var prevCh byte
+			matched := false
+			for first := true; ; first = false {
+				if !first {
+					prevCh = pCh
+					pi++
+					if pCh = byteAt(p, pi); pCh == ']' {
+						break
+					}
+				}
+				if pCh == 0 {
+					return wmAbortAll
+				}
+				if pCh == '\\' {
+					pi++
+					if pCh = byteAt(p, pi); pCh == 0 {
+						return wmAbortAll
+					}
+					if tCh == pCh {
+						matched = true
+					}
+				} else if pCh == '-' && prevCh != 0 && byteAt(p, pi+1) != 0 && byteAt(p, pi+1) != ']' {
+					pi++
+					pCh = p[pi]
+					if pCh == '\\' {
+						pi++
+						if pCh = byteAt(p, pi); pCh == 0 {
+							return wmAbortAll
+						}
+					}
+					if tCh <= pCh && tCh >= prevCh {
+						matched = true
+					}
+					pCh = 0 // This makes prevCh get set to 0.
+				} else if pCh == '[' && byteAt(p, pi+1) == ':' {
+					pi += 2
+					s := pi
+					for pi < len(p) && p[pi] != ']' {
+						pi++
+					}
+					if pi == len(p) {
+						return wmAbortAll
+					}
+					if pi-s-1 < 0 || p[pi-1] != ':' {
+						// Didn't find ":]", so treat like a normal set.
+						pi = s - 2
+						pCh = '['
+						if tCh == pCh {
+							matched = true
+						}
+						continue
+					}
+					inClass, known := isClass(p[s:pi-1], tCh)
+					if !known {
+						// malformed [:class:] string
+						return wmAbortAll
+					}
+					if inClass {
+						matched = true
+					}
+					pCh = 0 // This makes prevCh get set to 0.
+				} else if tCh == pCh {
+					matched = true
+				}
+			}
+			if matched == special || tCh == '/' {
+				return wmNoMatch
+			}
+		}
+	}
+
+	if ti < len(text) {
+		return wmNoMatch
+	}
+	return wmMatch
+}
+
+// Wildmatch reports whether pattern (see dowild) matches all of text.
+//
+// rsync/lib/wildmatch.c:wildmatch
+func Wildmatch(pattern, text string) bool {
+	return dowild(pattern, text) == wmMatch
+}
+
+// trailingNElements returns the suffix of text which consists of the last
+// count path elements.
+//
+// rsync/lib/wildmatch.c:trailing_N_elements
+func trailingNElements(text string, count int) (string, bool) {
+	for i := len(text) - 1; i >= 0; i-- {
+		if text[i] == '/' {
+			count--
+			if count == 0 {
+				return text[i+1:], true
+			}
+		}
+	}
+	if count == 1 {
+		return text, true
+	}
+	return "", false
+}
+
+// wildmatchArray matches pattern against text. If where is 0, the match must
+// start at the beginning of text. If where is -1, the match may start after
+// any slash. If where is N > 0, the match must cover the last N path
+// elements.
+//
+// rsync/lib/wildmatch.c:wildmatch_array
+func wildmatchArray(pattern, text string, where int) bool {
+	if where > 0 {
+		var ok bool
+		if text, ok = trailingNElements(text, where); !ok {
+			return false
+		}
+	}
+	matched := dowild(pattern, text)
+	if matched != wmMatch && where < 0 && matched != wmAbortAll {
+		for {
+			idx := strings.IndexByte(text, '/')
+			if idx == -1 {
+				return false
+			}
+			text = text[idx+1:]
+			matched = dowild(pattern, text)
+			if matched != wmNoMatch && matched != wmAbortToStarStar {
+				break
+			}
+		}
+	}
+	return matched == wmMatch
+}
+
+// litmatchArray is like wildmatchArray, but for patterns without wildcards.
+//
+// rsync/lib/wildmatch.c:litmatch_array
+func litmatchArray(pattern, text string, where int) bool {
+	if where > 0 {
+		var ok bool
+		if text, ok = trailingNElements(text, where); !ok {
+			return false
+		}
+	}
+	return pattern == text
+}
@@ -8,13 +8,17 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/gokrazy/rsync"
+	"github.com/gokrazy/rsync/internal/filter"
 	"github.com/gokrazy/rsync/internal/progress"
 	"github.com/gokrazy/rsync/internal/receiver"
 	"github.com/gokrazy/rsync/internal/restrict"
+	"github.com/gokrazy/rsync/internal/rsynccommon"
 	"github.com/gokrazy/rsync/internal/rsyncopts"
 	"github.com/gokrazy/rsync/internal/rsyncos"
 	"github.com/gokrazy/rsync/internal/rsyncstats"
@@ -78,6 +82,20 @@ func rsyncMain(ctx context.Context, osenv *rsyncos.Env, opts *rsyncopts.Options,
 	}
 
 	// TODO: if opts.AmSender(), verify extra source args have no hostspec
+
+	// rsync/options.c:parse_arguments
+	if ff := opts.FilesFrom(); ff != "" && ff != "-" {
+		if ffHost, ffPath, _, err := checkForHostspec(ff); err == nil {
+			if ffPath == "-" {
+				return nil, fmt.Errorf("Invalid --files-from remote filename")
+			}
+			if ffHost != "" && ffHost != host {
+				return nil, fmt.Errorf("--files-from hostname is not the same as the transfer hostname")
+			}
+			opts.SetRemoteFilesFrom(ffPath)
+		}
+	}
+
 	var roDirs, rwDirs []string
 	other := dest
 	if other != "" {
@@ -86,6 +104,19 @@ func rsyncMain(ctx context.Context, osenv *rsyncos.Env, opts *rsyncopts.Options,
 			if err := os.MkdirAll(other, 0755); err != nil {
 				return nil, err
 			}
+			// Verify --backup-dir and --partial-dir before the local
+			// server starts receiving: the server cannot report errors
+			// while the client is still sending.
+			if dir := opts.BackupDir(); dir != "" {
+				if _, err := receiver.DirWithinDest("--backup-dir", other, dir); err != nil {
+					return nil, err
+				}
+			}
+			if dir := opts.PartialDir(); dir != "" {
+				if _, err := receiver.DirWithinDest("--partial-dir", other, dir); err != nil {
+					return nil, err
+				}
+			}
 		}
 	}
 	paths := []string{other}
@@ -93,7 +124,7 @@ func rsyncMain(ctx context.Context, osenv *rsyncos.Env, opts *rsyncopts.Options,
 		// source is local
 		// other = src
 		paths = sources
-		roDirs = sources
+		roDirs = sourceRules(opts, sources)
 		if opts.LocalServer() {
 			// source and dest are both local
 			rwDirs = []string{dest}
@@ -103,6 +134,21 @@ func rsyncMain(ctx context.Context, osenv *rsyncos.Env, opts *rsyncopts.Options,
 			rwDirs = paths
 		}
 	}
+	if other != "" && (!opts.Sender() || opts.LocalServer()) {
+		roDirs, rwDirs = basisDirRules(opts, dest, roDirs, rwDirs)
+	}
+
+	// Files specified on the command line are read after the file system
+	// access was restricted.
+	roDirs = slices.Clip(roDirs)
+	if ff := opts.FilesFrom(); ff != "" && ff != "-" && !opts.FilesFromRemote() {
+		roDirs = append(roDirs, ff)
+	}
+	for _, fr := range opts.FilterRules() {
+		if fr.File && fr.Rule != "-" {
+			roDirs = append(roDirs, fr.Rule)
+		}
+	}
 
 	if daemonConnection < 0 {
 		stats, err := socketClient(ctx, osenv, opts, host, path, port, paths, roDirs, rwDirs)
@@ -118,16 +164,14 @@ func rsyncMain(ctx context.Context, osenv *rsyncos.Env, opts *rsyncopts.Options,
 		user = machine[:idx]
 		machine = machine[idx+1:]
 	}
-	rc, wc, err := doCmd(osenv, opts, machine, user, path, daemonConnection)
+	rc, wc, err := doCmd(ctx, osenv, opts, machine, user, path, daemonConnection)
 	if err != nil {
 		return nil, err
 	}
 	defer rc.Close()
 	defer wc.Close()
-	conn := &readWriter{
-		r: rc,
-		w: wc,
-	}
+	conn := rsynccommon.NewWatchdog(ctx, rc, wc, ioTimeout(opts))
+	defer conn.Stop()
 
 	if osenv.Restrict() {
 		if err := restrict.MaybeFileSystem(roDirs, rwDirs); err != nil {
@@ -139,7 +183,7 @@ func rsyncMain(ctx context.Context, osenv *rsyncos.Env, opts *rsyncopts.Options,
 	if daemonConnection != 0 {
 		done, err := StartInbandExchange(osenv, opts, conn, path)
 		if err != nil {
-			return nil, err
+			return nil, conn.Err(err)
 		}
 		if done {
 			return nil, nil
@@ -148,13 +192,39 @@ func rsyncMain(ctx context.Context, osenv *rsyncos.Env, opts *rsyncopts.Options,
 	}
 	stats, err := ClientRun(osenv, opts, conn, paths, negotiate)
 	if err != nil {
-		return nil, err
+		return nil, conn.Err(err)
 	}
 	return stats, nil
 }
 
+// ioTimeout returns the I/O timeout (--timeout) for a Watchdog.
+func ioTimeout(opts *rsyncopts.Options) time.Duration {
+	return time.Duration(opts.IOTimeoutSeconds()) * time.Second
+}
+
+// sourceRules returns the landlock rules for reading the sources: with
+// --copy-links and --copy-unsafe-links, the sender follows symlinks to
+// referents anywhere in the file system.
+func sourceRules(opts *rsyncopts.Options, sources []string) []string {
+	if opts.CopyLinks() || opts.CopyUnsafeLinks() {
+		return []string{"/"}
+	}
+	return sources
+}
+
+// basisDirRules adds the alternate basis directories for the destination
+// dest to the landlock rules: --link-dest needs to create hard links of files
+// in the basis directories, which landlock only allows within rwDirs.
+func basisDirRules(opts *rsyncopts.Options, dest string, roDirs, rwDirs []string) ([]string, []string) {
+	paths := receiver.BasisDirPaths(dest, opts.BasisDirs())
+	if opts.AltDestType() == rsyncopts.LINK_DEST {
+		return roDirs, append(slices.Clip(rwDirs), paths...)
+	}
+	return append(slices.Clip(roDirs), paths...), rwDirs
+}
+
 // rsync/main.c:do_cmd
-func doCmd(osenv *rsyncos.Env, opts *rsyncopts.Options, machine, user, path string, daemonConnection int) (io.ReadCloser, io.WriteCloser, error) {
+func doCmd(ctx context.Context, osenv *rsyncos.Env, opts *rsyncopts.Options, machine, user, path string, daemonConnection int) (io.ReadCloser, io.WriteCloser, error) {
 	if opts.Verbose() {
 		osenv.Logf("doCmd(machine=%q, user=%q, path=%q, daemonConnection=%d)",
 			machine, user, path, daemonConnection)
@@ -220,7 +290,7 @@ func doCmd(osenv *rsyncos.Env, opts *rsyncopts.Options, machine, user, path stri
 				// (including the other end of the connection) are affected.
 				DontRestrict: true,
 			}
-			_, err := Main(context.Background(), osenv, args, nil)
+			_, err := Main(ctx, osenv, args, nil)
 			if err != nil {
 				osenv.Logf("Main(): %v", err)
 			}
@@ -233,14 +303,20 @@ func doCmd(osenv *rsyncos.Env, opts *rsyncopts.Options, machine, user, path stri
 	if err != nil {
 		return nil, nil, err
 	}
-	rc, err := ssh.StdoutPipe()
+	// Not using ssh.StdoutPipe(): Wait closes that pipe once the process
+	// exits, which can happen before we read the final goodbye.
+	rc, stdoutwr, err := os.Pipe()
 	if err != nil {
 		return nil, nil, err
 	}
+	ssh.Stdout = stdoutwr
 	ssh.Stderr = osenv.Stderr
 	if err := ssh.Start(); err != nil {
+		rc.Close()
+		stdoutwr.Close()
 		return nil, nil, err
 	}
+	stdoutwr.Close()
 
 	go func() {
 		// TODO: correctly terminate the main process when the underlying SSH
@@ -253,17 +329,25 @@ func doCmd(osenv *rsyncos.Env, opts *rsyncopts.Options, machine, user, path stri
 	return rc, wc, nil
 }
 
+// ClientRun transfers the files on conn, which the caller aborts once its
+// context is done.
+//
 // rsync/main.c:client_run
-func ClientRun(osenv *rsyncos.Env, opts *rsyncopts.Options, conn io.ReadWriter, paths []string, negotiate bool) (*rsyncstats.TransferStats, error) {
+func ClientRun(osenv *rsyncos.Env, opts *rsyncopts.Options, conn *rsynccommon.Watchdog, paths []string, negotiate bool) (*rsyncstats.TransferStats, error) {
+	var wr io.Writer = conn
+	if bwlimit := opts.BwLimit(); bwlimit > 0 {
+		wr = rsyncwire.NewBwLimitWriter(conn, bwlimit)
+	}
 	crd := &rsyncwire.CountingReader{R: conn}
-	cwr := &rsyncwire.CountingWriter{W: conn}
+	cwr := &rsyncwire.CountingWriter{W: wr}
 	c := &rsyncwire.Conn{
 		Reader: crd,
 		Writer: cwr,
 	}
 
+	protocol := opts.ProtocolVersion()
 	if negotiate {
-		if err := c.WriteInt32(rsync.ProtocolVersion); err != nil {
+		if err := c.WriteInt32(protocol); err != nil {
 			return nil, err
 		}
 		remoteProtocol, err := c.ReadInt32()
@@ -273,6 +357,32 @@ func ClientRun(osenv *rsyncos.Env, opts *rsyncopts.Options, conn io.ReadWriter,
 		if opts.Verbose() {
 			osenv.Logf("remote protocol: %d", remoteProtocol)
 		}
+		protocol = min(protocol, remoteProtocol)
+		if protocol < rsync.MinProtocolVersion {
+			return nil, fmt.Errorf("protocol version mismatch: remote protocol %d too old", remoteProtocol)
+		}
+	}
+
+	// rsync/compat.c:setup_protocol
+	opts.SetDeleteTiming(protocol)
+	if err := opts.CheckProtocol(protocol); err != nil {
+		return nil, err
+	}
+	var compatFlags int32
+	if protocol >= 30 {
+		var err error
+		compatFlags, err = c.ReadVarint()
+		if err != nil {
+			return nil, fmt.Errorf("reading compat flags: %v", err)
+		}
+	}
+
+	checksums, err := rsynccommon.NegotiateChecksums(c, opts, protocol, compatFlags)
+	if err != nil {
+		return nil, err
+	}
+	if opts.DebugGTE(rsyncopts.DEBUG_NSTR, 1) {
+		osenv.Logf("Client checksum: %s", checksums.Xfer)
 	}
 
 	seed, err := c.ReadInt32()
@@ -280,6 +390,10 @@ func ClientRun(osenv *rsyncos.Env, opts *rsyncopts.Options, conn io.ReadWriter,
 		return nil, fmt.Errorf("reading seed: %v", err)
 	}
 
+	// Protocols < 31 forward the --files-from list without multiplexing.
+	var filesFromReader io.Reader = crd
+	var filesFromWriter io.Writer = cwr
+
 	mrd := &rsyncwire.MultiplexReader{
 		Env:    osenv,
 		Reader: conn,
@@ -295,19 +409,89 @@ func ClientRun(osenv *rsyncos.Env, opts *rsyncopts.Options, conn io.ReadWriter,
 	}
 	c.Reader = crd
 
+	if protocol >= 30 {
+		// Starting with protocol 30, the client multiplexes, too
+		// (need_messages_from_generator).
+		cwr = &rsyncwire.CountingWriter{
+			W:            &rsyncwire.MultiplexWriter{Writer: wr},
+			BytesWritten: cwr.BytesWritten,
+		}
+		c.Writer = cwr
+	}
+	if protocol >= 31 {
+		filesFromReader, filesFromWriter = c.Reader, c.Writer
+	}
+
+	filterList, err := filter.FromOptions(opts, osenv.Stdin, protocol)
+	if err != nil {
+		return nil, err
+	}
+
+	// A local --files-from list is read by the sender (us) or forwarded to
+	// the remote sender. A remote list is read by the remote side.
+	var filesFrom io.Reader
+	if ff := opts.FilesFrom(); ff != "" && !opts.FilesFromRemote() {
+		if ff == "-" {
+			filesFrom = osenv.Stdin
+		} else {
+			f, err := os.Open(ff)
+			if err != nil {
+				return nil, fmt.Errorf("failed to open files-from file %s: %v", ff, err)
+			}
+			defer f.Close()
+			filesFrom = f
+		}
+	}
+
 	if opts.Sender() {
 		st := &sender.Transfer{
-			Logger:   osenv.Logger(),
-			Opts:     opts,
-			Conn:     c,
-			Seed:     seed,
-			Env:      osenv,
-			Progress: progress.NewPrinter(osenv.Stdout, time.Now),
+			Logger:      osenv.Logger(),
+			Opts:        opts,
+			Conn:        c,
+			Seed:        seed,
+			Protocol:    protocol,
+			CompatFlags: compatFlags,
+			Checksums:   checksums,
+			Env:         osenv,
+			Progress:    progress.NewPrinter(osenv.Stdout, time.Now),
+			Items: rsynccommon.NewItemLog(opts, osenv.Stdout, func() int64 {
+				return cwr.BytesWritten
+			}),
 		}
 		if opts.Verbose() {
 			osenv.Logf("sender(paths=%q)", paths)
 		}
 
+		// The receiver uses the filter rules to protect files from
+		// deletion.
+		if opts.ReceiverWantsFilterList(protocol) {
+			if err := filterList.Send(c, true /* amSender */); err != nil {
+				return nil, err
+			}
+		}
+
+		var ioErrors atomic.Int32
+		mrd.IOError = func(flags int32) { ioErrors.Or(flags) }
+		mrd.Deleted = func(name string, isDir bool) {
+			mode := int32(rsync.S_IFREG)
+			if isDir {
+				mode = rsync.S_IFDIR
+			}
+			st.Items.LogDelete(name, mode)
+		}
+
+		if opts.FilesFrom() != "" {
+			r := filesFrom
+			if opts.FilesFromRemote() {
+				// the remote side forwards the list over the connection
+				r = filesFromReader
+			}
+			st.FilesFrom, err = sender.ReadFilesFrom(r, opts.EOLNulls(), opts.FilesFromRemote())
+			if err != nil {
+				return nil, err
+			}
+		}
+
 		// Turn relative paths like ./gcexportdata or bin/gcexportdata
 		// into absolute paths so that we can call Transfer.Do()
 		// with modPath="/" below.
@@ -325,10 +509,15 @@ func ClientRun(osenv *rsyncos.Env, opts *rsyncopts.Options, conn io.ReadWriter,
 			}
 		}
 
-		stats, err := st.Do(crd, cwr, FileSystemRoot, paths, nil)
+		stats, err := st.Do(crd, cwr, FileSystemRoot, paths, filterList)
 		if err != nil {
 			return nil, err
 		}
+		// The receiver reported its flags, and the sender’s own flags
+		// were sent to the receiver.
+		if err := rsynccommon.ExitError(ioErrors.Load() | st.IOErrors()); err != nil {
+			return nil, err
+		}
 		return stats, nil
 	}
 
@@ -338,12 +527,37 @@ func ClientRun(osenv *rsyncos.Env, opts *rsyncopts.Options, conn io.ReadWriter,
 
 	rt := &receiver.Transfer{
 		Logger: osenv.Logger(),
+		Abort:  conn.Abort,
 		Opts: &receiver.TransferOpts{
 			Verbose:  opts.Verbose(),
 			DryRun:   opts.DryRun(),
 			Progress: opts.Progress(),
 
-			DeleteMode:        opts.DeleteMode(),
+			Recurse: opts.Recurse(),
+
+			DeleteMode:   opts.DeleteMode(),
+			DeleteBefore: opts.DeleteBefore(),
+			DeleteDuring: opts.DeleteDuring() == 1,
+			DeleteDelay:  opts.DeleteDuring() == 2,
+			DeleteAfter:  opts.DeleteAfter(),
+			IgnoreErrors: opts.IgnoreErrors(),
+			MaxDelete:    opts.MaxDelete(),
+
+			MakeBackups:  opts.MakeBackups(),
+			BackupDir:    opts.BackupDir(),
+			BackupSuffix: opts.BackupSuffix(),
+			KeepPartial:  opts.KeepPartial(),
+			PartialDir:   opts.PartialDir(),
+			Inplace:      opts.Inplace(),
+			AppendMode:   opts.AppendMode(),
+			Sparse:       opts.SparseFiles(),
+			Preallocate:  opts.PreallocateFiles(),
+			BasisDirs:    opts.BasisDirs(),
+			AltDestType:  opts.AltDestType(),
+			FuzzyBasis:   opts.FuzzyBasis(),
+			WholeFile:    opts.WholeFile(),
+			BlockSize:    opts.BlockSize(),
+
 			PreserveGid:       opts.PreserveGid(),
 			PreserveUid:       opts.PreserveUid(),
 			PreserveLinks:     opts.PreserveLinks(),
@@ -354,16 +568,34 @@ func ClientRun(osenv *rsyncos.Env, opts *rsyncopts.Options, conn io.ReadWriter,
 			PreserveHardlinks: opts.PreserveHardLinks(),
 			IgnoreTimes:       opts.IgnoreTimes(),
 			AlwaysChecksum:    opts.AlwaysChecksum(),
+			Compress:          opts.Compress(),
+
+			PreserveACLs:   opts.PreserveACLs(),
+			PreserveXattrs: opts.PreserveXattrs(),
+			ChmodModes:     opts.ChmodModes(),
+			SafeLinks:      opts.SafeLinks(),
+			MungeLinks:     opts.MungeLinks(),
+			NumericIds:     opts.NumericIds(),
+			UserMap:        opts.UserMap(),
+			GroupMap:       opts.GroupMap(),
 
 			InfoGTE:  opts.InfoGTE,
 			DebugGTE: opts.DebugGTE,
 		},
-		Dest:     paths[0],
-		Env:      osenv,
-		Conn:     c,
-		Seed:     seed,
-		Progress: progress.NewPrinter(osenv.Stdout, time.Now),
-	}
+		Dest:        paths[0],
+		Env:         osenv,
+		FilterList:  filterList,
+		Conn:        c,
+		Seed:        seed,
+		Protocol:    protocol,
+		CompatFlags: compatFlags,
+		Checksums:   checksums,
+		Progress:    progress.NewPrinter(osenv.Stdout, time.Now),
+		Items: rsynccommon.NewItemLog(opts, osenv.Stdout, func() int64 {
+			return crd.BytesRead
+		}),
+	}
+	mrd.IOError = func(flags int32) { rt.IOErrors.Or(flags) }
 	if opts.Verbose() {
 		osenv.Logf("receiving to dest=%s", rt.Dest)
 	}
@@ -378,19 +610,25 @@ func ClientRun(osenv *rsyncos.Env, opts *rsyncopts.Options, conn io.ReadWriter,
 			return nil, fmt.Errorf("OpenRoot(dest=%s): %v", rt.Dest, err)
 		}
 		defer rt.DestRoot.Close()
+		if err := rt.ResolveDirs(); err != nil {
+			return nil, err
+		}
+		if err := rt.ParseIdMaps(); err != nil {
+			return nil, err
+		}
+		if err := rt.OpenBasisDirs(nil, ""); err != nil {
+			return nil, err
+		}
+		defer rt.CloseBasisDirs()
 		if osenv.Restrict() {
-			if err := restrict.MaybeFileSystem(nil, []string{rt.Dest}); err != nil {
+			roDirs, rwDirs := basisDirRules(opts, rt.Dest, nil, []string{rt.Dest})
+			if err := restrict.MaybeFileSystem(roDirs, rwDirs); err != nil {
 				return nil, fmt.Errorf("landlock: %v", err)
 			}
 		}
 	}
 
-	for _, rule := range opts.FilterRules() {
-		c.WriteInt32(int32(len(rule)))
-		c.WriteString(rule)
-	}
-	const exclusionListEnd = 0
-	if err := c.WriteInt32(exclusionListEnd); err != nil {
+	if err := filterList.Send(c, false /* amSender */); err != nil {
 		return nil, err
 	}
 
@@ -398,6 +636,12 @@ func ClientRun(osenv *rsyncos.Env, opts *rsyncopts.Options, conn io.ReadWriter,
 		osenv.Logf("exclusion list sent")
 	}
 
+	if filesFrom != nil {
+		if err := receiver.ForwardFilesFrom(filesFromWriter, filesFrom, opts.EOLNulls()); err != nil {
+			return nil, err
+		}
+	}
+
 	// receive file list
 	if opts.DebugGTE(rsyncopts.DEBUG_FLIST, 1) {
 		osenv.Logf("receiving file list")
@@ -410,7 +654,14 @@ func ClientRun(osenv *rsyncos.Env, opts *rsyncopts.Options, conn io.ReadWriter,
 		osenv.Logf("received %d names", len(fileList))
 	}
 
-	return rt.Do(c, fileList, false)
+	stats, err := rt.Do(c, fileList, false)
+	if err != nil {
+		return nil, err
+	}
+	if err := rt.ExitError(); err != nil {
+		return nil, err
+	}
+	return stats, nil
 }
 
 func clientMain(ctx context.Context, osenv *rsyncos.Env, opts *rsyncopts.Options, remaining []string) (*rsyncstats.TransferStats, error) {
@@ -426,6 +677,9 @@ func clientMain(ctx context.Context, osenv *rsyncos.Env, opts *rsyncopts.Options
 		sources := remaining
 		return rsyncMain(ctx, osenv, opts, sources, dest)
 	}
+	if opts.FilesFrom() != "" && len(remaining) > 2 {
+		return nil, fmt.Errorf("rsync error: syntax or usage error (--files-from requires exactly one source)")
+	}
 	dest := remaining[len(remaining)-1]
 	sources := remaining[:len(remaining)-1]
 	return rsyncMain(ctx, osenv, opts, sources, dest)
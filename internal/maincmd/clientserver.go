@@ -3,6 +3,7 @@ package maincmd
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -12,6 +13,7 @@ import (
 
 	"github.com/gokrazy/rsync"
 	"github.com/gokrazy/rsync/internal/restrict"
+	"github.com/gokrazy/rsync/internal/rsynccommon"
 	"github.com/gokrazy/rsync/internal/rsyncopts"
 	"github.com/gokrazy/rsync/internal/rsyncos"
 	"github.com/gokrazy/rsync/internal/rsyncstats"
@@ -44,6 +46,12 @@ func socketClient(ctx context.Context, osenv *rsyncos.Env, opts *rsyncopts.Optio
 	osenv.Logf("Opening TCP connection to %s%s", host, timeoutStr)
 	conn, err := dialer.DialContext(ctx, "tcp", host)
 	if err != nil {
+		if ctx.Err() == nil && errors.Is(err, context.DeadlineExceeded) {
+			return nil, &rsync.ExitError{
+				Code: rsync.RERR_CONTIMEOUT,
+				Err:  err,
+			}
+		}
 		return nil, err
 	}
 	defer conn.Close()
@@ -52,16 +60,18 @@ func socketClient(ctx context.Context, osenv *rsyncos.Env, opts *rsyncopts.Optio
 			return nil, err
 		}
 	}
-	done, err := StartInbandExchange(osenv, opts, conn, remotePath)
+	wd := rsynccommon.NewWatchdog(ctx, conn, conn, ioTimeout(opts))
+	defer wd.Stop()
+	done, err := StartInbandExchange(osenv, opts, wd, remotePath)
 	if err != nil {
-		return nil, err
+		return nil, wd.Err(err)
 	}
 	if done {
 		return nil, nil
 	}
-	stats, err := ClientRun(osenv, opts, conn, paths, false)
+	stats, err := ClientRun(osenv, opts, wd, paths, false)
 	if err != nil {
-		return nil, err
+		return nil, wd.Err(err)
 	}
 	return stats, nil
 }
@@ -77,7 +87,7 @@ func StartInbandExchange(osenv *rsyncos.Env, opts *rsyncopts.Options, conn io.Re
 	rd := bufio.NewReader(conn)
 
 	// send client greeting
-	fmt.Fprintf(conn, "@RSYNCD: %d\n", rsync.ProtocolVersion)
+	fmt.Fprintf(conn, "@RSYNCD: %d.0\n", opts.ProtocolVersion())
 
 	// read server greeting
 	serverGreeting, err := rd.ReadString('\n')
@@ -92,18 +102,21 @@ func StartInbandExchange(osenv *rsyncos.Env, opts *rsyncopts.Options, conn io.Re
 	// protocol negotiation: require at least version 27
 	serverGreeting = strings.TrimPrefix(serverGreeting, serverGreetingPrefix)
 	var remoteProtocol, remoteSub int32
-	if _, err := fmt.Sscanf(serverGreeting, "%d.%d", &remoteProtocol, &remoteSub); err != nil {
-		if _, err := fmt.Sscanf(serverGreeting, "%d", &remoteProtocol); err != nil {
-			return false, fmt.Errorf("reading server greeting: %v", err)
-		}
+	n, _ := fmt.Sscanf(serverGreeting, "%d.%d", &remoteProtocol, &remoteSub)
+	if n < 1 {
+		return false, fmt.Errorf("server sent %q rather than greeting", serverGreeting)
+	}
+	if n < 2 && remoteProtocol >= 30 {
+		return false, fmt.Errorf("the server omitted the subprotocol value: %q", serverGreeting)
 	}
-	if remoteProtocol < 27 {
+	protocol := rsynccommon.NegotiateProtocol(opts.ProtocolVersion(), remoteProtocol, remoteSub)
+	if protocol < rsync.MinProtocolVersion {
 		return false, fmt.Errorf("server version %d too old", remoteProtocol)
 	}
+	opts.SetProtocolVersion(protocol)
 
 	if opts.Verbose() {
-		osenv.Logf("(Client) Protocol versions: remote=%d, negotiated=%d", remoteProtocol, rsync.ProtocolVersion)
-		osenv.Logf("Client checksum: md4")
+		osenv.Logf("(Client) Protocol versions: remote=%d, negotiated=%d", remoteProtocol, protocol)
 	}
 
 	// send module name
@@ -29,14 +29,23 @@ func version(osenv *rsyncos.Env) {
 	osenv.Logf("gokrazy rsync, pid %d", os.Getpid())
 }
 
-type readWriter struct {
-	r io.Reader
-	w io.Writer
+// daemonBwLimit returns the bandwidth limit in KiB/s which the daemon enforces
+// for all connections: the lower of the bwlimit configuration setting and the
+// --bwlimit daemon flag, or 0 for no limit.
+func daemonBwLimit(opts *rsyncopts.Options, cfg *rsyncdconfig.Config) (int, error) {
+	bwlimit := opts.DaemonBwLimit()
+	if cfg.BwLimit != "" {
+		limit, err := rsyncopts.ParseBwLimit(cfg.BwLimit)
+		if err != nil {
+			return 0, fmt.Errorf("config: %v", err)
+		}
+		if limit > 0 && (bwlimit == 0 || bwlimit > limit) {
+			bwlimit = limit
+		}
+	}
+	return bwlimit, nil
 }
 
-func (r *readWriter) Read(p []byte) (n int, err error)  { return r.r.Read(p) }
-func (r *readWriter) Write(p []byte) (n int, err error) { return r.w.Write(p) }
-
 func Main(ctx context.Context, osenv *rsyncos.Env, args []string, cfg *rsyncdconfig.Config) (*rsyncstats.TransferStats, error) {
 	osenv.Logf("Main(osenv=%v, args=%q)", osenv, args)
 	pc := rsyncopts.NewContext(rsyncopts.NewOptionsWithGokrazyDefaults(osenv))
@@ -63,8 +72,13 @@ func Main(ctx context.Context, osenv *rsyncos.Env, args []string, cfg *rsyncdcon
 				return nil, err
 			}
 		}
+		bwlimit, err := daemonBwLimit(opts, cfg)
+		if err != nil {
+			return nil, err
+		}
 		rsyncdOpts := []rsyncd.Option{
 			rsyncd.WithStderr(osenv.Stderr),
+			rsyncd.WithBwLimit(bwlimit),
 		}
 		if osenv.DontRestrict {
 			rsyncdOpts = append(rsyncdOpts, rsyncd.DontRestrict())
@@ -99,7 +113,7 @@ func Main(ctx context.Context, osenv *rsyncos.Env, args []string, cfg *rsyncdcon
 		}
 		var roDirs, rwDirs []string
 		if opts.Sender() {
-			roDirs = append(roDirs, paths...)
+			roDirs = sourceRules(opts, paths)
 		} else {
 			for _, path := range paths {
 				if err := os.MkdirAll(path, 0755); err != nil {
@@ -107,6 +121,9 @@ func Main(ctx context.Context, osenv *rsyncos.Env, args []string, cfg *rsyncdcon
 				}
 			}
 			rwDirs = append(rwDirs, paths...)
+			for _, path := range paths {
+				roDirs, rwDirs = basisDirRules(opts, path, roDirs, rwDirs)
+			}
 		}
 		if osenv.Restrict() {
 			if err := restrict.MaybeFileSystem(roDirs, rwDirs); err != nil {
@@ -253,7 +270,11 @@ func Main(ctx context.Context, osenv *rsyncos.Env, args []string, cfg *rsyncdcon
 		}()
 	}
 
-	srv, err := rsyncd.NewServer(cfg.Modules, rsyncd.WithStderr(osenv.Stderr))
+	bwlimit, err := daemonBwLimit(opts, cfg)
+	if err != nil {
+		return nil, err
+	}
+	srv, err := rsyncd.NewServer(cfg.Modules, rsyncd.WithStderr(osenv.Stderr), rsyncd.WithBwLimit(bwlimit))
 	if err != nil {
 		return nil, err
 	}
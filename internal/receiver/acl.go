@@ -0,0 +1,251 @@
+package receiver
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+
+	"github.com/gokrazy/rsync"
+	"github.com/gokrazy/rsync/internal/rsynccommon"
+	"github.com/gokrazy/rsync/internal/xattr"
+)
+
+// receiveACLs receives the access ACL and (for directories) the default ACL
+// of the file list entry f.
+//
+// rsync/acls.c:receive_acl
+func (rt *Transfer) receiveACLs(f *File) error {
+	var err error
+	f.acl, err = rt.receiveACL(&rt.accessACLs, "access")
+	if err != nil {
+		return err
+	}
+	if f.Mode&rsync.S_IFMT == rsync.S_IFDIR {
+		f.defACL, err = rt.receiveACL(&rt.defaultACLs, "default")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// receiveACL receives an ACL: either an index into the ACLs (of the same type)
+// received so far, or an ACL which is appended to them.
+//
+// rsync/acls.c:recv_rsync_acl
+func (rt *Transfer) receiveACL(list *[]*rsynccommon.ACL, typ string) (*rsynccommon.ACL, error) {
+	ndx, err := rt.Conn.ReadVarint()
+	if err != nil {
+		return nil, err
+	}
+	if ndx < 0 || int(ndx) > len(*list) {
+		return nil, fmt.Errorf("recv_acl_index: %s ACL index %d > %d", typ, ndx, len(*list))
+	}
+	if ndx != 0 {
+		return (*list)[ndx-1], nil
+	}
+
+	flags, err := rt.Conn.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	acl := rsynccommon.EmptyACL()
+	for _, obj := range []struct {
+		flag byte
+		ptr  *uint8
+	}{
+		{rsync.XMIT_USER_OBJ, &acl.UserObj},
+		{rsync.XMIT_GROUP_OBJ, &acl.GroupObj},
+		{rsync.XMIT_MASK_OBJ, &acl.MaskObj},
+		{rsync.XMIT_OTHER_OBJ, &acl.OtherObj},
+	} {
+		if flags&obj.flag == 0 {
+			continue
+		}
+		access, err := rt.Conn.ReadVarint()
+		if err != nil {
+			return nil, err
+		}
+		if access&^7 != 0 {
+			return nil, fmt.Errorf("recv_acl_access: value out of range: %x", access)
+		}
+		*obj.ptr = uint8(access)
+	}
+	var computedMask uint8
+	if flags&rsync.XMIT_NAME_LIST != 0 {
+		acl.Names, computedMask, err = rt.receiveACLNames()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(acl.Names) == 0 {
+		// If we received a superfluous mask, throw it away.
+		if acl.MaskObj != rsynccommon.NoACLEntry {
+			// mask off group perms with it first
+			acl.GroupObj &= acl.MaskObj | rsynccommon.NoACLEntry
+			acl.MaskObj = rsynccommon.NoACLEntry
+		}
+	} else if acl.MaskObj == rsynccommon.NoACLEntry {
+		// The mask must be present with named entries. Its value is taken
+		// from the group permission bits when applying the ACL.
+		acl.MaskObj = (computedMask | acl.GroupObj) &^ rsynccommon.NoACLEntry
+	}
+	*list = append(*list, acl)
+	return acl, nil
+}
+
+// receiveACLNames receives the named entries of an ACL, and returns them
+// along with the union of their permissions.
+//
+// rsync/acls.c:recv_ida_entries
+func (rt *Transfer) receiveACLNames() ([]rsynccommon.ACLName, uint8, error) {
+	count, err := rt.Conn.ReadVarint()
+	if err != nil {
+		return nil, 0, err
+	}
+	if count < 0 {
+		return nil, 0, fmt.Errorf("recv_ida_entries: invalid count %d", count)
+	}
+	var computedMask uint8
+	names := make([]rsynccommon.ACLName, 0, count)
+	for range count {
+		id, err := rt.Conn.ReadVarint()
+		if err != nil {
+			return nil, 0, err
+		}
+		xbits, err := rt.Conn.ReadVarint()
+		if err != nil {
+			return nil, 0, err
+		}
+		// The permissions are shifted to make room for the flags.
+		access := uint32(xbits) >> 2
+		if access&^7 != 0 {
+			return nil, 0, fmt.Errorf("recv_acl_access: value out of range: %x", access)
+		}
+		n := rsynccommon.ACLName{
+			ID:     uint32(id),
+			Access: uint8(access),
+			IsUser: xbits&rsync.XFLAG_NAME_IS_USER != 0,
+		}
+		if xbits&rsync.XFLAG_NAME_FOLLOWS != 0 {
+			var localId int32
+			if n.IsUser {
+				localId, err = rt.recvUserName(id)
+			} else {
+				localId, err = rt.recvGroupName(id)
+			}
+			if err != nil {
+				return nil, 0, err
+			}
+			n.ID = uint32(localId)
+		} else if rt.incRecurse() {
+			// Without incremental recursion, the ids are converted after
+			// receiving the id lists (see RecvIdList).
+			if n.IsUser {
+				n.ID = uint32(rt.matchUid(id))
+			} else {
+				n.ID = uint32(rt.matchGid(id))
+			}
+		}
+		names = append(names, n)
+		computedMask |= n.Access
+	}
+	return names, computedMask, nil
+}
+
+// localACLs returns the access ACL and (for directories) the default ACL of
+// the file name in root with mode.
+//
+// rsync/acls.c:get_acl
+func localACLs(root *os.Root, name string, mode fs.FileMode) (access, def *rsynccommon.ACL, _ error) {
+	x := xattr.InRoot(root, name)
+	get := func(attr string, none *rsynccommon.ACL) (*rsynccommon.ACL, error) {
+		value, err := x.Get(attr)
+		if errors.Is(err, xattr.ErrNoAttr) || errors.Is(err, errors.ErrUnsupported) {
+			return none, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		acl, err := rsynccommon.ParsePosixACL(value)
+		if err != nil {
+			return nil, fmt.Errorf("get_acl: %s: %v", name, err)
+		}
+		return acl, nil
+	}
+	// Without an ACL, the permission bits are the ACL.
+	access, err := get(rsynccommon.ACLAccessXattr, rsynccommon.FakeACL(uint32(mode.Perm())))
+	if err != nil {
+		return nil, nil, err
+	}
+	if !mode.IsDir() {
+		return access, nil, nil
+	}
+	def, err = get(rsynccommon.ACLDefaultXattr, rsynccommon.EmptyACL())
+	if err != nil {
+		return nil, nil, err
+	}
+	return access, def, nil
+}
+
+// aclsDiffer reports whether the ACLs of f, whose permission bits become
+// mode, differ from the local ACLs.
+//
+// rsync/acls.c:set_acl
+func aclsDiffer(f *File, access, def *rsynccommon.ACL, mode fs.FileMode) (accessDiffers, defDiffers bool) {
+	accessDiffers = !access.EqualEnough(f.acl, uint32(mode.Perm()))
+	defDiffers = f.defACL != nil && (def == nil || !def.Equal(f.defACL))
+	return accessDiffers, defDiffers
+}
+
+// aclsChanged reports whether the ACLs of f differ from the existing file st
+// (name f.Name in root).
+func (rt *Transfer) aclsChanged(root *os.Root, f *File, st fs.FileInfo) bool {
+	if !rt.Opts.PreserveACLs || f.acl == nil {
+		return false
+	}
+	access, def, err := localACLs(root, f.Name, st.Mode())
+	if err != nil {
+		rt.Logger.Printf("%v", err)
+		return true
+	}
+	accessDiffers, defDiffers := aclsDiffer(f, access, def, fs.FileMode(f.Mode))
+	return accessDiffers || defDiffers
+}
+
+// setACLs sets the ACLs of f on the destination file st, whose permission
+// bits are perm (see setPerms).
+//
+// rsync/acls.c:set_acl
+func (rt *Transfer) setACLs(f *File, st fs.FileInfo, perm fs.FileMode) error {
+	if !rt.Opts.PreserveACLs || f.acl == nil {
+		return nil
+	}
+	access, def, err := localACLs(rt.DestRoot, f.Name, st.Mode())
+	if err != nil {
+		return err
+	}
+	accessDiffers, defDiffers := aclsDiffer(f, access, def, perm)
+	x := xattr.InRoot(rt.DestRoot, f.Name)
+	if accessDiffers {
+		// The owner, group and other entries (and the mask, which Linux
+		// shows as the group permission bits) reflect the permission bits.
+		value := f.acl.WithPerms(uint32(perm)).PosixACL()
+		if err := x.Set(rsynccommon.ACLAccessXattr, value); err != nil {
+			return fmt.Errorf("set_acl: %v", err)
+		}
+	}
+	if defDiffers {
+		if f.defACL.UserObj == rsynccommon.NoACLEntry {
+			// An empty default ACL is removed.
+			err := x.Remove(rsynccommon.ACLDefaultXattr)
+			if err != nil && !errors.Is(err, xattr.ErrNoAttr) {
+				return fmt.Errorf("set_acl: %v", err)
+			}
+		} else if err := x.Set(rsynccommon.ACLDefaultXattr, f.defACL.PosixACL()); err != nil {
+			return fmt.Errorf("set_acl: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,236 @@
+package receiver
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/gokrazy/rsync/internal/rsyncopts"
+	"github.com/gokrazy/rsync/internal/xattr"
+)
+
+// basisDir is an alternate basis directory (--compare-dest, --copy-dest or
+// --link-dest), see OpenBasisDirs.
+type basisDir struct {
+	root *os.Root // nil if the directory does not exist
+
+	// path is the directory relative to the module root of the rsync
+	// daemon, or a file system path otherwise.
+	path string
+}
+
+// BasisDirPaths returns the file system paths of the existing alternate
+// basis directories dirs (see TransferOpts.BasisDirs) for the destination
+// dest, to which file system access needs to be granted.
+func BasisDirPaths(dest string, dirs []string) []string {
+	var paths []string
+	for _, dir := range dirs {
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(dest, dir)
+		}
+		if _, err := os.Stat(dir); err == nil {
+			paths = append(paths, dir)
+		}
+	}
+	return paths
+}
+
+// OpenBasisDirs opens the alternate basis directories of
+// TransferOpts.BasisDirs once Dest is final. Relative directories are
+// relative to Dest.
+//
+// The rsync daemon passes the root of its module as module and Dest relative
+// to the module as destDir: the directories need to be within the module, in
+// which absolute directories are relative to the module root (like in a
+// chroot). Otherwise, module is nil and the directories can be anywhere.
+func (rt *Transfer) OpenBasisDirs(module *os.Root, destDir string) error {
+	rt.basisModule = module
+	rt.destDir = destDir
+	for _, dir := range rt.Opts.BasisDirs {
+		var bd basisDir
+		var err error
+		if module != nil {
+			if path.IsAbs(dir) {
+				bd.path = path.Join(".", dir)
+			} else {
+				bd.path = path.Join(destDir, dir)
+			}
+			if !filepath.IsLocal(bd.path) {
+				return fmt.Errorf("%s %s is not within the module", rsyncopts.AltDestOption(rt.Opts.AltDestType), dir)
+			}
+			bd.root, err = module.OpenRoot(bd.path)
+		} else {
+			bd.path = dir
+			if !filepath.IsAbs(dir) {
+				bd.path = filepath.Join(rt.Dest, dir)
+			}
+			bd.root, err = os.OpenRoot(bd.path)
+		}
+		if errors.Is(err, fs.ErrNotExist) {
+			rt.Logger.Printf("%s arg does not exist: %s", rsyncopts.AltDestOption(rt.Opts.AltDestType), dir)
+		} else if err != nil {
+			return fmt.Errorf("%s %s: %v", rsyncopts.AltDestOption(rt.Opts.AltDestType), dir, err)
+		}
+		rt.basisDirs = append(rt.basisDirs, bd)
+	}
+	return nil
+}
+
+// CloseBasisDirs closes the directories opened by OpenBasisDirs.
+func (rt *Transfer) CloseBasisDirs() {
+	for _, bd := range rt.basisDirs {
+		if bd.root != nil {
+			bd.root.Close()
+		}
+	}
+}
+
+// tryBasisDirs looks for f in the alternate basis directories, in order.
+//
+// If an unchanged file is found, f is hard linked to it (--link-dest),
+// copied from it (--copy-dest) or not transferred at all (--compare-dest),
+// and tryBasisDirs reports done. Files whose attributes differ are copied.
+// Otherwise, tryBasisDirs returns the index of the basis directory whose file
+// should be used as basis for the transfer of f (and its FileInfo), or -1.
+//
+// If existing (the destination file) is non-nil, only unchanged files are
+// considered, which replace the destination file.
+//
+// rsync/generator.c:try_dests_reg
+func (rt *Transfer) tryBasisDirs(f *File, existing fs.FileInfo) (int, fs.FileInfo, bool) {
+	best, matchLevel := -1, 0
+	var bestSt fs.FileInfo
+	for j, bd := range rt.basisDirs {
+		if bd.root == nil {
+			continue
+		}
+		st, err := bd.root.Lstat(f.Name)
+		if err != nil || !st.Mode().IsRegular() {
+			continue
+		}
+		if matchLevel == 0 {
+			best, bestSt, matchLevel = j, st, 1
+		}
+		if ok, err := rt.skipFile(bd.root, f, st); err != nil || !ok {
+			continue
+		}
+		if matchLevel == 1 {
+			best, bestSt, matchLevel = j, st, 2
+		}
+		if rt.unchangedAttrs(bd.root, f, st) {
+			best, bestSt, matchLevel = j, st, 3
+			break
+		}
+	}
+	if matchLevel == 0 {
+		return -1, nil, false
+	}
+
+	altDest := rt.Opts.AltDestType
+	tryCopy := matchLevel >= 2 && existing == nil
+	if matchLevel == 3 && altDest != rsyncopts.COPY_DEST {
+		if existing != nil {
+			if altDest == rsyncopts.LINK_DEST && os.SameFile(existing, bestSt) {
+				return -1, nil, false
+			}
+			if !rt.Opts.DryRun {
+				if err := rt.DestRoot.Remove(f.Name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+					return -1, nil, false
+				}
+			}
+		}
+		var err error
+		if altDest == rsyncopts.LINK_DEST {
+			err = rt.linkBasis(best, f.Name)
+		}
+		if err == nil {
+			if rt.Opts.InfoGTE(rsyncopts.INFO_NAME, 2) {
+				rt.Logger.Printf("%s is uptodate", f.Name)
+			}
+			return -1, nil, true
+		}
+		rt.Logger.Printf("link %s => %s failed, copying: %v", f.Name, rt.basisDirs[best].path, err)
+		tryCopy = true
+	}
+	if tryCopy {
+		if err := rt.copyBasis(best, f); err != nil {
+			rt.Logger.Printf("copying %s from %s failed: %v", f.Name, rt.basisDirs[best].path, err)
+			return -1, nil, false
+		}
+		return -1, nil, true
+	}
+	if existing != nil {
+		return -1, nil, false
+	}
+	return best, bestSt, false
+}
+
+// unchangedAttrs reports whether the attributes of the existing file st (in
+// root) match the attributes of f which the transfer preserves.
+//
+// rsync/generator.c:unchanged_attrs
+func (rt *Transfer) unchangedAttrs(root *os.Root, f *File, st fs.FileInfo) bool {
+	if rt.Opts.PreserveTimes && !rt.modTimeEqual(st.ModTime(), f.ModTime) {
+		return false
+	}
+	if rt.Opts.PreservePerms && st.Mode().Perm() != fs.FileMode(f.Mode)&os.ModePerm {
+		return false
+	}
+	if rt.aclsChanged(root, f, st) {
+		return false
+	}
+	if rt.Opts.PreserveXattrs > 0 {
+		local, err := rt.localXattrs(xattr.InRoot(root, f.Name))
+		if err != nil || xattrsDiffer(f, local, false) {
+			return false
+		}
+	}
+	return !rt.ownershipDiffers(f, st)
+}
+
+// linkBasis hard links the destination file name to the file name in the
+// basis directory j.
+//
+// rsync/hlink.c:hard_link_one
+func (rt *Transfer) linkBasis(j int, name string) error {
+	if rt.Opts.DryRun {
+		return nil
+	}
+	bd := rt.basisDirs[j]
+	if rt.basisModule != nil {
+		// Both files are within the module.
+		return rt.basisModule.Link(path.Join(bd.path, name), path.Join(rt.destDir, name))
+	}
+	return os.Link(filepath.Join(bd.path, name), filepath.Join(rt.Dest, name))
+}
+
+// copyBasis copies the file f from the basis directory j into the
+// destination.
+//
+// rsync/generator.c:copy_altdest_file
+func (rt *Transfer) copyBasis(j int, f *File) error {
+	if rt.Opts.DryRun {
+		return nil
+	}
+	in, err := rt.basisDirs[j].root.Open(f.Name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := newPendingFile(rt.DestRoot, f.Name)
+	if err != nil {
+		return err
+	}
+	defer out.Cleanup()
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	if err := out.CloseAtomicallyReplace(); err != nil {
+		return err
+	}
+	return rt.setPerms(f, fs.FileMode(f.Mode))
+}
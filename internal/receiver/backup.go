@@ -0,0 +1,265 @@
+package receiver
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/gokrazy/rsync/internal/rsyncopts"
+)
+
+// backupResult describes how makeBackup kept the previous version of a file.
+type backupResult int
+
+const (
+	backupNone    backupResult = iota // there was no file to keep
+	backupRenamed                     // the file was moved to its backup name
+	backupLinked                      // the file was hard linked, i.e. still exists
+)
+
+// DirWithinDest returns the directory dir (specified with option) relative to
+// the destination dest. Like in tridge rsync, a relative directory is relative
+// to the destination. An absolute directory needs to be within the
+// destination, too, because the receiver accesses the file system through its
+// DestRoot.
+func DirWithinDest(option, dest, dir string) (string, error) {
+	if filepath.IsAbs(dir) {
+		absDest, err := filepath.Abs(dest)
+		if err != nil {
+			return "", err
+		}
+		rel, err := filepath.Rel(absDest, dir)
+		if err != nil || !filepath.IsLocal(rel) {
+			return "", fmt.Errorf("%s %s is not within the destination %s", option, dir, absDest)
+		}
+		dir = rel
+	} else if !filepath.IsLocal(dir) {
+		return "", fmt.Errorf("%s %s is not within the destination %s", option, dir, dest)
+	}
+	return filepath.ToSlash(filepath.Clean(dir)), nil
+}
+
+// ResolveDirs verifies TransferOpts.BackupDir and TransferOpts.PartialDir (see
+// DirWithinDest) once Dest is final.
+func (rt *Transfer) ResolveDirs() error {
+	if rt.Opts.MakeBackups && rt.Opts.BackupDir != "" {
+		dir, err := DirWithinDest("--backup-dir", rt.Dest, rt.Opts.BackupDir)
+		if err != nil {
+			return err
+		}
+		rt.backupDir = dir
+	}
+	if rt.Opts.KeepPartial && rt.Opts.PartialDir != "" {
+		dir, err := DirWithinDest("--partial-dir", rt.Dest, rt.Opts.PartialDir)
+		if err != nil {
+			return err
+		}
+		rt.partialDir = dir
+		rt.partialDirShared = filepath.IsAbs(rt.Opts.PartialDir)
+	}
+	return nil
+}
+
+// isHoldingDir reports whether name is the backup directory, the (shared)
+// partial directory or one of their parent directories, which deletion must
+// not remove.
+func (rt *Transfer) isHoldingDir(name string) bool {
+	dirs := []string{rt.backupDir}
+	if rt.partialDirShared {
+		dirs = append(dirs, rt.partialDir)
+	}
+	for _, dir := range dirs {
+		if dir != "" && (name == dir || strings.HasPrefix(dir, name+"/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// isBackupFile reports whether name looks like a backup made without
+// --backup-dir, which deleteItem does not back up again.
+//
+// rsync/delete.c:is_backup_file
+func (rt *Transfer) isBackupFile(name string) bool {
+	return rt.backupDir == "" && strings.HasSuffix(name, rt.Opts.BackupSuffix)
+}
+
+// backupName returns the name under which the previous version of name is
+// kept, creating the parent directories in the backup directory hierarchy if
+// necessary.
+//
+// rsync/backup.c:get_backup_name
+func (rt *Transfer) backupName(name string) (string, error) {
+	if rt.backupDir == "" {
+		return name + rt.Opts.BackupSuffix, nil
+	}
+	if err := rt.makeBackupDirs(path.Dir(name)); err != nil {
+		return "", err
+	}
+	return path.Join(rt.backupDir, name) + rt.Opts.BackupSuffix, nil
+}
+
+// makeBackupDirs creates the directory dir within the backup directory
+// hierarchy, mirroring the permissions of the corresponding directories in
+// the destination. Non-directories in the way are removed.
+//
+// rsync/backup.c:copy_valid_path
+func (rt *Transfer) makeBackupDirs(dir string) error {
+	if err := rt.DestRoot.MkdirAll(rt.backupDir, 0755); err != nil {
+		return err
+	}
+	if dir == "." {
+		return nil
+	}
+	var rel string
+	for _, elem := range strings.Split(dir, "/") {
+		rel = path.Join(rel, elem)
+		bdir := path.Join(rt.backupDir, rel)
+		st, err := rt.DestRoot.Lstat(bdir)
+		if err == nil && st.IsDir() {
+			continue
+		}
+		if err == nil {
+			if err := rt.DestRoot.Remove(bdir); err != nil {
+				return err
+			}
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		perm := fs.FileMode(0755)
+		if st, err := rt.DestRoot.Stat(rel); err == nil {
+			// Keep the backup directory writable for subsequent backups.
+			perm = st.Mode().Perm() | 0700
+		}
+		if rt.Opts.DebugGTE(rsyncopts.DEBUG_BACKUP, 1) {
+			rt.Logger.Printf("make_bak_dir: mkdir %s", bdir)
+		}
+		if err := rt.DestRoot.Mkdir(bdir, perm); err != nil && !errors.Is(err, fs.ErrExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// makeBackup keeps the previous version of name (if any) before the receiver
+// replaces or deletes it. With preferRename, name is moved to its backup
+// name. Otherwise, name is hard linked to its backup name, so that name can
+// still be replaced atomically (regular files are moved if linking fails).
+//
+// rsync/backup.c:make_backup
+func (rt *Transfer) makeBackup(name string, preferRename bool) (backupResult, error) {
+	st, err := rt.DestRoot.Lstat(name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return backupNone, nil
+		}
+		return backupNone, err
+	}
+	bname, err := rt.backupName(name)
+	if err != nil {
+		return backupNone, err
+	}
+	res, err := rt.linkOrRename(name, bname, preferRename, st)
+	if err != nil && (errors.Is(err, fs.ErrExist) || errors.Is(err, syscall.EISDIR)) {
+		// Replace the previous backup.
+		if err := rt.DestRoot.RemoveAll(bname); err != nil {
+			return backupNone, err
+		}
+		res, err = rt.linkOrRename(name, bname, preferRename, st)
+	}
+	if err != nil {
+		return backupNone, err
+	}
+	if rt.Opts.InfoGTE(rsyncopts.INFO_BACKUP, 1) {
+		rt.Logger.Printf("backed up %s to %s", name, bname)
+	}
+	return res, nil
+}
+
+// copyBackup copies name to its backup name and returns the backup name. With
+// --inplace, the receiver overwrites name, so makeBackup cannot move it away
+// (or hard link it). The copy serves as basis file instead.
+//
+// rsync/generator.c:recv_generator (f_copy)
+func (rt *Transfer) copyBackup(name string, st fs.FileInfo) (string, error) {
+	bname, err := rt.backupName(name)
+	if err != nil {
+		return "", err
+	}
+	if err := rt.DestRoot.Remove(bname); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+	in, err := rt.DestRoot.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	out, err := rt.DestRoot.OpenFile(bname, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, in); err != nil {
+		return "", err
+	}
+	if err := out.Close(); err != nil {
+		return "", err
+	}
+	if err := rt.DestRoot.Chmod(bname, st.Mode().Perm()); err != nil {
+		return "", err
+	}
+	if err := rt.DestRoot.Chtimes(bname, st.ModTime(), st.ModTime()); err != nil {
+		return "", err
+	}
+	if rt.Opts.InfoGTE(rsyncopts.INFO_BACKUP, 1) {
+		rt.Logger.Printf("backed up %s to %s", name, bname)
+	}
+	return bname, nil
+}
+
+// rsync/backup.c:link_or_rename
+func (rt *Transfer) linkOrRename(from, to string, preferRename bool, st fs.FileInfo) (backupResult, error) {
+	if !preferRename {
+		err := rt.DestRoot.Link(from, to)
+		if err == nil {
+			if rt.Opts.DebugGTE(rsyncopts.DEBUG_BACKUP, 1) {
+				rt.Logger.Printf("make_backup: HLINK %s successful.", from)
+			}
+			return backupLinked, nil
+		}
+		// We prefer to rename a regular file rather than copy it.
+		if !st.Mode().IsRegular() || errors.Is(err, fs.ErrExist) {
+			return backupNone, err
+		}
+	}
+	if err := rt.DestRoot.Rename(from, to); err != nil {
+		return backupNone, err
+	}
+	if rt.Opts.DebugGTE(rsyncopts.DEBUG_BACKUP, 1) {
+		rt.Logger.Printf("make_backup: RENAME %s successful.", from)
+	}
+	return backupRenamed, nil
+}
+
+// removeInTheWay removes the file name, which is in the way of a file of
+// another type, keeping a backup of non-directories with --backup.
+//
+// rsync/delete.c:delete_item (DEL_MAKE_ROOM)
+func (rt *Transfer) removeInTheWay(name string, isDir bool) error {
+	if rt.Opts.MakeBackups && !isDir {
+		res, err := rt.makeBackup(name, true)
+		if err != nil {
+			return err
+		}
+		if res != backupLinked {
+			return nil
+		}
+	}
+	return rt.DestRoot.Remove(name)
+}
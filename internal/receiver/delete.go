@@ -0,0 +1,285 @@
+package receiver
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"syscall"
+
+	"github.com/gokrazy/rsync"
+	"github.com/gokrazy/rsync/internal/filter"
+	"github.com/gokrazy/rsync/internal/rsyncopts"
+	"github.com/gokrazy/rsync/internal/rsyncwire"
+)
+
+// rsync/delete.c:enum delret
+type deleteResult int
+
+const (
+	deleteSuccess deleteResult = iota
+	deleteFailure
+	deleteAtLimit
+	deleteNotEmpty
+)
+
+// delayedDeletion is an extraneous file which --delete-delay found during the
+// transfer, but deletes after the transfer.
+type delayedDeletion struct {
+	name  string
+	isDir bool
+}
+
+// deleteScope returns the filter scope for checking names in the destination,
+// creating it if necessary. The scope follows the directory which is being
+// deleted in (see filter.Scope.ChangeDir) until closeDeleteScope.
+func (rt *Transfer) deleteScope() (*filter.Scope, error) {
+	if rt.delFilters != nil {
+		return rt.delFilters, nil
+	}
+	filterRoot, err := filepath.Abs(rt.Dest)
+	if err != nil {
+		return nil, err
+	}
+	open := func(name string) (io.ReadCloser, error) {
+		return rt.DestRoot.Open(name)
+	}
+	rt.delFilters = rt.FilterList.NewScope(open, filterRoot, filterRoot)
+	return rt.delFilters, nil
+}
+
+func (rt *Transfer) closeDeleteScope() {
+	if rt.delFilters != nil {
+		rt.delFilters.Close()
+		rt.delFilters = nil
+	}
+}
+
+// deletePass deletes the extraneous files in all content directories of the
+// file list fl, i.e. --delete-before and --delete-after.
+//
+// rsync/generator.c:do_delete_pass
+func (rt *Transfer) deletePass(fl *fileList) error {
+	defer rt.closeDeleteScope()
+	for _, f := range fl.files {
+		if f.flags&flagContentDir == 0 {
+			continue
+		}
+		if f.flags&flagTopDir != 0 && rt.Opts.DebugGTE(rsyncopts.DEBUG_DEL, 2) {
+			rt.Logger.Printf("deleting in %s", f.Name)
+		}
+		st, err := rt.DestRoot.Lstat(f.Name)
+		if err != nil || !st.IsDir() {
+			continue
+		}
+		if err := rt.deleteInDir(fl, f.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteInDir deletes all files in dir which are not in the file list fl
+// (and not protected by filter rules). With --delete-delay, the files are only
+// remembered, see doDelayedDeletions.
+//
+// rsync/generator.c:delete_in_dir
+func (rt *Transfer) deleteInDir(fl *fileList, dir string) error {
+	if rt.Opts.DebugGTE(rsyncopts.DEBUG_DEL, 2) {
+		rt.Logger.Printf("delete_in_dir(%s)", dir)
+	}
+	if rt.IOErrors.Load()&rsync.IOERR_GENERAL != 0 && !rt.Opts.IgnoreErrors {
+		if !rt.warnedIOErrors {
+			rt.Logger.Printf("IO error encountered -- skipping file deletion")
+			rt.warnedIOErrors = true
+		}
+		return nil
+	}
+
+	filters, err := rt.deleteScope()
+	if err != nil {
+		return err
+	}
+	entries, err := fs.ReadDir(rt.DestRoot.FS(), dir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil // nothing to delete
+		}
+		return err
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		fn := path.Join(dir, e.Name())
+		if err := filters.ChangeDir(dir); err != nil {
+			return err
+		}
+		if rt.FilterList.Excluded(fn, e.IsDir(), filter.ReceiverSide) {
+			// Excluded files are protected from deletion.
+			continue
+		}
+		if rt.isHoldingDir(fn) {
+			continue
+		}
+		// Files are matched regardless of their type: replacing a file
+		// with one of another type is handled by recvGenerator.
+		if findInFileList(fl.files, fn) {
+			continue
+		}
+		if rt.Opts.DeleteDelay {
+			rt.delayedDeletions = append(rt.delayedDeletions, delayedDeletion{
+				name:  fn,
+				isDir: e.IsDir(),
+			})
+			continue
+		}
+		if _, err := rt.deleteItem(fn, e.IsDir(), false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// doDelayedDeletions deletes the files which deleteInDir remembered for
+// --delete-delay.
+//
+// rsync/generator.c:do_delayed_deletions
+func (rt *Transfer) doDelayedDeletions() error {
+	defer rt.closeDeleteScope()
+	for _, d := range rt.delayedDeletions {
+		if _, err := rt.deleteItem(d.name, d.isDir, false); err != nil {
+			return err
+		}
+	}
+	rt.delayedDeletions = nil
+	return nil
+}
+
+// deleteItem deletes the file or directory name, including the contents of
+// directories (unless dirIsEmpty is true). The error is only non-nil for
+// problems which should abort the transfer.
+//
+// rsync/delete.c:delete_item
+func (rt *Transfer) deleteItem(name string, isDir, dirIsEmpty bool) (deleteResult, error) {
+	if isDir && !dirIsEmpty {
+		ret, err := rt.deleteDirContents(name)
+		if err != nil {
+			return deleteFailure, err
+		}
+		if ret == deleteNotEmpty || ret == deleteAtLimit {
+			return ret, nil
+		}
+	}
+
+	if max := rt.Opts.MaxDelete; max >= 0 && rt.deletedFiles >= max {
+		rt.skippedDeletes++
+		return deleteAtLimit, nil
+	}
+
+	if !rt.Opts.DryRun {
+		if !isDir && rt.Opts.MakeBackups && !rt.isBackupFile(name) {
+			res, err := rt.makeBackup(name, true)
+			if err != nil {
+				rt.Logger.Printf("delete_file: make_backup %s failed: %v", name, err)
+				return deleteFailure, nil
+			}
+			if res != backupLinked {
+				// The file was moved to its backup name.
+				return rt.deleted(name, isDir)
+			}
+		}
+		if err := rt.DestRoot.Remove(name); err != nil {
+			switch {
+			case isDir && errors.Is(err, syscall.ENOTEMPTY):
+				rt.Logger.Printf("cannot delete non-empty directory: %s", name)
+				return deleteNotEmpty, nil
+			case errors.Is(err, fs.ErrNotExist):
+				return deleteSuccess, nil
+			default:
+				rt.Logger.Printf("delete_file: %v", err)
+				return deleteFailure, nil
+			}
+		}
+	}
+	return rt.deleted(name, isDir)
+}
+
+// deleted logs and counts the deletion of name. Servers tell the client
+// about the deletion, which logs it (see rsynccommon.ItemLog.LogDelete).
+//
+// rsync/log.c:log_delete
+func (rt *Transfer) deleted(name string, isDir bool) (deleteResult, error) {
+	rt.deletedFiles++
+	switch {
+	case rt.Opts.Server && rt.Protocol >= 29:
+		msg := []byte(name)
+		if isDir {
+			msg = append(msg, 0) // directories include a trailing NUL
+		}
+		if err := rt.Conn.WriteMsg(rsyncwire.MsgDeleted, msg); err != nil {
+			return deleteFailure, err
+		}
+
+	case rt.Opts.Server:
+		if rt.Opts.InfoGTE(rsyncopts.INFO_DEL, 1) {
+			if isDir {
+				rt.Logger.Printf("deleting %s/", name)
+			} else {
+				rt.Logger.Printf("deleting %s", name)
+			}
+		}
+
+	default:
+		mode := int32(rsync.S_IFREG)
+		if isDir {
+			mode = rsync.S_IFDIR
+		}
+		rt.Items.LogDelete(name, mode)
+	}
+	return deleteSuccess, nil
+}
+
+// deleteDirContents deletes the contents of dir, except for files which are
+// protected by filter rules (perishable rules are ignored).
+//
+// rsync/delete.c:delete_dir_contents
+func (rt *Transfer) deleteDirContents(dir string) (deleteResult, error) {
+	filters, err := rt.deleteScope()
+	if err != nil {
+		return deleteFailure, err
+	}
+	entries, err := fs.ReadDir(rt.DestRoot.FS(), dir)
+	if err != nil {
+		rt.Logger.Printf("delete_dir_contents: %v", err)
+		return deleteNotEmpty, nil
+	}
+	ret := deleteSuccess
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		fn := path.Join(dir, e.Name())
+		if err := filters.ChangeDir(dir); err != nil {
+			return deleteFailure, err
+		}
+		if rt.FilterList.ExcludedIgnorePerishable(fn, e.IsDir()) {
+			ret = deleteNotEmpty
+			continue
+		}
+		if e.IsDir() {
+			res, err := rt.deleteDirContents(fn)
+			if err != nil {
+				return deleteFailure, err
+			}
+			if res != deleteSuccess {
+				ret = deleteNotEmpty
+			}
+		}
+		res, err := rt.deleteItem(fn, e.IsDir(), true)
+		if err != nil {
+			return deleteFailure, err
+		}
+		if res != deleteSuccess {
+			ret = deleteNotEmpty
+		}
+	}
+	return ret, nil
+}
@@ -1,109 +1,77 @@
 package receiver
 
 import (
-	"context"
-	"io/fs"
-	"os"
+	"fmt"
 
+	"github.com/gokrazy/rsync"
+	"github.com/gokrazy/rsync/internal/rsynccommon"
 	"github.com/gokrazy/rsync/internal/rsyncopts"
 	"github.com/gokrazy/rsync/internal/rsyncstats"
 	"github.com/gokrazy/rsync/internal/rsyncwire"
 	"golang.org/x/sync/errgroup"
 )
 
-func isTopDir(f *File) bool {
-	// TODO: once we check the f.Flags:
-	// if !f.FileMode().IsDir() {
-	//    // non-directories can get the top_dir flag set,
-	//    // but it must be ignored (only for protocol reasons).
-	//   return false
-	// }
-	// return (f.Flags & TOP_DIR) != 0
-	return f.Name == "."
-}
-
-func (rt *Transfer) deleteFiles(fileList []*File) error {
-	if rt.IOErrors > 0 {
-		rt.Logger.Printf("IO error encountered, skipping file deletion")
-		return nil
-	}
-
-	for _, f := range fileList {
-		if !isTopDir(f) {
-			continue
-		}
-		rt.Logger.Printf("deleting in %s", f.Name)
-		// Other rsync implementations generate a local file list and compare it
-		// with the remote file list, we re-implement the path→name mapping part
-		// of file list generation here. We could change it for consistency.
-		err := fs.WalkDir(rt.DestRoot.FS(), ".", func(path string, info fs.DirEntry, err error) error {
-			if err != nil {
-				return err
-			}
-			rt.Logger.Printf("WalkDir(%q)", path)
-			if findInFileList(fileList, path) {
-				return nil
-			}
-			if rt.Opts.Verbose {
-				rt.Logger.Printf("  deleting %s", path)
-			}
-			if rt.Opts.DryRun {
-				return nil
-			}
-			if err := rt.DestRoot.RemoveAll(path); err != nil {
-				rt.Logger.Printf("  deleting %s failed: %v", path, err)
-				// keep going
-			}
-			return fs.SkipDir // skip the just-deleted directory
-		})
-		if err != nil {
-			if os.IsNotExist(err) {
-				return nil // destination does not exist, nothing to do
-			}
-			return err
-		}
-	}
-	return nil
-}
-
-// waitFor calls f and waits for it to complete, but only until the specified
-// context is cancelled.
-func waitFor(ctx context.Context, f func() error) error {
-	errChan := make(chan error, 1)
-	go func() { errChan <- f() }()
-	select {
-	case <-ctx.Done():
-		return ctx.Err()
-	case err := <-errChan:
-		return err
-	}
-}
-
+// Do receives the files of fileList. Do returns once both, the generator and
+// the receiver goroutine, returned. When the caller aborts the connection
+// (e.g. because its context was cancelled), blocked reads and writes fail and
+// both goroutines return.
+//
 // rsync/main.c:do_recv
 func (rt *Transfer) Do(c *rsyncwire.Conn, fileList []*File, noReport bool) (*rsyncstats.TransferStats, error) {
-	if rt.Opts.DeleteMode {
-		if err := rt.deleteFiles(fileList); err != nil {
-			return nil, err
+	if rt.Opts.DeleteMode && rt.Opts.DeleteBefore && !rt.listOnly() {
+		for _, fl := range rt.flists {
+			if err := rt.deletePass(fl); err != nil {
+				return nil, err
+			}
 		}
 	}
 
-	ctx := context.Background()
-	eg, ctx := errgroup.WithContext(ctx)
-	// Wrap both, the generator and the receiver goroutine, in waitFor() calls
-	// to ensure we don’t block on the generator when the receiver returns an
-	// error, or vice versa (instead, return and let the goroutine finish in the
-	// background).
+	var eg errgroup.Group
 	eg.Go(func() error {
-		return waitFor(ctx, func() error { return rt.GenerateFiles(fileList) })
+		return rt.abortOnError(rt.GenerateFiles())
 	})
 	eg.Go(func() error {
-		return waitFor(ctx, func() error { return rt.RecvFiles(fileList) })
+		return rt.abortOnError(rt.RecvFiles())
 	})
 	if err := eg.Wait(); err != nil {
 		return nil, err
 	}
-	if rt.retouchDirPerms /* || rt.retouchDirTimes */ {
-		if err := rt.touchUpDirs(fileList); err != nil {
+	if rt.Opts.DeleteMode && !rt.listOnly() {
+		if rt.Opts.DeleteDelay {
+			if err := rt.doDelayedDeletions(); err != nil {
+				return nil, err
+			}
+		}
+		if rt.Opts.DeleteAfter {
+			for _, fl := range rt.flists {
+				if err := rt.deletePass(fl); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if rt.Opts.MaxDelete >= 0 && rt.skippedDeletes > 0 {
+			rt.Logger.Printf("Deletions stopped due to --max-delete limit (%d skipped)", rt.skippedDeletes)
+			rt.IOErrors.Or(rsync.IOERR_DEL_LIMIT)
+			if rt.Protocol >= 30 {
+				// Let the sender know, so that it can exit with
+				// rsync.RERR_DEL_LIMIT, too.
+				if err := c.WriteMsgInt32(rsyncwire.MsgIOError, rsync.IOERR_DEL_LIMIT); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	if rt.retouchDirPerms || rt.retouchDirTimes {
+		for _, fl := range rt.flists {
+			if err := rt.touchUpDirs(fl.files); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if ioErrors := rt.ReceiverIOErrors.Load(); ioErrors != 0 && rt.Opts.Server && rt.Protocol >= 30 {
+		// Let the sender (the client) know, so that it can exit with
+		// rsync.RERR_PARTIAL, too.
+		if err := c.WriteMsgInt32(rsyncwire.MsgIOError, ioErrors); err != nil {
 			return nil, err
 		}
 	}
@@ -118,31 +86,64 @@ func (rt *Transfer) Do(c *rsyncwire.Conn, fileList []*File, noReport bool) (*rsy
 	}
 
 	// send final goodbye message
-	if err := c.WriteInt32(-1); err != nil {
+	if err := c.WriteNdx(rt.Protocol, rsync.NDX_DONE); err != nil {
 		return nil, err
 	}
+	if rt.Protocol >= 31 {
+		// rsync/main.c:read_final_goodbye
+		finish, err := c.ReadNdx(rt.Protocol)
+		if err != nil {
+			return nil, err
+		}
+		if finish != rsync.NDX_DONE {
+			return nil, fmt.Errorf("protocol error: expected final NDX_DONE, got %d", finish)
+		}
+	}
 
 	return stats, nil
 }
 
+// abortOnError aborts the connection if err is non-nil, so that we don’t block
+// on the generator when the receiver returns an error, or vice versa.
+func (rt *Transfer) abortOnError(err error) error {
+	if err != nil && rt.Abort != nil {
+		rt.Abort(err)
+	}
+	return err
+}
+
+// ExitError returns the error which determines the exit code of the completed
+// transfer (see rsynccommon.ExitError), or nil.
+func (rt *Transfer) ExitError() error {
+	return rsynccommon.ExitError(rt.IOErrors.Load() | rt.ReceiverIOErrors.Load())
+}
+
 // rsync/main.c:report
 func (rt *Transfer) report(c *rsyncwire.Conn) (*rsyncstats.TransferStats, error) {
 	// read statistics:
 	// total bytes read (from network connection)
-	read, err := c.ReadInt64()
+	read, err := c.ReadVarlong30(rt.Protocol, 3)
 	if err != nil {
 		return nil, err
 	}
 	// total bytes written (to network connection)
-	written, err := c.ReadInt64()
+	written, err := c.ReadVarlong30(rt.Protocol, 3)
 	if err != nil {
 		return nil, err
 	}
 	// total size of files
-	size, err := c.ReadInt64()
+	size, err := c.ReadVarlong30(rt.Protocol, 3)
 	if err != nil {
 		return nil, err
 	}
+	if rt.Protocol >= 29 {
+		// file list generation and transfer time (in milliseconds)
+		for range 2 {
+			if _, err := c.ReadVarlong30(rt.Protocol, 3); err != nil {
+				return nil, err
+			}
+		}
+	}
 	if rt.Opts.InfoGTE(rsyncopts.INFO_STATS, 1) {
 		rt.Logger.Printf("server sent stats: read=%d, written=%d, size=%d", read, written, size)
 	}
@@ -0,0 +1,50 @@
+package receiver
+
+import (
+	"bufio"
+	"io"
+)
+
+// ForwardFilesFrom forwards the --files-from list read from r (a local file)
+// to the sender on the remote side: names are NUL-terminated, empty names and
+// comments (see sender.ReadFilesFrom) are dropped and an empty name marks the
+// end of the list.
+//
+// rsync/io.c:forward_filesfrom_data
+func ForwardFilesFrom(w io.Writer, r io.Reader, eolNulls bool) error {
+	br := bufio.NewReader(r)
+	bw := bufio.NewWriter(w)
+	var name []byte
+	for {
+		ch, err := br.ReadByte()
+		if err != nil && err != io.EOF {
+			return err
+		}
+		eof := err == io.EOF
+		if !eolNulls && (ch == '\n' || ch == '\r') {
+			ch = 0
+		}
+		if !eof && ch != 0 {
+			name = append(name, ch)
+			continue
+		}
+		// An empty name would end the list.
+		if len(name) > 0 && name[0] != '#' && name[0] != ';' {
+			if _, err := bw.Write(name); err != nil {
+				return err
+			}
+			if err := bw.WriteByte(0); err != nil {
+				return err
+			}
+		}
+		name = name[:0]
+		if eof {
+			break
+		}
+	}
+	// Send an empty name to end the list.
+	if err := bw.WriteByte(0); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
@@ -4,12 +4,14 @@ import (
 	"fmt"
 	"io"
 	"io/fs"
+	"path"
 	"path/filepath"
 	"sort"
 	"time"
 
 	"github.com/gokrazy/rsync"
 	"github.com/gokrazy/rsync/internal/rsyncchecksum"
+	"github.com/gokrazy/rsync/internal/rsynccommon"
 	"github.com/gokrazy/rsync/internal/rsyncopts"
 )
 
@@ -37,9 +39,41 @@ type File struct {
 	Gid        int32
 	LinkTarget string
 	Rdev       int32
-	Checksum   [rsyncchecksum.Size]byte
+	Checksum   [rsyncchecksum.MaxSize]byte
+
+	// Dev and Inode are only set for hard linked files with -H (protocol
+	// versions < 28 transmit them for all regular files). Protocol 30 does
+	// not transmit them at all, so they identify the hard link group by the
+	// index of its first file instead.
+	Dev     int64
+	Inode   int64
+	hlinked bool
+
+	// linkHead is the first file (in file list order) of the hard link
+	// group this file belongs to, or nil if the file is not hard linked.
+	linkHead *File
+
+	// acl and defACL are the access ACL and the default ACL (directories
+	// only) of the file (with --acls), see receiveACLs.
+	acl    *rsynccommon.ACL
+	defACL *rsynccommon.ACL
+
+	// xattrs are the extended attributes of the file (with --xattrs).
+	xattrs *xattrList
+
+	flags int // flagTopDir, flagContentDir
 }
 
+// File flags of directories, which determine where the receiver deletes.
+//
+// rsync/rsync.h
+const (
+	// flagTopDir marks a top-level directory of the transfer.
+	flagTopDir = 1 << iota
+	// flagContentDir marks a directory whose contents are transferred.
+	flagContentDir
+)
+
 // FileMode converts from the Linux permission bits to Go’s permission bits.
 func (f *File) FileMode() fs.FileMode {
 	ret := fs.FileMode(f.Mode) & fs.ModePerm
@@ -63,9 +97,21 @@ func (f *File) FileMode() fs.FileMode {
 	return ret
 }
 
+// logFile returns f as logged by rsynccommon.ItemLog.
+func (f *File) logFile() rsynccommon.LogFile {
+	return rsynccommon.LogFile{
+		Name:       f.Name,
+		Mode:       f.Mode,
+		Length:     f.Length,
+		ModTime:    f.ModTime,
+		LinkTarget: f.LinkTarget,
+	}
+}
+
 // rsync/flist.c:receive_file_entry
-func (rt *Transfer) receiveFileEntry(flags uint16, last *File) (*File, error) {
+func (rt *Transfer) receiveFileEntry(flags uint16, last *File, fl *fileList) (*File, error) {
 	f := &File{}
+	protocol := rt.Protocol
 
 	var l1 int
 	if flags&rsync.XMIT_SAME_NAME != 0 {
@@ -78,7 +124,7 @@ func (rt *Transfer) receiveFileEntry(flags uint16, last *File) (*File, error) {
 
 	var l2 int
 	if flags&rsync.XMIT_LONG_NAME != 0 {
-		l, err := rt.Conn.ReadInt32()
+		l, err := rt.Conn.ReadVarint30(protocol)
 		if err != nil {
 			return nil, err
 		}
@@ -110,21 +156,67 @@ func (rt *Transfer) receiveFileEntry(flags uint16, last *File) (*File, error) {
 	// anything more than Go’s filepath.Clean()?
 	f.Name = filepath.Clean(string(b))
 
-	length, err := rt.Conn.ReadInt64()
+	hlinkRef := protocol >= 30 &&
+		flags&rsync.XMIT_HLINKED != 0 &&
+		flags&rsync.XMIT_HLINK_FIRST == 0
+	if hlinkRef {
+		first, err := rt.Conn.ReadVarint()
+		if err != nil {
+			return nil, err
+		}
+		f.Dev, f.Inode = 0, int64(first)
+		f.hlinked = true
+		if idx := int(first - fl.ndxStart); idx >= 0 && idx < len(fl.files) {
+			// All other attributes are those of the first file in the group.
+			head := fl.files[idx]
+			f.Length = head.Length
+			f.ModTime = head.ModTime
+			f.Mode = head.Mode
+			f.Uid = head.Uid
+			f.Gid = head.Gid
+			f.Rdev = head.Rdev
+			f.Checksum = head.Checksum
+			return f, nil
+		}
+		if !rt.incRecurse() || first < 0 || first >= fl.ndxStart {
+			return nil, fmt.Errorf("hard link reference out of range: %d", first)
+		}
+		// The first file is in an earlier file list, which the sender
+		// does not rely on, so all attributes follow.
+	}
+
+	length, err := rt.Conn.ReadVarlong30(protocol, 3)
 	if err != nil {
 		return nil, err
 	}
 	f.Length = length
 
+	var modTime int64
 	if flags&rsync.XMIT_SAME_TIME != 0 {
-		f.ModTime = last.ModTime
+		modTime = last.ModTime.Unix()
+	} else if protocol >= 30 {
+		t, err := rt.Conn.ReadVarlong(4)
+		if err != nil {
+			return nil, err
+		}
+		modTime = t
 	} else {
-		modTime, err := rt.Conn.ReadInt32()
+		t, err := rt.Conn.ReadInt32()
 		if err != nil {
 			return nil, err
 		}
-		f.ModTime = time.Unix(int64(modTime), 0)
+		modTime = int64(t)
 	}
+	var modTimeNsec int32
+	if flags&rsync.XMIT_MOD_NSEC != 0 {
+		// Protocol 31 transmits the nanoseconds (if any) separately.
+		nsec, err := rt.Conn.ReadVarint()
+		if err != nil {
+			return nil, err
+		}
+		modTimeNsec = nsec
+	}
+	f.ModTime = time.Unix(modTime, int64(modTimeNsec))
 
 	if flags&rsync.XMIT_SAME_MODE != 0 {
 		f.Mode = last.Mode
@@ -135,16 +227,28 @@ func (rt *Transfer) receiveFileEntry(flags uint16, last *File) (*File, error) {
 		}
 		f.Mode = mode
 	}
+	// --chmod applies to all files but symlinks.
+	if len(rt.Opts.ChmodModes) > 0 && f.Mode&rsync.S_IFMT != rsync.S_IFLNK {
+		f.Mode = int32(rsyncopts.TweakMode(uint32(f.Mode), rt.Opts.ChmodModes))
+	}
 
 	if rt.Opts.PreserveUid {
 		if flags&rsync.XMIT_SAME_UID != 0 {
 			f.Uid = last.Uid
 		} else {
-			uid, err := rt.Conn.ReadInt32()
+			uid, err := rt.Conn.ReadVarint30(protocol)
 			if err != nil {
 				return nil, err
 			}
 			f.Uid = uid
+			if flags&rsync.XMIT_USER_NAME_FOLLOWS != 0 {
+				f.Uid, err = rt.recvUserName(uid)
+				if err != nil {
+					return nil, err
+				}
+			} else if rt.incRecurse() {
+				f.Uid = rt.matchUid(uid)
+			}
 		}
 	}
 
@@ -152,34 +256,92 @@ func (rt *Transfer) receiveFileEntry(flags uint16, last *File) (*File, error) {
 		if flags&rsync.XMIT_SAME_GID != 0 {
 			f.Gid = last.Gid
 		} else {
-			gid, err := rt.Conn.ReadInt32()
+			gid, err := rt.Conn.ReadVarint30(protocol)
 			if err != nil {
 				return nil, err
 			}
 			f.Gid = gid
+			if flags&rsync.XMIT_GROUP_NAME_FOLLOWS != 0 {
+				f.Gid, err = rt.recvGroupName(gid)
+				if err != nil {
+					return nil, err
+				}
+			} else if rt.incRecurse() {
+				f.Gid = rt.matchGid(gid)
+			}
 		}
 	}
 
 	mode := f.Mode & rsync.S_IFMT
+	if mode == rsync.S_IFDIR {
+		if protocol >= 30 {
+			if flags&rsync.XMIT_NO_CONTENT_DIR == 0 {
+				if flags&rsync.XMIT_TOP_DIR != 0 {
+					f.flags |= flagTopDir
+				}
+				f.flags |= flagContentDir
+			}
+		} else if flags&rsync.XMIT_TOP_DIR != 0 {
+			// Older protocols only mark the top-level directories: with
+			// recursion, all directories that follow are content dirs.
+			rt.inDelHier = rt.Opts.Recurse
+			f.flags |= flagTopDir | flagContentDir
+		} else if rt.inDelHier {
+			f.flags |= flagContentDir
+		}
+	}
 	isDev := mode == rsync.S_IFCHR || mode == rsync.S_IFBLK
 	isSpecial := mode == rsync.S_IFIFO || mode == rsync.S_IFSOCK
 	isLink := mode == rsync.S_IFLNK
 
 	if rt.Opts.PreserveDevices && (isDev || isSpecial) {
-		// TODO(protocol >= 28): rdev/major/minor handling
-		if flags&rsync.XMIT_SAME_RDEV_pre28 != 0 {
-			f.Rdev = last.Rdev
+		if protocol < 28 {
+			if flags&rsync.XMIT_SAME_RDEV_pre28 != 0 {
+				f.Rdev = last.Rdev
+			} else {
+				rdev, err := rt.Conn.ReadInt32()
+				if err != nil {
+					return nil, err
+				}
+				f.Rdev = rdev
+			}
 		} else {
-			rdev, err := rt.Conn.ReadInt32()
-			if err != nil {
-				return nil, err
+			major := rt.rdevMajor
+			if flags&rsync.XMIT_SAME_RDEV_MAJOR == 0 {
+				var err error
+				major, err = rt.Conn.ReadVarint30(protocol)
+				if err != nil {
+					return nil, err
+				}
+			}
+			var minor int32
+			switch {
+			case protocol >= 30:
+				m, err := rt.Conn.ReadVarint()
+				if err != nil {
+					return nil, err
+				}
+				minor = m
+			case flags&rsync.XMIT_RDEV_MINOR_8_pre30 != 0:
+				m, err := rt.Conn.ReadByte()
+				if err != nil {
+					return nil, err
+				}
+				minor = int32(m)
+			default:
+				m, err := rt.Conn.ReadInt32()
+				if err != nil {
+					return nil, err
+				}
+				minor = m
 			}
-			f.Rdev = rdev
+			rt.rdevMajor = major
+			f.Rdev = makeDev(uint32(major), uint32(minor))
 		}
 	}
 
 	if rt.Opts.PreserveLinks && isLink {
-		length, err := rt.Conn.ReadInt32()
+		length, err := rt.Conn.ReadVarint30(protocol)
 		if err != nil {
 			return nil, err
 		}
@@ -188,10 +350,43 @@ func (rt *Transfer) receiveFileEntry(flags uint16, last *File) (*File, error) {
 			return nil, err
 		}
 		f.LinkTarget = string(b)
+		if rt.Opts.MungeLinks {
+			f.LinkTarget = rsync.SYMLINK_PREFIX + f.LinkTarget
+		}
+	}
+
+	if rt.Opts.PreserveHardlinks && protocol < 28 && mode == rsync.S_IFREG {
+		// Protocol versions < 28 transmit the device and inode number of all
+		// regular files.
+		flags |= rsync.XMIT_HLINKED
+	}
+	if flags&rsync.XMIT_HLINKED != 0 {
+		f.hlinked = true
+		if protocol >= 30 {
+			if !hlinkRef {
+				// The first file of a group: later files refer to its index.
+				f.Dev, f.Inode = 0, int64(fl.ndxStart)+int64(len(fl.files))
+			}
+		} else {
+			if flags&rsync.XMIT_SAME_DEV_pre30 != 0 {
+				f.Dev = last.Dev
+			} else {
+				dev, err := rt.Conn.ReadInt64()
+				if err != nil {
+					return nil, err
+				}
+				f.Dev = dev
+			}
+			ino, err := rt.Conn.ReadInt64()
+			if err != nil {
+				return nil, err
+			}
+			f.Inode = ino
+		}
 	}
 
-	if rt.Opts.AlwaysChecksum {
-		if _, err := io.ReadFull(rt.Conn.Reader, f.Checksum[:]); err != nil {
+	if rt.Opts.AlwaysChecksum && (mode == rsync.S_IFREG || protocol < 28) {
+		if _, err := io.ReadFull(rt.Conn.Reader, f.Checksum[:rt.Checksums.File.Size()]); err != nil {
 			return nil, err
 		}
 	}
@@ -202,68 +397,214 @@ func (rt *Transfer) receiveFileEntry(flags uint16, last *File) (*File, error) {
 // rsync/flist.c:recv_file_list
 func (rt *Transfer) ReceiveFileList() ([]*File, error) {
 	if rt.Opts.Progress {
-		fmt.Fprintln(rt.Env.Stdout, "receiving file list...")
-		fmt.Fprint(rt.Env.Stdout, "0 files to consider")
+		if rt.incRecurse() {
+			fmt.Fprintln(rt.Env.Stdout, "receiving incremental file list")
+		} else {
+			fmt.Fprintln(rt.Env.Stdout, "receiving file list...")
+			fmt.Fprint(rt.Env.Stdout, "0 files to consider")
+		}
 	}
-	lastFileEntry := new(File)
-	var fileList []*File
-	for {
-		b, err := rt.Conn.ReadByte()
+	rt.lastFileEntry = new(File)
+	fl := &fileList{}
+	if rt.incRecurse() {
+		// Index 0 refers to the (non-existent) parent directory of the
+		// initial file list.
+		fl.ndxStart = 1
+	}
+	if err := rt.recvFileEntries(fl, nil); err != nil {
+		return nil, err
+	}
+	if rt.Opts.Progress && !rt.incRecurse() {
+		fmt.Fprintf(rt.Env.Stdout, "\r%d files to consider\n", len(fl.files))
+	}
+
+	sortFileList(fl.files)
+
+	if rt.Opts.PreserveHardlinks && !rt.incRecurse() {
+		initHardLinks(fl.files)
+	}
+
+	rt.flists = []*fileList{fl}
+	rt.newLists = newFlistQueue()
+	rt.redo = newRedoQueue()
+	rt.newLists.push(fl)
+	if rt.incRecurse() {
+		rt.addDirs(fl)
+	} else {
+		rt.newLists.close()
+	}
+
+	// With incremental recursion, names are received along with the file
+	// list entries instead (see XMIT_USER_NAME_FOLLOWS). The lists also
+	// contain the ids of named ACL entries.
+	if (rt.Opts.PreserveUid || rt.Opts.PreserveGid || rt.Opts.PreserveACLs) && !rt.incRecurse() {
+		// receive the uid/gid list
+		if err := rt.RecvIdList(fl.files); err != nil {
+			return nil, err
+		}
+	}
+
+	if rt.Protocol < 30 {
+		// read the i/o error flag (protocol 30 sends MSG_IO_ERROR instead)
+		ioErrors, err := rt.Conn.ReadInt32()
 		if err != nil {
 			return nil, err
 		}
-		if b == 0 {
-			break
+		if rt.Opts.DebugGTE(rsyncopts.DEBUG_FLIST, 2) {
+			rt.Logger.Printf("ioErrors: %v", ioErrors)
+		}
+		rt.IOErrors.Or(ioErrors)
+	}
+
+	return fl.files, nil
+}
+
+// recvFileEntries receives file list entries into fl until the end of the
+// file list. For extra file lists (incremental recursion), parent is the
+// directory whose contents the list holds.
+func (rt *Transfer) recvFileEntries(fl *fileList, parent *File) error {
+	for {
+		var flags uint16
+		if rt.varintFlags() {
+			v, err := rt.Conn.ReadVarint()
+			if err != nil {
+				return err
+			}
+			if v == 0 {
+				ioErrors, err := rt.Conn.ReadVarint()
+				if err != nil {
+					return err
+				}
+				rt.IOErrors.Or(ioErrors)
+				break
+			}
+			flags = uint16(v)
+		} else {
+			b, err := rt.Conn.ReadByte()
+			if err != nil {
+				return err
+			}
+			if b == 0 {
+				break
+			}
+			flags = uint16(b)
+			if rt.Protocol >= 28 && flags&rsync.XMIT_EXTENDED_FLAGS != 0 {
+				b, err := rt.Conn.ReadByte()
+				if err != nil {
+					return err
+				}
+				flags |= uint16(b) << 8
+			}
+			if rt.Protocol >= 31 && flags == rsync.XMIT_EXTENDED_FLAGS|rsync.XMIT_IO_ERROR_ENDLIST {
+				// end of the file list, followed by the I/O error flag
+				ioErrors, err := rt.Conn.ReadVarint()
+				if err != nil {
+					return err
+				}
+				rt.IOErrors.Or(ioErrors)
+				break
+			}
 		}
-		flags := uint16(b)
 		// rt.Logger.Printf("flags: %x", flags)
-		// TODO(protocol >= 28): extended flags
 
-		f, err := rt.receiveFileEntry(flags, lastFileEntry)
+		f, err := rt.receiveFileEntry(flags, rt.lastFileEntry, fl)
 		if err != nil {
-			return nil, err
+			return err
+		}
+		rt.lastFileEntry = f
+		if rt.Opts.PreserveACLs && f.Mode&rsync.S_IFMT != rsync.S_IFLNK {
+			if err := rt.receiveACLs(f); err != nil {
+				return err
+			}
+		}
+		if rt.Opts.PreserveXattrs > 0 {
+			if err := rt.receiveXattrs(f); err != nil {
+				return err
+			}
+		}
+		if parent != nil && path.Dir(f.Name) != parent.Name {
+			return fmt.Errorf("file list entry %q is not in directory %q", f.Name, parent.Name)
+		}
+		if f.hlinked && rt.incRecurse() {
+			if err := rt.addHardLink(f, fl.ndxStart+int32(len(fl.files))); err != nil {
+				return err
+			}
 		}
-		lastFileEntry = f
 		// TODO: include depth in output?
 		if rt.Opts.DebugGTE(rsyncopts.DEBUG_FLIST, 1) {
 			rt.Logger.Printf("[Receiver] i=%d ? %s mode=%o len=%d uid=%d gid=%d flags=?",
-				len(fileList),
+				fl.ndxStart+int32(len(fl.files)),
 				f.Name,
 				f.Mode,
 				f.Length,
 				f.Uid,
 				f.Gid)
 		}
-		fileList = append(fileList, f)
-		if rt.Opts.Progress && len(fileList)%100 == 0 {
-			fmt.Fprintf(rt.Env.Stdout, "\r%d files to consider", len(fileList))
+		fl.files = append(fl.files, f)
+		if rt.Opts.Progress && !rt.incRecurse() && len(fl.files)%100 == 0 {
+			fmt.Fprintf(rt.Env.Stdout, "\r%d files to consider", len(fl.files))
 		}
 	}
-	if rt.Opts.Progress {
-		fmt.Fprintf(rt.Env.Stdout, "\r%d files to consider\n", len(fileList))
-	}
+	return nil
+}
 
-	sortFileList(fileList)
+// recvExtraFileList receives the file list holding the contents of the
+// directory with index dirNdx (see Transfer.dirList).
+//
+// rsync/flist.c:recv_file_list (inc_recurse)
+func (rt *Transfer) recvExtraFileList(dirNdx int32) error {
+	if dirNdx < 0 || int(dirNdx) >= len(rt.dirList) {
+		return fmt.Errorf("protocol error: invalid directory index %d", dirNdx)
+	}
+	parent := rt.dirList[dirNdx]
+	last := rt.flists[len(rt.flists)-1]
+	fl := &fileList{
+		ndxStart: last.ndxStart + int32(len(last.files)) + 1,
+		parent:   parent,
+	}
+	if rt.Opts.DebugGTE(rsyncopts.DEBUG_FLIST, 1) {
+		rt.Logger.Printf("recvExtraFileList(%q), ndxStart=%d", parent.Name, fl.ndxStart)
+	}
+	if err := rt.recvFileEntries(fl, parent); err != nil {
+		return err
+	}
+	sortFileList(fl.files)
+	rt.flists = append(rt.flists, fl)
+	rt.addDirs(fl)
+	rt.newLists.push(fl)
+	return nil
+}
 
-	if rt.Opts.PreserveUid || rt.Opts.PreserveGid {
-		// receive the uid/gid list
-		users, groups, err := rt.RecvIdList()
-		if err != nil {
-			return nil, err
+// addDirs numbers the directories of the (sorted) file list fl, so that
+// extra file lists can refer to them.
+//
+// rsync/flist.c:flist_done_allocating (dir_flist)
+func (rt *Transfer) addDirs(fl *fileList) {
+	for _, f := range fl.files {
+		if f.FileMode().IsDir() {
+			rt.dirList = append(rt.dirList, f)
 		}
-		rt.Users = users
-		rt.Groups = groups
 	}
+}
 
-	// read the i/o error flag
-	ioErrors, err := rt.Conn.ReadInt32()
-	if err != nil {
-		return nil, err
-	}
-	if rt.Opts.DebugGTE(rsyncopts.DEBUG_FLIST, 2) {
-		rt.Logger.Printf("ioErrors: %v", ioErrors)
+// fileForIndex returns the file with the specified file list index, or nil
+// if the index refers to the parent directory of a file list.
+//
+// rsync/rsync.c:flist_for_ndx
+func (rt *Transfer) fileForIndex(ndx int32) (*File, error) {
+	// find the last file list starting at or before ndx+1 (the index of
+	// its parent directory)
+	i := sort.Search(len(rt.flists), func(i int) bool {
+		return rt.flists[i].ndxStart > ndx+1
+	}) - 1
+	if i >= 0 {
+		fl := rt.flists[i]
+		if ndx == fl.ndxStart-1 && rt.incRecurse() {
+			return nil, nil
+		}
+		if idx := int(ndx - fl.ndxStart); idx >= 0 && idx < len(fl.files) {
+			return fl.files[idx], nil
+		}
 	}
-	rt.IOErrors = ioErrors
-
-	return fileList, nil
+	return nil, fmt.Errorf("invalid file index %d", ndx)
 }
@@ -0,0 +1,233 @@
+package receiver
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/gokrazy/rsync/internal/rsyncopts"
+)
+
+// fuzzyFile is a regular file in one of the directories which the generator
+// searches for a fuzzy basis file (--fuzzy).
+type fuzzyFile struct {
+	st fs.FileInfo
+	// sent is set if the file is being replaced by the transfer, which makes
+	// it unsuitable as basis file for other files.
+	sent bool
+}
+
+// fuzzyRoot returns the root of the fuzzy directory list i: the destination
+// (0), or the alternate basis directory i-1.
+func (rt *Transfer) fuzzyRoot(i int) *os.Root {
+	if i == 0 {
+		return rt.DestRoot
+	}
+	return rt.basisDirs[i-1].root
+}
+
+// fuzzyDirs returns the regular files of the directory dir in the
+// destination and (with -yy) in the alternate basis directories, sorted by
+// name. The lists of the directory of the previous file are re-used: the
+// generator processes the files of each directory together.
+//
+// rsync/generator.c:recv_generator (fuzzy_dirlist)
+func (rt *Transfer) fuzzyDirs(dir string) [][]*fuzzyFile {
+	if rt.fuzzyLists != nil && rt.fuzzyDir == dir {
+		return rt.fuzzyLists
+	}
+	rt.fuzzyDir = dir
+	rt.fuzzyLists = make([][]*fuzzyFile, min(rt.Opts.FuzzyBasis, len(rt.basisDirs)+1))
+	for i := range rt.fuzzyLists {
+		root := rt.fuzzyRoot(i)
+		if root == nil {
+			continue
+		}
+		d, err := root.Open(dir)
+		if err != nil {
+			continue
+		}
+		entries, err := d.ReadDir(-1)
+		d.Close()
+		if err != nil {
+			continue
+		}
+		slices.SortFunc(entries, func(a, b fs.DirEntry) int {
+			return strings.Compare(a.Name(), b.Name())
+		})
+		for _, e := range entries {
+			if !e.Type().IsRegular() {
+				continue
+			}
+			st, err := e.Info()
+			if err != nil {
+				continue
+			}
+			rt.fuzzyLists[i] = append(rt.fuzzyLists[i], &fuzzyFile{st: st})
+		}
+	}
+	return rt.fuzzyLists
+}
+
+// markFuzzySent excludes the destination file of f from the fuzzy basis
+// files, because the transfer replaces it.
+func (rt *Transfer) markFuzzySent(f *File) {
+	list := rt.fuzzyDirs(path.Dir(f.Name))[0]
+	name := path.Base(f.Name)
+	if idx, ok := slices.BinarySearchFunc(list, name, func(ff *fuzzyFile, name string) int {
+		return strings.Compare(ff.st.Name(), name)
+	}); ok {
+		list[idx].sent = true
+	}
+}
+
+// findFuzzy returns the regular file which matches f best, and the index of
+// its directory list (see fuzzyRoot): a file with the same size and
+// modification time, or otherwise the file with the most similar name.
+//
+// rsync/generator.c:find_fuzzy
+func (rt *Transfer) findFuzzy(f *File) (*fuzzyFile, int) {
+	lists := rt.fuzzyDirs(path.Dir(f.Name))
+	candidate := func(ff *fuzzyFile) bool {
+		return ff.st.Size() > 0 && !ff.sent
+	}
+
+	// Try to find an exact size+mtime match first.
+	for i, list := range lists {
+		for _, ff := range list {
+			if !candidate(ff) {
+				continue
+			}
+			if ff.st.Size() == f.Length && ff.st.ModTime().Unix() == f.ModTime.Unix() {
+				if rt.Opts.DebugGTE(rsyncopts.DEBUG_FUZZY, 2) {
+					rt.Logger.Printf("fuzzy size/modtime match for %s", path.Join(path.Dir(f.Name), ff.st.Name()))
+				}
+				return ff, i
+			}
+		}
+	}
+
+	fname := path.Base(f.Name)
+	fnameSuffix := filenameSuffix(fname)
+	var (
+		lowest     *fuzzyFile
+		lowestList int
+	)
+	lowestDist := uint32(25 << 16) // ignore a distance greater than 25
+	for i, list := range lists {
+		for _, ff := range list {
+			if !candidate(ff) {
+				continue
+			}
+			name := ff.st.Name()
+			dist := fuzzyDistance(name, fname, lowestDist)
+			// Add some extra weight to how well the suffixes match unless
+			// the file was already disqualified.
+			if dist < 0xFFFF0000 {
+				dist += fuzzyDistance(filenameSuffix(name), fnameSuffix, 0xFFFF0000) * 10
+			}
+			if rt.Opts.DebugGTE(rsyncopts.DEBUG_FUZZY, 2) {
+				rt.Logger.Printf("fuzzy distance for %s = %d.%05d",
+					path.Join(path.Dir(f.Name), name), dist>>16, dist&0xFFFF)
+			}
+			if dist <= lowestDist {
+				lowestDist = dist
+				lowest, lowestList = ff, i
+			}
+		}
+	}
+	return lowest, lowestList
+}
+
+// filenameSuffix returns the suffix of the file name fn, including the dot,
+// ignoring backup suffixes and (if possible) numeric suffixes.
+//
+// rsync/generator.c:find_filename_suffix
+func filenameSuffix(fn string) string {
+	// Skip any leading dots, which do not start a suffix.
+	for len(fn) > 1 && fn[0] == '.' {
+		fn = fn[1:]
+	}
+	// Ignore the tilde of backup files.
+	if len(fn) > 1 && fn[len(fn)-1] == '~' {
+		fn = fn[:len(fn)-1]
+	}
+	var suffix string
+	for {
+		idx := strings.LastIndexByte(fn, '.')
+		if idx <= 0 {
+			break
+		}
+		s := fn[idx:]
+		fn = fn[:idx]
+		if s == ".bak" || s == ".old" || s == ".orig" {
+			continue
+		}
+		suffix = s
+		if len(s) == 1 {
+			break
+		}
+		// An all-digit suffix may not be that significant, so look for
+		// another one.
+		if strings.Trim(s[1:], "0123456789") != "" {
+			break
+		}
+	}
+	return suffix
+}
+
+const fuzzyUnit = 1 << 16
+
+// fuzzyDistance returns the Levenshtein distance of s1 and s2 (in units of
+// 1<<16), weighted by how different the changed characters are. Distances
+// which are known to exceed upperLimit are not computed.
+//
+// rsync/util1.c:fuzzy_distance
+func fuzzyDistance(s1, s2 string, upperLimit uint32) uint32 {
+	len1, len2 := len(s1), len(s2)
+	if uint32(max(len1-len2, len2-len1))*fuzzyUnit > upperLimit {
+		return 0xFFFF*fuzzyUnit + 1
+	}
+
+	if len1 == 0 || len2 == 0 {
+		if len1 == 0 {
+			s1 = s2
+		}
+		var cost int32
+		for i := 0; i < len(s1); i++ {
+			cost += int32(s1[i])
+		}
+		return uint32(int32(len(s1))*fuzzyUnit + cost)
+	}
+
+	a := make([]int32, len2)
+	for i2 := range a {
+		a[i2] = int32(i2+1) * fuzzyUnit
+	}
+	for i1 := 0; i1 < len1; i1++ {
+		diag := int32(i1) * fuzzyUnit
+		above := int32(i1+1) * fuzzyUnit
+		for i2 := 0; i2 < len2; i2++ {
+			left := a[i2]
+			cost := int32(s1[i1]) - int32(s2[i2])
+			if cost < 0 {
+				cost = fuzzyUnit - cost
+			} else if cost > 0 {
+				cost = fuzzyUnit + cost
+			}
+			diagInc := diag + cost
+			leftInc := left + fuzzyUnit + int32(s1[i1])
+			aboveInc := above + fuzzyUnit + int32(s2[i2])
+			if left < above {
+				above = min(leftInc, diagInc)
+			} else {
+				above = min(aboveInc, diagInc)
+			}
+			a[i2] = above
+			diag = left
+		}
+	}
+	return uint32(a[len2-1])
+}
@@ -6,6 +6,7 @@ import (
 	"io"
 	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
 	"syscall"
 	"time"
@@ -16,31 +17,97 @@ import (
 	"github.com/gokrazy/rsync/internal/rsyncopts"
 )
 
+// GenerateFiles requests the files of all file lists from the sender.
+//
 // rsync/generator.c:generate_files()
-func (rt *Transfer) GenerateFiles(fileList []*File) error {
+func (rt *Transfer) GenerateFiles() error {
 	phase := 0
-	for idx, f := range fileList {
-		if err := rt.recvGenerator(idx, f); err != nil {
-			return err
+	for fl := rt.newLists.pop(); fl != nil; {
+		if rt.deleteDuring() && fl.parent != nil && fl.parent.flags&flagContentDir != 0 {
+			// With incremental recursion, the extraneous files of a
+			// directory are known once its file list arrived.
+			if err := rt.deleteInDir(fl, fl.parent.Name); err != nil {
+				return err
+			}
+		}
+		for idx, f := range fl.files {
+			if err := rt.recvGenerator(fl.ndxStart+int32(idx), f); err != nil {
+				return err
+			}
+			// Except for dot dirs, the contents of directories follow in
+			// extra file lists with incremental recursion (see above).
+			if rt.deleteDuring() && f.flags&flagContentDir != 0 &&
+				(!rt.incRecurse() || f.Name == ".") {
+				if err := rt.deleteInDir(fl, f.Name); err != nil {
+					return err
+				}
+			}
 		}
+		// With incremental recursion, wait for the next file list (or the
+		// end of all file lists) before declaring this file list done.
+		next := rt.newLists.pop()
+		if next != nil {
+			if err := rt.Conn.WriteNdx(rt.Protocol, rsync.NDX_DONE); err != nil {
+				return err
+			}
+		}
+		fl = next
 	}
+	rt.closeDeleteScope()
 	phase++
 	if rt.Opts.DebugGTE(rsyncopts.DEBUG_GENR, 1) {
 		rt.Logger.Printf("generateFiles phase=%d", phase)
 	}
-	if err := rt.Conn.WriteInt32(-1); err != nil {
+	if err := rt.Conn.WriteNdx(rt.Protocol, rsync.NDX_DONE); err != nil {
 		return err
 	}
 
-	// TODO: re-do any files that failed
+	// Request the files which failed verification again, now with the
+	// entire strong checksum of each block. The receiver reports them until
+	// it finished the first phase.
+	//
+	// rsync/generator.c:check_for_finished_files
+	rt.redoing = true
+	for _, r := range rt.redo.wait() {
+		if err := rt.recvGenerator(r.ndx, r.f); err != nil {
+			return err
+		}
+	}
+	rt.redoing = false
+
 	phase++
 	if rt.Opts.DebugGTE(rsyncopts.DEBUG_GENR, 1) {
 		rt.Logger.Printf("generateFiles phase=%d", phase)
 	}
-	if err := rt.Conn.WriteInt32(-1); err != nil {
+	if err := rt.Conn.WriteNdx(rt.Protocol, rsync.NDX_DONE); err != nil {
 		return err
 	}
 
+	if rt.Opts.PreserveHardlinks {
+		// The heads of all hard link groups were transferred once the
+		// receiver finished the redo phase.
+		if !rt.redo.waitFinished() {
+			return nil // the receiver failed
+		}
+		for _, fl := range rt.flists {
+			if err := rt.doHardLinks(fl); err != nil {
+				return err
+			}
+		}
+	}
+
+	if rt.Protocol >= 29 {
+		// Protocol versions >= 29 have an additional phase for delayed
+		// updates, which we do not use.
+		phase++
+		if rt.Opts.DebugGTE(rsyncopts.DEBUG_GENR, 1) {
+			rt.Logger.Printf("generateFiles phase=%d", phase)
+		}
+		if err := rt.Conn.WriteNdx(rt.Protocol, rsync.NDX_DONE); err != nil {
+			return err
+		}
+	}
+
 	// NOTE: touchUpDirs is called from [Transfer.Do]
 	// so that both goroutines (generator and receiver)
 	// have finished before we set final permissions.
@@ -63,7 +130,7 @@ func (rt *Transfer) touchUpDirs(fileList []*File) error {
 		if rt.Opts.DryRun {
 			continue
 		}
-		if mode&syscall.S_IWUSR > 0 {
+		if mode&syscall.S_IWUSR > 0 && !rt.retouchDirTimes {
 			continue // directory is writeable, no touchup needed
 		}
 		if err := rt.setPerms(f, mode); err != nil {
@@ -73,35 +140,112 @@ func (rt *Transfer) touchUpDirs(fileList []*File) error {
 	return nil
 }
 
+// skipFile reports whether the existing file st (name f.Name in root) has
+// the same content as f, judging by size and modification time (or checksum).
+//
 // rsync/generator.c:skip_file
-func (rt *Transfer) skipFile(f *File, st os.FileInfo) (bool, error) {
+func (rt *Transfer) skipFile(root *os.Root, f *File, st os.FileInfo) (bool, error) {
 	if st.Size() != f.Length {
 		return false, nil
 	}
 
-	if rt.Opts.AlwaysChecksum {
-		checksum, err := rsyncchecksum.RootChecksum(rt.DestRoot, f.Name)
+	if rt.Opts.AlwaysChecksum && !rt.redoing {
+		checksum, err := rt.Checksums.File.RootChecksum(root, f.Name)
 		if err != nil {
 			return false, err
 		}
-		return bytes.Equal(f.Checksum[:], checksum[:]), nil
+		return bytes.Equal(f.Checksum[:len(checksum)], checksum), nil
 	}
 
 	// TODO: size only
 
-	if rt.Opts.IgnoreTimes {
+	// A file which failed verification differs from the destination file,
+	// whatever its modification time says.
+	if rt.Opts.IgnoreTimes || rt.redoing {
 		return false, nil
 	}
 
-	return modTimeEqual(st.ModTime(), f.ModTime), nil
+	return rt.modTimeEqual(st.ModTime(), f.ModTime), nil
 }
 
-func modTimeEqual(a, b time.Time) bool {
-	a = a.Truncate(time.Second)
-	b = b.Truncate(time.Second)
+// modTimeEqual compares modification times at the precision which the
+// protocol transfers: seconds, or nanoseconds starting with protocol 31.
+func (rt *Transfer) modTimeEqual(a, b time.Time) bool {
+	if rt.Protocol < 31 {
+		a = a.Truncate(time.Second)
+		b = b.Truncate(time.Second)
+	}
 	return a.Equal(b)
 }
 
+// itemFlags adds the changes of f compared to the existing file st (nil if
+// there is none) to the item flags iflags.
+//
+// rsync/generator.c:itemize
+func (rt *Transfer) itemFlags(f *File, st fs.FileInfo, iflags uint16) uint16 {
+	if rt.Opts.PreserveXattrs > 0 && rt.xattrsChanged(f, st != nil, true) {
+		iflags |= rsync.ITEM_REPORT_XATTR
+	}
+	if st == nil {
+		return iflags | rsync.ITEM_IS_NEW
+	}
+	if rt.aclsChanged(rt.DestRoot, f, st) {
+		iflags |= rsync.ITEM_REPORT_ACL
+	}
+	mode := f.Mode & rsync.S_IFMT
+	if mode == rsync.S_IFREG && f.Length != st.Size() {
+		iflags |= rsync.ITEM_REPORT_SIZE
+	}
+	// Symlink times are not preserved (see setPerms), so their time is
+	// reported as changed whenever the symlink is.
+	keepTime := rt.Opts.PreserveTimes && mode != rsync.S_IFLNK
+	if keepTime && !rt.modTimeEqual(st.ModTime(), f.ModTime) ||
+		!keepTime && iflags&(rsync.ITEM_TRANSFER|rsync.ITEM_LOCAL_CHANGE) != 0 {
+		iflags |= rsync.ITEM_REPORT_TIME
+	}
+	if rt.Opts.PreservePerms && mode != rsync.S_IFLNK &&
+		st.Mode().Perm() != fs.FileMode(f.Mode)&os.ModePerm {
+		iflags |= rsync.ITEM_REPORT_PERMS
+	}
+	changeUid, changeGid := rt.ownershipChanges(f, st)
+	if changeUid {
+		iflags |= rsync.ITEM_REPORT_OWNER
+	}
+	if changeGid {
+		iflags |= rsync.ITEM_REPORT_GROUP
+	}
+	return iflags
+}
+
+// itemize reports the changes of f compared to the existing file st (nil if
+// there is none) to the sender, which echoes them back for logging. Files
+// without significant changes are only reported with -ii or -vv.
+//
+// rsync/generator.c:itemize
+func (rt *Transfer) itemize(ndx int32, f *File, st fs.FileInfo, iflags uint16) error {
+	return rt.itemizeXname(ndx, f, st, iflags, "")
+}
+
+// itemizeXname is like itemize, but reports the hard link target xname (with
+// rsync.ITEM_XNAME_FOLLOWS), which is reported even without significant
+// changes.
+func (rt *Transfer) itemizeXname(ndx int32, f *File, st fs.FileInfo, iflags uint16, xname string) error {
+	iflags = rt.itemFlags(f, st, iflags)
+	if iflags&rsynccommon.SignificantItemFlags == 0 && xname == "" && !rt.Items.ReportUnchanged() {
+		return nil
+	}
+	if rt.Protocol < 29 {
+		// Only the indexes of transferred files can be sent, so log
+		// the item right away.
+		rt.Items.LogItem(f.logFile(), iflags, xname)
+		return nil
+	}
+	return rt.writeNdxAndAttrs(ndx, f, rsynccommon.ItemAttrs{
+		Flags: iflags,
+		Xname: xname,
+	})
+}
+
 // rsync/rsync.c:set_perms
 func (rt *Transfer) setPerms(f *File, mode fs.FileMode) error {
 	if rt.Opts.DryRun {
@@ -117,7 +261,7 @@ func (rt *Transfer) setPerms(f *File, mode fs.FileMode) error {
 	mode = mode & rsync.S_IFMT
 	if rt.Opts.PreserveTimes &&
 		mode != rsync.S_IFLNK &&
-		!modTimeEqual(st.ModTime(), f.ModTime) {
+		!rt.modTimeEqual(st.ModTime(), f.ModTime) {
 		if err := rt.DestRoot.Chtimes(f.Name, f.ModTime, f.ModTime); err != nil {
 			return err
 		}
@@ -134,13 +278,17 @@ func (rt *Transfer) setPerms(f *File, mode fs.FileMode) error {
 				return err
 			}
 		}
+		if err := rt.setACLs(f, st, perm); err != nil {
+			rt.Logger.Printf("%v", err)
+			rt.ReceiverIOErrors.Or(rsync.IOERR_GENERAL)
+		}
 	}
 
 	return nil
 }
 
 // rsync/generator.c:recv_generator
-func (rt *Transfer) recvGenerator(idx int, f *File) error {
+func (rt *Transfer) recvGenerator(ndx int32, f *File) error {
 	if rt.listOnly() {
 		fmt.Fprintf(rt.Env.Stdout, "%s %11.0f %s %s\n",
 			f.FileMode().String(),
@@ -158,13 +306,25 @@ func (rt *Transfer) recvGenerator(idx int, f *File) error {
 
 	mode := f.Mode & rsync.S_IFMT
 	if mode == rsync.S_IFDIR {
+		var destSt fs.FileInfo
+		if err == nil && st.IsDir() {
+			destSt = st
+		}
+		var iflags uint16
+		if destSt == nil {
+			iflags = rsync.ITEM_LOCAL_CHANGE
+		}
 		if rt.Opts.DryRun {
-			return nil
+			return rt.itemize(ndx, f, destSt, iflags)
+		}
+		if destSt != nil && rt.aclsChanged(rt.DestRoot, f, destSt) {
+			// Compare before setPerms applies the ACLs.
+			iflags |= rsync.ITEM_REPORT_ACL
 		}
 		if err == nil && !st.IsDir() {
 			// A file (not a directory) with this name exists. Delete it so that
 			// we can create a directory instead.
-			if err := rt.DestRoot.Remove(f.Name); err != nil {
+			if err := rt.removeInTheWay(f.Name, false); err != nil {
 				return fmt.Errorf("unlinking to make room for directory: %v", err)
 			}
 			err = fmt.Errorf("file removed")
@@ -189,14 +349,27 @@ func (rt *Transfer) recvGenerator(idx int, f *File) error {
 			rt.retouchDirPerms = true
 			mode |= syscall.S_IWUSR
 		}
+		if rt.Opts.PreserveTimes {
+			// Creating files inside the directory changes its
+			// modification time, so GenerateFiles needs to
+			// restore it afterwards.
+			rt.retouchDirTimes = true
+		}
 		if err := rt.setPerms(f, mode); err != nil {
 			return err
 		}
-		return nil
+		// Itemize once the directory exists: the receiver sets its
+		// extended attributes when it gets the item.
+		return rt.itemize(ndx, f, destSt, iflags)
 	}
 
 	if rt.Opts.PreserveLinks && mode == rsync.S_IFLNK {
-		// TODO: safe_symlinks option
+		if rt.Opts.SafeLinks && rsynccommon.UnsafeSymlink(f.LinkTarget, f.Name) {
+			if rt.Opts.InfoGTE(rsyncopts.INFO_NAME, 1) {
+				rt.Logger.Printf("ignoring unsafe symlink %q -> %q", f.Name, f.LinkTarget)
+			}
+			return nil
+		}
 		if err == nil {
 			// local file exists, verify target matches
 			if target, err := rt.DestRoot.Readlink(f.Name); err == nil {
@@ -204,6 +377,9 @@ func (rt *Transfer) recvGenerator(idx int, f *File) error {
 					rt.Logger.Printf("existing target: %q", target)
 				}
 				if target == f.LinkTarget {
+					if err := rt.itemize(ndx, f, st, 0); err != nil {
+						return err
+					}
 					if err := rt.setPerms(f, fs.FileMode(f.Mode)); err != nil {
 						return err
 					}
@@ -213,6 +389,20 @@ func (rt *Transfer) recvGenerator(idx int, f *File) error {
 			}
 			// fallthrough to create or replace the symlink
 		}
+		var destSt fs.FileInfo
+		if err == nil && st.Mode()&fs.ModeSymlink != 0 {
+			destSt = st
+		}
+		const iflags = rsync.ITEM_LOCAL_CHANGE | rsync.ITEM_REPORT_CHANGE
+		if rt.Opts.DryRun {
+			return rt.itemize(ndx, f, destSt, iflags)
+		}
+		if err == nil && !st.IsDir() && rt.Opts.MakeBackups {
+			// The symlink replaces the existing file atomically.
+			if _, err := rt.makeBackup(f.Name, false); err != nil {
+				return err
+			}
+		}
 		if rt.Opts.DebugGTE(rsyncopts.DEBUG_GENR, 1) {
 			rt.Logger.Printf("symlink %s -> %s", f.Name, f.LinkTarget)
 		}
@@ -222,21 +412,34 @@ func (rt *Transfer) recvGenerator(idx int, f *File) error {
 		if err := rt.setPerms(f, fs.FileMode(f.Mode)); err != nil {
 			return err
 		}
-		return nil
+		return rt.itemize(ndx, f, destSt, iflags)
 	}
 
 	if rt.Opts.PreserveDevices && (mode == rsync.S_IFCHR ||
 		mode == rsync.S_IFBLK ||
 		mode == rsync.S_IFSOCK ||
 		mode == rsync.S_IFIFO) {
+		if err != nil {
+			st = nil
+		}
+		if st != nil && st.Mode().Type() == f.FileMode().Type() {
+			// The device or special file exists.
+			return rt.itemize(ndx, f, st, 0)
+		}
+		const iflags = rsync.ITEM_LOCAL_CHANGE | rsync.ITEM_REPORT_CHANGE
+		if rt.Opts.DryRun {
+			return rt.itemize(ndx, f, st, iflags)
+		}
 		if err := rt.createDevice(f, st); err != nil {
 			return err
 		}
-		return nil
+		return rt.itemize(ndx, f, st, iflags)
 	}
 
-	if rt.Opts.PreserveHardlinks {
-		// TODO: hard link check
+	if rt.Opts.PreserveHardlinks && rt.hardLinkCheck(f) {
+		// f is hard-linked to the head of its group once the head was
+		// transferred, see doHardLinks.
+		return nil
 	}
 
 	if !f.FileMode().IsRegular() {
@@ -245,11 +448,11 @@ func (rt *Transfer) recvGenerator(idx int, f *File) error {
 		return nil
 	}
 
-	requestFullFile := func() error {
+	requestFullFile := func(iflags uint16) error {
 		if rt.Opts.DebugGTE(rsyncopts.DEBUG_GENR, 1) {
 			rt.Logger.Printf("requesting: %s", f.Name)
 		}
-		if err := rt.Conn.WriteInt32(int32(idx)); err != nil {
+		if err := rt.writeNdx(ndx, f, iflags); err != nil {
 			return err
 		}
 		if rt.Opts.DryRun {
@@ -262,71 +465,234 @@ func (rt *Transfer) recvGenerator(idx int, f *File) error {
 		return nil
 	}
 
-	if os.IsNotExist(err) {
-		return requestFullFile()
+	if rt.Opts.FuzzyBasis > 0 {
+		rt.markFuzzySent(f)
 	}
-	if err != nil {
-		return err
+
+	// A partial file from an interrupted transfer is a better basis than
+	// the destination file (if any). Only protocol 29 and newer can tell the
+	// receiver about the basis file.
+	var partialName string
+	var partialSt fs.FileInfo
+	if rt.partialDir != "" && rt.Protocol >= 29 {
+		name := rt.partialName(f.Name)
+		if pst, err := rt.DestRoot.Lstat(name); err == nil && pst.Mode().IsRegular() {
+			partialName, partialSt = name, pst
+		}
 	}
 
-	if !st.Mode().IsRegular() {
+	exists := false
+	switch {
+	case os.IsNotExist(err):
+
+	case err != nil:
+		return err
+
+	case !st.Mode().IsRegular():
 		// A non-regular file with this name exists. Delete it so that we can
 		// create our file instead.
-		if err := rt.DestRoot.Remove(f.Name); err != nil {
+		if err := rt.removeInTheWay(f.Name, st.IsDir()); err != nil {
 			return fmt.Errorf("unlinking to make room for regular file: %v", err)
 		}
-		return requestFullFile()
-	}
 
-	// TODO: update-only check
+	default:
+		exists = true
+	}
 
-	skip, err := rt.skipFile(f, st)
-	if err != nil {
-		return err
+	iflags := uint16(rsync.ITEM_TRANSFER)
+	if rt.Opts.AlwaysChecksum {
+		iflags |= rsync.ITEM_REPORT_CHANGE
+	}
+	var destSt fs.FileInfo
+	if exists {
+		destSt = st
+	}
+	iflags = rt.itemFlags(f, destSt, iflags)
+
+	// The alternate basis directories can provide the whole file, or a
+	// basis file if the destination file does not exist. --copy-dest does
+	// not replace existing destination files.
+	basisDir := -1
+	if len(rt.basisDirs) > 0 && (!exists || rt.Opts.AltDestType != rsyncopts.COPY_DEST) {
+		var existing fs.FileInfo
+		if exists {
+			existing = st
+		}
+		j, basisSt, done := rt.tryBasisDirs(f, existing)
+		if done {
+			if partialName != "" && !rt.Opts.DryRun {
+				rt.removePartial(partialName)
+			}
+			return nil
+		}
+		if j >= 0 {
+			basisDir, st = j, basisSt
+		}
 	}
-	if skip {
-		if rt.Opts.InfoGTE(rsyncopts.INFO_SKIP, 1) {
-			rt.Logger.Printf("skipping %s", local)
+
+	// A similarly named file is a better basis than none (--fuzzy).
+	var fuzzy *fuzzyFile
+	var fuzzyList int
+	if !exists && basisDir < 0 && partialName == "" && rt.Opts.FuzzyBasis > 0 {
+		fuzzy, fuzzyList = rt.findFuzzy(f)
+		if fuzzy != nil {
+			st = fuzzy.st
+			if rt.Opts.DebugGTE(rsyncopts.DEBUG_FUZZY, 1) {
+				rt.Logger.Printf("fuzzy basis selected for %s: %s", f.Name, path.Join(path.Dir(f.Name), st.Name()))
+			}
 		}
-		if err := rt.setPerms(f, fs.FileMode(f.Mode)); err != nil {
+	}
+
+	if !exists && basisDir < 0 && partialName == "" && fuzzy == nil {
+		return requestFullFile(iflags)
+	}
+
+	if exists {
+		// TODO: update-only check
+
+		skip, err := rt.skipFile(rt.DestRoot, f, st)
+		if err != nil {
 			return err
 		}
-		return nil
+		if skip {
+			if err := rt.itemize(ndx, f, st, 0); err != nil {
+				return err
+			}
+		} else if rt.Opts.AppendMode > 0 && !rt.redoing && st.Size() >= f.Length {
+			// Only data beyond the length of the destination file is
+			// transferred, and there is none.
+			skip = true
+		}
+		if skip {
+			if rt.Opts.InfoGTE(rsyncopts.INFO_SKIP, 1) {
+				rt.Logger.Printf("skipping %s", local)
+			}
+			if partialName != "" && !rt.Opts.DryRun {
+				rt.removePartial(partialName)
+			}
+			if err := rt.setPerms(f, fs.FileMode(f.Mode)); err != nil {
+				return err
+			}
+			return nil
+		}
 	}
 
 	if rt.Opts.DryRun {
-		if err := rt.Conn.WriteInt32(int32(idx)); err != nil {
+		if err := rt.writeNdx(ndx, f, iflags); err != nil {
 			return err
 		}
 
 		return nil
 	}
 
-	// TODO: if deltas are disabled, request the file in full
+	attrs := rsynccommon.ItemAttrs{Flags: iflags}
+	root, basis := rt.DestRoot, f.Name
+	if partialName != "" {
+		basis, st = partialName, partialSt
+		attrs.Flags |= rsync.ITEM_BASIS_TYPE_FOLLOWS
+		attrs.FnamecmpType = rsync.FNAMECMP_PARTIAL_DIR
+	} else if basisDir >= 0 {
+		root = rt.basisDirs[basisDir].root
+		if rt.Protocol >= 29 {
+			attrs.Flags |= rsync.ITEM_BASIS_TYPE_FOLLOWS
+			attrs.FnamecmpType = byte(rsync.FNAMECMP_BASIS_DIR_LOW + basisDir)
+		}
+	} else if fuzzy != nil {
+		root = rt.fuzzyRoot(fuzzyList)
+		basis = path.Join(path.Dir(f.Name), fuzzy.st.Name())
+		attrs.Flags |= rsync.ITEM_BASIS_TYPE_FOLLOWS | rsync.ITEM_XNAME_FOLLOWS
+		attrs.FnamecmpType = byte(rsync.FNAMECMP_FUZZY + fuzzyList)
+		attrs.Xname = fuzzy.st.Name()
+	} else if rt.Opts.Inplace && rt.Opts.MakeBackups {
+		var bname string
+		var err error
+		if rt.redoing {
+			// The backup was made when the file was first requested.
+			bname, err = rt.backupName(f.Name)
+			if err == nil {
+				st, err = rt.DestRoot.Lstat(bname)
+			}
+		} else {
+			bname, err = rt.copyBackup(f.Name, st)
+		}
+		if err != nil {
+			return err
+		}
+		basis = bname
+		if rt.Protocol >= 29 {
+			attrs.Flags |= rsync.ITEM_BASIS_TYPE_FOLLOWS
+			attrs.FnamecmpType = rsync.FNAMECMP_BACKUP
+		}
+	}
 
-	in, err := rt.DestRoot.Open(f.Name)
+	if rt.Opts.WholeFile {
+		// Deltas are disabled: request the file in full.
+		if rt.Opts.DebugGTE(rsyncopts.DEBUG_GENR, 1) {
+			rt.Logger.Printf("requesting: %s", f.Name)
+		}
+		if err := rt.writeNdxAndAttrs(ndx, f, attrs); err != nil {
+			return err
+		}
+		var sh rsync.SumHead
+		return sh.WriteTo(rt.Conn)
+	}
+
+	in, err := root.Open(basis)
 	if err != nil {
-		rt.Logger.Printf("failed to open %s, continuing: %v", local, err)
-		return requestFullFile()
+		rt.Logger.Printf("failed to open %s, continuing: %v", filepath.Join(root.Name(), basis), err)
+		return requestFullFile(iflags)
 	}
 	defer in.Close()
 
 	if rt.Opts.DebugGTE(rsyncopts.DEBUG_GENR, 1) {
-		rt.Logger.Printf("sending sums for: %s", f.Name)
+		rt.Logger.Printf("sending sums for: %s (basis %s)", f.Name, basis)
 	}
-	if err := rt.Conn.WriteInt32(int32(idx)); err != nil {
+	if err := rt.writeNdxAndAttrs(ndx, f, attrs); err != nil {
 		return err
 	}
 
 	return rt.generateAndSendSums(in, st.Size())
 }
 
+// writeNdx requests the transfer of the file list entry ndx (f) from the
+// sender, or reports its item flags.
+func (rt *Transfer) writeNdx(ndx int32, f *File, iflags uint16) error {
+	return rt.writeNdxAndAttrs(ndx, f, rsynccommon.ItemAttrs{
+		Flags: iflags,
+	})
+}
+
+// writeNdxAndAttrs writes the file list index ndx (f) and its item
+// attributes, followed by the request of abbreviated extended attribute
+// values.
+//
+// rsync/generator.c:itemize
+func (rt *Transfer) writeNdxAndAttrs(ndx int32, f *File, attrs rsynccommon.ItemAttrs) error {
+	if err := rsynccommon.WriteNdxAndAttrs(rt.Conn, rt.Protocol, ndx, attrs); err != nil {
+		return err
+	}
+	if rt.Opts.PreserveXattrs == 0 || rt.Opts.DryRun ||
+		attrs.Flags&(rsync.ITEM_REPORT_XATTR|rsync.ITEM_TRANSFER) == 0 {
+		return nil
+	}
+	return rt.sendXattrRequest(f, rsynccommon.XattrRequestFollows(rt.Protocol, rt.CompatFlags, attrs))
+}
+
 // rsync/generator.c:generate_and_send_sums
 func (rt *Transfer) generateAndSendSums(in *os.File, fileLen int64) error {
-	sh := rsynccommon.SumSizesSqroot(fileLen)
+	csumLength := rsynccommon.ShortSumLength
+	if rt.redoing {
+		csumLength = rt.Checksums.Xfer.Size()
+	}
+	sh := rsynccommon.SumSizesSqroot(rt.Protocol, fileLen, int32(rt.Opts.BlockSize), csumLength, rt.Checksums.Xfer.Size())
 	if err := sh.WriteTo(rt.Conn); err != nil {
 		return err
 	}
+	if rt.Opts.AppendMode > 0 && !rt.redoing {
+		// The sender only needs the length of the basis file, see
+		// rsync.SumHead.FileLength.
+		return nil
+	}
 	buf := make([]byte, int(sh.BlockLength))
 	remaining := fileLen
 	for i := int32(0); i < sh.ChecksumCount; i++ {
@@ -337,11 +703,11 @@ func (rt *Transfer) generateAndSendSums(in *os.File, fileLen int64) error {
 		}
 
 		sum1 := rsyncchecksum.Checksum1(b)
-		sum2 := rsyncchecksum.Checksum2(rt.Seed, b)
+		sum2 := rt.Checksums.Xfer.Checksum2(rt.Seed, rt.properSeedOrder(), b)
 		if err := rt.Conn.WriteInt32(int32(sum1)); err != nil {
 			return err
 		}
-		if _, err := rt.Conn.Writer.Write(sum2); err != nil {
+		if _, err := rt.Conn.Writer.Write(sum2[:sh.ChecksumLength]); err != nil {
 			return err
 		}
 		remaining -= n1
@@ -10,6 +10,12 @@ import (
 	"golang.org/x/sys/unix"
 )
 
+// makeDev combines the device major and minor numbers transmitted by
+// protocol versions >= 28.
+func makeDev(major, minor uint32) int32 {
+	return int32(unix.Mkdev(major, minor))
+}
+
 func (rt *Transfer) createDevice(f *File, st fs.FileInfo) error {
 	local := filepath.Join(rt.Dest, f.Name)
 	perm := fs.FileMode(f.Mode) & os.ModePerm
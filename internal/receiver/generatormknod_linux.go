@@ -12,6 +12,12 @@ import (
 	"golang.org/x/sys/unix"
 )
 
+// makeDev combines the device major and minor numbers transmitted by
+// protocol versions >= 28.
+func makeDev(major, minor uint32) int32 {
+	return int32(unix.Mkdev(major, minor))
+}
+
 func (rt *Transfer) createDevice(f *File, st fs.FileInfo) error {
 	base := filepath.Base(f.Name)
 	parentDir, err := rt.DestRoot.OpenFile(filepath.Dir(f.Name), 0, 0)
@@ -7,3 +7,7 @@ import "io/fs"
 func (rt *Transfer) createDevice(*File, fs.FileInfo) error {
 	return nil
 }
+
+func makeDev(major, minor uint32) int32 {
+	return int32(major<<8 | minor)
+}
@@ -32,21 +32,34 @@ var inGroup = func() map[uint32]bool {
 	return m
 }()
 
-func (rt *Transfer) setUid(f *File, st fs.FileInfo) (fs.FileInfo, error) {
+// ownershipChanges reports whether setUid changes the owner and group of st.
+func (rt *Transfer) ownershipChanges(f *File, st fs.FileInfo) (changeUid, changeGid bool) {
 	stt := st.Sys().(*syscall.Stat_t)
 
-	changeUid := rt.Opts.PreserveUid &&
+	changeUid = rt.Opts.PreserveUid &&
 		amRoot &&
 		stt.Uid != uint32(f.Uid)
 
-	changeGid := rt.Opts.PreserveGid &&
+	changeGid = rt.Opts.PreserveGid &&
 		(amRoot || inGroup[uint32(f.Gid)]) &&
 		stt.Gid != uint32(f.Gid)
 
+	return changeUid, changeGid
+}
+
+// rsync/generator.c:ownership_differs
+func (rt *Transfer) ownershipDiffers(f *File, st fs.FileInfo) bool {
+	changeUid, changeGid := rt.ownershipChanges(f, st)
+	return changeUid || changeGid
+}
+
+func (rt *Transfer) setUid(f *File, st fs.FileInfo) (fs.FileInfo, error) {
+	changeUid, changeGid := rt.ownershipChanges(f, st)
 	if !changeUid && !changeGid {
 		return st, nil
 	}
 
+	stt := st.Sys().(*syscall.Stat_t)
 	uid := stt.Uid
 	if changeUid {
 		uid = uint32(f.Uid)
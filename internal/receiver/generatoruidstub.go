@@ -7,3 +7,11 @@ import "io/fs"
 func (rt *Transfer) setUid(_ *File, st fs.FileInfo) (fs.FileInfo, error) {
 	return st, nil
 }
+
+func (rt *Transfer) ownershipDiffers(_ *File, _ fs.FileInfo) bool {
+	return false
+}
+
+func (rt *Transfer) ownershipChanges(*File, fs.FileInfo) (changeUid, changeGid bool) {
+	return false, false
+}
@@ -0,0 +1,137 @@
+package receiver
+
+import (
+	"cmp"
+	"fmt"
+	"os"
+	"slices"
+
+	"github.com/gokrazy/rsync"
+	"github.com/gokrazy/rsync/internal/rsyncopts"
+)
+
+// initHardLinks groups the hard linked files of the (sorted) file list by
+// their device and inode number. Within each group, the first file is
+// transferred and all other files are hard-linked to it (see doHardLinks).
+//
+// rsync/hlink.c:init_hard_links
+func initHardLinks(fileList []*File) {
+	var hlinkList []*File
+	for _, f := range fileList {
+		if f.hlinked {
+			hlinkList = append(hlinkList, f)
+		}
+	}
+	// The stable sort keeps file list order within a group.
+	slices.SortStableFunc(hlinkList, func(a, b *File) int {
+		if c := cmp.Compare(a.Dev, b.Dev); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Inode, b.Inode)
+	})
+	for start := 0; start < len(hlinkList); {
+		head := hlinkList[start]
+		end := start + 1
+		for end < len(hlinkList) &&
+			hlinkList[end].Dev == head.Dev &&
+			hlinkList[end].Inode == head.Inode {
+			end++
+		}
+		if end-start > 1 {
+			for _, f := range hlinkList[start:end] {
+				f.linkHead = head
+			}
+		}
+		start = end
+	}
+}
+
+// addHardLink assigns f (with file list index ndx) to its hard link group
+// while receiving with incremental recursion. Hard link groups span file
+// lists, so they are tracked by the index of their first file (which
+// protocol 30 transmits in place of the device and inode number) instead of
+// using initHardLinks.
+func (rt *Transfer) addHardLink(f *File, ndx int32) error {
+	if f.Inode == int64(ndx) {
+		// f is the first file of its group.
+		if rt.linkHeads == nil {
+			rt.linkHeads = make(map[int32]*File)
+		}
+		rt.linkHeads[ndx] = f
+		f.linkHead = f
+		return nil
+	}
+	head, ok := rt.linkHeads[int32(f.Inode)]
+	if !ok {
+		return fmt.Errorf("hard link reference out of range: %d", f.Inode)
+	}
+	f.linkHead = head
+	return nil
+}
+
+// hardLinkCheck reports whether the transfer of f should be skipped because
+// f will be hard-linked to the head of its hard link group.
+//
+// rsync/hlink.c:hard_link_check
+func (rt *Transfer) hardLinkCheck(f *File) bool {
+	return f.linkHead != nil && f.linkHead != f
+}
+
+// doHardLinks creates the hard links for all files of fl which were skipped
+// by hardLinkCheck, once the heads of their groups have been transferred.
+//
+// rsync/hlink.c:finish_hard_link
+func (rt *Transfer) doHardLinks(fl *fileList) error {
+	for idx, f := range fl.files {
+		if !rt.hardLinkCheck(f) {
+			continue
+		}
+		if err := rt.hardLinkOne(fl.ndxStart+int32(idx), f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hardLinkOne hard-links f (with file list index ndx) to the head of its
+// group and itemizes it as “hf” with the name of the head.
+//
+// rsync/hlink.c:maybe_hard_link
+func (rt *Transfer) hardLinkOne(ndx int32, f *File) error {
+	head := f.linkHead
+	headSt, err := rt.DestRoot.Lstat(head.Name)
+	if err != nil {
+		// The head could not be transferred, which was already reported.
+		rt.Logger.Printf("hard link target %s missing: %v", head.Name, err)
+		return nil
+	}
+	const iflags = rsync.ITEM_LOCAL_CHANGE | rsync.ITEM_XNAME_FOLLOWS
+	st, err := rt.DestRoot.Lstat(f.Name)
+	if err != nil {
+		st = nil
+	}
+	if st != nil {
+		if os.SameFile(st, headSt) {
+			// Already linked, which is only itemized with -ii.
+			return rt.itemizeXname(ndx, f, st, iflags, "")
+		}
+		if st.IsDir() {
+			rt.Logger.Printf("cannot hard link %s: is a directory", f.Name)
+			return nil
+		}
+		if !rt.Opts.DryRun {
+			if err := rt.removeInTheWay(f.Name, false); err != nil {
+				return err
+			}
+		}
+	}
+	if !rt.Opts.DryRun {
+		if err := rt.DestRoot.Link(head.Name, f.Name); err != nil {
+			return err
+		}
+	}
+	if rt.Opts.Server && rt.Opts.InfoGTE(rsyncopts.INFO_NAME, 1) {
+		rt.Logger.Printf("%s => %s", f.Name, head.Name)
+	}
+	return rt.itemizeXname(ndx, f, st, iflags, head.Name)
+}
@@ -0,0 +1,83 @@
+package receiver
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+)
+
+// partialName returns the name under which the partially transferred file
+// name is kept in the partial directory.
+//
+// rsync/util1.c:partial_dir_fname
+func (rt *Transfer) partialName(name string) string {
+	if rt.partialDirShared {
+		return path.Join(rt.partialDir, path.Base(name))
+	}
+	return path.Join(path.Dir(name), rt.partialDir, path.Base(name))
+}
+
+// handlePartialDir creates the partial directory of partialName (removing a
+// non-directory in the way), or with create == false, removes the partial
+// directory if it is empty.
+//
+// rsync/util1.c:handle_partial_dir
+func (rt *Transfer) handlePartialDir(partialName string, create bool) error {
+	dir := path.Dir(partialName)
+	if !create {
+		rt.DestRoot.Remove(dir) // fails if not empty
+		return nil
+	}
+	st, err := rt.DestRoot.Lstat(dir)
+	if err == nil && st.IsDir() {
+		return nil
+	}
+	if err == nil {
+		if err := rt.DestRoot.Remove(dir); err != nil {
+			return err
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return rt.DestRoot.MkdirAll(dir, 0700)
+}
+
+// keepPartial keeps the partially received file out instead of deleting it:
+// in the partial directory (--partial-dir), or under its final name
+// (--partial). The next transfer uses the partial file as basis.
+//
+// rsync/cleanup.c:_exit_cleanup
+func (rt *Transfer) keepPartial(f *File, out *pendingFile) error {
+	name := f.Name
+	if rt.partialDir != "" {
+		name = rt.partialName(f.Name)
+		if err := rt.handlePartialDir(name, true); err != nil {
+			return err
+		}
+		if err := out.CloseAndRename(name); err != nil {
+			return err
+		}
+	} else {
+		if rt.Opts.MakeBackups {
+			if _, err := rt.makeBackup(f.Name, false); err != nil {
+				return err
+			}
+		}
+		if err := out.CloseAtomicallyReplace(); err != nil {
+			return err
+		}
+	}
+	// Like tridge rsync, keep the modification time of the partial file, so
+	// that the next transfer does not consider it up to date.
+	return rt.DestRoot.Chmod(name, fs.FileMode(f.Mode)&os.ModePerm)
+}
+
+// removePartial removes the partial file which the transfer of a file used as
+// basis, and its partial directory (if empty).
+func (rt *Transfer) removePartial(partialName string) {
+	if err := rt.DestRoot.Remove(partialName); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		rt.Logger.Printf("removing partial file: %v", err)
+	}
+	rt.handlePartialDir(partialName, false)
+}
@@ -2,46 +2,124 @@ package receiver
 
 import (
 	"bytes"
-	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
 
 	"github.com/gokrazy/rsync"
+	"github.com/gokrazy/rsync/internal/rsynccommon"
 	"github.com/gokrazy/rsync/internal/rsyncopts"
-	"github.com/mmcloughlin/md4"
+	"github.com/gokrazy/rsync/internal/xattr"
 )
 
+// errFailedVerification is returned when the whole-file checksum of a
+// received file does not match. The short strong checksums of the blocks (see
+// rsynccommon.SumSizesSqroot) make this possible, so the generator requests
+// such files again.
+var errFailedVerification = errors.New("failed verification")
+
+// RecvFiles receives the files which the generator requested, and (with
+// incremental recursion) the extra file lists.
+//
 // rsync/receiver.c:recv_files
-func (rt *Transfer) RecvFiles(fileList []*File) error {
+func (rt *Transfer) RecvFiles() error {
+	// Wake up the generator if no more file lists arrive.
+	defer rt.newLists.close()
+	defer rt.redo.finish(false)
 	phase := 0
+	maxPhase := 1
+	if rt.Protocol >= 29 {
+		maxPhase = 2
+	}
 	for {
-		idx, err := rt.Conn.ReadInt32()
+		idx, attrs, err := rsynccommon.ReadNdxAndAttrs(rt.Conn, rt.Protocol)
 		if err != nil {
 			return err
 		}
-		if idx == -1 {
-			if phase == 0 {
-				phase++
-				if rt.Opts.DebugGTE(rsyncopts.DEBUG_RECV, 1) {
-					rt.Logger.Printf("recvFiles phase=%d", phase)
+		if idx == rsync.NDX_FLIST_EOF && rt.incRecurse() {
+			rt.newLists.close()
+			continue
+		}
+		if idx <= rsync.NDX_FLIST_OFFSET && rt.incRecurse() {
+			if err := rt.recvExtraFileList(rsync.NDX_FLIST_OFFSET - idx); err != nil {
+				return err
+			}
+			continue
+		}
+		if idx == rsync.NDX_DONE {
+			if rt.incRecurse() && rt.flistsDone < len(rt.flists) {
+				// The sender finished a file list.
+				rt.flistsDone++
+				if rt.flistsDone < len(rt.flists) {
+					continue
 				}
-				// TODO: send done message
-				continue
 			}
-			break
+			phase++
+			if phase == 2 {
+				// The files to redo were received.
+				rt.redo.finish(true)
+			}
+			if phase > maxPhase {
+				break
+			}
+			if rt.Opts.DebugGTE(rsyncopts.DEBUG_RECV, 1) {
+				rt.Logger.Printf("recvFiles phase=%d", phase)
+			}
+			if phase == 1 {
+				// All files which failed verification are known.
+				rt.receivingRedo = true
+				rt.redo.close()
+			}
+			continue
+		}
+		if idx < 0 {
+			return fmt.Errorf("invalid file index %d", idx)
+		}
+		f, err := rt.fileForIndex(idx)
+		if err != nil {
+			return err
+		}
+		if rt.Opts.PreserveXattrs > 0 && !rt.Opts.DryRun &&
+			rsynccommon.XattrRequestFollows(rt.Protocol, rt.CompatFlags, attrs) {
+			if err := rt.recvXattrRequest(f); err != nil {
+				return err
+			}
+		}
+		if attrs.Flags&rsync.ITEM_TRANSFER == 0 {
+			// No file data follows, the generator only itemized f.
+			if f != nil {
+				rt.Items.MaybeLogItem(f.logFile(), attrs.Flags, attrs.Xname)
+				rt.maybeSetXattrs(f, attrs)
+			}
+			continue
+		}
+		if f == nil {
+			return fmt.Errorf("cannot receive directory index %d", idx)
 		}
 		if rt.Opts.DebugGTE(rsyncopts.DEBUG_RECV, 1) {
-			rt.Logger.Printf("receiving file idx=%d: %+v", idx, fileList[idx])
+			rt.Logger.Printf("receiving file idx=%d: %+v", idx, f)
 		}
-		if rt.Opts.Progress {
-			fmt.Fprintln(rt.Env.Stdout, fileList[idx].Name)
+		if rt.Opts.DryRun {
+			rt.Items.LogItem(f.logFile(), attrs.Flags, "")
+			continue
 		}
-		if err := rt.recvFile1(fileList[idx]); err != nil {
+		rt.Items.BeginTransfer(f.logFile(), attrs.Flags)
+		err = rt.recvFile1(f, attrs)
+		if errors.Is(err, errFailedVerification) && phase == 0 {
+			if rt.Opts.InfoGTE(rsyncopts.INFO_NAME, 1) {
+				rt.Logger.Printf("WARNING: %s failed verification -- update discarded (will try again).", f.Name)
+			}
+			rt.redo.push(idx, f)
+			continue
+		}
+		if err != nil {
 			return err
 		}
+		rt.Items.EndTransfer(f.logFile(), attrs.Flags)
 	}
 	if rt.Opts.DebugGTE(rsyncopts.DEBUG_RECV, 1) {
 		rt.Logger.Printf("recvFiles finished")
@@ -49,27 +127,71 @@ func (rt *Transfer) RecvFiles(fileList []*File) error {
 	return nil
 }
 
-func (rt *Transfer) recvFile1(f *File) error {
-	if rt.Opts.DryRun {
-		if !rt.Opts.Server {
-			fmt.Fprintln(rt.Env.Stdout, f.Name)
+func (rt *Transfer) recvFile1(f *File, attrs rsynccommon.ItemAttrs) error {
+	// The generator tells us (via the sender) which basis file it used.
+	root, basis := rt.DestRoot, f.Name
+	follows := attrs.Flags&rsync.ITEM_BASIS_TYPE_FOLLOWS != 0
+	usePartial := false
+	altBasis := false // another file than the destination file or its backup
+	switch {
+	case follows && attrs.FnamecmpType <= rsync.FNAMECMP_BASIS_DIR_HIGH:
+		if j := int(attrs.FnamecmpType); j < len(rt.basisDirs) && rt.basisDirs[j].root != nil {
+			root = rt.basisDirs[j].root
 		}
-		return nil
+		altBasis = true
+
+	case follows && attrs.FnamecmpType >= rsync.FNAMECMP_FUZZY:
+		// The generator chose a similarly named file, see findFuzzy.
+		i := int(attrs.FnamecmpType - rsync.FNAMECMP_FUZZY)
+		if i > len(rt.basisDirs) {
+			return fmt.Errorf("invalid basis_dir index: %d", i)
+		}
+		if r := rt.fuzzyRoot(i); r != nil {
+			root = r
+		}
+		basis = path.Join(path.Dir(f.Name), attrs.Xname)
+		altBasis = true
+
+	case follows && attrs.FnamecmpType == rsync.FNAMECMP_PARTIAL_DIR && rt.partialDir != "":
+		basis = rt.partialName(f.Name)
+		usePartial = true
+
+	case follows && attrs.FnamecmpType == rsync.FNAMECMP_BACKUP,
+		rt.Protocol < 29 && rt.Opts.Inplace && rt.Opts.MakeBackups:
+		// The generator copied the destination file, see copyBackup.
+		bname, err := rt.backupName(f.Name)
+		if err != nil {
+			return err
+		}
+		basis = bname
 	}
+	// With --inplace, the basis file (the destination file or its backup
+	// copy) has the same content as the file being written.
+	updatingBasis := rt.Opts.Inplace && !usePartial && !altBasis
 
-	localFile, err := rt.openLocalFile(f)
+	localFile, err := rt.openLocalFile(root, f, basis)
+	if os.IsNotExist(err) && !follows && rt.Protocol < 29 &&
+		len(rt.basisDirs) > 0 && rt.basisDirs[0].root != nil {
+		// Protocol versions < 29 allowed only one alternate basis
+		// directory, which the generator did not need to tell us about.
+		updatingBasis = false
+		localFile, err = rt.openLocalFile(rt.basisDirs[0].root, f, basis)
+	}
 	if err != nil && !os.IsNotExist(err) {
 		rt.Logger.Printf("opening local file failed, continuing: %v", err)
 	}
 	defer localFile.Close()
-	if err := rt.receiveData(f, localFile); err != nil {
+	if err := rt.receiveData(f, localFile, updatingBasis); err != nil {
 		return err
 	}
+	if usePartial {
+		rt.removePartial(basis)
+	}
 	return nil
 }
 
-func (rt *Transfer) openLocalFile(f *File) (*os.File, error) {
-	in, err := rt.DestRoot.Open(f.Name)
+func (rt *Transfer) openLocalFile(root *os.Root, f *File, basis string) (*os.File, error) {
+	in, err := root.Open(basis)
 	if err != nil {
 		return nil, err
 	}
@@ -80,7 +202,7 @@ func (rt *Transfer) openLocalFile(f *File) (*os.File, error) {
 	}
 
 	if st.IsDir() {
-		return nil, fmt.Errorf("%s is a directory", filepath.Join(rt.Dest, f.Name))
+		return nil, fmt.Errorf("%s is a directory", filepath.Join(root.Name(), basis))
 	}
 
 	if !st.Mode().IsRegular() {
@@ -96,11 +218,17 @@ func (rt *Transfer) openLocalFile(f *File) (*os.File, error) {
 	return in, nil
 }
 
+// receiveData receives the data of f, consisting of literal data and blocks
+// of localFile (the basis file, if any). With --inplace, the data is written
+// into the destination file directly, otherwise into a temporary file which
+// replaces the destination file once complete. With updatingBasis, blocks
+// which are already in place are not written again.
+//
 // rsync/receiver.c:receive_data
-func (rt *Transfer) receiveData(f *File, localFile *os.File) error {
+func (rt *Transfer) receiveData(f *File, localFile *os.File, updatingBasis bool) (err error) {
 	rt.Progress.Reset(uint64(f.Length))
 	var sh rsync.SumHead
-	if err := sh.ReadFrom(rt.Conn); err != nil {
+	if err := sh.ReadFrom(rt.Conn, rt.Protocol); err != nil {
 		return err
 	}
 
@@ -108,18 +236,55 @@ func (rt *Transfer) receiveData(f *File, localFile *os.File) error {
 		local := filepath.Join(rt.Dest, f.Name)
 		rt.Logger.Printf("creating %s", local)
 	}
-	out, err := newPendingFile(rt.DestRoot, f.Name)
+	var (
+		file *os.File     // receives the data
+		out  *pendingFile // without --inplace
+	)
+	gotLiteral := false
+	if rt.Opts.Inplace {
+		file, err = rt.DestRoot.OpenFile(f.Name, os.O_WRONLY|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+	} else {
+		out, err = newPendingFile(rt.DestRoot, f.Name)
+		if err != nil {
+			return err
+		}
+		defer out.Cleanup()
+		defer func() {
+			// A partial file is only useful if it contains data which the
+			// basis file did not already provide.
+			if err != nil && gotLiteral && rt.Opts.KeepPartial {
+				if err := rt.keepPartial(f, out); err != nil {
+					rt.Logger.Printf("keeping partial file %s failed: %v", f.Name, err)
+				}
+			}
+		}()
+		file = out.file()
+	}
+	w, err := rt.newFileWriter(f, file)
 	if err != nil {
 		return err
 	}
-	defer out.Cleanup()
 
-	h := md4.New()
-	binary.Write(h, binary.LittleEndian, rt.Seed)
+	h := rt.Checksums.Xfer.New(rt.Seed)
 
-	wr := io.MultiWriter(out, h)
+	wr := io.MultiWriter(w, h)
 
-	offset := 0
+	var offset int64
+	if rt.Opts.AppendMode > 0 && !rt.receivingRedo {
+		// The sender only sends the data beyond the length of the basis
+		// file, which is the destination file.
+		offset = sh.FileLength()
+		if rt.appendVerify() && localFile != nil {
+			if _, err := io.Copy(h, io.NewSectionReader(localFile, 0, offset)); err != nil {
+				return err
+			}
+		}
+		w.seekTo(offset)
+	}
 	for {
 		token, data, err := rt.recvToken()
 		if err != nil {
@@ -141,11 +306,12 @@ func (rt *Transfer) receiveData(f *File, localFile *os.File) error {
 			if err != nil {
 				return err
 			}
-			offset += n
+			offset += int64(n)
+			gotLiteral = true
 			continue
 		}
 		if localFile == nil {
-			return fmt.Errorf("BUG: local file %s not open for copying chunk", out.Name())
+			return fmt.Errorf("BUG: local file %s not open for copying chunk", f.Name)
 		}
 		token = -(token + 1)
 		offset2 := int64(token) * int64(sh.BlockLength)
@@ -157,12 +323,23 @@ func (rt *Transfer) receiveData(f *File, localFile *os.File) error {
 		if _, err := localFile.ReadAt(data, offset2); err != nil {
 			return err
 		}
+		rt.seeToken(data)
+
+		if updatingBasis && offset == offset2 {
+			// The block is already in place.
+			h.Write(data)
+			if err := w.skip(int64(dataLen)); err != nil {
+				return err
+			}
+			offset += int64(dataLen)
+			continue
+		}
 
 		n, err := wr.Write(data)
 		if err != nil {
 			return err
 		}
-		offset += n
+		offset += int64(n)
 	}
 	localSum := h.Sum(nil)
 	remoteSum := make([]byte, len(localSum))
@@ -170,15 +347,39 @@ func (rt *Transfer) receiveData(f *File, localFile *os.File) error {
 		return err
 	}
 	if !bytes.Equal(localSum, remoteSum) {
-		return fmt.Errorf("file corruption in %s", f.Name)
+		return fmt.Errorf("file corruption in %s: %w", f.Name, errFailedVerification)
 	}
 	if rt.Opts.DebugGTE(rsyncopts.DEBUG_DELTASUM, 1) {
 		rt.Logger.Printf("checksum %x matches!", localSum)
 	}
 
-	if err := out.CloseAtomicallyReplace(); err != nil {
+	if err := w.finish(); err != nil {
 		return err
 	}
+	if rt.Opts.PreserveXattrs > 0 {
+		// rsync/rsync.c:set_file_attrs
+		if err := rt.setXattrs(f, xattr.OfFile(file), xattr.InRoot(rt.DestRoot, f.Name)); err != nil {
+			rt.Logger.Printf("%v", err)
+			rt.ReceiverIOErrors.Or(rsync.IOERR_GENERAL)
+		}
+	}
+	if out == nil {
+		if err := file.Close(); err != nil {
+			return err
+		}
+	} else {
+		if rt.Opts.MakeBackups {
+			// rsync/rsync.c:finish_transfer
+			if _, err := rt.makeBackup(f.Name, false); err != nil {
+				rt.Logger.Printf("make_backup %s failed: %v", f.Name, err)
+				return nil // keep the previous version in place
+			}
+		}
+
+		if err := out.CloseAtomicallyReplace(); err != nil {
+			return err
+		}
+	}
 
 	if err := rt.setPerms(f, fs.FileMode(f.Mode)); err != nil {
 		return err
@@ -186,3 +387,30 @@ func (rt *Transfer) receiveData(f *File, localFile *os.File) error {
 
 	return nil
 }
+
+// newFileWriter returns a fileWriter for the data of f, preallocating space
+// for it with --preallocate.
+//
+// rsync/receiver.c:receive_data
+func (rt *Transfer) newFileWriter(f *File, file *os.File) (*fileWriter, error) {
+	w := &fileWriter{
+		f:      file,
+		sparse: rt.Opts.Sparse,
+	}
+	if rt.Opts.Inplace {
+		st, err := file.Stat()
+		if err != nil {
+			return nil, err
+		}
+		w.existing = st.Size()
+	}
+	if rt.Opts.Preallocate && f.Length > w.existing {
+		// Reduces fragmentation on file systems like ext4 and xfs.
+		if err := fallocate(file, f.Length); err != nil {
+			rt.Logger.Printf("do_fallocate %s: %v", filepath.Join(rt.Dest, f.Name), err)
+		} else {
+			w.existing = f.Length
+		}
+	}
+	return w, nil
+}
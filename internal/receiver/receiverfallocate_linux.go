@@ -0,0 +1,29 @@
+//go:build linux
+
+package receiver
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// fallocate allocates length bytes for f, so that writing the file does not
+// fragment it (--preallocate).
+//
+// rsync/syscall.c:do_fallocate
+func fallocate(f *os.File, length int64) error {
+	return unix.Fallocate(int(f.Fd()), 0, 0, length)
+}
+
+// punchHole deallocates length bytes at offset in f, which then read as
+// zeros. If the file system cannot punch holes, punchHole writes zeros.
+//
+// rsync/syscall.c:do_punch_hole
+func punchHole(f *os.File, offset, length int64) error {
+	err := unix.Fallocate(int(f.Fd()), unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, offset, length)
+	if err == nil {
+		return nil
+	}
+	return writeZeros(f, offset, length)
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package receiver
+
+import (
+	"errors"
+	"os"
+)
+
+func fallocate(f *os.File, length int64) error {
+	return errors.ErrUnsupported
+}
+
+func punchHole(f *os.File, offset, length int64) error {
+	return writeZeros(f, offset, length)
+}
@@ -4,10 +4,53 @@ package receiver
 
 import (
 	"os"
+	"path/filepath"
 
 	"github.com/google/renameio/v2"
 )
 
-func newPendingFile(root *os.Root, fn string) (*renameio.PendingFile, error) {
-	return renameio.NewPendingFile(fn, renameio.WithRoot(root))
+type pendingFile struct {
+	*renameio.PendingFile
+	root *os.Root
+	kept bool
+}
+
+func newPendingFile(root *os.Root, fn string) (*pendingFile, error) {
+	pf, err := renameio.NewPendingFile(fn, renameio.WithRoot(root))
+	if err != nil {
+		return nil, err
+	}
+	return &pendingFile{
+		PendingFile: pf,
+		root:        root,
+	}, nil
+}
+
+// file returns the temporary file.
+func (p *pendingFile) file() *os.File {
+	return p.PendingFile.File
+}
+
+// CloseAndRename closes the temporary file and moves it to name instead of
+// the destination file, see keepPartial.
+func (p *pendingFile) CloseAndRename(name string) error {
+	tmpName, err := filepath.Rel(p.root.Name(), p.Name())
+	if err != nil {
+		return err
+	}
+	if err := p.PendingFile.Close(); err != nil {
+		return err
+	}
+	if err := p.root.Rename(tmpName, name); err != nil {
+		return err
+	}
+	p.kept = true
+	return nil
+}
+
+func (p *pendingFile) Cleanup() error {
+	if p.kept {
+		return nil
+	}
+	return p.PendingFile.Cleanup()
 }
@@ -8,8 +8,10 @@ import (
 )
 
 type pendingFile struct {
-	fn string
-	f  *os.File
+	root *os.Root
+	fn   string
+	f    *os.File
+	kept bool
 }
 
 func newPendingFile(root *os.Root, fn string) (*pendingFile, error) {
@@ -19,8 +21,9 @@ func newPendingFile(root *os.Root, fn string) (*pendingFile, error) {
 		return nil, err
 	}
 	return &pendingFile{
-		fn: fn,
-		f:  f,
+		root: root,
+		fn:   fn,
+		f:    f,
 	}, nil
 }
 
@@ -28,6 +31,10 @@ func (p *pendingFile) Name() string {
 	return p.fn
 }
 
+func (p *pendingFile) file() *os.File {
+	return p.f
+}
+
 func (p *pendingFile) Write(buf []byte) (n int, _ error) {
 	return p.f.Write(buf)
 }
@@ -42,7 +49,21 @@ func (p *pendingFile) CloseAtomicallyReplace() error {
 	return nil
 }
 
+func (p *pendingFile) CloseAndRename(name string) error {
+	if err := p.f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(p.f.Name(), filepath.Join(p.root.Name(), name)); err != nil {
+		return err
+	}
+	p.kept = true
+	return nil
+}
+
 func (p *pendingFile) Cleanup() error {
+	if p.kept {
+		return nil
+	}
 	tmpName := p.f.Name()
 	err := p.f.Close()
 	if err := os.Remove(tmpName); err != nil {
@@ -0,0 +1,126 @@
+package receiver
+
+import (
+	"os"
+)
+
+// sparseWriteSize is the granularity in which fileWriter finds runs of zeros.
+//
+// rsync/rsync.h:SPARSE_WRITE_SIZE
+const sparseWriteSize = 1024
+
+// fileWriter writes the received data of a file into f, starting at offset 0.
+// With --sparse, fileWriter seeks over runs of zeros instead of writing them,
+// so that the file system can leave holes. Zeros within data which exists in
+// f already (see existing) are punched out instead.
+type fileWriter struct {
+	f      *os.File
+	sparse bool
+	// existing is the length of the data which f contains already: the
+	// destination file with --inplace, or the space allocated with
+	// --preallocate.
+	existing int64
+
+	offset    int64 // offset of the next byte to write
+	pastWrite int64 // offset after the last write (sparse_past_write)
+	seek      int64 // number of zeros not yet written (sparse_seek)
+}
+
+// seekTo continues writing at offset, leaving the data before offset as is.
+func (w *fileWriter) seekTo(offset int64) {
+	w.offset = offset
+	w.pastWrite = offset
+}
+
+// rsync/fileio.c:write_file
+func (w *fileWriter) Write(p []byte) (int, error) {
+	if !w.sparse {
+		n, err := w.f.WriteAt(p, w.offset)
+		w.offset += int64(n)
+		return n, err
+	}
+	for written := 0; written < len(p); written += sparseWriteSize {
+		if err := w.writeSparse(p[written:min(written+sparseWriteSize, len(p))]); err != nil {
+			return written, err
+		}
+	}
+	return len(p), nil
+}
+
+// rsync/fileio.c:write_sparse
+func (w *fileWriter) writeSparse(p []byte) error {
+	l1 := 0
+	for l1 < len(p) && p[l1] == 0 {
+		l1++
+	}
+	w.seek += int64(l1)
+	if l1 == len(p) {
+		w.offset += int64(len(p))
+		return nil
+	}
+	l2 := 0
+	for l2 < len(p)-l1 && p[len(p)-(l2+1)] == 0 {
+		l2++
+	}
+
+	if err := w.flushSeek(); err != nil {
+		return err
+	}
+	if _, err := w.f.WriteAt(p[l1:len(p)-l2], w.offset+int64(l1)); err != nil {
+		return err
+	}
+	w.offset += int64(len(p))
+	w.pastWrite = w.offset - int64(l2)
+	w.seek = int64(l2)
+	return nil
+}
+
+// flushSeek ensures that the zeros which writeSparse did not write read as
+// zeros, by punching a hole into existing data.
+func (w *fileWriter) flushSeek() error {
+	if w.seek > 0 && w.pastWrite < w.existing {
+		if err := punchHole(w.f, w.pastWrite, w.seek); err != nil {
+			return err
+		}
+	}
+	w.seek = 0
+	return nil
+}
+
+// skip skips over n bytes which are already in place (--inplace).
+//
+// rsync/receiver.c:skip_matched
+func (w *fileWriter) skip(n int64) error {
+	if err := w.flushSeek(); err != nil {
+		return err
+	}
+	w.offset += n
+	w.pastWrite = w.offset
+	return nil
+}
+
+// finish sets the length of the file to the data written: the new data could
+// be shorter than the existing data, more space could have been preallocated
+// or trailing zeros could have been seeked over.
+//
+// rsync/fileio.c:sparse_end
+func (w *fileWriter) finish() error {
+	if err := w.flushSeek(); err != nil {
+		return err
+	}
+	return w.f.Truncate(w.offset)
+}
+
+// writeZeros writes length zeros at offset in f.
+func writeZeros(f *os.File, offset, length int64) error {
+	buf := make([]byte, min(length, 4096))
+	for length > 0 {
+		n, err := f.WriteAt(buf[:min(length, int64(len(buf)))], offset)
+		if err != nil {
+			return err
+		}
+		offset += int64(n)
+		length -= int64(n)
+	}
+	return nil
+}
@@ -1,9 +1,17 @@
 package receiver
 
-import "io"
+import (
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+)
 
 // rsync/token.c:recvToken
 func (rt *Transfer) recvToken() (token int32, data []byte, _ error) {
+	if rt.Opts.Compress {
+		return rt.recvDeflatedToken()
+	}
 	var err error
 	token, err = rt.Conn.ReadInt32()
 	if err != nil {
@@ -18,3 +26,242 @@ func (rt *Transfer) recvToken() (token int32, data []byte, _ error) {
 	}
 	return token, data, nil
 }
+
+// seeToken is called with the data of each matched block, which a compressed
+// transfer needs to add to the decompressor’s history.
+//
+// rsync/token.c:see_token
+func (rt *Transfer) seeToken(data []byte) {
+	if !rt.Opts.Compress || rt.inflater == nil {
+		return
+	}
+	rt.inflater.seeToken(rt.Protocol, data)
+}
+
+// Flags of the deflated token stream.
+//
+// rsync/token.c
+const (
+	endFlag      = 0    // that's all folks
+	deflatedData = 0x40 // + 6-bit high len, then low len byte
+	tokenRel     = 0x80 // + 6-bit relative token number
+
+	maxDataCount = 16383 // fit 14 bit count into 2 bytes with flags
+
+	// The deflate window size: the sender can reference data which we have
+	// seen within the last windowSize bytes.
+	windowSize = 32 * 1024
+
+	// like CHUNK_SIZE in rsync/rsync.h
+	inflateChunkSize = 32 * 1024
+)
+
+// errEndOfData is returned by deflatedSource once all compressed data up to
+// the next token (or the end of the file) was read.
+var errEndOfData = errors.New("end of deflated data")
+
+// deflatedSource provides the data of consecutive DEFLATED_DATA frames to the
+// decompressor. When a frame is followed by a token instead of more data, the
+// sync marker which the sender trimmed is re-inserted and the token flag is
+// kept in flag.
+type deflatedSource struct {
+	r    io.Reader
+	cbuf []byte // the current frame
+	pos  int
+	flag byte // the flag which ended the data
+	done bool
+}
+
+var syncMarker = []byte{0, 0, 0xff, 0xff}
+
+// start begins a run of compressed data with the frame announced by flag.
+func (s *deflatedSource) start(flag byte) error {
+	s.done = false
+	return s.readFrame(flag)
+}
+
+func (s *deflatedSource) readFrame(flag byte) error {
+	var lo [1]byte
+	if _, err := io.ReadFull(s.r, lo[:]); err != nil {
+		return err
+	}
+	n := int(flag&0x3f)<<8 + int(lo[0])
+	if cap(s.cbuf) < maxDataCount {
+		s.cbuf = make([]byte, maxDataCount)
+	}
+	s.cbuf = s.cbuf[:n]
+	s.pos = 0
+	_, err := io.ReadFull(s.r, s.cbuf)
+	return err
+}
+
+func (s *deflatedSource) fill() error {
+	for s.pos >= len(s.cbuf) {
+		if s.done {
+			return errEndOfData
+		}
+		var flag [1]byte
+		if _, err := io.ReadFull(s.r, flag[:]); err != nil {
+			return err
+		}
+		if flag[0]&0xc0 == deflatedData {
+			if err := s.readFrame(flag[0]); err != nil {
+				return err
+			}
+			continue
+		}
+		// The data is followed by a token (or END_FLAG): the decompressor
+		// should now be expecting to see the 0, 0, ff, ff bytes.
+		s.flag = flag[0]
+		s.done = true
+		s.cbuf = append(s.cbuf[:0], syncMarker...)
+		s.pos = 0
+	}
+	return nil
+}
+
+func (s *deflatedSource) Read(p []byte) (int, error) {
+	if err := s.fill(); err != nil {
+		return 0, err
+	}
+	n := copy(p, s.cbuf[s.pos:])
+	s.pos += n
+	return n, nil
+}
+
+func (s *deflatedSource) ReadByte() (byte, error) {
+	if err := s.fill(); err != nil {
+		return 0, err
+	}
+	b := s.cbuf[s.pos]
+	s.pos++
+	return b, nil
+}
+
+// tokenInflater holds the state of the deflated token stream, which spans all
+// tokens of one file.
+type tokenInflater struct {
+	src       deflatedSource
+	fr        io.ReadCloser
+	inflating bool
+	rxToken   int32
+	rxRun     int32
+	dbuf      []byte
+	// history contains the last windowSize bytes of data that the
+	// decompressor has seen: inflated data as well as matched blocks. It is
+	// used as preset dictionary when a new run of compressed data starts.
+	history []byte
+}
+
+func (inf *tokenInflater) see(data []byte) {
+	if len(data) >= windowSize {
+		inf.history = append(inf.history[:0], data[len(data)-windowSize:]...)
+		return
+	}
+	if len(inf.history)+len(data) > windowSize {
+		drop := len(inf.history) + len(data) - windowSize
+		inf.history = append(inf.history[:0], inf.history[drop:]...)
+	}
+	inf.history = append(inf.history, data...)
+}
+
+// Put the data corresponding to a token that we've just returned from
+// recvDeflatedToken into the decompressor's history buffer.
+//
+// rsync/token.c:see_deflate_token
+func (inf *tokenInflater) seeToken(protocol int32, data []byte) {
+	for len(data) > 0 {
+		// The sender breaks up long sections into stored blocks of at most
+		// 0xffff bytes.
+		n := min(len(data), 0xffff)
+		inf.see(data[:n])
+		if protocol >= 31 {
+			// Newer protocols avoid a data-duplicating bug.
+			data = data[n:]
+		} else {
+			data = data[:len(data)-n]
+		}
+	}
+}
+
+// Receive a deflated token and inflate it if required.
+//
+// rsync/token.c:recv_deflated_token
+func (rt *Transfer) recvDeflatedToken() (int32, []byte, error) {
+	if rt.inflater == nil {
+		rt.inflater = &tokenInflater{
+			src:  deflatedSource{r: rt.Conn.Reader},
+			dbuf: make([]byte, inflateChunkSize),
+		}
+	}
+	inf := rt.inflater
+	for {
+		if inf.rxRun > 0 {
+			inf.rxRun--
+			inf.rxToken++
+			return -1 - inf.rxToken, nil, nil
+		}
+
+		var flag byte
+		if inf.inflating {
+			n, err := io.ReadFull(inf.fr, inf.dbuf)
+			if n > 0 {
+				inf.see(inf.dbuf[:n])
+				return int32(n), inf.dbuf[:n], nil
+			}
+			if err != errEndOfData {
+				if err == io.EOF || err == io.ErrUnexpectedEOF || err == nil {
+					err = fmt.Errorf("decompressor lost sync")
+				}
+				return 0, nil, fmt.Errorf("inflate: %v", err)
+			}
+			inf.inflating = false
+			flag = inf.src.flag
+		} else {
+			var err error
+			flag, err = rt.Conn.ReadByte()
+			if err != nil {
+				return 0, nil, err
+			}
+			if flag&0xc0 == deflatedData {
+				if err := inf.src.start(flag); err != nil {
+					return 0, nil, err
+				}
+				if inf.fr == nil {
+					inf.fr = flate.NewReaderDict(&inf.src, inf.history)
+				} else if err := inf.fr.(flate.Resetter).Reset(&inf.src, inf.history); err != nil {
+					return 0, nil, err
+				}
+				inf.inflating = true
+				continue
+			}
+		}
+
+		if flag == endFlag {
+			// end of file: start over with the next file
+			inf.rxToken = 0
+			inf.history = inf.history[:0]
+			return 0, nil, nil
+		}
+
+		// here we have a token of some kind
+		if flag&tokenRel != 0 {
+			inf.rxToken += int32(flag & 0x3f)
+			flag >>= 6
+		} else {
+			var err error
+			inf.rxToken, err = rt.Conn.ReadInt32()
+			if err != nil {
+				return 0, nil, err
+			}
+		}
+		if flag&1 != 0 {
+			var run [2]byte
+			if _, err := io.ReadFull(rt.Conn.Reader, run[:]); err != nil {
+				return 0, nil, err
+			}
+			inf.rxRun = int32(run[0]) | int32(run[1])<<8
+		}
+		return -1 - inf.rxToken, nil, nil
+	}
+}
@@ -2,9 +2,15 @@ package receiver
 
 import (
 	"os"
+	"sync"
+	"sync/atomic"
 
+	"github.com/gokrazy/rsync"
+	"github.com/gokrazy/rsync/internal/filter"
 	"github.com/gokrazy/rsync/internal/log"
 	"github.com/gokrazy/rsync/internal/progress"
+	"github.com/gokrazy/rsync/internal/rsyncchecksum"
+	"github.com/gokrazy/rsync/internal/rsynccommon"
 	"github.com/gokrazy/rsync/internal/rsyncopts"
 	"github.com/gokrazy/rsync/internal/rsyncos"
 	"github.com/gokrazy/rsync/internal/rsyncwire"
@@ -17,7 +23,61 @@ type TransferOpts struct {
 	Server   bool
 	Progress bool
 
-	DeleteMode        bool
+	Recurse bool
+
+	// DeleteMode enables deleting extraneous files in the destination.
+	// Exactly one of DeleteBefore, DeleteDuring, DeleteDelay and DeleteAfter
+	// specifies when (see rsyncopts.Options.SetDeleteTiming).
+	DeleteMode   bool
+	DeleteBefore bool
+	DeleteDuring bool
+	DeleteDelay  bool
+	DeleteAfter  bool
+	IgnoreErrors bool
+	MaxDelete    int // -1 for unlimited
+
+	// MakeBackups keeps the previous version of replaced or deleted files,
+	// either renamed with BackupSuffix or moved into the BackupDir hierarchy
+	// (which must be within Dest).
+	MakeBackups  bool
+	BackupDir    string
+	BackupSuffix string
+
+	// KeepPartial keeps partially transferred files, in PartialDir (if set)
+	// or under their final name.
+	KeepPartial bool
+	PartialDir  string
+
+	// Inplace writes into the destination files directly instead of into
+	// temporary files. AppendMode (1 for --append, 2 for --append-verify)
+	// implies Inplace and only transfers data beyond the length of the
+	// destination files.
+	Inplace    bool
+	AppendMode int
+
+	// BasisDirs are alternate basis directories, in which the generator
+	// looks for files missing from the destination. AltDestType
+	// (rsyncopts.COMPARE_DEST, COPY_DEST or LINK_DEST) specifies what happens
+	// to unchanged files, see tryBasisDirs.
+	BasisDirs   []string
+	AltDestType int
+
+	// FuzzyBasis is the number of directories (the destination directory,
+	// followed by the BasisDirs) in which the generator looks for a similar
+	// file as basis for files missing from the destination.
+	FuzzyBasis int
+
+	// WholeFile disables the delta-transfer algorithm: files are requested
+	// in full. Otherwise, BlockSize overrides the block size of the
+	// delta-transfer algorithm, see rsynccommon.SumSizesSqroot.
+	WholeFile bool
+	BlockSize int
+
+	// Sparse turns runs of zeros into holes, Preallocate allocates the
+	// space for each file before writing it.
+	Sparse      bool
+	Preallocate bool
+
 	PreserveGid       bool
 	PreserveUid       bool
 	PreserveLinks     bool
@@ -28,6 +88,29 @@ type TransferOpts struct {
 	PreserveHardlinks bool
 	IgnoreTimes       bool
 	AlwaysChecksum    bool
+	Compress          bool
+
+	// PreserveACLs preserves POSIX ACLs (--acls), PreserveXattrs is the
+	// number of -X options, see rsyncopts.Options.PreserveXattrs.
+	PreserveACLs   bool
+	PreserveXattrs int
+
+	// SafeLinks ignores symlinks which point outside of the transfer
+	// (--safe-links), MungeLinks prefixes the targets of symlinks with
+	// rsync.SYMLINK_PREFIX (--munge-links).
+	SafeLinks  bool
+	MungeLinks bool
+
+	// ChmodModes change the permissions of received file list entries
+	// (--chmod), see rsyncopts.TweakMode.
+	ChmodModes []rsyncopts.ChmodRule
+
+	// NumericIds transfers uids and gids without mapping them by name
+	// (--numeric-ids). UserMap and GroupMap are the rules of --usermap and
+	// --groupmap (or --chown), see parseIdMap.
+	NumericIds bool
+	UserMap    string
+	GroupMap   string
 
 	InfoGTE  func(rsyncopts.InfoLevel, uint16) bool
 	DebugGTE func(rsyncopts.DebugLevel, uint16) bool
@@ -42,13 +125,270 @@ type Transfer struct {
 	Env      *rsyncos.Env
 	Progress progress.Printer
 
+	// Items logs the transferred, changed and deleted files (--out-format,
+	// --itemize-changes).
+	Items *rsynccommon.ItemLog
+
+	// FilterList protects files from deletion (see TransferOpts.DeleteMode).
+	FilterList *filter.List
+
+	// Abort aborts the connection (see rsynccommon.Watchdog.Abort). Do calls
+	// Abort once the generator or the receiver goroutine failed, so that the
+	// other one does not stay blocked on the connection.
+	Abort func(error)
+
 	// state
-	Conn            *rsyncwire.Conn
-	Seed            int32
-	IOErrors        int32
+	Conn *rsyncwire.Conn
+	Seed int32
+	// Protocol is the negotiated protocol version.
+	Protocol int32
+	// CompatFlags are the rsync.CF_* flags sent by the server (protocol >= 30).
+	CompatFlags int32
+	// Checksums are the negotiated checksum algorithms.
+	Checksums rsyncchecksum.Choice
+	// IOErrors holds the rsync.IOERR_* flags of the transfer. The receiver
+	// goroutine and the generator goroutine both access IOErrors.
+	IOErrors        atomic.Int32
+	rdevMajor       int32 // last received device major number
+	inDelHier       bool  // see receiveFileEntry (protocols < 30)
 	Users           map[int32]mapping
 	Groups          map[int32]mapping
+	userMap         []idMapRule // --usermap, see ParseIdMaps
+	groupMap        []idMapRule // --groupmap
 	retouchDirPerms bool
+	retouchDirTimes bool
+	inflater        *tokenInflater // see recvDeflatedToken
+
+	// ReceiverIOErrors holds the rsync.IOERR_* flags of errors which the
+	// receiver ran into itself, e.g. when applying file attributes. The
+	// receiver goroutine and the generator goroutine both access it.
+	ReceiverIOErrors atomic.Int32
+
+	// xattrLists are the extended attribute lists received so far, to which
+	// file list entries can refer. Only the receiver goroutine accesses
+	// xattrLists.
+	xattrLists []*xattrList
+
+	// accessACLs and defaultACLs are the ACLs received so far, to which file
+	// list entries can refer. Only the receiver goroutine accesses them.
+	accessACLs  []*rsynccommon.ACL
+	defaultACLs []*rsynccommon.ACL
+
+	// flists are the file lists received so far. The sender finished the
+	// first flistsDone lists. Only the receiver goroutine accesses flists,
+	// the generator goroutine takes the lists from newLists (and accesses
+	// flists once the receiver finished the redo phase).
+	flists     []*fileList
+	flistsDone int
+	newLists   *flistQueue
+
+	// redo holds the files which failed verification, which the generator
+	// requests again (with the entire strong checksum of each block, and
+	// without --append) in the redo phase. The generator goroutine sets
+	// redoing, the receiver goroutine sets receivingRedo.
+	redo          *redoQueue
+	redoing       bool
+	receivingRedo bool
+
+	// incremental recursion state, see recvExtraFileList
+	lastFileEntry *File
+	dirList       []*File         // all directories, indexed by directory index
+	linkHeads     map[int32]*File // first file of each hard link group
+
+	// deletion state, see delete.go
+	deletedFiles     int
+	skippedDeletes   int
+	warnedIOErrors   bool
+	delayedDeletions []delayedDeletion
+	delFilters       *filter.Scope
+
+	// backupDir and partialDir are TransferOpts.BackupDir and
+	// TransferOpts.PartialDir relative to DestRoot, see ResolveDirs. An
+	// absolute --partial-dir is shared by all directories.
+	backupDir        string
+	partialDir       string
+	partialDirShared bool
+
+	// basisDirs are TransferOpts.BasisDirs, see OpenBasisDirs. The daemon
+	// confines them to basisModule, in which Dest is destDir.
+	basisDirs   []basisDir
+	basisModule *os.Root
+	destDir     string
+
+	// fuzzyLists are the files of fuzzyDir, see fuzzyDirs.
+	fuzzyDir   string
+	fuzzyLists [][]*fuzzyFile
+}
+
+// fileList is one file list of the transfer. Without incremental recursion,
+// there is only one file list.
+type fileList struct {
+	// ndxStart is the file list index of files[0]. With incremental
+	// recursion, all file lists share one index space, in which the index
+	// before ndxStart refers to the directory whose contents the list holds.
+	ndxStart int32
+	files    []*File
+
+	// parent is the directory whose contents the list holds, or nil for the
+	// initial file list.
+	parent *File
+}
+
+// flistQueue passes file lists from the receiver goroutine to the generator
+// goroutine. The queue is unbounded so that receiving never blocks on the
+// generator (which might itself be blocked on the sender).
+type flistQueue struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	lists  []*fileList
+	closed bool
+}
+
+func newFlistQueue() *flistQueue {
+	q := &flistQueue{}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+func (q *flistQueue) push(fl *fileList) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.lists = append(q.lists, fl)
+	q.cond.Signal()
+}
+
+// close signals that no more file lists will be pushed.
+func (q *flistQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.cond.Signal()
+}
+
+// pop returns the next file list, blocking until one is available. It
+// returns nil once the queue is closed and empty.
+func (q *flistQueue) pop() *fileList {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.lists) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if len(q.lists) == 0 {
+		return nil
+	}
+	fl := q.lists[0]
+	q.lists = q.lists[1:]
+	return fl
+}
+
+// redoFile is a file which failed verification, see redoQueue.
+type redoFile struct {
+	ndx int32
+	f   *File
+}
+
+// redoQueue passes the files which failed verification from the receiver
+// goroutine to the generator goroutine, which waits for the receiver to
+// finish the first phase before requesting them again, and to finish the redo
+// phase before creating hard links.
+type redoQueue struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	files    []redoFile
+	closed   bool
+	ended    bool // see finish
+	finished bool
+}
+
+func newRedoQueue() *redoQueue {
+	q := &redoQueue{}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+func (q *redoQueue) push(ndx int32, f *File) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.files = append(q.files, redoFile{ndx: ndx, f: f})
+}
+
+// close signals that no more files will be pushed.
+func (q *redoQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+// wait returns the files to redo, blocking until the queue is closed.
+func (q *redoQueue) wait() []redoFile {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for !q.closed {
+		q.cond.Wait()
+	}
+	return q.files
+}
+
+// finish signals that the receiver received the files to redo (ok is true),
+// or that it returned before (ok is false). Only the first call counts.
+func (q *redoQueue) finish(ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	if !q.ended {
+		q.ended = true
+		q.finished = ok
+	}
+	q.cond.Broadcast()
+}
+
+// waitFinished blocks until finish was called and reports whether the
+// receiver received the files to redo.
+func (q *redoQueue) waitFinished() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for !q.ended {
+		q.cond.Wait()
+	}
+	return q.finished
 }
 
 func (rt *Transfer) listOnly() bool { return rt.Dest == "" }
+
+// deleteDuring reports whether the generator deletes extraneous files while
+// going through the file lists (--delete-during and --delete-delay).
+func (rt *Transfer) deleteDuring() bool {
+	return rt.Opts.DeleteMode && (rt.Opts.DeleteDuring || rt.Opts.DeleteDelay) && !rt.listOnly()
+}
+
+// appendVerify reports whether the data which the receiver already has is
+// included in the whole-file checksum: with --append-verify, and with --append
+// for protocol versions < 30.
+//
+// rsync/compat.c:setup_protocol
+func (rt *Transfer) appendVerify() bool {
+	mode := rt.Opts.AppendMode
+	if rt.receivingRedo {
+		mode = 0
+	}
+	return mode > 1 || (mode == 1 && rt.Protocol < 30)
+}
+
+// properSeedOrder reports whether the checksum seed is hashed before the
+// data (see rsyncchecksum.Type.Checksum2).
+func (rt *Transfer) properSeedOrder() bool {
+	return rt.CompatFlags&rsync.CF_CHKSUM_SEED_FIX != 0
+}
+
+// incRecurse reports whether the file list is received incrementally, one
+// file list per directory.
+func (rt *Transfer) incRecurse() bool {
+	return rt.CompatFlags&rsync.CF_INC_RECURSE != 0
+}
+
+// varintFlags reports whether the file list flags are transferred as varint,
+// which also terminates the file list with the I/O error flag.
+func (rt *Transfer) varintFlags() bool {
+	return rt.CompatFlags&rsync.CF_VARINT_FLIST_FLAGS != 0
+}
@@ -1,10 +1,14 @@
 package receiver
 
 import (
+	"fmt"
 	"io"
 	"os/user"
 	"strconv"
+	"strings"
 
+	"github.com/gokrazy/rsync/internal/filter"
+	"github.com/gokrazy/rsync/internal/rsynccommon"
 	"github.com/gokrazy/rsync/internal/rsyncopts"
 )
 
@@ -13,79 +17,293 @@ type mapping struct {
 	LocalId int32
 }
 
-func (rt *Transfer) recvIdMapping1(localId func(id int32, name string) int32) (map[int32]mapping, error) {
-	idMapping := make(map[int32]mapping)
+// idMapRule is a rule of --usermap or --groupmap: ids of the sender whose
+// name matches name (a wildcard pattern with wild), or, without name, ids in
+// the range from minId to maxId, are mapped to localId.
+//
+// rsync/uidlist.c:idlist
+type idMapRule struct {
+	name         string
+	wild         bool
+	minId, maxId uint32
+	localId      int32
+}
+
+func (r *idMapRule) matches(id int32, name string) bool {
+	switch {
+	case r.wild:
+		return filter.Wildmatch(r.name, name)
+	case r.name != "":
+		return r.name == name
+	default:
+		return uint32(id) >= r.minId && uint32(id) <= r.maxId
+	}
+}
+
+// parseIdMap parses the rules of --usermap or --groupmap (what is "user" or
+// "group"): a comma-separated list of FROM:TO items, where FROM is a name, a
+// wildcard pattern, an id or an id range (LOW-HIGH) of the sender, and TO is
+// a local name or id, which lookup resolves.
+//
+// rsync/uidlist.c:parse_name_map
+func (rt *Transfer) parseIdMap(spec, what string, lookup func(string, bool) (int32, bool)) ([]idMapRule, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	var rules []idMapRule
+	for _, item := range strings.Split(spec, ",") {
+		from, to, ok := strings.Cut(item, ":")
+		if !ok {
+			return nil, fmt.Errorf("No colon found in --%smap: %s", what, item)
+		}
+		if to == "" {
+			return nil, fmt.Errorf("No name found after colon --%smap: %s", what, item)
+		}
+		var r idMapRule
+		if from != "" && from[0] >= '0' && from[0] <= '9' {
+			low, high, isRange := strings.Cut(from, "-")
+			minId, err := strconv.ParseUint(low, 10, 32)
+			maxId := minId
+			if err == nil && isRange {
+				maxId, err = strconv.ParseUint(high, 10, 32)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("Invalid number in --%smap: %s", what, from)
+			}
+			r.minId, r.maxId = uint32(minId), uint32(maxId)
+		} else {
+			r.name = from
+			r.wild = strings.ContainsAny(from, "*[?")
+		}
+		localId, ok := lookup(to, true)
+		if !ok {
+			rt.Logger.Printf("Unknown --%smap name on receiver: %s", what, to)
+			continue
+		}
+		r.localId = localId
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// ParseIdMaps parses the --usermap and --groupmap rules (--chown is turned
+// into such rules by rsyncopts). Call it before receiving the file list.
+func (rt *Transfer) ParseIdMaps() error {
+	var err error
+	rt.userMap, err = rt.parseIdMap(rt.Opts.UserMap, "user", lookupUid)
+	if err != nil {
+		return err
+	}
+	rt.groupMap, err = rt.parseIdMap(rt.Opts.GroupMap, "group", lookupGid)
+	return err
+}
+
+// addId adds the local id for the id of the sender with name (empty if
+// unknown) to ids, and returns it: the first matching rule determines the
+// local id, otherwise the local id of the same name, otherwise the id itself.
+//
+// rsync/uidlist.c:recv_add_id
+func (rt *Transfer) addId(ids *map[int32]mapping, rules []idMapRule, id int32, name string, lookup func(string, bool) (int32, bool)) int32 {
+	if id == 0 && name == "" && !rt.Opts.NumericIds {
+		// The sender does not transmit the name of id 0, which we
+		// assume to be root.
+		name = "root"
+	}
+	localId := id
+	matched := false
+	for _, r := range rules {
+		if r.matches(id, name) {
+			localId, matched = r.localId, true
+			break
+		}
+	}
+	if !matched && name != "" && id != 0 {
+		if lid, ok := lookup(name, false); ok {
+			localId = lid
+		}
+	}
+	if *ids == nil {
+		*ids = make(map[int32]mapping)
+	}
+	(*ids)[id] = mapping{
+		Name:    name,
+		LocalId: localId,
+	}
+	return localId
+}
+
+// recvIdName reads the length-prefixed name of a uid or gid.
+func (rt *Transfer) recvIdName() (string, error) {
+	length, err := rt.Conn.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	name := make([]byte, length)
+	if _, err := io.ReadFull(rt.Conn.Reader, name); err != nil {
+		return "", err
+	}
+	return string(name), nil
+}
+
+// lookupUid returns the local uid of the user name, which can be numeric with
+// numOK.
+//
+// rsync/uidlist.c:user_to_uid
+func lookupUid(name string, numOK bool) (int32, bool) {
+	if numOK {
+		if uid, err := strconv.ParseUint(name, 10, 32); err == nil {
+			return int32(uid), true
+		}
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return 0, false
+	}
+	uid, err := strconv.ParseInt(u.Uid, 0, 32)
+	if err != nil {
+		return 0, false
+	}
+	return int32(uid), true
+}
+
+// lookupGid returns the local gid of the group name, which can be numeric
+// with numOK.
+//
+// rsync/uidlist.c:group_to_gid
+func lookupGid(name string, numOK bool) (int32, bool) {
+	if numOK {
+		if gid, err := strconv.ParseUint(name, 10, 32); err == nil {
+			return int32(gid), true
+		}
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, false
+	}
+	gid, err := strconv.ParseInt(g.Gid, 0, 32)
+	if err != nil {
+		return 0, false
+	}
+	return int32(gid), true
+}
+
+// recvUserName reads the name of uid, which follows the first file list
+// entry using uid with incremental recursion (see XMIT_USER_NAME_FOLLOWS),
+// and returns the local uid.
+//
+// rsync/uidlist.c:recv_user_name
+func (rt *Transfer) recvUserName(uid int32) (int32, error) {
+	name, err := rt.recvIdName()
+	if err != nil {
+		return 0, err
+	}
+	return rt.addId(&rt.Users, rt.userMap, uid, name, lookupUid), nil
+}
+
+// rsync/uidlist.c:recv_group_name
+func (rt *Transfer) recvGroupName(gid int32) (int32, error) {
+	name, err := rt.recvIdName()
+	if err != nil {
+		return 0, err
+	}
+	return rt.addId(&rt.Groups, rt.groupMap, gid, name, lookupGid), nil
+}
+
+// matchUid returns the local uid for the uid of the sender.
+//
+// rsync/uidlist.c:match_uid
+func (rt *Transfer) matchUid(uid int32) int32 {
+	if m, ok := rt.Users[uid]; ok {
+		return m.LocalId
+	}
+	return rt.addId(&rt.Users, rt.userMap, uid, "", lookupUid)
+}
+
+// rsync/uidlist.c:match_gid
+func (rt *Transfer) matchGid(gid int32) int32 {
+	if m, ok := rt.Groups[gid]; ok {
+		return m.LocalId
+	}
+	return rt.addId(&rt.Groups, rt.groupMap, gid, "", lookupGid)
+}
+
+// matchACLIds converts the ids of the named entries of the ACLs received so
+// far to local ids.
+//
+// rsync/acls.c:match_acl_ids
+func (rt *Transfer) matchACLIds() {
+	for _, acls := range [][]*rsynccommon.ACL{rt.accessACLs, rt.defaultACLs} {
+		for _, acl := range acls {
+			for i := range acl.Names {
+				n := &acl.Names[i]
+				if n.IsUser {
+					n.ID = uint32(rt.matchUid(int32(n.ID)))
+				} else {
+					n.ID = uint32(rt.matchGid(int32(n.ID)))
+				}
+			}
+		}
+	}
+}
+
+// recvIdList1 reads a uid or gid list, adding the names to ids.
+func (rt *Transfer) recvIdList1(ids *map[int32]mapping, rules []idMapRule, lookup func(string, bool) (int32, bool)) error {
 	for {
-		id, err := rt.Conn.ReadInt32()
+		id, err := rt.Conn.ReadVarint30(rt.Protocol)
 		if err != nil {
-			return nil, err
+			return err
 		}
 		if id == 0 {
 			break
 		}
-		length, err := rt.Conn.ReadByte()
+		name, err := rt.recvIdName()
 		if err != nil {
-			return nil, err
-		}
-		name := make([]byte, length)
-		if _, err := io.ReadFull(rt.Conn.Reader, name); err != nil {
-			return nil, err
-		}
-		idMapping[id] = mapping{
-			Name:    string(name),
-			LocalId: localId(id, string(name)),
+			return err
 		}
+		rt.addId(ids, rules, id, name, lookup)
 	}
-	return idMapping, nil
+	return nil
 }
 
+// RecvIdList receives the uid and gid lists which follow the file list
+// (unless --numeric-ids is used), and converts the ids of files (and of named
+// ACL entries) to local ids.
+//
 // rsync/uidlist.c:recv_id_list
-func (rt *Transfer) RecvIdList() (users map[int32]mapping, groups map[int32]mapping, _ error) {
-	if rt.Opts.PreserveUid {
-		var err error
-		users, err = rt.recvIdMapping1(func(remoteUid int32, remoteUsername string) int32 {
-			u, err := user.Lookup(remoteUsername)
-			if err != nil {
-				return remoteUid
-			}
-			uid, err := strconv.ParseInt(u.Uid, 0, 32)
-			if err != nil {
-				return remoteUid
-			}
-			return int32(uid)
-		})
-		if err != nil {
-			return nil, nil, err
+func (rt *Transfer) RecvIdList(files []*File) error {
+	if (rt.Opts.PreserveUid || rt.Opts.PreserveACLs) && !rt.Opts.NumericIds {
+		if err := rt.recvIdList1(&rt.Users, rt.userMap, lookupUid); err != nil {
+			return err
 		}
 		if rt.Opts.DebugGTE(rsyncopts.DEBUG_FLIST, 2) {
-			for remoteUid, mapping := range users {
+			for remoteUid, mapping := range rt.Users {
 				rt.Logger.Printf("remote uid %d(%s) maps to local uid %d", remoteUid, mapping.Name, mapping.LocalId)
 			}
 		}
 	}
 
-	if rt.Opts.PreserveGid {
-		var err error
-		groups, err = rt.recvIdMapping1(func(remoteGid int32, remoteGroupname string) int32 {
-			g, err := user.LookupGroup(remoteGroupname)
-			if err != nil {
-				return remoteGid
-			}
-			gid, err := strconv.ParseInt(g.Gid, 0, 32)
-			if err != nil {
-				return remoteGid
-			}
-			return int32(gid)
-		})
-		if err != nil {
-			return nil, nil, err
+	if (rt.Opts.PreserveGid || rt.Opts.PreserveACLs) && !rt.Opts.NumericIds {
+		if err := rt.recvIdList1(&rt.Groups, rt.groupMap, lookupGid); err != nil {
+			return err
 		}
 		if rt.Opts.DebugGTE(rsyncopts.DEBUG_FLIST, 2) {
-			for remoteGid, mapping := range groups {
+			for remoteGid, mapping := range rt.Groups {
 				rt.Logger.Printf("remote gid %d(%s) maps to local gid %d", remoteGid, mapping.Name, mapping.LocalId)
 			}
 		}
 	}
 
-	return users, groups, nil
+	// Now convert all the uids/gids from sender values to our values.
+	if rt.Opts.PreserveACLs {
+		rt.matchACLIds()
+	}
+	for _, f := range files {
+		if rt.Opts.PreserveUid {
+			f.Uid = rt.matchUid(f.Uid)
+		}
+		if rt.Opts.PreserveGid {
+			f.Gid = rt.matchGid(f.Gid)
+		}
+	}
+	return nil
 }
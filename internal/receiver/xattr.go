@@ -0,0 +1,398 @@
+package receiver
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/gokrazy/rsync"
+	"github.com/gokrazy/rsync/internal/rsynccommon"
+	"github.com/gokrazy/rsync/internal/xattr"
+)
+
+// xattrUserOnly is whether only the extended attributes of the user namespace
+// are preserved: other namespaces require root privileges.
+var xattrUserOnly = os.Getuid() != 0
+
+// xattrState tracks an abbreviated extended attribute value in the generator.
+//
+// rsync/xattrs.c:XSTATE_*
+type xattrState int
+
+const (
+	xattrAbbrev xattrState = iota // the local value might match
+	xattrTodo                     // the value needs to be requested
+	xattrDone                     // the value was requested (or is local)
+)
+
+// xattrItem is an extended attribute of a file list entry, or of a local file.
+type xattrItem struct {
+	name   string
+	length int
+	// value is nil for abbreviated values (longer than
+	// rsynccommon.MaxFullXattrDatum) until the receiver obtained the value.
+	// Only the receiver goroutine accesses the value of abbreviated items.
+	value []byte
+	sum   []byte // only for abbreviated values
+
+	// num is the (1-based) position of the item in the sender's list, by
+	// which the values are requested.
+	num int32
+
+	// state is only accessed by the generator goroutine.
+	state xattrState
+}
+
+// abbreviated reports whether the value of the item is longer than what the
+// file list contains.
+func (it *xattrItem) abbreviated() bool {
+	return it.length > rsynccommon.MaxFullXattrDatum
+}
+
+// xattrList is a list of extended attributes sorted by name. File list
+// entries with the same extended attributes share their list.
+type xattrList struct {
+	items []xattrItem
+}
+
+// find returns the item with name, or nil.
+func (xal *xattrList) find(name string) *xattrItem {
+	if xal == nil {
+		return nil
+	}
+	for i := range xal.items {
+		if xal.items[i].name == name {
+			return &xal.items[i]
+		}
+	}
+	return nil
+}
+
+// receiveXattrs receives the extended attributes of the file list entry f.
+//
+// rsync/xattrs.c:receive_xattr
+func (rt *Transfer) receiveXattrs(f *File) error {
+	ndx, err := rt.Conn.ReadVarint()
+	if err != nil {
+		return err
+	}
+	if ndx < 0 || int(ndx) > len(rt.xattrLists) {
+		return fmt.Errorf("receive_xattr: xa index %d out of range for %s", ndx, f.Name)
+	}
+	if ndx != 0 {
+		f.xattrs = rt.xattrLists[ndx-1]
+		return nil
+	}
+
+	count, err := rt.Conn.ReadVarint()
+	if err != nil {
+		return err
+	}
+	xal := &xattrList{}
+	for num := int32(1); num <= count; num++ {
+		nameLen, err := rt.Conn.ReadVarint()
+		if err != nil {
+			return err
+		}
+		datumLen, err := rt.Conn.ReadVarint()
+		if err != nil {
+			return err
+		}
+		if nameLen <= 0 || datumLen < 0 {
+			return fmt.Errorf("receive_xattr: invalid xattr lengths %d/%d for %s", nameLen, datumLen, f.Name)
+		}
+		it := xattrItem{
+			length: int(datumLen),
+			num:    num,
+		}
+		valueLen := it.length
+		if it.abbreviated() {
+			valueLen = len(rsynccommon.XattrSum(nil))
+		}
+		buf := make([]byte, int(nameLen)+valueLen)
+		if _, err := io.ReadFull(rt.Conn.Reader, buf); err != nil {
+			return err
+		}
+		name, datum := buf[:nameLen], buf[nameLen:]
+		if name[len(name)-1] != 0 {
+			return fmt.Errorf("Invalid xattr name received (missing trailing \\0).")
+		}
+		it.name = string(name[:len(name)-1])
+		if it.abbreviated() {
+			it.sum = datum
+		} else {
+			it.value = datum
+		}
+		if rsynccommon.SkipXattr(it.name, rt.Opts.PreserveXattrs, xattrUserOnly) {
+			continue
+		}
+		xal.items = append(xal.items, it)
+	}
+	slices.SortFunc(xal.items, func(a, b xattrItem) int {
+		return strings.Compare(a.name, b.name)
+	})
+	rt.xattrLists = append(rt.xattrLists, xal)
+	f.xattrs = xal
+	return nil
+}
+
+// localXattrs returns the (preserved) extended attributes of x, with the
+// checksums of abbreviated values like in the file list.
+//
+// rsync/xattrs.c:rsync_xal_get
+func (rt *Transfer) localXattrs(x xattr.File) (*xattrList, error) {
+	names, err := x.List()
+	if err != nil {
+		return nil, err
+	}
+	xal := &xattrList{}
+	for _, name := range names {
+		if rsynccommon.SkipXattr(name, rt.Opts.PreserveXattrs, xattrUserOnly) {
+			continue
+		}
+		value, err := x.Get(name)
+		if err != nil {
+			return nil, err
+		}
+		it := xattrItem{
+			name:   name,
+			length: len(value),
+			value:  value,
+		}
+		if it.abbreviated() {
+			sum := rsynccommon.XattrSum(value)
+			it.sum = sum[:]
+		}
+		xal.items = append(xal.items, it)
+	}
+	slices.SortFunc(xal.items, func(a, b xattrItem) int {
+		return strings.Compare(a.name, b.name)
+	})
+	return xal, nil
+}
+
+// xattrsDiffer reports whether the extended attributes of f differ from the
+// local attributes (nil if there is no local file). With findAll, all
+// abbreviated values which do not match are marked for requesting them (see
+// sendXattrRequest).
+//
+// rsync/xattrs.c:xattr_diff
+func xattrsDiffer(f *File, local *xattrList, findAll bool) bool {
+	var snd, rec []xattrItem
+	if f.xattrs != nil {
+		snd = f.xattrs.items
+	}
+	if local != nil {
+		rec = local.items
+	}
+	differ := len(snd) != len(rec)
+	if differ && !findAll {
+		return true
+	}
+	for len(snd) > 0 {
+		cmp := -1
+		if len(rec) > 0 {
+			cmp = strings.Compare(snd[0].name, rec[0].name)
+		}
+		same := false
+		if cmp == 0 && snd[0].length == rec[0].length {
+			if snd[0].abbreviated() {
+				same = bytes.Equal(snd[0].sum, rec[0].sum)
+			} else {
+				same = bytes.Equal(snd[0].value, rec[0].value)
+			}
+		}
+		if !same && findAll && snd[0].abbreviated() && snd[0].state == xattrAbbrev {
+			// Flag unrequested items that we need.
+			snd[0].state = xattrTodo
+		}
+		if !same {
+			if !findAll {
+				return true
+			}
+			differ = true
+		}
+		if cmp <= 0 {
+			snd = snd[1:]
+		}
+		if cmp >= 0 {
+			rec = rec[1:]
+		}
+	}
+	return differ || len(rec) > 0
+}
+
+// xattrsChanged reports whether the extended attributes of f differ from the
+// destination file (with findAll, see xattrsDiffer).
+func (rt *Transfer) xattrsChanged(f *File, exists, findAll bool) bool {
+	var local *xattrList
+	if exists {
+		var err error
+		local, err = rt.localXattrs(xattr.InRoot(rt.DestRoot, f.Name))
+		if err != nil {
+			rt.Logger.Printf("%v", err)
+		}
+	}
+	return xattrsDiffer(f, local, findAll)
+}
+
+// sendXattrRequest requests the abbreviated extended attribute values of f
+// which the generator marked, if active is set. Otherwise, the values are only
+// marked as handled.
+//
+// rsync/xattrs.c:send_xattr_request
+func (rt *Transfer) sendXattrRequest(f *File, active bool) error {
+	var prior int32
+	if f.xattrs != nil {
+		for i := range f.xattrs.items {
+			it := &f.xattrs.items[i]
+			if !it.abbreviated() {
+				continue
+			}
+			switch it.state {
+			case xattrAbbrev:
+				// Items left abbreviated matched the local value, which
+				// the receiver caches for future use (see setXattrs).
+				it.state = xattrDone
+				continue
+			case xattrTodo:
+				if !active {
+					continue
+				}
+			default:
+				continue
+			}
+			it.state = xattrDone
+			if err := rt.Conn.WriteVarint(it.num - prior); err != nil {
+				return err
+			}
+			prior = it.num
+		}
+	}
+	if !active {
+		return nil
+	}
+	return rt.Conn.WriteByte(0) // end the list
+}
+
+// recvXattrRequest receives the abbreviated extended attribute values of f
+// which the generator requested.
+//
+// rsync/xattrs.c:recv_xattr_request
+func (rt *Transfer) recvXattrRequest(f *File) error {
+	var num int32
+	for {
+		rel, err := rt.Conn.ReadVarint()
+		if err != nil {
+			return err
+		}
+		if rel == 0 {
+			return nil
+		}
+		num += rel
+		var it *xattrItem
+		if f != nil && f.xattrs != nil {
+			for i := range f.xattrs.items {
+				if f.xattrs.items[i].num == num {
+					it = &f.xattrs.items[i]
+					break
+				}
+			}
+		}
+		if it == nil {
+			return fmt.Errorf("could not find xattr #%d", num)
+		}
+		if !it.abbreviated() {
+			return fmt.Errorf("internal abbrev error on %s (%s, len=%d)", f.Name, it.name, it.length)
+		}
+		length, err := rt.Conn.ReadVarint()
+		if err != nil {
+			return err
+		}
+		if length < 0 {
+			return fmt.Errorf("invalid xattr length %d", length)
+		}
+		value := make([]byte, length)
+		if _, err := io.ReadFull(rt.Conn.Reader, value); err != nil {
+			return err
+		}
+		it.value = value
+	}
+}
+
+// setXattrs sets the extended attributes of f on target, and removes all
+// other (preserved) extended attributes. The values of abbreviated items
+// which were not requested are taken from basis, which the generator compared
+// them with.
+//
+// rsync/xattrs.c:rsync_xal_set
+func (rt *Transfer) setXattrs(f *File, target, basis xattr.File) error {
+	if rt.Opts.DryRun {
+		return nil
+	}
+	local, err := rt.localXattrs(target)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	var items []xattrItem
+	if f.xattrs != nil {
+		items = f.xattrs.items
+	}
+	for i := range items {
+		it := &items[i]
+		if f.Mode&rsync.S_IFMT == rsync.S_IFLNK && strings.HasPrefix(it.name, "user.") {
+			// Linux does not allow user.* attributes on symlinks.
+			continue
+		}
+		if it.abbreviated() && it.value == nil {
+			// See if the basis has the identical value.
+			value, err := basis.Get(it.name)
+			sum := rsynccommon.XattrSum(value)
+			if err != nil || len(value) != it.length || !bytes.Equal(sum[:], it.sum) {
+				errs = append(errs, fmt.Errorf("Missing abbreviated xattr value, %s, for %s", it.name, f.Name))
+				continue
+			}
+			// Cache the value for other files sharing the list.
+			it.value = value
+		}
+		if l := local.find(it.name); l != nil && bytes.Equal(l.value, it.value) {
+			continue // unchanged
+		}
+		if err := target.Set(it.name, it.value); err != nil {
+			errs = append(errs, fmt.Errorf("rsync_xal_set: %v", err))
+		}
+	}
+	// Remove any extraneous names.
+	for _, l := range local.items {
+		if f.xattrs.find(l.name) != nil {
+			continue
+		}
+		if err := target.Remove(l.name); err != nil {
+			errs = append(errs, fmt.Errorf("rsync_xal_set: %v", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// maybeSetXattrs sets the extended attributes of f, which the generator
+// reported as changed without transferring f.
+//
+// rsync/receiver.c:recv_files
+func (rt *Transfer) maybeSetXattrs(f *File, attrs rsynccommon.ItemAttrs) {
+	const local = rsync.ITEM_XNAME_FOLLOWS | rsync.ITEM_LOCAL_CHANGE
+	if rt.Opts.PreserveXattrs == 0 || rt.Opts.DryRun ||
+		attrs.Flags&rsync.ITEM_REPORT_XATTR == 0 ||
+		attrs.Flags&local == local {
+		return
+	}
+	x := xattr.InRoot(rt.DestRoot, f.Name)
+	if err := rt.setXattrs(f, x, x); err != nil {
+		rt.Logger.Printf("%v", err)
+		rt.ReceiverIOErrors.Or(rsync.IOERR_GENERAL)
+	}
+}
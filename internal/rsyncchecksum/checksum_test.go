@@ -2,6 +2,7 @@ package rsyncchecksum_test
 
 import (
 	"bytes"
+	"encoding/hex"
 	"os"
 	"path/filepath"
 	"testing"
@@ -71,3 +72,109 @@ func TestSyncExtended(t *testing.T) {
 		}
 	}
 }
+
+func TestChecksum2Empty(t *testing.T) {
+	// Digests of the empty input with seed 0, as listed in the xxHash
+	// reference implementation, in rsync’s (little endian) byte order.
+	for _, tt := range []struct {
+		typ  rsyncchecksum.Type
+		want string
+	}{
+		{rsyncchecksum.XXH64, "99e9d85137db46ef"},
+		{rsyncchecksum.XXH3, "c294d3380580062d"},
+		{rsyncchecksum.XXH128, "7f498d4624c30160d8984701d306aa99"},
+		{rsyncchecksum.MD5, "d41d8cd98f00b204e9800998ecf8427e"},
+		{rsyncchecksum.MD4, "31d6cfe0d16ae931b73c59d7e0c089c0"},
+	} {
+		t.Run(tt.typ.String(), func(t *testing.T) {
+			if got, want := hex.EncodeToString(tt.typ.Checksum2(0, true, nil)), tt.want; got != want {
+				t.Errorf("Checksum2() = %s, want %s", got, want)
+			}
+			if got, want := hex.EncodeToString(tt.typ.New(0).Sum(nil)), tt.want; tt.typ != rsyncchecksum.MD4 && got != want {
+				t.Errorf("New().Sum() = %s, want %s", got, want)
+			}
+			if got, want := len(tt.typ.Checksum2(0, true, nil)), tt.typ.Size(); got != want {
+				t.Errorf("len(Checksum2()) = %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestChecksum2Seed(t *testing.T) {
+	buf := bytes.Repeat([]byte("gokrazy rsync "), 100)
+	for _, typ := range []rsyncchecksum.Type{
+		rsyncchecksum.XXH64,
+		rsyncchecksum.XXH3,
+		rsyncchecksum.XXH128,
+	} {
+		t.Run(typ.String(), func(t *testing.T) {
+			// The whole-file checksum does not use the seed, so it must match
+			// the block checksum with seed 0.
+			h := typ.New(4711)
+			h.Write(buf[:100])
+			h.Write(buf[100:])
+			if got, want := h.Sum(nil), typ.Checksum2(0, true, buf); !bytes.Equal(got, want) {
+				t.Errorf("New().Sum() = %x, want %x", got, want)
+			}
+			if bytes.Equal(typ.Checksum2(4711, true, buf), typ.Checksum2(0, true, buf)) {
+				t.Errorf("Checksum2() does not depend on the seed")
+			}
+			// rsync passes the (signed) int32 seed to a uint64 parameter.
+			if bytes.Equal(typ.Checksum2(-1, true, buf), typ.Checksum2(0x7fffffff, true, buf)) {
+				t.Errorf("Checksum2() does not sign-extend the seed")
+			}
+		})
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	for _, tt := range []struct {
+		remote string
+		server bool
+		want   rsyncchecksum.Type
+		ok     bool
+	}{
+		// rsync 3.2 sends this list when built with xxhash and OpenSSL
+		{"xxh128 xxh3 xxh64 md5 md4 sha1 none", true, rsyncchecksum.XXH128, true},
+		{"xxh128 xxh3 xxh64 md5 md4 sha1 none", false, rsyncchecksum.XXH128, true},
+		// rsync 3.2 without xxhash support
+		{"md5 md4 sha1 none", false, rsyncchecksum.MD5, true},
+		// the server picks the client’s preference
+		{"sha1 md4 md5", true, rsyncchecksum.MD4, true},
+		// the client picks its own preference
+		{"sha1 md4 md5", false, rsyncchecksum.MD5, true},
+		{"xxhash", false, rsyncchecksum.XXH64, true},
+		{"sha1 none", false, 0, false},
+		{"", true, 0, false},
+	} {
+		got, ok := rsyncchecksum.Negotiate(tt.remote, tt.server)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("Negotiate(%q, server=%v) = %v, %v, want %v, %v", tt.remote, tt.server, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestParseChoice(t *testing.T) {
+	for _, tt := range []struct {
+		protocol int32
+		choice   string
+		want     rsyncchecksum.Choice
+	}{
+		{30, "", rsyncchecksum.Choice{Xfer: rsyncchecksum.MD5, File: rsyncchecksum.MD5}},
+		{29, "auto", rsyncchecksum.Choice{Xfer: rsyncchecksum.MD4, File: rsyncchecksum.MD4}},
+		{30, "xxh3", rsyncchecksum.Choice{Xfer: rsyncchecksum.XXH3, File: rsyncchecksum.XXH3}},
+		{30, "xxh128,MD5", rsyncchecksum.Choice{Xfer: rsyncchecksum.XXH128, File: rsyncchecksum.MD5}},
+		{30, "auto,xxh64", rsyncchecksum.Choice{Xfer: rsyncchecksum.MD5, File: rsyncchecksum.XXH64}},
+	} {
+		got, err := rsyncchecksum.ParseChoice(tt.protocol, tt.choice)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("ParseChoice(%d, %q) = %+v, want %+v", tt.protocol, tt.choice, got, tt.want)
+		}
+	}
+	if _, err := rsyncchecksum.ParseChoice(30, "sha1"); err == nil {
+		t.Errorf("ParseChoice(sha1) unexpectedly succeeded")
+	}
+}
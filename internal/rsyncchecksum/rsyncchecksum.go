@@ -1,11 +1,17 @@
 package rsyncchecksum
 
 import (
+	"crypto/md5"
 	"encoding/binary"
+	"fmt"
+	"hash"
 	"io"
 	"os"
+	"strings"
 
+	"github.com/cespare/xxhash/v2"
 	"github.com/mmcloughlin/md4"
+	"github.com/zeebo/xxh3"
 )
 
 func Tag2(s1, s2 uint16) uint16 {
@@ -50,28 +56,271 @@ func Checksum1(buf []byte) uint32 {
 	return (s1 & 0xffff) + (s2 << 16)
 }
 
-func Checksum2(seed int32, buf []byte) []byte {
-	h := md4.New()
+// Type is a strong checksum algorithm, used for block checksums (checksum2)
+// and whole-file checksums.
+type Type int
+
+const (
+	MD4    Type = iota // protocol < 30
+	MD5                // protocol >= 30
+	XXH64              // negotiated
+	XXH3               // negotiated, 64 bit XXH3
+	XXH128             // negotiated, 128 bit XXH3
+)
+
+// algorithms lists the supported checksum algorithms in order of preference,
+// which is the order in which they are offered during negotiation.
+//
+// rsync/checksum.c:valid_checksums_items
+var algorithms = []struct {
+	typ  Type
+	name string
+	size int
+}{
+	{XXH128, "xxh128", 16},
+	{XXH3, "xxh3", 8},
+	{XXH64, "xxh64", 8},
+	{MD5, "md5", md5.Size},
+	{MD4, "md4", md4.Size},
+}
+
+// aliases are additional names which rsync accepts for an algorithm.
+var aliases = map[string]Type{
+	"xxhash": XXH64,
+}
+
+// Lookup returns the checksum algorithm with the specified name.
+//
+// rsync/compat.c:get_nni_by_name
+func Lookup(name string) (Type, bool) {
+	if t, ok := aliases[strings.ToLower(name)]; ok {
+		return t, true
+	}
+	for _, a := range algorithms {
+		if strings.EqualFold(a.name, name) {
+			return a.typ, true
+		}
+	}
+	return 0, false
+}
+
+// Names returns the names of all supported checksum algorithms in order of
+// preference, separated by spaces (the format of the negotiation string).
+//
+// rsync/compat.c:get_default_nno_list
+func Names() string {
+	names := make([]string, len(algorithms))
+	for idx, a := range algorithms {
+		names[idx] = a.name
+	}
+	return strings.Join(names, " ")
+}
+
+// Negotiate returns the checksum algorithm to use, given the space-separated
+// list of algorithms the remote side supports. The server uses the first
+// algorithm of the client’s list which it supports, the client uses the most
+// preferred algorithm of its own list which the server supports. Both sides
+// hence end up with the same choice.
+//
+// rsync/compat.c:recv_negotiate_str
+func Negotiate(remote string, server bool) (Type, bool) {
+	if server {
+		for _, name := range strings.Fields(remote) {
+			if t, ok := Lookup(name); ok {
+				return t, true
+			}
+		}
+		return 0, false
+	}
+	supported := make(map[Type]bool)
+	for _, name := range strings.Fields(remote) {
+		if t, ok := Lookup(name); ok {
+			supported[t] = true
+		}
+	}
+	for _, a := range algorithms {
+		if supported[a.typ] {
+			return a.typ, true
+		}
+	}
+	return 0, false
+}
+
+// ForProtocol returns the strong checksum algorithm which the specified
+// protocol version uses when no checksum was negotiated.
+//
+// rsync/checksum.c:parse_csum_name
+func ForProtocol(protocol int32) Type {
+	if protocol >= 30 {
+		return MD5
+	}
+	return MD4
+}
+
+// Choice are the checksum algorithms of a transfer.
+type Choice struct {
+	// Xfer is used for block checksums and the whole-file checksum which
+	// the sender transmits after the file data.
+	Xfer Type
+	// File is used for the file list checksums (--checksum).
+	File Type
+}
+
+// ParseChoice parses the argument of the --checksum-choice option, which
+// names one algorithm for both purposes, or two algorithms separated by a
+// comma (transfer checksum, file checksum). The name “auto” selects the
+// default of the specified protocol version.
+//
+// rsync/checksum.c:parse_checksum_choice
+func ParseChoice(protocol int32, choice string) (Choice, error) {
+	parse := func(name string) (Type, error) {
+		if name == "" || strings.EqualFold(name, "auto") {
+			return ForProtocol(protocol), nil
+		}
+		t, ok := Lookup(name)
+		if !ok {
+			return 0, fmt.Errorf("unknown checksum name: %s", name)
+		}
+		return t, nil
+	}
+	xfer, file, ok := strings.Cut(choice, ",")
+	if !ok {
+		file = xfer
+	}
+	var c Choice
+	var err error
+	if c.Xfer, err = parse(xfer); err != nil {
+		return c, err
+	}
+	if c.File, err = parse(file); err != nil {
+		return c, err
+	}
+	return c, nil
+}
+
+func (t Type) String() string {
+	for _, a := range algorithms {
+		if a.typ == t {
+			return a.name
+		}
+	}
+	return fmt.Sprintf("Type(%d)", int(t))
+}
+
+// Size returns the length of checksums of this algorithm in bytes.
+//
+// rsync/checksum.c:csum_len_for_type
+func (t Type) Size() int {
+	for _, a := range algorithms {
+		if a.typ == t {
+			return a.size
+		}
+	}
+	return 0
+}
+
+func (t Type) new() hash.Hash {
+	switch t {
+	case MD5:
+		return md5.New()
+	case XXH64:
+		return xxh64Hash{xxhash.New()}
+	case XXH3:
+		return xxh3Hash{xxh3.New()}
+	case XXH128:
+		return xxh128Hash{xxh3.New()}
+	}
+	return md4.New()
+}
+
+// Checksum2 returns the strong checksum of a data block. properSeedOrder
+// corresponds to CF_CHKSUM_SEED_FIX: MD5 checksums then include the seed
+// before the data instead of after it. The xxhash algorithms use the seed as
+// their seed.
+//
+// rsync/checksum.c:get_checksum2
+func (t Type) Checksum2(seed int32, properSeedOrder bool, buf []byte) []byte {
+	switch t {
+	case XXH64:
+		h := xxhash.NewWithSeed(uint64(seed))
+		h.Write(buf)
+		return binary.LittleEndian.AppendUint64(nil, h.Sum64())
+	case XXH3:
+		return binary.LittleEndian.AppendUint64(nil, xxh3.HashSeed(buf, uint64(seed)))
+	case XXH128:
+		return appendUint128(nil, xxh3.Hash128Seed(buf, uint64(seed)))
+	}
+	h := t.new()
+	if seed != 0 && t == MD5 && properSeedOrder {
+		binary.Write(h, binary.LittleEndian, seed)
+	}
 	h.Write(buf)
-	binary.Write(h, binary.LittleEndian, seed)
+	if seed != 0 && (t == MD4 || !properSeedOrder) {
+		binary.Write(h, binary.LittleEndian, seed)
+	}
 	return h.Sum(nil)
 }
 
-func ReaderChecksum(r io.Reader) ([]byte, error) {
-	h := md4.New()
+// New returns a hash for the whole-file checksum which the sender transmits
+// after the file data. Only MD4 includes the seed.
+//
+// rsync/checksum.c:sum_init
+func (t Type) New(seed int32) hash.Hash {
+	h := t.new()
+	if t == MD4 {
+		binary.Write(h, binary.LittleEndian, seed)
+	}
+	return h
+}
+
+// ReaderChecksum returns the file list checksum (--checksum) of the data read
+// from r.
+//
+// rsync/checksum.c:file_checksum
+func (t Type) ReaderChecksum(r io.Reader) ([]byte, error) {
+	h := t.new()
 	if _, err := io.Copy(h, r); err != nil {
 		return nil, err
 	}
 	return h.Sum(nil), nil
 }
 
-func RootChecksum(root *os.Root, fn string) ([]byte, error) {
+func (t Type) RootChecksum(root *os.Root, fn string) ([]byte, error) {
 	f, err := root.Open(fn)
 	if err != nil {
 		return nil, err
 	}
 	defer f.Close()
-	return ReaderChecksum(f)
+	return t.ReaderChecksum(f)
 }
 
-const Size = md4.Size
+// MaxSize is the length of the longest supported checksum.
+const MaxSize = 16 // rsync/rsync.h:SUM_LENGTH
+
+// The xxhash packages append their digests in big endian byte order, whereas
+// rsync transmits them in little endian byte order (SIVAL64).
+
+type xxh64Hash struct{ *xxhash.Digest }
+
+func (h xxh64Hash) Sum(b []byte) []byte {
+	return binary.LittleEndian.AppendUint64(b, h.Sum64())
+}
+
+type xxh3Hash struct{ *xxh3.Hasher }
+
+func (h xxh3Hash) Sum(b []byte) []byte {
+	return binary.LittleEndian.AppendUint64(b, h.Sum64())
+}
+
+type xxh128Hash struct{ *xxh3.Hasher }
+
+func (h xxh128Hash) Size() int { return 16 }
+
+func (h xxh128Hash) Sum(b []byte) []byte {
+	return appendUint128(b, h.Sum128())
+}
+
+func appendUint128(b []byte, u xxh3.Uint128) []byte {
+	b = binary.LittleEndian.AppendUint64(b, u.Lo)
+	return binary.LittleEndian.AppendUint64(b, u.Hi)
+}
@@ -0,0 +1,239 @@
+package rsynccommon
+
+import (
+	"cmp"
+	"encoding/binary"
+	"fmt"
+	"slices"
+)
+
+// The extended attributes in which Linux stores POSIX ACLs.
+const (
+	ACLAccessXattr  = "system.posix_acl_access"
+	ACLDefaultXattr = "system.posix_acl_default"
+)
+
+// NoACLEntry is the value of an ACL entry which is not present.
+//
+// rsync/acls.c:NO_ENTRY
+const NoACLEntry = 0x80
+
+// ACLName is a named user or group entry of an ACL.
+//
+// rsync/lib/sysacls.h:id_access
+type ACLName struct {
+	ID     uint32
+	Access uint8
+	IsUser bool // rsync/acls.c:NAME_IS_USER
+}
+
+// ACL is a POSIX ACL as rsync transfers it: the permissions of the owner,
+// group, mask and others entries (NoACLEntry if absent) and the named entries.
+//
+// rsync/acls.c:rsync_acl
+type ACL struct {
+	UserObj  uint8
+	GroupObj uint8
+	MaskObj  uint8
+	OtherObj uint8
+	Names    []ACLName
+}
+
+// EmptyACL returns an ACL without entries, e.g. the default ACL of a
+// directory which has none.
+//
+// rsync/acls.c:create_racl
+func EmptyACL() *ACL {
+	return &ACL{
+		UserObj:  NoACLEntry,
+		GroupObj: NoACLEntry,
+		MaskObj:  NoACLEntry,
+		OtherObj: NoACLEntry,
+	}
+}
+
+// FakeACL returns the access ACL of a file with mode which has no ACL (or
+// whose file system does not support ACLs).
+//
+// rsync/acls.c:rsync_acl_fake_perms
+func FakeACL(mode uint32) *ACL {
+	acl := EmptyACL()
+	acl.UserObj = uint8(mode>>6) & 7
+	acl.GroupObj = uint8(mode>>3) & 7
+	acl.OtherObj = uint8(mode) & 7
+	return acl
+}
+
+// Linux POSIX ACL extended attribute format, see
+// include/uapi/linux/posix_acl_xattr.h and include/uapi/linux/posix_acl.h.
+const (
+	posixACLVersion   = 2
+	posixACLEntrySize = 8
+
+	posixACLUserObj  = 0x01
+	posixACLUser     = 0x02
+	posixACLGroupObj = 0x04
+	posixACLGroup    = 0x08
+	posixACLMask     = 0x10
+	posixACLOther    = 0x20
+)
+
+// ParsePosixACL parses the value of ACLAccessXattr or ACLDefaultXattr.
+//
+// rsync/acls.c:unpack_smb_acl
+func ParsePosixACL(value []byte) (*ACL, error) {
+	if len(value) < 4 || (len(value)-4)%posixACLEntrySize != 0 {
+		return nil, fmt.Errorf("invalid POSIX ACL of %d bytes", len(value))
+	}
+	if version := binary.LittleEndian.Uint32(value); version != posixACLVersion {
+		return nil, fmt.Errorf("unsupported POSIX ACL version %d", version)
+	}
+	acl := EmptyACL()
+	for entries := value[4:]; len(entries) > 0; entries = entries[posixACLEntrySize:] {
+		tag := binary.LittleEndian.Uint16(entries[0:])
+		access := uint8(binary.LittleEndian.Uint16(entries[2:])) & 7
+		id := binary.LittleEndian.Uint32(entries[4:])
+		var obj *uint8
+		switch tag {
+		case posixACLUserObj:
+			obj = &acl.UserObj
+		case posixACLGroupObj:
+			obj = &acl.GroupObj
+		case posixACLMask:
+			obj = &acl.MaskObj
+		case posixACLOther:
+			obj = &acl.OtherObj
+		case posixACLUser, posixACLGroup:
+			acl.Names = append(acl.Names, ACLName{
+				ID:     id,
+				Access: access,
+				IsUser: tag == posixACLUser,
+			})
+			continue
+		default:
+			return nil, fmt.Errorf("unknown POSIX ACL tag type %#x", tag)
+		}
+		if *obj != NoACLEntry {
+			return nil, fmt.Errorf("duplicate POSIX ACL entry %#x", tag)
+		}
+		*obj = access
+	}
+	return acl, nil
+}
+
+// PosixACL returns acl in the format of ACLAccessXattr or ACLDefaultXattr.
+// Entries which are not present (NoACLEntry) have no permissions.
+//
+// rsync/acls.c:pack_smb_acl
+func (acl *ACL) PosixACL() []byte {
+	// Linux requires the named entries to be sorted by tag and id.
+	names := slices.Clone(acl.Names)
+	slices.SortFunc(names, func(a, b ACLName) int {
+		if a.IsUser != b.IsUser {
+			if a.IsUser {
+				return -1
+			}
+			return 1
+		}
+		return cmp.Compare(a.ID, b.ID)
+	})
+	value := binary.LittleEndian.AppendUint32(nil, posixACLVersion)
+	entry := func(tag uint16, access uint8, id uint32) {
+		value = binary.LittleEndian.AppendUint16(value, tag)
+		value = binary.LittleEndian.AppendUint16(value, uint16(access&^NoACLEntry))
+		value = binary.LittleEndian.AppendUint32(value, id)
+	}
+	const undefinedID = ^uint32(0) // ACL_UNDEFINED_ID
+	entry(posixACLUserObj, acl.UserObj, undefinedID)
+	for _, n := range names {
+		if n.IsUser {
+			entry(posixACLUser, n.Access, n.ID)
+		}
+	}
+	entry(posixACLGroupObj, acl.GroupObj, undefinedID)
+	for _, n := range names {
+		if !n.IsUser {
+			entry(posixACLGroup, n.Access, n.ID)
+		}
+	}
+	if acl.MaskObj != NoACLEntry {
+		entry(posixACLMask, acl.MaskObj, undefinedID)
+	}
+	entry(posixACLOther, acl.OtherObj, undefinedID)
+	return value
+}
+
+// WithPerms returns a copy of the access ACL acl in which the entries that
+// correspond to the permission bits are taken from mode.
+//
+// rsync/acls.c:change_sacl_perms
+func (acl *ACL) WithPerms(mode uint32) *ACL {
+	perms := *acl
+	perms.UserObj = uint8(mode>>6) & 7
+	if perms.GroupObj == NoACLEntry {
+		// The group entry is only omitted when identical to the group
+		// permission bits.
+		perms.GroupObj = uint8(mode>>3) & 7
+	}
+	if perms.MaskObj != NoACLEntry {
+		// With a mask, the group permission bits are the mask.
+		perms.MaskObj = uint8(mode>>3) & 7
+	}
+	perms.OtherObj = uint8(mode) & 7
+	return &perms
+}
+
+// StripPerms removes the entries from the access ACL acl of a file with mode
+// which can be reconstructed from the permission bits.
+//
+// rsync/acls.c:rsync_acl_strip_perms
+func (acl *ACL) StripPerms(mode uint32) {
+	acl.UserObj = NoACLEntry
+	if acl.MaskObj == NoACLEntry {
+		acl.GroupObj = NoACLEntry
+	} else {
+		groupPerms := uint8(mode>>3) & 7
+		if acl.GroupObj == groupPerms {
+			acl.GroupObj = NoACLEntry
+		}
+		if len(acl.Names) != 0 && acl.MaskObj == groupPerms {
+			acl.MaskObj = NoACLEntry
+		}
+	}
+	acl.OtherObj = NoACLEntry
+}
+
+// Equal reports whether acl and other have the same entries.
+//
+// rsync/acls.c:rsync_acl_equal
+func (acl *ACL) Equal(other *ACL) bool {
+	return acl.UserObj == other.UserObj &&
+		acl.GroupObj == other.GroupObj &&
+		acl.MaskObj == other.MaskObj &&
+		acl.OtherObj == other.OtherObj &&
+		slices.Equal(acl.Names, other.Names)
+}
+
+// EqualEnough reports whether the access ACL acl of a local file matches the
+// received access ACL other of a file with mode, whose permission bits are
+// compared separately.
+//
+// rsync/acls.c:rsync_acl_equal_enough
+func (acl *ACL) EqualEnough(other *ACL, mode uint32) bool {
+	if (acl.MaskObj^other.MaskObj)&NoACLEntry != 0 {
+		return false // one has a mask and the other does not
+	}
+	// When there is a mask, the group entry becomes a named entry.
+	if acl.MaskObj != NoACLEntry {
+		// Without a group entry, the received ACL's group entry was
+		// identical to the mask, i.e. to the group permission bits.
+		if other.GroupObj == NoACLEntry {
+			if acl.GroupObj != uint8(mode>>3)&7 {
+				return false
+			}
+		} else if acl.GroupObj != other.GroupObj {
+			return false
+		}
+	}
+	return slices.Equal(acl.Names, other.Names)
+}
@@ -0,0 +1,403 @@
+package rsynccommon
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gokrazy/rsync"
+	"github.com/gokrazy/rsync/internal/rsyncopts"
+)
+
+// SignificantItemFlags are the item flags which indicate a change of the
+// file, as opposed to flags which only describe how it is transferred.
+//
+// rsync/rsync.h:SIGNIFICANT_ITEM_FLAGS
+const SignificantItemFlags = ^uint16(rsync.ITEM_BASIS_TYPE_FOLLOWS |
+	rsync.ITEM_XNAME_FOLLOWS | rsync.ITEM_LOCAL_CHANGE)
+
+// itemDeleted marks deletions in the item flags passed to logFormatted. It
+// does not fit the 16 bits of item flags which are sent over the wire.
+//
+// rsync/rsync.h:ITEM_DELETED
+const itemDeleted = 1 << 17
+
+// LogFile is a file list entry as logged by ItemLog.
+type LogFile struct {
+	Name       string // relative to the transfer root
+	Path       string // local path (%f), if different from Name
+	Mode       int32  // file type and permission bits
+	Length     int64
+	ModTime    time.Time
+	LinkTarget string
+}
+
+// ItemLog logs transferred, changed and deleted files on the stdout of the
+// client in the --out-format, which --itemize-changes and --verbose imply.
+// Servers do not log anything, but the options they receive from the client
+// tell their generator which items to report.
+//
+// rsync/log.c
+type ItemLog struct {
+	opts  *rsyncopts.Options
+	out   io.Writer
+	bytes func() int64 // for %b
+
+	// initialBytes is the value of bytes when the transfer of the current
+	// file started.
+	initialBytes int64
+
+	// mu serializes writes by the receiver and generator goroutines.
+	mu sync.Mutex
+}
+
+// NewItemLog returns an ItemLog writing to out. The bytes function returns
+// the number of data bytes sent (for senders) or received (for receivers) so
+// far, and may be nil on servers.
+func NewItemLog(opts *rsyncopts.Options, out io.Writer, bytes func() int64) *ItemLog {
+	return &ItemLog{
+		opts:  opts,
+		out:   out,
+		bytes: bytes,
+	}
+}
+
+// ReportUnchanged reports whether the generator reports unchanged files to
+// the sender, too (-ii or -vv), not just files with significant changes.
+func (l *ItemLog) ReportUnchanged() bool {
+	return l.opts.InfoGTE(rsyncopts.INFO_NAME, 2) || l.opts.StdoutFormatHasI() > 1
+}
+
+// LogItem logs f with its item flags (see rsync.ITEM_REPORT_CHANGE and
+// others). A non-empty hlink is logged as the hard link target of f (%L).
+//
+// rsync/log.c:log_item
+func (l *ItemLog) LogItem(f LogFile, iflags uint16, hlink string) {
+	if l.opts.Server() || l.opts.StdoutFormat() == "" {
+		return
+	}
+	op := "recv"
+	if l.opts.Sender() {
+		op = "send"
+	}
+	l.write(l.logFormatted(l.opts.StdoutFormat(), op, f, "", int(iflags), hlink))
+}
+
+// MaybeLogItem logs f if it has significant changes, or if all items are
+// itemized (-ii). Directories with significant changes and local changes
+// (like created symlinks) are logged even without %i in the format.
+//
+// rsync/log.c:maybe_log_item
+func (l *ItemLog) MaybeLogItem(f LogFile, iflags uint16, xname string) {
+	if l.opts.Server() {
+		return
+	}
+	significant := iflags & SignificantItemFlags
+	hasI := l.opts.StdoutFormatHasI()
+	seeItem := hasI != 0 && (significant != 0 || xname != "" || hasI > 1 ||
+		l.opts.InfoGTE(rsyncopts.INFO_NAME, 2))
+	localChange := iflags&rsync.ITEM_LOCAL_CHANGE != 0 && significant != 0
+	if seeItem || localChange || xname != "" ||
+		(f.Mode&rsync.S_IFMT == rsync.S_IFDIR && significant != 0) {
+		l.LogItem(f, iflags, xname)
+	}
+}
+
+// BeginTransfer is called before the data of f is transferred. It logs f
+// unless the format contains transfer statistics (like %b), in which case
+// EndTransfer logs f.
+//
+// rsync/sender.c:send_files
+// rsync/receiver.c:recv_files
+func (l *ItemLog) BeginTransfer(f LogFile, iflags uint16) {
+	if l.bytes != nil {
+		l.initialBytes = l.bytes()
+	}
+	if l.opts.LogBeforeTransfer() {
+		l.LogItem(f, iflags, "")
+	} else if !l.opts.Server() &&
+		l.opts.InfoGTE(rsyncopts.INFO_NAME, 1) &&
+		l.opts.InfoEQ(rsyncopts.INFO_PROGRESS, 1) {
+		l.write(f.Name + "\n")
+	}
+}
+
+// EndTransfer is called once the data of f was transferred, see
+// BeginTransfer.
+func (l *ItemLog) EndTransfer(f LogFile, iflags uint16) {
+	if !l.opts.LogBeforeTransfer() {
+		l.LogItem(f, iflags, "")
+	}
+}
+
+// LogDelete logs the deletion of name, a file of the specified mode (only
+// the file type bits matter). Without %i or %o in the format, deletions are
+// logged as “deleting <name>”.
+//
+// rsync/log.c:log_delete
+func (l *ItemLog) LogDelete(name string, mode int32) {
+	if l.opts.Server() {
+		return
+	}
+	if !l.opts.InfoGTE(rsyncopts.INFO_DEL, 1) && l.opts.StdoutFormat() == "" {
+		return
+	}
+	format := "deleting %n"
+	if l.opts.StdoutFormatHasOOrI() {
+		format = l.opts.StdoutFormat()
+	}
+	f := LogFile{Name: name, Mode: mode, ModTime: time.Unix(0, 0)}
+	l.write(l.logFormatted(format, "del.", f, name, itemDeleted, ""))
+}
+
+func (l *ItemLog) write(line string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	io.WriteString(l.out, line)
+}
+
+// logFormatted expands the escapes of format for f. A non-empty fname
+// overrides the name of f (and suppresses its symlink target), which
+// LogDelete uses. Unknown escapes are copied verbatim.
+//
+// rsync/log.c:log_formatted
+func (l *ItemLog) logFormatted(format, op string, f LogFile, fname string, iflags int, hlink string) string {
+	var b strings.Builder
+	for i := 0; i < len(format); {
+		if format[i] != '%' {
+			b.WriteByte(format[i])
+			i++
+			continue
+		}
+		start := i
+		i++
+		humanize := 0
+		for i < len(format) && format[i] == '\'' {
+			humanize++
+			i++
+		}
+		padded := false // width modifier present (fmt[1] in tridge)
+		left := false
+		if i < len(format) && format[i] == '-' {
+			padded, left = true, true
+			i++
+		}
+		width := 0
+		for i < len(format) && format[i] >= '0' && format[i] <= '9' {
+			padded = true
+			width = width*10 + int(format[i]-'0')
+			i++
+		}
+		for i < len(format) && format[i] == '\'' {
+			humanize++
+			i++
+		}
+		if i >= len(format) {
+			b.WriteString(format[start:])
+			break
+		}
+		pad := func(s string) string {
+			if len(s) >= width {
+				return s
+			}
+			if left {
+				return s + strings.Repeat(" ", width-len(s))
+			}
+			return strings.Repeat(" ", width-len(s)) + s
+		}
+
+		var n string
+		ok := true
+		switch format[i] {
+		case 'n':
+			n = f.Name
+			if fname != "" {
+				n = fname
+			}
+			if f.Mode&rsync.S_IFMT == rsync.S_IFDIR {
+				n += "/"
+			}
+
+		case 'f':
+			n = f.Name
+			if fname != "" {
+				n = fname
+			} else if f.Path != "" {
+				n = f.Path
+			}
+			n = strings.TrimPrefix(path.Clean(n), "/")
+
+		case 'L':
+			var prefix string
+			switch {
+			case hlink != "":
+				prefix, n = " => ", hlink
+			case f.Mode&rsync.S_IFMT == rsync.S_IFLNK && fname == "":
+				prefix, n = " -> ", f.LinkTarget
+			case padded:
+				prefix = "    "
+			}
+			n = prefix + pad(n)
+			padded = false
+
+		case 'l':
+			n = bigNum(f.Length, humanize)
+
+		case 'b':
+			var transferred int64
+			if iflags&rsync.ITEM_TRANSFER != 0 && l.bytes != nil {
+				transferred = l.bytes() - l.initialBytes
+			}
+			n = bigNum(transferred, humanize)
+
+		case 'M':
+			n = f.ModTime.Local().Format("2006/01/02-15:04:05")
+
+		case 'o':
+			n = op
+
+		case 'i':
+			n = l.itemString(op, f, iflags)
+
+		default:
+			ok = false
+		}
+		if !ok {
+			// Leave the escape as-is, and continue after its modifiers.
+			b.WriteString(format[start:i])
+			continue
+		}
+		if padded {
+			n = pad(n)
+		}
+		b.WriteString(n)
+		i++
+	}
+	b.WriteByte('\n')
+	return b.String()
+}
+
+// itemString returns the change summary of f (%i), e.g. “>f.st......”.
+//
+// rsync/log.c:log_formatted
+func (l *ItemLog) itemString(op string, f LogFile, iflags int) string {
+	if iflags&itemDeleted != 0 {
+		return "*deleting  "
+	}
+	var c [11]byte
+	switch {
+	case iflags&rsync.ITEM_LOCAL_CHANGE != 0:
+		if iflags&rsync.ITEM_XNAME_FOLLOWS != 0 {
+			c[0] = 'h'
+		} else {
+			c[0] = 'c'
+		}
+	case iflags&rsync.ITEM_TRANSFER == 0:
+		c[0] = '.'
+	case !l.opts.LocalServer() && op == "send":
+		c[0] = '<'
+	default:
+		c[0] = '>'
+	}
+	flag := func(bit int, ch byte) byte {
+		if iflags&bit != 0 {
+			return ch
+		}
+		return '.'
+	}
+	mode := f.Mode & rsync.S_IFMT
+	switch mode {
+	case rsync.S_IFLNK:
+		c[1] = 'L'
+		c[3] = '.'
+		c[4] = flag(rsync.ITEM_REPORT_TIME, 'T') // symlink times are not preserved
+	default:
+		switch mode {
+		case rsync.S_IFDIR:
+			c[1] = 'd'
+		case rsync.S_IFSOCK, rsync.S_IFIFO:
+			c[1] = 'S'
+		case rsync.S_IFCHR, rsync.S_IFBLK:
+			c[1] = 'D'
+		default:
+			c[1] = 'f'
+		}
+		c[3] = flag(rsync.ITEM_REPORT_SIZE, 's')
+		c[4] = flag(rsync.ITEM_REPORT_TIME, 't')
+		if c[4] == 't' && !l.opts.PreserveMTimes() {
+			c[4] = 'T'
+		}
+	}
+	c[2] = flag(rsync.ITEM_REPORT_CHANGE, 'c')
+	c[5] = flag(rsync.ITEM_REPORT_PERMS, 'p')
+	c[6] = flag(rsync.ITEM_REPORT_OWNER, 'o')
+	c[7] = flag(rsync.ITEM_REPORT_GROUP, 'g')
+	switch iflags & (rsync.ITEM_REPORT_ATIME | rsync.ITEM_REPORT_CRTIME) {
+	case 0:
+		c[8] = '.'
+	case rsync.ITEM_REPORT_ATIME | rsync.ITEM_REPORT_CRTIME:
+		c[8] = 'b'
+	case rsync.ITEM_REPORT_ATIME:
+		c[8] = 'u'
+	default:
+		c[8] = 'n'
+	}
+	c[9] = flag(rsync.ITEM_REPORT_ACL, 'a')
+	c[10] = flag(rsync.ITEM_REPORT_XATTR, 'x')
+
+	if iflags&rsync.ITEM_IS_NEW != 0 {
+		for i := 2; i < len(c); i++ {
+			c[i] = '+'
+		}
+	} else if c[0] == '.' || c[0] == 'h' || c[0] == 'c' {
+		if strings.Trim(string(c[2:]), ".") == "" {
+			for i := 2; i < len(c); i++ {
+				c[i] = ' '
+			}
+		}
+	}
+	return string(c[:])
+}
+
+// bigNum formats num, with thousands separators if human is 1, or with
+// units of 1000 (human is 2) or 1024 (human is 3 or more).
+//
+// rsync/lib/compat.c:do_big_num
+func bigNum(num int64, human int) string {
+	if human > 1 {
+		mult := int64(1000)
+		if human > 2 {
+			mult = 1024
+		}
+		if num >= mult || num <= -mult {
+			dnum := float64(num) / float64(mult)
+			units := "KMGTPE"
+			for (dnum >= float64(mult) || dnum <= -float64(mult)) && len(units) > 1 {
+				dnum /= float64(mult)
+				units = units[1:]
+			}
+			return fmt.Sprintf("%.2f%c", dnum, units[0])
+		}
+	}
+	s := strconv.FormatInt(num, 10)
+	if human == 0 {
+		return s
+	}
+	neg := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+	var b strings.Builder
+	if neg {
+		b.WriteByte('-')
+	}
+	for i, r := range s {
+		if i > 0 && (len(s)-i)%3 == 0 {
+			b.WriteByte(',')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,133 @@
+package rsynccommon_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gokrazy/rsync"
+	"github.com/gokrazy/rsync/internal/rsynccommon"
+	"github.com/gokrazy/rsync/internal/rsyncopts"
+	"github.com/gokrazy/rsync/internal/rsyncostest"
+)
+
+func TestItemLog(t *testing.T) {
+	file := rsynccommon.LogFile{
+		Name:    "dir/file.txt",
+		Mode:    rsync.S_IFREG | 0644,
+		Length:  1234567,
+		ModTime: time.Date(2009, 11, 10, 23, 0, 0, 0, time.Local),
+	}
+	dir := rsynccommon.LogFile{
+		Name: "dir",
+		Mode: rsync.S_IFDIR | 0755,
+	}
+	link := rsynccommon.LogFile{
+		Name:       "link",
+		Mode:       rsync.S_IFLNK | 0777,
+		LinkTarget: "dir/file.txt",
+	}
+	for _, tt := range []struct {
+		name   string
+		args   []string
+		f      rsynccommon.LogFile
+		iflags uint16
+		want   string
+	}{
+		{
+			name:   "new-file",
+			args:   []string{"-i"},
+			f:      file,
+			iflags: rsync.ITEM_TRANSFER | rsync.ITEM_IS_NEW,
+			want:   ">f+++++++++ dir/file.txt\n",
+		},
+		{
+			name:   "changed-file",
+			args:   []string{"-it"},
+			f:      file,
+			iflags: rsync.ITEM_TRANSFER | rsync.ITEM_REPORT_SIZE | rsync.ITEM_REPORT_TIME,
+			want:   ">f.st...... dir/file.txt\n",
+		},
+		{
+			name:   "perms",
+			args:   []string{"-i"},
+			f:      file,
+			iflags: rsync.ITEM_REPORT_PERMS,
+			want:   ".f...p..... dir/file.txt\n",
+		},
+		{
+			name: "unchanged",
+			args: []string{"-ii"},
+			f:    file,
+			want: ".f          dir/file.txt\n",
+		},
+		{
+			name:   "new-dir",
+			args:   []string{"-i"},
+			f:      dir,
+			iflags: rsync.ITEM_LOCAL_CHANGE | rsync.ITEM_IS_NEW,
+			want:   "cd+++++++++ dir/\n",
+		},
+		{
+			name:   "new-symlink",
+			args:   []string{"-i"},
+			f:      link,
+			iflags: rsync.ITEM_LOCAL_CHANGE | rsync.ITEM_IS_NEW,
+			want:   "cL+++++++++ link -> dir/file.txt\n",
+		},
+		{
+			name: "out-format",
+			args: []string{"--out-format=%o|%n|%l|%'l|%10l|%-10l|%M|%Z"},
+			f:    file,
+			want: "recv|dir/file.txt|1234567|1,234,567|   1234567|1234567   |2009/11/10-23:00:00|%Z\n",
+		},
+		{
+			name: "out-format-human",
+			args: []string{"--out-format=%''l %'''l"},
+			f:    file,
+			want: "1.23M 1.18M\n",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			osenv := rsyncostest.New(t)
+			pc := rsyncopts.NewContext(rsyncopts.NewOptions(osenv))
+			if err := pc.ParseArguments(osenv, tt.args); err != nil {
+				t.Fatalf("ParseArguments: %v", err)
+			}
+			var out strings.Builder
+			l := rsynccommon.NewItemLog(pc.Options, &out, nil)
+			l.LogItem(tt.f, tt.iflags, "")
+			if got := out.String(); got != tt.want {
+				t.Errorf("LogItem() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestItemLogDelete(t *testing.T) {
+	for _, tt := range []struct {
+		args []string
+		mode int32
+		want string
+	}{
+		{[]string{"-v"}, rsync.S_IFREG, "deleting dir/file.txt\n"},
+		{[]string{"-v"}, rsync.S_IFDIR, "deleting dir/file.txt/\n"},
+		{[]string{"-i"}, rsync.S_IFREG, "*deleting   dir/file.txt\n"},
+		{[]string{"--out-format=%o %n"}, rsync.S_IFREG, "del. dir/file.txt\n"},
+		{nil, rsync.S_IFREG, ""},
+	} {
+		t.Run(strings.Join(tt.args, " "), func(t *testing.T) {
+			osenv := rsyncostest.New(t)
+			pc := rsyncopts.NewContext(rsyncopts.NewOptions(osenv))
+			if err := pc.ParseArguments(osenv, tt.args); err != nil {
+				t.Fatalf("ParseArguments: %v", err)
+			}
+			var out strings.Builder
+			l := rsynccommon.NewItemLog(pc.Options, &out, nil)
+			l.LogDelete("dir/file.txt", tt.mode)
+			if got := out.String(); got != tt.want {
+				t.Errorf("LogDelete() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -3,35 +3,279 @@
 package rsynccommon
 
 import (
-	"math"
+	"fmt"
+	"slices"
+	"strings"
 
 	"github.com/gokrazy/rsync"
+	"github.com/gokrazy/rsync/internal/rsyncchecksum"
+	"github.com/gokrazy/rsync/internal/rsyncopts"
+	"github.com/gokrazy/rsync/internal/rsyncwire"
 )
 
-const blockSize = 700 // rsync/rsync.h
+const (
+	blockSize    = 700 // rsync/rsync.h:BLOCK_SIZE
+	blocksumBias = 10  // rsync/rsync.h:BLOCKSUM_BIAS
 
-// Corresponds to rsync/generator.c:sum_sizes_sqroot
-func SumSizesSqroot(contentLen int64) rsync.SumHead {
-	// * The block size is a rounded square root of file length.
-
-	// 	The block size algorithm plays a crucial role in the protocol efficiency. In general, the block size is the rounded square root of the total file size. The minimum block size, however, is 700 B. Otherwise, the square root computation is simply sqrt(3) followed by ceil(3)
-
-	// For reasons unknown, the square root result is rounded up to the nearest multiple of eight.
+	// ShortSumLength is the minimum length of the strong checksum of each
+	// block (rsync/rsync.h:SHORT_SUM_LENGTH).
+	ShortSumLength = 2
+)
 
-	// TODO: round this
-	blockLength := max(int32(math.Sqrt(float64(contentLen))), blockSize)
+// SumSizesSqroot returns the sum head for a basis file of contentLen bytes.
+//
+// The block length is blockLength if non-zero (--block-size), otherwise the
+// square root of contentLen, rounded down to a multiple of 8 (700 at least).
+//
+// The strong checksum length is xferSumLength (the length of the negotiated
+// checksum) if checksumLength is at least as long, which the generator uses
+// when it requests a file again after it failed verification. Otherwise, the
+// length is calculated according to:
+//
+//	blocksum_bits = BLOCKSUM_BIAS + 2*log2(file_len) - log2(block_len)
+//
+// provided by Donovan Baarda, which gives a probability of rsync algorithm
+// corrupting data and falling back using the whole checksums, limited to
+// the range from checksumLength (usually ShortSumLength) to xferSumLength.
+// Protocol versions < 27 always use checksumLength.
+//
+// rsync/generator.c:sum_sizes_sqroot
+func SumSizesSqroot(protocol int32, contentLen int64, blockLength int32, checksumLength, xferSumLength int) rsync.SumHead {
+	if blockLength == 0 {
+		if contentLen <= blockSize*blockSize {
+			blockLength = blockSize
+		} else {
+			maxBlength := rsync.MaxBlockSize(protocol)
+			c := int64(1)
+			for l := contentLen >> 2; l != 0; l >>= 2 {
+				c <<= 1
+			}
+			if c >= int64(maxBlength) {
+				blockLength = maxBlength
+			} else {
+				var blength int64
+				for ; c >= 8; c >>= 1 { // round to multiple of 8
+					blength |= c
+					if contentLen < blength*blength {
+						blength &^= c
+					}
+				}
+				blockLength = max(int32(blength), blockSize)
+			}
+		}
+	}
 
-	// * The checksum size is determined according to:
-	// *     blocksum_bits = BLOCKSUM_EXP + 2*log2(file_len) - log2(block_len)
-	// * provided by Donovan Baarda which gives a probability of rsync
-	// * algorithm corrupting data and falling back using the whole md4
-	// * checksums.
-	const checksumLength = 16 // TODO?
+	xferSumLength = min(xferSumLength, rsyncchecksum.MaxSize)
+	var s2length int
+	switch {
+	case protocol < 27:
+		s2length = checksumLength
+	case checksumLength >= xferSumLength:
+		s2length = xferSumLength
+	default:
+		b := blocksumBias
+		for l := contentLen >> 1; l != 0; l >>= 1 {
+			b += 2
+		}
+		for c := blockLength >> 1; c != 0 && b != 0; c >>= 1 {
+			b--
+		}
+		// add a bit, subtract rollsum, round up.
+		s2length = (b + 1 - 32 + 7) / 8
+		s2length = max(s2length, checksumLength)
+		s2length = min(s2length, xferSumLength)
+	}
 
+	remainder := int32(contentLen % int64(blockLength))
+	count := contentLen / int64(blockLength)
+	if remainder != 0 {
+		count++
+	}
 	return rsync.SumHead{
-		ChecksumCount:   int32((contentLen + (int64(blockLength) - 1)) / int64(blockLength)),
-		RemainderLength: int32(contentLen % int64(blockLength)),
+		ChecksumCount:   int32(count),
+		RemainderLength: remainder,
 		BlockLength:     blockLength,
-		ChecksumLength:  checksumLength,
+		ChecksumLength:  int32(s2length),
+	}
+}
+
+// ItemAttrs are the item flags (and the data they announce) which protocol 29
+// and newer send along with each file list index.
+type ItemAttrs struct {
+	Flags        uint16 // rsync.ITEM_*
+	FnamecmpType byte   // only if rsync.ITEM_BASIS_TYPE_FOLLOWS
+	Xname        string // only if rsync.ITEM_XNAME_FOLLOWS
+}
+
+// ReadNdxAndAttrs reads a file list index and (for protocol 29 and newer) its
+// item attributes. Older protocols only transfer files, so ITEM_TRANSFER is
+// implied. Negative indexes (rsync.NDX_DONE, and with incremental recursion
+// rsync.NDX_FLIST_EOF and rsync.NDX_FLIST_OFFSET-based directory indexes)
+// are not followed by item attributes.
+//
+// rsync/rsync.c:read_ndx_and_attrs
+func ReadNdxAndAttrs(c *rsyncwire.Conn, protocol int32) (int32, ItemAttrs, error) {
+	attrs := ItemAttrs{Flags: rsync.ITEM_TRANSFER}
+	ndx, err := c.ReadNdx(protocol)
+	if err != nil {
+		return 0, attrs, err
+	}
+	if protocol < 29 || ndx < 0 {
+		return ndx, attrs, nil
+	}
+	attrs.Flags, err = c.ReadShortInt()
+	if err != nil {
+		return 0, attrs, err
+	}
+	if attrs.Flags&rsync.ITEM_BASIS_TYPE_FOLLOWS != 0 {
+		attrs.FnamecmpType, err = c.ReadByte()
+		if err != nil {
+			return 0, attrs, err
+		}
+	}
+	if attrs.Flags&rsync.ITEM_XNAME_FOLLOWS != 0 {
+		attrs.Xname, err = c.ReadVstring()
+		if err != nil {
+			return 0, attrs, err
+		}
+	}
+	return ndx, attrs, nil
+}
+
+// WriteNdxAndAttrs writes a file list index and (for protocol 29 and newer)
+// its item attributes.
+//
+// rsync/sender.c:write_ndx_and_attrs
+func WriteNdxAndAttrs(c *rsyncwire.Conn, protocol int32, ndx int32, attrs ItemAttrs) error {
+	if err := c.WriteNdx(protocol, ndx); err != nil {
+		return err
+	}
+	if protocol < 29 {
+		return nil
+	}
+	var buf rsyncwire.Buffer
+	buf.WriteShortInt(attrs.Flags)
+	if attrs.Flags&rsync.ITEM_BASIS_TYPE_FOLLOWS != 0 {
+		buf.WriteByte(attrs.FnamecmpType)
+	}
+	if attrs.Flags&rsync.ITEM_XNAME_FOLLOWS != 0 {
+		buf.WriteVstring(attrs.Xname)
+	}
+	return c.WriteString(buf.String())
+}
+
+// NegotiateProtocol returns the protocol version to use after the rsync daemon
+// greetings were exchanged. A non-zero remoteSub marks a pre-release version of
+// remoteProtocol, which is not compatible with the released version.
+//
+// rsync/clientserver.c:exchange_protocols
+func NegotiateProtocol(protocol, remoteProtocol, remoteSub int32) int32 {
+	if protocol > remoteProtocol {
+		protocol = remoteProtocol
+		if remoteSub != 0 {
+			protocol--
+		}
+	} else if protocol == remoteProtocol {
+		if remoteSub != 0 {
+			protocol--
+		}
+	}
+	return protocol
+}
+
+// NegotiateChecksums determines the checksum algorithms of the transfer,
+// either from the --checksum-choice option, or by negotiating with the remote
+// side. Negotiation happens if the client supports negotiated strings (which
+// results in rsync.CF_VARINT_FLIST_FLAGS): both sides exchange the lists of
+// checksum (and compression) algorithms they support.
+//
+// rsync/compat.c:negotiate_the_strings
+func NegotiateChecksums(c *rsyncwire.Conn, opts *rsyncopts.Options, protocol, compatFlags int32) (rsyncchecksum.Choice, error) {
+	choice, err := rsyncchecksum.ParseChoice(protocol, opts.ChecksumChoice())
+	if err != nil {
+		return choice, err
+	}
+	if protocol < 30 || compatFlags&rsync.CF_VARINT_FLIST_FLAGS == 0 {
+		return choice, nil
+	}
+
+	negotiateChecksum := opts.ChecksumChoice() == ""
+	negotiateCompress := opts.Compress()
+	// Only the zlib algorithm is implemented (see rsyncopts).
+	const compressNames = "zlib"
+
+	send := func() error {
+		if negotiateChecksum {
+			if err := c.WriteVstring(rsyncchecksum.Names()); err != nil {
+				return err
+			}
+		}
+		if negotiateCompress {
+			if err := c.WriteVstring(compressNames); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// tridge rsync sends its lists before reading the lists of the other side
+	// to avoid a round trip, which is fine with either side doing so as long
+	// as the connection is buffered. Our server reads first (like it does in
+	// the protocol version exchange) so that unbuffered connections (e.g.
+	// io.Pipe) work, too.
+	if !opts.Server() {
+		if err := send(); err != nil {
+			return choice, err
+		}
+	}
+
+	if negotiateChecksum {
+		remote, err := c.ReadVstring()
+		if err != nil {
+			return choice, err
+		}
+		t, ok := rsyncchecksum.Negotiate(remote, opts.Server())
+		if !ok {
+			return choice, fmt.Errorf("failed to negotiate checksum choice: remote supports %q, we support %q", remote, rsyncchecksum.Names())
+		}
+		choice = rsyncchecksum.Choice{Xfer: t, File: t}
+	}
+	if negotiateCompress {
+		remote, err := c.ReadVstring()
+		if err != nil {
+			return choice, err
+		}
+		if !slices.Contains(strings.Fields(remote), compressNames) {
+			return choice, fmt.Errorf("failed to negotiate compress choice: remote supports %q, we support %q", remote, compressNames)
+		}
+	}
+
+	if opts.Server() {
+		if err := send(); err != nil {
+			return choice, err
+		}
+	}
+	return choice, nil
+}
+
+// ExitError turns the I/O error flags of a completed transfer into the error
+// which determines the exit code, or nil.
+//
+// rsync/cleanup.c:_exit_cleanup
+func ExitError(ioErrors int32) error {
+	if ioErrors&rsync.IOERR_GENERAL != 0 {
+		return &rsync.ExitError{
+			Code: rsync.RERR_PARTIAL,
+			Err:  fmt.Errorf("some files/attrs were not transferred"),
+		}
+	}
+	// TODO: return rsync.RERR_VANISHED for IOERR_VANISHED, once the sender
+	// handles it.
+	if ioErrors&rsync.IOERR_DEL_LIMIT != 0 {
+		return &rsync.ExitError{
+			Code: rsync.RERR_DEL_LIMIT,
+			Err:  fmt.Errorf("the --max-delete limit stopped deletions"),
+		}
 	}
+	return nil
 }
@@ -0,0 +1,77 @@
+package rsynccommon_test
+
+import (
+	"testing"
+
+	"github.com/gokrazy/rsync"
+	"github.com/gokrazy/rsync/internal/rsynccommon"
+	"github.com/google/go-cmp/cmp"
+)
+
+// The expected sum heads are those of tridge rsync (see
+// rsync/generator.c:sum_sizes_sqroot).
+func TestSumSizesSqroot(t *testing.T) {
+	const short = rsynccommon.ShortSumLength
+	head := func(count, blockLength, checksumLength, remainder int32) rsync.SumHead {
+		return rsync.SumHead{
+			ChecksumCount:   count,
+			BlockLength:     blockLength,
+			ChecksumLength:  checksumLength,
+			RemainderLength: remainder,
+		}
+	}
+	for _, tt := range []struct {
+		name           string
+		protocol       int32
+		contentLen     int64
+		blockLength    int32
+		checksumLength int
+		want           rsync.SumHead
+	}{
+		{"empty", 31, 0, 0, short, head(0, 700, 2, 0)},
+		{"one-byte", 31, 1, 0, short, head(1, 700, 2, 1)},
+		{"min-block", 31, 700 * 700, 0, short, head(700, 700, 2, 0)},
+		{"min-block+1", 31, 700*700 + 1, 0, short, head(701, 700, 2, 1)},
+		{"1MiB", 31, 1 << 20, 0, short, head(1024, 1024, 2, 0)},
+		{"100MiB", 31, 100 << 20, 0, short, head(10240, 10240, 3, 0)},
+		{"10GiB", 31, 10 << 30, 0, short, head(103628, 103616, 4, 3008)},
+		{"1TiB", 31, 1 << 40, 0, short, head(8388608, 1<<17, 6, 0)},
+		{"block-size", 31, 1 << 20, 4096, short, head(256, 4096, 2, 0)},
+		{"redo", 31, 1 << 20, 0, 16, head(1024, 1024, 16, 0)},
+		{"protocol26", 26, 1 << 20, 0, short, head(1024, 1024, 2, 0)},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got := rsynccommon.SumSizesSqroot(tt.protocol, tt.contentLen, tt.blockLength, tt.checksumLength, 16)
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("SumSizesSqroot(%d): unexpected sum head: diff (-want +got):\n%s", tt.contentLen, diff)
+			}
+		})
+	}
+}
+
+func TestUnsafeSymlink(t *testing.T) {
+	for _, tt := range []struct {
+		dest, src string
+		want      bool
+	}{
+		{dest: "", src: "link", want: true},
+		{dest: "/etc/passwd", src: "link", want: true},
+		{dest: "file", src: "link", want: false},
+		{dest: "sub/file", src: "link", want: false},
+		{dest: "./file", src: "link", want: false},
+		{dest: "..", src: "link", want: true},
+		{dest: "../file", src: "link", want: true},
+		{dest: "../file", src: "sub/link", want: false},
+		{dest: "../../file", src: "sub/link", want: true},
+		{dest: "..", src: "sub/link", want: false},
+		{dest: "sub/../../file", src: "link", want: true},
+		{dest: "a/b/../../file", src: "link", want: false},
+		{dest: "a//b/../..//..", src: "sub//link", want: false},
+		{dest: "../file", src: "./link", want: true},
+		{dest: "../file", src: "sub/../link", want: true},
+	} {
+		if got := rsynccommon.UnsafeSymlink(tt.dest, tt.src); got != tt.want {
+			t.Errorf("UnsafeSymlink(%q, %q) = %v, want %v", tt.dest, tt.src, got, tt.want)
+		}
+	}
+}
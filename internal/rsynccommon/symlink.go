@@ -0,0 +1,53 @@
+package rsynccommon
+
+import "strings"
+
+// UnsafeSymlink reports whether the symlink src (a path relative to the
+// transfer root) with the target dest points outside of the transfer: all
+// absolute and empty targets are unsafe, as are targets whose ".." elements
+// climb above the transfer root.
+//
+// rsync/util1.c:unsafe_symlink
+func UnsafeSymlink(dest, src string) bool {
+	if dest == "" || dest[0] == '/' {
+		return true
+	}
+
+	// Find out what our safety margin is: the depth of the directory
+	// containing src.
+	depth := 0
+	elems := strings.Split(src, "/")
+	for _, elem := range elems[:len(elems)-1] {
+		switch elem {
+		case "", ".":
+			// Ignore empty (from repeated slashes) and "." elements.
+		case "..":
+			// A ".." element starts the count over.
+			depth = 0
+		default:
+			depth++
+		}
+	}
+	if elems[len(elems)-1] == ".." {
+		depth = 0
+	}
+
+	elems = strings.Split(dest, "/")
+	for _, elem := range elems[:len(elems)-1] {
+		switch elem {
+		case "", ".":
+		case "..":
+			// If at any point we go outside the transfer, it is unsafe.
+			depth--
+			if depth < 0 {
+				return true
+			}
+		default:
+			depth++
+		}
+	}
+	if elems[len(elems)-1] == ".." {
+		depth--
+	}
+	return depth < 0
+}
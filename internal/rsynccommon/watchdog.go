@@ -0,0 +1,162 @@
+package rsynccommon
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gokrazy/rsync"
+)
+
+// Watchdog aborts a connection once its context is done or once no data was
+// read or written for the I/O timeout (--timeout). The connection is aborted
+// by closing its reader and writer (if they implement io.Closer), which makes
+// blocked reads and writes in all goroutines of the transfer return. Once
+// aborted, reads and writes fail without touching the connection. A read or
+// write which is blocked in a reader or writer that does not implement
+// io.Closer cannot be interrupted.
+//
+// rsync/io.c:check_timeout
+type Watchdog struct {
+	r io.Reader
+	w io.Writer
+
+	timeout atomic.Int64 // time.Duration, 0 for no timeout
+	lastIO  atomic.Int64 // time.Time.UnixNano
+	reset   chan struct{}
+	stop    chan struct{}
+	once    sync.Once
+
+	mu      sync.Mutex
+	err     error         // why the connection was aborted
+	aborted chan struct{} // closed once the connection was aborted
+}
+
+// NewWatchdog returns a Watchdog for the connection consisting of r and w. The
+// transfer must use the Watchdog as its reader and writer, so that the I/O
+// timeout can be tracked. Stop must be called once the transfer is done.
+func NewWatchdog(ctx context.Context, r io.Reader, w io.Writer, timeout time.Duration) *Watchdog {
+	wd := &Watchdog{
+		r:       r,
+		w:       w,
+		reset:   make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		aborted: make(chan struct{}),
+	}
+	wd.timeout.Store(int64(timeout))
+	wd.lastIO.Store(time.Now().UnixNano())
+	go wd.watch(ctx)
+	return wd
+}
+
+func (wd *Watchdog) Read(p []byte) (n int, err error) {
+	if err := wd.abortErr(); err != nil {
+		return 0, err
+	}
+	n, err = wd.r.Read(p)
+	if n > 0 {
+		wd.lastIO.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+func (wd *Watchdog) Write(p []byte) (n int, err error) {
+	if err := wd.abortErr(); err != nil {
+		return 0, err
+	}
+	n, err = wd.w.Write(p)
+	if n > 0 {
+		wd.lastIO.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// SetTimeout changes the I/O timeout, e.g. once a server parsed the options
+// of its client. A timeout of 0 disables the I/O timeout.
+func (wd *Watchdog) SetTimeout(timeout time.Duration) {
+	wd.lastIO.Store(time.Now().UnixNano())
+	wd.timeout.Store(int64(timeout))
+	select {
+	case wd.reset <- struct{}{}:
+	default:
+	}
+}
+
+// Stop stops watching the connection.
+func (wd *Watchdog) Stop() {
+	wd.once.Do(func() { close(wd.stop) })
+}
+
+// Err returns why the connection was aborted (the context error, an
+// *rsync.ExitError with code RERR_TIMEOUT or the error passed to Abort) instead
+// of err, which is the resulting read or write error. If the connection was
+// not aborted, Err returns err.
+func (wd *Watchdog) Err(err error) error {
+	wd.mu.Lock()
+	defer wd.mu.Unlock()
+	if wd.err != nil {
+		return wd.err
+	}
+	return err
+}
+
+// abortErr returns why the connection was aborted, or nil if it was not.
+func (wd *Watchdog) abortErr() error {
+	select {
+	case <-wd.aborted:
+		wd.mu.Lock()
+		defer wd.mu.Unlock()
+		return wd.err
+	default:
+		return nil
+	}
+}
+
+func (wd *Watchdog) watch(ctx context.Context) {
+	for {
+		var expired <-chan time.Time
+		if timeout := time.Duration(wd.timeout.Load()); timeout > 0 {
+			idle := time.Since(time.Unix(0, wd.lastIO.Load()))
+			if idle >= timeout {
+				wd.Abort(&rsync.ExitError{
+					Code: rsync.RERR_TIMEOUT,
+					Err:  fmt.Errorf("io timeout after %d seconds -- exiting", int(idle.Seconds())),
+				})
+				return
+			}
+			expired = time.After(timeout - idle)
+		}
+		select {
+		case <-wd.stop:
+			return
+		case <-ctx.Done():
+			wd.Abort(ctx.Err())
+			return
+		case <-wd.reset:
+		case <-expired:
+		}
+	}
+}
+
+// Abort aborts the connection because of err, unless it was already aborted.
+// It is also used to make all goroutines of a transfer return once one of them
+// failed.
+func (wd *Watchdog) Abort(err error) {
+	wd.mu.Lock()
+	if wd.err != nil {
+		wd.mu.Unlock()
+		return
+	}
+	wd.err = err
+	close(wd.aborted)
+	wd.mu.Unlock()
+	if c, ok := wd.r.(io.Closer); ok {
+		c.Close()
+	}
+	if c, ok := wd.w.(io.Closer); ok {
+		c.Close()
+	}
+}
@@ -0,0 +1,60 @@
+package rsynccommon
+
+import (
+	"crypto/md5"
+	"strings"
+
+	"github.com/gokrazy/rsync"
+)
+
+// MaxFullXattrDatum is the length up to which extended attribute values are
+// sent in the file list. Longer values are abbreviated to their checksum, and
+// only sent if the receiver requests them.
+//
+// rsync/xattrs.c:MAX_FULL_DATUM
+const MaxFullXattrDatum = 32
+
+// XattrSum returns the checksum of an abbreviated extended attribute value.
+// Extended attributes require protocol 30 or newer, which uses MD5.
+func XattrSum(value []byte) [md5.Size]byte {
+	return md5.Sum(value)
+}
+
+const (
+	xattrUserPrefix   = "user."
+	xattrSystemPrefix = "system."
+
+	// xattrRsyncPrefix is the prefix of the attributes in which rsync
+	// stores its own data (e.g. user.rsync.%stat for --fake-super).
+	xattrRsyncPrefix = "user.rsync."
+)
+
+// SkipXattr reports whether the extended attribute name is not transferred:
+// the system namespace (e.g. ACLs) never is, and with userOnly, only the user
+// namespace is. rsync's own attributes are only transferred with -XX
+// (preserveXattrs > 1).
+//
+// rsync/xattrs.c:rsync_xal_get
+func SkipXattr(name string, preserveXattrs int, userOnly bool) bool {
+	if userOnly && !strings.HasPrefix(name, xattrUserPrefix) ||
+		strings.HasPrefix(name, xattrSystemPrefix) {
+		return true
+	}
+	return preserveXattrs < 2 && strings.HasPrefix(name, xattrRsyncPrefix+"%")
+}
+
+// XattrRequestFollows reports whether the item attributes attrs are followed
+// by the exchange of abbreviated extended attribute values: the receiver
+// requests the values it does not have, and the sender responds with them.
+// Unless the client avoids it (rsync.CF_AVOID_XATTR_OPTIM), protocol 31 omits
+// the exchange for files hard linked locally, which need no values.
+//
+// rsync/sender.c:write_ndx_and_attrs
+func XattrRequestFollows(protocol, compatFlags int32, attrs ItemAttrs) bool {
+	if attrs.Flags&rsync.ITEM_REPORT_XATTR == 0 {
+		return false
+	}
+	wantOptim := protocol >= 31 && compatFlags&rsync.CF_AVOID_XATTR_OPTIM == 0
+	const local = rsync.ITEM_XNAME_FOLLOWS | rsync.ITEM_LOCAL_CHANGE
+	return !wantOptim || attrs.Flags&local != local
+}
@@ -25,6 +25,10 @@ type Config struct {
 	Listeners     []Listener      `toml:"listener"`
 	Modules       []rsyncd.Module `toml:"module"`
 	DontNamespace bool            `toml:"dont_namespace"`
+
+	// BwLimit is the maximum socket I/O bandwidth (e.g. "10M", see rsync
+	// --bwlimit) of each connection. Clients can lower, but not raise it.
+	BwLimit string `toml:"bwlimit"`
 }
 
 func FromString(input string) (*Config, error) {
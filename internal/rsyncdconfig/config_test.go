@@ -10,6 +10,8 @@ import (
 
 func TestConfig(t *testing.T) {
 	cfg, err := rsyncdconfig.FromString(`
+bwlimit = "10M"
+
 [[listener]]
 rsyncd = "localhost:873"
 
@@ -22,12 +24,17 @@ anon_ssh = "localhost:22873"
 [[module]]
 name = "interop"
 path = "/non/existant/path"
+bwlimit = "1M"
 
 `)
 	if err != nil {
 		t.Fatal(err)
 	}
 
+	if got, want := cfg.BwLimit, "10M"; got != want {
+		t.Fatalf("unexpected bwlimit: got %q, want %q", got, want)
+	}
+
 	if got, want := len(cfg.Listeners), 3; got != want {
 		t.Fatalf("unexpected number of listeners: got %d, want %d", got, want)
 	}
@@ -45,7 +52,7 @@ path = "/non/existant/path"
 
 	{
 		want := []rsyncd.Module{
-			{Name: "interop", Path: "/non/existant/path"},
+			{Name: "interop", Path: "/non/existant/path", BwLimit: "1M"},
 		}
 		if diff := cmp.Diff(want, cfg.Modules); diff != "" {
 			t.Fatalf("unexpected module config: diff (-want +got):\n%s", diff)
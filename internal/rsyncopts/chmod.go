@@ -0,0 +1,201 @@
+package rsyncopts
+
+import (
+	"fmt"
+
+	"github.com/gokrazy/rsync"
+)
+
+// chmodBits are the mode bits which --chmod can change.
+const chmodBits = 0o7777
+
+// Flags of a ChmodRule.
+const (
+	chmodXKeep     = 1 << iota // X: only set x bits if any are set (or for dirs)
+	chmodDirsOnly              // D prefix
+	chmodFilesOnly             // F prefix
+)
+
+// ChmodRule is one rule of a --chmod argument: the permission bits are ANDed
+// with modeAND and ORed with modeOR.
+//
+// rsync/chmod.c:chmod_mode_struct
+type ChmodRule struct {
+	modeAND uint32
+	modeOR  uint32
+	flags   int
+}
+
+// ParseChmod parses a --chmod argument: a comma-separated list of rules in
+// chmod(1) syntax, either symbolic (e.g. ug+w, o-rwx, a=rX) or octal (e.g.
+// 644), optionally prefixed with D (directories only) or F (files only).
+//
+// rsync/chmod.c:parse_chmod
+func ParseChmod(modestr string) ([]ChmodRule, error) {
+	const (
+		stateError = iota
+		state1stHalf
+		state2ndHalf
+		stateOctalNum
+	)
+	const (
+		opAdd = 1 + iota
+		opSub
+		opEq
+		opSet
+	)
+	var rules []ChmodRule
+	state := state1stHalf
+	var where, what, op, topbits, topoct uint32
+	var flags int
+	for i := 0; state != stateError; i++ {
+		if i == len(modestr) || modestr[i] == ',' {
+			if op == 0 {
+				state = stateError
+				break
+			}
+			var bits uint32
+			if where != 0 {
+				bits = where * what
+			} else {
+				where = 0o111
+				bits = (where * what) &^ umask()
+			}
+			var r ChmodRule
+			switch op {
+			case opAdd:
+				r.modeAND = chmodBits
+				r.modeOR = bits + topoct
+			case opSub:
+				r.modeAND = chmodBits - bits - topoct
+			case opEq:
+				r.modeAND = chmodBits - where*7
+				if topoct != 0 {
+					r.modeAND -= topbits
+				}
+				r.modeOR = bits + topoct
+			case opSet:
+				r.modeOR = bits
+			}
+			r.flags = flags
+			rules = append(rules, r)
+			if i == len(modestr) {
+				break
+			}
+			i++
+			state = state1stHalf
+			where, what, op, topoct, topbits, flags = 0, 0, 0, 0, 0, 0
+			if i == len(modestr) {
+				// trailing comma
+				state = stateError
+				break
+			}
+		}
+
+		c := modestr[i]
+		switch state {
+		case state1stHalf:
+			switch c {
+			case 'D':
+				if flags&chmodFilesOnly != 0 {
+					state = stateError
+				}
+				flags |= chmodDirsOnly
+			case 'F':
+				if flags&chmodDirsOnly != 0 {
+					state = stateError
+				}
+				flags |= chmodFilesOnly
+			case 'u':
+				where |= 0o100
+				topbits |= 0o4000
+			case 'g':
+				where |= 0o010
+				topbits |= 0o2000
+			case 'o':
+				where |= 0o001
+			case 'a':
+				where |= 0o111
+			case '+':
+				op = opAdd
+				state = state2ndHalf
+			case '-':
+				op = opSub
+				state = state2ndHalf
+			case '=':
+				op = opEq
+				state = state2ndHalf
+			default:
+				if c >= '0' && c < '8' && where == 0 {
+					op = opSet
+					state = stateOctalNum
+					where = 1
+					what = 0
+					i-- // the digit is part of the number
+				} else {
+					state = stateError
+				}
+			}
+		case state2ndHalf:
+			switch c {
+			case 'r':
+				what |= 4
+			case 'w':
+				what |= 2
+			case 'X':
+				flags |= chmodXKeep
+				what |= 1
+			case 'x':
+				what |= 1
+			case 's':
+				if topbits != 0 {
+					topoct |= topbits
+				} else {
+					topoct = 0o4000
+				}
+			case 't':
+				topoct |= 0o1000
+			default:
+				state = stateError
+			}
+		case stateOctalNum:
+			if c >= '0' && c < '8' {
+				what = what*8 + uint32(c-'0')
+				if what > chmodBits {
+					state = stateError
+				}
+			} else {
+				state = stateError
+			}
+		}
+	}
+	if state == stateError {
+		return nil, fmt.Errorf("Invalid argument passed to --chmod (%s)", modestr)
+	}
+	return rules, nil
+}
+
+// TweakMode applies the --chmod rules to mode (including the rsync.S_IFMT
+// file type bits).
+//
+// rsync/chmod.c:tweak_mode
+func TweakMode(mode uint32, rules []ChmodRule) uint32 {
+	isX := mode&0o111 != 0
+	nonPerm := mode &^ chmodBits
+	isDir := nonPerm&rsync.S_IFMT == rsync.S_IFDIR
+	for _, r := range rules {
+		if r.flags&chmodDirsOnly != 0 && !isDir {
+			continue
+		}
+		if r.flags&chmodFilesOnly != 0 && isDir {
+			continue
+		}
+		mode &= r.modeAND
+		if r.flags&chmodXKeep != 0 && !isX && !isDir {
+			mode |= r.modeOR &^ 0o111
+		} else {
+			mode |= r.modeOR
+		}
+	}
+	return mode | nonPerm
+}
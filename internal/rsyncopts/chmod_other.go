@@ -0,0 +1,7 @@
+//go:build !unix
+
+package rsyncopts
+
+// umask returns the default file mode creation mask on platforms without
+// umask(2).
+func umask() uint32 { return 0o022 }
@@ -0,0 +1,13 @@
+//go:build unix
+
+package rsyncopts
+
+import "syscall"
+
+// umask returns the file mode creation mask of the process, which --chmod
+// rules without u, g, o or a respect (like chmod(1)).
+func umask() uint32 {
+	mask := syscall.Umask(0)
+	syscall.Umask(mask)
+	return uint32(mask)
+}
@@ -12,12 +12,16 @@ import (
 	"fmt"
 	"math"
 	"os"
+	"path"
+	"runtime"
 	"slices"
 	"strconv"
 	"strings"
 	"syscall"
 	"unicode"
 
+	"github.com/gokrazy/rsync"
+	"github.com/gokrazy/rsync/internal/rsyncchecksum"
 	"github.com/gokrazy/rsync/internal/rsyncos"
 	"github.com/gokrazy/rsync/internal/version"
 )
@@ -111,6 +115,34 @@ const (
 	COUNT_DEBUG
 )
 
+// Types of alternate basis directories, see Options.AltDestType.
+//
+// rsync/rsync.h
+const (
+	COMPARE_DEST = 1
+	COPY_DEST    = 2
+	LINK_DEST    = 3
+)
+
+// MAX_BASIS_DIRS is the maximum number of alternate basis directories.
+const MAX_BASIS_DIRS = 20
+
+// AltDestOption returns the name of the option which specifies alternate
+// basis directories of type altDestType.
+//
+// rsync/options.c:alt_dest_opt
+func AltDestOption(altDestType int) string {
+	switch altDestType {
+	case COMPARE_DEST:
+		return "--compare-dest"
+	case COPY_DEST:
+		return "--copy-dest"
+	case LINK_DEST:
+		return "--link-dest"
+	}
+	return ""
+}
+
 var tridgeDefaults = Options{
 	msgs2stderr:          2, // Default: send errors to stderr for local & remote-shell transfers
 	output_motd:          1,
@@ -125,7 +157,7 @@ var tridgeDefaults = Options{
 	rsync_path:           "rsync",
 	default_af_hint:      syscall.AF_INET6,
 	blocking_io:          -1,
-	protocol_version:     27,
+	protocol_version:     rsync.ProtocolVersion,
 }
 
 // NewOptions returns an Options struct with all options initialized to their
@@ -141,12 +173,10 @@ func NewOptions(osenv *rsyncos.Env) *Options {
 }
 
 var gokrazyDefaults = Options{
-	msgs2stderr:    2, // Default: send errors to stderr for local & remote-shell transfers
-	output_motd:    1,
-	human_readable: 1,
-	// TODO: if/when allow_inc_recurse gets implemented,
-	// default to 1 to match tridge rsync
-	allow_inc_recurse:    0,
+	msgs2stderr:          2, // Default: send errors to stderr for local & remote-shell transfers
+	output_motd:          1,
+	human_readable:       1,
+	allow_inc_recurse:    1,
 	xfer_dirs:            -1,
 	relative_paths:       -1,
 	implied_dirs:         1,
@@ -156,7 +186,7 @@ var gokrazyDefaults = Options{
 	rsync_path:           "rsync",
 	default_af_hint:      syscall.AF_INET6,
 	blocking_io:          -1,
-	protocol_version:     27,
+	protocol_version:     rsync.ProtocolVersion,
 }
 
 // NewOptions returns an Options struct with all options initialized to their
@@ -171,6 +201,24 @@ func NewOptionsWithGokrazyDefaults(osenv *rsyncos.Env) *Options {
 	return &opts
 }
 
+// FilterRule is a filter rule as specified on the command line (see
+// Options.FilterRules).
+type FilterRule struct {
+	Rule string
+
+	// Include is set for --include rules.
+	Include bool
+
+	// OldPrefixes is set for --include and --exclude rules, which only
+	// understand the "+ " and "- " prefixes.
+	OldPrefixes bool
+
+	// File is set for --include-from and --exclude-from rules, in which
+	// case Rule is the name of the file to read the rules from ("-" for
+	// stdin).
+	File bool
+}
+
 // GokrazyClientOptions contains additional command-line flags, prefixed with
 // gokr. (like --gokr.dont_restrict) to not clash with rsync flag names.
 type GokrazyClientOptions struct {
@@ -217,7 +265,12 @@ type Options struct {
 	info           [COUNT_INFO]uint16
 	debug          [COUNT_DEBUG]uint16
 	local_server   int
-	filterRules    []string
+	filterRules    []FilterRule
+
+	// derived from stdout_format, see ParseArguments
+	stdout_format_has_i      int
+	stdout_format_has_o_or_i bool
+	log_before_transfer      bool
 
 	// order matches long_options order
 	verbose                int
@@ -287,6 +340,7 @@ type Options struct {
 	// If -1, then look at whether we're local or remote and go by that.
 	// See also disable_deltas_p()
 	whole_file           int
+	block_size           int
 	always_checksum      int
 	checksum_choice      string
 	fuzzy_basis          int
@@ -306,15 +360,23 @@ type Options struct {
 	bwlimit              int
 	make_backups         int
 	backup_dir           string
+	basis_dirs           []string
+	alt_dest_type        int
 	backup_suffix        string
 	list_only            int
 	batch_name           string
 	files_from           string
+	filesfrom_remote     int // files_from is read from the connection
 	eol_nulls            int
 	old_style_args       int // intentionally set to 0; unsupported
 	protect_args         int // intentionally set to 0; currently unsupported
 	trust_sender         int
 	numeric_ids          int
+	chmod_modes          []ChmodRule
+	usermap              string
+	groupmap             string
+	usermap_via_chown    bool
+	groupmap_via_chown   bool
 	io_timeout           int
 	connect_timeout      int
 	do_fsync             int
@@ -453,6 +515,78 @@ Level:
 	return nil
 }
 
+// parseSizeArg parses the size argument of the option optName, like 10k or
+// 1.5MB: a (decimal) number followed by an optional suffix (defSuffix if
+// none) which is a power of 1024 (k, m, g, t, p, with an optional "ib") or of
+// 1000 (kb, mb, …), optionally followed by +1 or -1. A maxValue < 0 means
+// unlimited. With unlimited0, 0 is accepted even if minValue is larger.
+//
+// rsync/options.c:parse_size_arg
+func parseSizeArg(sizeArg string, defSuffix byte, optName string, minValue, maxValue int64, unlimited0 bool) (int64, error) {
+	failure := func(reason string) (int64, error) {
+		return -1, fmt.Errorf("--%s value is %s: %s", optName, reason, sizeArg)
+	}
+	arg := strings.TrimLeft(sizeArg, "0123456789")
+	if strings.HasPrefix(arg, ".") {
+		arg = strings.TrimLeft(arg[1:], "0123456789")
+	}
+	num := sizeArg[:len(sizeArg)-len(arg)]
+	suffix := defSuffix
+	if arg != "" && arg[0] != '+' && arg[0] != '-' {
+		suffix, arg = arg[0], arg[1:]
+	}
+	reps := strings.IndexByte("bkmgtp", byte(unicode.ToLower(rune(suffix))))
+	if reps < 0 {
+		return failure("invalid")
+	}
+	var mult float64
+	switch {
+	case strings.HasPrefix(arg, "b") || strings.HasPrefix(arg, "B"):
+		mult, arg = 1000, arg[1:]
+	case arg == "" || arg[0] == '+' || arg[0] == '-':
+		mult = 1024
+	case strings.HasPrefix(strings.ToLower(arg), "ib"):
+		mult, arg = 1024, arg[2:]
+	default:
+		return failure("invalid")
+	}
+	f, err := strconv.ParseFloat(num, 64)
+	if err != nil && num != "" {
+		return failure("invalid")
+	}
+	size := int64(f * math.Pow(mult, float64(reps)))
+	if (strings.HasPrefix(arg, "+1") || strings.HasPrefix(arg, "-1")) && num != "" {
+		if arg[0] == '+' {
+			size++
+		} else {
+			size--
+		}
+		arg = arg[2:]
+	}
+	if arg != "" {
+		return failure("invalid")
+	}
+	if size < 0 || (maxValue >= 0 && size > maxValue) {
+		return -1, fmt.Errorf("--%s value is too large: %s (max=%d)", optName, sizeArg, maxValue)
+	}
+	if size < minValue && (!unlimited0 || size != 0) {
+		return -1, fmt.Errorf("--%s value is too small: %s (min=%d)", optName, sizeArg, minValue)
+	}
+	return size, nil
+}
+
+// ParseBwLimit parses a --bwlimit RATE like 500 (KiB/s, the default unit),
+// 1.5m or 10MB and returns it in KiB/s, or 0 for no limit.
+//
+// rsync/options.c:parse_arguments (OPT_BWLIMIT)
+func ParseBwLimit(arg string) (int, error) {
+	size, err := parseSizeArg(arg, 'K', "bwlimit", 512, -1, true)
+	if err != nil {
+		return 0, err
+	}
+	return int((size + 512) / 1024), nil
+}
+
 func (o *Options) setOutputVerbosity(prio priority) error {
 	debugVerbosity := [...]string{
 		"",
@@ -720,20 +854,334 @@ func (o *Options) DeleteMode() bool           { return o.delete_mode != 0 }
 func (o *Options) Sender() bool               { return o.am_sender != 0 }
 func (o *Options) SetSender()                 { o.am_sender = 1 }
 func (o *Options) LocalServer() bool          { return o.local_server != 0 }
-func (o *Options) SetLocalServer()            { o.local_server = 1 }
 func (o *Options) Server() bool               { return o.am_server != 0 }
 func (o *Options) Daemon() bool               { return o.am_daemon != 0 }
 func (o *Options) ConnectTimeoutSeconds() int { return o.connect_timeout }
+func (o *Options) IOTimeoutSeconds() int      { return o.io_timeout }
 func (o *Options) AlwaysChecksum() bool       { return o.always_checksum != 0 }
 func (o *Options) IgnoreTimes() bool          { return o.ignore_times != 0 }
 func (o *Options) OutputMOTD() bool           { return o.output_motd != 0 }
 func (o *Options) RsyncPort() int             { return o.rsync_port }
 func (o *Options) XferDirs() int              { return o.xfer_dirs }
-func (o *Options) FilterRules() []string      { return o.filterRules }
+func (o *Options) FilterRules() []FilterRule  { return o.filterRules }
+func (o *Options) FilesFrom() string          { return o.files_from }
+func (o *Options) FilesFromRemote() bool      { return o.filesfrom_remote != 0 }
+func (o *Options) EOLNulls() bool             { return o.eol_nulls != 0 }
+func (o *Options) Compress() bool             { return o.do_compression != 0 }
+func (o *Options) SkipCompress() string       { return o.skip_compress }
+
+// ChecksumChoice returns the argument of the --checksum-choice option, or the
+// empty string if the checksum algorithm should be negotiated.
+func (o *Options) ChecksumChoice() string { return o.checksum_choice }
+
+// DeleteBefore reports whether the receiver deletes extraneous files before
+// the transfer (--delete-before).
+func (o *Options) DeleteBefore() bool { return o.delete_before != 0 }
+
+// DeleteDuring returns 1 if the receiver deletes extraneous files during the
+// transfer (--delete-during), 2 if it finds them during the transfer, but
+// deletes them afterwards (--delete-delay), and 0 otherwise.
+func (o *Options) DeleteDuring() int { return o.delete_during }
+
+// DeleteAfter reports whether the receiver deletes extraneous files after the
+// transfer (--delete-after).
+func (o *Options) DeleteAfter() bool { return o.delete_after != 0 }
+
+// DeleteExcluded reports whether excluded files are deleted from the
+// destination, too (--delete-excluded).
+func (o *Options) DeleteExcluded() bool { return o.delete_excluded != 0 }
+
+// IgnoreErrors reports whether the receiver deletes files even if there were
+// I/O errors (--ignore-errors).
+func (o *Options) IgnoreErrors() bool { return o.ignore_errors != 0 }
+
+// MaxDelete returns the maximum number of files to delete (--max-delete), or
+// -1 if the number is unlimited.
+func (o *Options) MaxDelete() int {
+	if o.max_delete == math.MinInt32 {
+		return -1
+	}
+	return o.max_delete
+}
+
+// MakeBackups reports whether the receiver keeps the previous version of
+// files which it replaces or deletes (--backup).
+func (o *Options) MakeBackups() bool { return o.make_backups != 0 }
+
+// BackupDir returns the directory hierarchy into which the receiver moves
+// backups (--backup-dir), or an empty string to keep backups next to the
+// original files.
+func (o *Options) BackupDir() string { return o.backup_dir }
+
+// BackupSuffix returns the suffix which the receiver appends to the names of
+// backups (--suffix).
+func (o *Options) BackupSuffix() string { return o.backup_suffix }
+
+// BasisDirs returns the alternate basis directories (--compare-dest,
+// --copy-dest or --link-dest, see AltDestType), in which the receiver looks
+// for files missing from the destination. Relative directories are relative
+// to the destination directory.
+func (o *Options) BasisDirs() []string { return o.basis_dirs }
+
+// AltDestType returns COMPARE_DEST, COPY_DEST or LINK_DEST, depending on which
+// option specified the BasisDirs, or 0 if there are none.
+func (o *Options) AltDestType() int { return o.alt_dest_type }
+
+// KeepPartial reports whether the receiver keeps partially transferred files
+// (--partial) instead of deleting them.
+func (o *Options) KeepPartial() bool { return o.keep_partial != 0 }
+
+// PartialDir returns the directory in which the receiver keeps partially
+// transferred files (--partial-dir), or an empty string to keep them under
+// their final name. A relative directory is relative to the directory of each
+// file.
+func (o *Options) PartialDir() string { return o.partial_dir }
+
+// Inplace reports whether the receiver writes into the destination files
+// directly (--inplace, implied by --append) instead of into temporary files.
+func (o *Options) Inplace() bool { return o.inplace != 0 }
+
+// AppendMode returns 1 for --append, 2 for --append-verify and 0 otherwise.
+// With protocol versions < 30, --append behaves like --append-verify.
+func (o *Options) AppendMode() int { return o.append_mode }
+
+// FuzzyBasis returns the number of directories in which the receiver looks
+// for a similar file as basis for a file missing from the destination
+// (--fuzzy): 1 for the destination directory only, more to include the
+// BasisDirs (-yy), or 0 to disable fuzzy matching.
+func (o *Options) FuzzyBasis() int { return o.fuzzy_basis }
+
+// SetLocalServer marks the transfer as local, which implies --whole-file
+// unless specified otherwise. The local server learns about it from the
+// server options, so --append (which conflicts with an explicit --whole-file)
+// keeps using the delta-transfer algorithm.
+//
+// rsync/main.c:do_cmd
+func (o *Options) SetLocalServer() {
+	o.local_server = 1
+	if o.whole_file < 0 && o.append_mode == 0 {
+		o.whole_file = 1
+	}
+}
+
+// WholeFile reports whether files are transferred in full instead of using
+// the delta-transfer algorithm (--whole-file), which is the default if source
+// and destination are both local (see SetLocalServer).
+func (o *Options) WholeFile() bool {
+	return o.whole_file > 0
+}
+
+// BlockSize returns the block size of the delta-transfer algorithm
+// (--block-size), or 0 to calculate it from the size of each file.
+func (o *Options) BlockSize() int { return o.block_size }
+
+// BwLimit returns the maximum socket I/O bandwidth in KiB/s (--bwlimit), or 0
+// for no limit.
+func (o *Options) BwLimit() int { return o.bwlimit }
+
+// SetBwLimit overrides the bandwidth limit, e.g. to enforce the limit of an
+// rsync daemon module.
+func (o *Options) SetBwLimit(bwlimit int) { o.bwlimit = bwlimit }
+
+// PreserveXattrs returns the number of -X options: extended attributes are
+// preserved with 1, and with 2 (-XX), rsync.%FOO attributes are copied, too.
+func (o *Options) PreserveXattrs() int { return o.preserve_xattrs }
+
+// PreserveACLs reports whether POSIX ACLs are preserved (--acls).
+func (o *Options) PreserveACLs() bool { return o.preserve_acls != 0 }
+
+// CopyLinks reports whether symlinks are transformed into the files they
+// refer to (--copy-links), CopyUnsafeLinks whether only symlinks which point
+// outside of the transfer are (--copy-unsafe-links).
+func (o *Options) CopyLinks() bool       { return o.copy_links != 0 }
+func (o *Options) CopyUnsafeLinks() bool { return o.copy_unsafe_links != 0 }
+
+// SafeLinks reports whether the receiver ignores symlinks which point outside
+// of the transfer (--safe-links).
+func (o *Options) SafeLinks() bool { return o.safe_symlinks != 0 }
+
+// MungeLinks reports whether symlinks are munged (--munge-links): the
+// receiver prefixes their targets with rsync.SYMLINK_PREFIX, which the sender
+// removes.
+func (o *Options) MungeLinks() bool { return o.munge_symlinks != 0 }
+func (o *Options) SetMungeLinks()   { o.munge_symlinks = 1 }
+
+// ChmodModes returns the --chmod rules, see TweakMode.
+func (o *Options) ChmodModes() []ChmodRule { return o.chmod_modes }
+
+// AddChmod appends the rules of a --chmod argument (or of the "incoming
+// chmod" and "outgoing chmod" module settings of the daemon).
+func (o *Options) AddChmod(modestr string) error {
+	rules, err := ParseChmod(modestr)
+	if err != nil {
+		return err
+	}
+	o.chmod_modes = append(o.chmod_modes, rules...)
+	return nil
+}
+
+// NumericIds reports whether uids and gids are transferred without their
+// user and group names (--numeric-ids).
+func (o *Options) NumericIds() bool { return o.numeric_ids != 0 }
+
+// UserMap and GroupMap return the rules by which the receiver maps the uids
+// and gids of the sender to local ids (--usermap, --groupmap or --chown).
+func (o *Options) UserMap() string  { return o.usermap }
+func (o *Options) GroupMap() string { return o.groupmap }
+
+// DaemonBwLimit returns the bandwidth limit in KiB/s that the daemon applies
+// to all connections (rsync --daemon --bwlimit), or 0 for no limit.
+func (o *Options) DaemonBwLimit() int { return o.daemon_bwlimit }
+
+// CheckProtocol returns an error if the options require a newer protocol
+// version than the negotiated protocol.
+//
+// rsync/compat.c:setup_protocol
+func (o *Options) CheckProtocol(protocol int32) error {
+	if protocol < 29 && o.fuzzy_basis != 0 {
+		return fmt.Errorf("--fuzzy requires protocol 29 or higher (negotiated %d).", protocol)
+	}
+	if protocol < 30 && o.preserve_acls != 0 && o.local_server == 0 {
+		return fmt.Errorf("--acls requires protocol 30 or higher (negotiated %d).", protocol)
+	}
+	if protocol < 30 && o.preserve_xattrs != 0 && o.local_server == 0 {
+		return fmt.Errorf("--xattrs requires protocol 30 or higher (negotiated %d).", protocol)
+	}
+	return nil
+}
+
+// SparseFiles reports whether runs of zeros are turned into holes (--sparse):
+// the receiver does not write them, and the sender does not read holes.
+func (o *Options) SparseFiles() bool { return o.sparse_files != 0 }
+
+// PreallocateFiles reports whether the receiver allocates the space for each
+// file before writing it (--preallocate).
+func (o *Options) PreallocateFiles() bool { return o.preallocate_files != 0 }
+
+// SetDeleteTiming chooses when to delete if --delete was specified without
+// one of the --delete-WHEN options: before the transfer for protocol
+// versions < 30, during the transfer otherwise.
+//
+// rsync/compat.c:setup_protocol
+func (o *Options) SetDeleteTiming(protocol int32) {
+	if o.delete_mode == 0 || o.delete_before+o.delete_during+o.delete_after > 0 {
+		return
+	}
+	if protocol < 30 {
+		o.delete_before = 1
+	} else {
+		o.delete_during = 1
+	}
+}
+
+// ReceiverWantsFilterList reports whether the sending side needs to transmit
+// its filter rules to the receiving side, which uses them to protect files
+// from deletion.
+//
+// rsync/main.c:client_run (receiver_wants_list)
+func (o *Options) ReceiverWantsFilterList(protocol int32) bool {
+	return o.DeleteMode() && (!o.DeleteExcluded() || protocol >= 29)
+}
+
+// AllowIncRecurse reports whether this side supports incremental recursion
+// with the given options. A server additionally requires the client to
+// announce incremental recursion support (with 'i' in the -e option).
+//
+// rsync/compat.c:set_allow_inc_recurse
+func (o *Options) AllowIncRecurse() bool {
+	if o.allow_inc_recurse == 0 || !o.Recurse() {
+		return false
+	}
+	if o.FilesFrom() != "" {
+		// Names from --files-from are sent in a single file list.
+		return false
+	}
+	if !o.Sender() && (o.DeleteBefore() || o.DeleteAfter()) {
+		// Deleting before or after the transfer requires the complete
+		// file list.
+		return false
+	}
+	return true
+}
+
+// ProtocolVersion returns the newest protocol version to use, which is lower
+// than rsync.ProtocolVersion if --protocol was specified, or after negotiating
+// with an older daemon (see SetProtocolVersion).
+func (o *Options) ProtocolVersion() int32 { return int32(o.protocol_version) }
+
+// SetProtocolVersion lowers the protocol version to the version negotiated
+// in the rsync daemon protocol greeting.
+func (o *Options) SetProtocolVersion(protocol int32) { o.protocol_version = int(protocol) }
+
+// CompressionLevel returns the zlib compression level to use for files which
+// are not matched by SkipCompress.
+//
+// rsync/compat.c:init_compression_level
+func (o *Options) CompressionLevel() int {
+	const (
+		minLevel = 1
+		maxLevel = 9 // Z_BEST_COMPRESSION
+		defLevel = 6 // Z_DEFAULT_COMPRESSION is -1, so use the real default
+	)
+	lvl := o.do_compression_level
+	if lvl == math.MinInt32 || lvl == -1 {
+		return defLevel
+	}
+	return max(minLevel, min(lvl, maxLevel))
+}
+
+// SetRemoteFilesFrom is called by the client when the --files-from argument
+// refers to a file on the remote host (e.g. --files-from=:/path/to/list).
+func (o *Options) SetRemoteFilesFrom(path string) {
+	o.files_from = path
+	o.filesfrom_remote = 1
+}
 func (o *Options) Progress() bool {
 	return o.info[INFO_PROGRESS] > 0
 }
 
+// StdoutFormat returns the format in which transferred and changed files are
+// logged (--out-format, implied by --itemize-changes and --verbose), or the
+// empty string if they are not logged.
+func (o *Options) StdoutFormat() string { return o.stdout_format }
+
+// StdoutFormatHasI returns 0 if the StdoutFormat contains no %i escape, 1
+// if it does, and 2 if unchanged files are itemized, too (-ii).
+func (o *Options) StdoutFormatHasI() int { return o.stdout_format_has_i }
+
+// StdoutFormatHasOOrI reports whether the StdoutFormat contains an %i or %o
+// escape, in which case deletions are logged in the StdoutFormat, too.
+func (o *Options) StdoutFormatHasOOrI() bool { return o.stdout_format_has_o_or_i }
+
+// LogBeforeTransfer reports whether files are logged before their transfer,
+// which is only possible if the StdoutFormat contains no transfer statistics
+// (like %b).
+func (o *Options) LogBeforeTransfer() bool { return o.log_before_transfer }
+
+// logFormatHas reports whether format contains the escape esc, with
+// optional modifiers (like %-10n).
+//
+// rsync/options.c:log_format_has
+func logFormatHas(format string, esc byte) bool {
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			continue
+		}
+		for i++; i < len(format) && format[i] == '\''; i++ {
+		}
+		if i < len(format) && format[i] == '-' {
+			i++
+		}
+		for i < len(format) && format[i] >= '0' && format[i] <= '9' {
+			i++
+		}
+		if i < len(format) && format[i] == esc {
+			return true
+		}
+	}
+	return false
+}
+
 func (o *Options) InfoGTE(flag InfoLevel, lvl uint16) bool {
 	return o.info[int(flag)] >= lvl
 }
@@ -802,10 +1250,10 @@ func (o *Options) gokrazyTable() []poptOption {
 		{"recursive", "r", POPT_ARG_VAL, &o.recurse, 2},
 		{"no-recursive", "", POPT_ARG_VAL, &o.recurse, 0},
 		{"no-r", "", POPT_ARG_VAL, &o.recurse, 0},
-		//{"inc-recursive", "", POPT_ARG_VAL, &o.allow_inc_recurse, 1},
-		//{"no-inc-recursive", "", POPT_ARG_VAL, &o.allow_inc_recurse, 0},
-		//{"i-r", "", POPT_ARG_VAL, &o.allow_inc_recurse, 1},
-		//{"no-i-r", "", POPT_ARG_VAL, &o.allow_inc_recurse, 0},
+		{"inc-recursive", "", POPT_ARG_VAL, &o.allow_inc_recurse, 1},
+		{"no-inc-recursive", "", POPT_ARG_VAL, &o.allow_inc_recurse, 0},
+		{"i-r", "", POPT_ARG_VAL, &o.allow_inc_recurse, 1},
+		{"no-i-r", "", POPT_ARG_VAL, &o.allow_inc_recurse, 0},
 		{"dirs", "d", POPT_ARG_VAL, &o.xfer_dirs, 2},
 		{"no-dirs", "", POPT_ARG_VAL, &o.xfer_dirs, 0},
 		{"no-d", "", POPT_ARG_VAL, &o.xfer_dirs, 0},
@@ -815,12 +1263,12 @@ func (o *Options) gokrazyTable() []poptOption {
 		{"no-perms", "", POPT_ARG_VAL, &o.preserve_perms, 0},
 		{"no-p", "", POPT_ARG_VAL, &o.preserve_perms, 0},
 		//{"executability", "E", POPT_ARG_NONE, &o.preserve_executability, 0},
-		//{"acls", "A", POPT_ARG_NONE, nil, 'A'},
-		//{"no-acls", "", POPT_ARG_VAL, &o.preserve_acls, 0},
-		//{"no-A", "", POPT_ARG_VAL, &o.preserve_acls, 0},
-		//{"xattrs", "X", POPT_ARG_NONE, nil, 'X'},
-		//{"no-xattrs", "", POPT_ARG_VAL, &o.preserve_xattrs, 0},
-		//{"no-X", "", POPT_ARG_VAL, &o.preserve_xattrs, 0},
+		{"acls", "A", POPT_ARG_NONE, nil, 'A'},
+		{"no-acls", "", POPT_ARG_VAL, &o.preserve_acls, 0},
+		{"no-A", "", POPT_ARG_VAL, &o.preserve_acls, 0},
+		{"xattrs", "X", POPT_ARG_NONE, nil, 'X'},
+		{"no-xattrs", "", POPT_ARG_VAL, &o.preserve_xattrs, 0},
+		{"no-X", "", POPT_ARG_VAL, &o.preserve_xattrs, 0},
 		{"times", "t", POPT_ARG_VAL, &o.preserve_mtimes, 1},
 		{"no-times", "", POPT_ARG_VAL, &o.preserve_mtimes, 0},
 		{"no-t", "", POPT_ARG_VAL, &o.preserve_mtimes, 0},
@@ -860,11 +1308,11 @@ func (o *Options) gokrazyTable() []poptOption {
 		{"links", "l", POPT_ARG_VAL, &o.preserve_links, 1},
 		{"no-links", "", POPT_ARG_VAL, &o.preserve_links, 0},
 		{"no-l", "", POPT_ARG_VAL, &o.preserve_links, 0},
-		//{"copy-links", "L", POPT_ARG_NONE, &o.copy_links, 0},
-		//{"copy-unsafe-links", "", POPT_ARG_NONE, &o.copy_unsafe_links, 0},
-		//{"safe-links", "", POPT_ARG_NONE, &o.safe_symlinks, 0},
-		//{"munge-links", "", POPT_ARG_VAL, &o.munge_symlinks, 1},
-		//{"no-munge-links", "", POPT_ARG_VAL, &o.munge_symlinks, 0},
+		{"copy-links", "L", POPT_ARG_NONE, &o.copy_links, 0},
+		{"copy-unsafe-links", "", POPT_ARG_NONE, &o.copy_unsafe_links, 0},
+		{"safe-links", "", POPT_ARG_NONE, &o.safe_symlinks, 0},
+		{"munge-links", "", POPT_ARG_VAL, &o.munge_symlinks, 1},
+		{"no-munge-links", "", POPT_ARG_VAL, &o.munge_symlinks, 0},
 		//{"copy-dirlinks", "k", POPT_ARG_NONE, &o.copy_dirlinks, 0},
 		//{"keep-dirlinks", "K", POPT_ARG_NONE, &o.keep_dirlinks, 0},
 		{"hard-links", "H", POPT_ARG_NONE, nil, 'H'},
@@ -877,7 +1325,7 @@ func (o *Options) gokrazyTable() []poptOption {
 		//{"no-implied-dirs", "", POPT_ARG_VAL, &o.implied_dirs, 0},
 		//{"i-d", "", POPT_ARG_VAL, &o.implied_dirs, 1},
 		//{"no-i-d", "", POPT_ARG_VAL, &o.implied_dirs, 0},
-		//{"chmod", "", POPT_ARG_STRING, nil, OPT_CHMOD},
+		{"chmod", "", POPT_ARG_STRING, nil, OPT_CHMOD},
 		{"ignore-times", "I", POPT_ARG_NONE, &o.ignore_times, 0},
 		//{"size-only", "", POPT_ARG_NONE, &o.size_only, 0},
 		//{"one-file-system", "x", POPT_ARG_NONE, nil, 'x'},
@@ -890,74 +1338,76 @@ func (o *Options) gokrazyTable() []poptOption {
 		//{"max-size", "", POPT_ARG_STRING, &o.max_size_arg, OPT_MAX_SIZE},
 		//{"min-size", "", POPT_ARG_STRING, &o.min_size_arg, OPT_MIN_SIZE},
 		//{"max-alloc", "", POPT_ARG_STRING, &o.max_alloc_arg, 0},
-		//{"sparse", "S", POPT_ARG_VAL, &o.sparse_files, 1},
-		//{"no-sparse", "", POPT_ARG_VAL, &o.sparse_files, 0},
-		//{"no-S", "", POPT_ARG_VAL, &o.sparse_files, 0},
-		//{"preallocate", "", POPT_ARG_NONE, &o.preallocate_files, 0},
-		//{"inplace", "", POPT_ARG_VAL, &o.inplace, 1},
-		//{"no-inplace", "", POPT_ARG_VAL, &o.inplace, 0},
-		//{"append", "", POPT_ARG_NONE, nil, OPT_APPEND},
-		//{"append-verify", "", POPT_ARG_VAL, &o.append_mode, 2},
-		//{"no-append", "", POPT_ARG_VAL, &o.append_mode, 0},
-		//{"del", "", POPT_ARG_NONE, &o.delete_during, 0},
+		{"sparse", "S", POPT_ARG_VAL, &o.sparse_files, 1},
+		{"no-sparse", "", POPT_ARG_VAL, &o.sparse_files, 0},
+		{"no-S", "", POPT_ARG_VAL, &o.sparse_files, 0},
+		{"preallocate", "", POPT_ARG_NONE, &o.preallocate_files, 0},
+		{"inplace", "", POPT_ARG_VAL, &o.inplace, 1},
+		{"no-inplace", "", POPT_ARG_VAL, &o.inplace, 0},
+		{"append", "", POPT_ARG_NONE, nil, OPT_APPEND},
+		{"append-verify", "", POPT_ARG_VAL, &o.append_mode, 2},
+		{"no-append", "", POPT_ARG_VAL, &o.append_mode, 0},
+		{"del", "", POPT_ARG_NONE, &o.delete_during, 0},
 		{"delete", "", POPT_ARG_NONE, &o.delete_mode, 0},
-		//{"delete-before", "", POPT_ARG_NONE, &o.delete_before, 0},
-		//{"delete-during", "", POPT_ARG_VAL, &o.delete_during, 1},
-		//{"delete-delay", "", POPT_ARG_VAL, &o.delete_during, 2},
-		//{"delete-after", "", POPT_ARG_NONE, &o.delete_after, 0},
-		//{"delete-excluded", "", POPT_ARG_NONE, &o.delete_excluded, 0},
+		{"delete-before", "", POPT_ARG_NONE, &o.delete_before, 0},
+		{"delete-during", "", POPT_ARG_VAL, &o.delete_during, 1},
+		{"delete-delay", "", POPT_ARG_VAL, &o.delete_during, 2},
+		{"delete-after", "", POPT_ARG_NONE, &o.delete_after, 0},
+		{"delete-excluded", "", POPT_ARG_NONE, &o.delete_excluded, 0},
 		//{"delete-missing-args", "", POPT_BIT_SET, &o.missing_args, 2},
 		//{"ignore-missing-args", "", POPT_BIT_SET, &o.missing_args, 1},
 		//{"remove-sent-files", "", POPT_ARG_VAL, &o.remove_source_files, 2}, /* deprecated */
 		//{"remove-source-files", "", POPT_ARG_VAL, &o.remove_source_files, 1},
 		//{"force", "", POPT_ARG_VAL, &o.force_delete, 1},
 		//{"no-force", "", POPT_ARG_VAL, &o.force_delete, 0},
-		//{"ignore-errors", "", POPT_ARG_VAL, &o.ignore_errors, 1},
-		//{"no-ignore-errors", "", POPT_ARG_VAL, &o.ignore_errors, 0},
-		//{"max-delete", "", POPT_ARG_INT, &o.max_delete, 0},
-		//{"", "F", POPT_ARG_NONE, nil, 'F'},
+		{"ignore-errors", "", POPT_ARG_VAL, &o.ignore_errors, 1},
+		{"no-ignore-errors", "", POPT_ARG_VAL, &o.ignore_errors, 0},
+		{"max-delete", "", POPT_ARG_INT, &o.max_delete, 0},
+		{"", "F", POPT_ARG_NONE, nil, 'F'},
 		{"filter", "f", POPT_ARG_STRING, nil, OPT_FILTER},
 		{"exclude", "", POPT_ARG_STRING, nil, OPT_EXCLUDE},
 		{"include", "", POPT_ARG_STRING, nil, OPT_INCLUDE},
-		//{"exclude-from", "", POPT_ARG_STRING, nil, OPT_EXCLUDE_FROM},
-		//{"include-from", "", POPT_ARG_STRING, nil, OPT_INCLUDE_FROM},
+		{"exclude-from", "", POPT_ARG_STRING, nil, OPT_EXCLUDE_FROM},
+		{"include-from", "", POPT_ARG_STRING, nil, OPT_INCLUDE_FROM},
 		//{"cvs-exclude", "C", POPT_ARG_NONE, &o.cvs_exclude, 0},
-		//{"whole-file", "W", POPT_ARG_VAL, &o.whole_file, 1},
-		//{"no-whole-file", "", POPT_ARG_VAL, &o.whole_file, 0},
-		//{"no-W", "", POPT_ARG_VAL, &o.whole_file, 0},
+		{"whole-file", "W", POPT_ARG_VAL, &o.whole_file, 1},
+		{"no-whole-file", "", POPT_ARG_VAL, &o.whole_file, 0},
+		{"no-W", "", POPT_ARG_VAL, &o.whole_file, 0},
 		{"checksum", "c", POPT_ARG_VAL, &o.always_checksum, 1},
 		{"no-checksum", "", POPT_ARG_VAL, &o.always_checksum, 0},
 		{"no-c", "", POPT_ARG_VAL, &o.always_checksum, 0},
-		//{"checksum-choice", "", POPT_ARG_STRING, &o.checksum_choice, 0},
-		//{"cc", "", POPT_ARG_STRING, &o.checksum_choice, 0},
-		//{"block-size", "B", POPT_ARG_STRING, nil, OPT_BLOCK_SIZE},
-		//{"compare-dest", "", POPT_ARG_STRING, nil, OPT_COMPARE_DEST},
-		//{"copy-dest", "", POPT_ARG_STRING, nil, OPT_COPY_DEST},
-		//{"link-dest", "", POPT_ARG_STRING, nil, OPT_LINK_DEST},
-		//{"fuzzy", "y", POPT_ARG_NONE, nil, 'y'},
-		//{"no-fuzzy", "", POPT_ARG_VAL, &o.fuzzy_basis, 0},
-		//{"no-y", "", POPT_ARG_VAL, &o.fuzzy_basis, 0},
-
-		// Regarding compression support, see:
+		{"checksum-choice", "", POPT_ARG_STRING, &o.checksum_choice, 0},
+		{"cc", "", POPT_ARG_STRING, &o.checksum_choice, 0},
+		{"block-size", "B", POPT_ARG_STRING, nil, OPT_BLOCK_SIZE},
+		{"compare-dest", "", POPT_ARG_STRING, nil, OPT_COMPARE_DEST},
+		{"copy-dest", "", POPT_ARG_STRING, nil, OPT_COPY_DEST},
+		{"link-dest", "", POPT_ARG_STRING, nil, OPT_LINK_DEST},
+		{"fuzzy", "y", POPT_ARG_NONE, nil, 'y'},
+		{"no-fuzzy", "", POPT_ARG_VAL, &o.fuzzy_basis, 0},
+		{"no-y", "", POPT_ARG_VAL, &o.fuzzy_basis, 0},
+
+		// Only the zlib algorithm (with matched block data primed into the
+		// compressor history) is supported, which is the only algorithm that
+		// protocol 27 knows about. Regarding other algorithms, see:
 		// https://github.com/gokrazy/rsync/issues/35#issuecomment-2988582190
 		//
-		//{"compress", "z", POPT_ARG_NONE, nil, 'z'},
+		{"compress", "z", POPT_ARG_NONE, nil, 'z'},
 		//{"old-compress", "", POPT_ARG_NONE, nil, OPT_OLD_COMPRESS},
 		//{"new-compress", "", POPT_ARG_NONE, nil, OPT_NEW_COMPRESS},
-		//{"no-compress", "", POPT_ARG_NONE, nil, OPT_NO_COMPRESS},
-		//{"no-z", "", POPT_ARG_NONE, nil, OPT_NO_COMPRESS},
+		{"no-compress", "", POPT_ARG_NONE, nil, OPT_NO_COMPRESS},
+		{"no-z", "", POPT_ARG_NONE, nil, OPT_NO_COMPRESS},
 		//{"compress-choice", "", POPT_ARG_STRING, &o.compress_choice, 0},
 		//{"zc", "", POPT_ARG_STRING, &o.compress_choice, 0},
-		//{"skip-compress", "", POPT_ARG_STRING, &o.skip_compress, 0},
-		//{"compress-level", "", POPT_ARG_INT, &o.do_compression_level, 0},
-		//{"zl", "", POPT_ARG_INT, &o.do_compression_level, 0},
+		{"skip-compress", "", POPT_ARG_STRING, &o.skip_compress, 0},
+		{"compress-level", "", POPT_ARG_INT, &o.do_compression_level, 0},
+		{"zl", "", POPT_ARG_INT, &o.do_compression_level, 0},
 
-		//{"", "P", POPT_ARG_NONE, nil, 'P'},
+		{"", "P", POPT_ARG_NONE, nil, 'P'},
 		{"progress", "", POPT_ARG_VAL, &o.do_progress, 1},
 		{"no-progress", "", POPT_ARG_VAL, &o.do_progress, 0},
-		//{"partial", "", POPT_ARG_VAL, &o.keep_partial, 1},
-		//{"no-partial", "", POPT_ARG_VAL, &o.keep_partial, 0},
-		//{"partial-dir", "", POPT_ARG_STRING, &o.partial_dir, 0},
+		{"partial", "", POPT_ARG_VAL, &o.keep_partial, 1},
+		{"no-partial", "", POPT_ARG_VAL, &o.keep_partial, 0},
+		{"partial-dir", "", POPT_ARG_STRING, &o.partial_dir, 0},
 		//{"delay-updates", "", POPT_ARG_VAL, &o.delay_updates, 1},
 		//{"no-delay-updates", "", POPT_ARG_VAL, &o.delay_updates, 0},
 		//{"prune-empty-dirs", "m", POPT_ARG_VAL, &o.prune_empty_dirs, 1},
@@ -965,24 +1415,24 @@ func (o *Options) gokrazyTable() []poptOption {
 		//{"no-m", "", POPT_ARG_VAL, &o.prune_empty_dirs, 0},
 		//{"log-file", "", POPT_ARG_STRING, &o.logfile_name, 0},
 		//{"log-file-format", "", POPT_ARG_STRING, &o.logfile_format, 0},
-		//{"out-format", "", POPT_ARG_STRING, &o.stdout_format, 0},
-		//{"log-format", "", POPT_ARG_STRING, &o.stdout_format, 0}, /* DEPRECATED */
-		//{"itemize-changes", "i", POPT_ARG_NONE, nil, 'i'},
-		//{"no-itemize-changes", "", POPT_ARG_VAL, &o.itemize_changes, 0},
-		//{"no-i", "", POPT_ARG_VAL, &o.itemize_changes, 0},
-		//{"bwlimit", "", POPT_ARG_STRING, &o.bwlimit_arg, OPT_BWLIMIT},
-		//{"no-bwlimit", "", POPT_ARG_VAL, &o.bwlimit, 0},
-		//{"backup", "b", POPT_ARG_VAL, &o.make_backups, 1},
-		//{"no-backup", "", POPT_ARG_VAL, &o.make_backups, 0},
-		//{"backup-dir", "", POPT_ARG_STRING, &o.backup_dir, 0},
-		//{"suffix", "", POPT_ARG_STRING, &o.backup_suffix, 0},
+		{"out-format", "", POPT_ARG_STRING, &o.stdout_format, 0},
+		{"log-format", "", POPT_ARG_STRING, &o.stdout_format, 0}, /* DEPRECATED */
+		{"itemize-changes", "i", POPT_ARG_NONE, nil, 'i'},
+		{"no-itemize-changes", "", POPT_ARG_VAL, &o.itemize_changes, 0},
+		{"no-i", "", POPT_ARG_VAL, &o.itemize_changes, 0},
+		{"bwlimit", "", POPT_ARG_STRING, &o.bwlimit_arg, OPT_BWLIMIT},
+		{"no-bwlimit", "", POPT_ARG_VAL, &o.bwlimit, 0},
+		{"backup", "b", POPT_ARG_VAL, &o.make_backups, 1},
+		{"no-backup", "", POPT_ARG_VAL, &o.make_backups, 0},
+		{"backup-dir", "", POPT_ARG_STRING, &o.backup_dir, 0},
+		{"suffix", "", POPT_ARG_STRING, &o.backup_suffix, 0},
 		//{"list-only", "", POPT_ARG_VAL, &o.list_only, 2},
 		//{"read-batch", "", POPT_ARG_STRING, &o.batch_name, OPT_READ_BATCH},
 		//{"write-batch", "", POPT_ARG_STRING, &o.batch_name, OPT_WRITE_BATCH},
 		//{"only-write-batch", "", POPT_ARG_STRING, &o.batch_name, OPT_ONLY_WRITE_BATCH},
-		//{"files-from", "", POPT_ARG_STRING, &o.files_from, 0},
-		//{"from0", "0", POPT_ARG_VAL, &o.eol_nulls, 1},
-		//{"no-from0", "", POPT_ARG_VAL, &o.eol_nulls, 0},
+		{"files-from", "", POPT_ARG_STRING, &o.files_from, 0},
+		{"from0", "0", POPT_ARG_VAL, &o.eol_nulls, 1},
+		{"no-from0", "", POPT_ARG_VAL, &o.eol_nulls, 0},
 		//{"old-args", "", POPT_ARG_NONE, nil, OPT_OLD_ARGS},
 		//{"no-old-args", "", POPT_ARG_VAL, &o.old_style_args, 0},
 		//{"secluded-args", "s", POPT_ARG_VAL, &o.protect_args, 1},
@@ -991,13 +1441,13 @@ func (o *Options) gokrazyTable() []poptOption {
 		//{"no-protect-args", "", POPT_ARG_VAL, &o.protect_args, 0},
 		//{"no-s", "", POPT_ARG_VAL, &o.protect_args, 0},
 		//{"trust-sender", "", POPT_ARG_VAL, &o.trust_sender, 1},
-		//{"numeric-ids", "", POPT_ARG_VAL, &o.numeric_ids, 1},
-		//{"no-numeric-ids", "", POPT_ARG_VAL, &o.numeric_ids, 0},
-		//{"usermap", "", POPT_ARG_STRING, nil, OPT_USERMAP},
-		//{"groupmap", "", POPT_ARG_STRING, nil, OPT_GROUPMAP},
-		//{"chown", "", POPT_ARG_STRING, nil, OPT_CHOWN},
-		//{"timeout", "", POPT_ARG_INT, &o.io_timeout, 0},
-		//{"no-timeout", "", POPT_ARG_VAL, &o.io_timeout, 0},
+		{"numeric-ids", "", POPT_ARG_VAL, &o.numeric_ids, 1},
+		{"no-numeric-ids", "", POPT_ARG_VAL, &o.numeric_ids, 0},
+		{"usermap", "", POPT_ARG_STRING, nil, OPT_USERMAP},
+		{"groupmap", "", POPT_ARG_STRING, nil, OPT_GROUPMAP},
+		{"chown", "", POPT_ARG_STRING, nil, OPT_CHOWN},
+		{"timeout", "", POPT_ARG_INT, &o.io_timeout, 0},
+		{"no-timeout", "", POPT_ARG_VAL, &o.io_timeout, 0},
 		{"contimeout", "", POPT_ARG_INT, &o.connect_timeout, 0},
 		{"no-contimeout", "", POPT_ARG_VAL, &o.connect_timeout, 0},
 		//{"fsync", "", POPT_ARG_NONE, &o.do_fsync, 0},
@@ -1027,7 +1477,7 @@ func (o *Options) gokrazyTable() []poptOption {
 		//{"no-blocking-io", "", POPT_ARG_VAL, &o.blocking_io, 0},
 		//{"outbuf", "", POPT_ARG_STRING, &o.outbuf_mode, 0},
 		//{"remote-option", "M", POPT_ARG_STRING, nil, 'M'},
-		//{"protocol", "", POPT_ARG_INT, &o.protocol_version, 0},
+		{"protocol", "", POPT_ARG_INT, &o.protocol_version, 0},
 		//{"checksum-seed", "", POPT_ARG_INT, &o.checksum_seed, 0},
 		{"server", "", POPT_ARG_NONE, nil, OPT_SERVER},
 		{"sender", "", POPT_ARG_NONE, nil, OPT_SENDER},
@@ -1315,6 +1765,7 @@ func (pc *Context) ParseArguments(osenv *rsyncos.Env, args []string) error {
 	// here, as we have our own configuration file.
 
 	version_opt_cnt := 0
+	F_option_cnt := 0
 
 	pc.args = args
 	opts := pc.Options
@@ -1383,15 +1834,29 @@ func (pc *Context) ParseArguments(osenv *rsyncos.Env, args []string) error {
 			return nil
 
 		case OPT_FILTER:
-			opts.filterRules = append(opts.filterRules, pc.poptGetOptArg())
+			opts.filterRules = append(opts.filterRules, FilterRule{
+				Rule: pc.poptGetOptArg(),
+			})
 		case OPT_EXCLUDE:
-			opts.filterRules = append(opts.filterRules, "- "+pc.poptGetOptArg())
+			opts.filterRules = append(opts.filterRules, FilterRule{
+				Rule:        pc.poptGetOptArg(),
+				OldPrefixes: true,
+			})
 		case OPT_INCLUDE:
-			opts.filterRules = append(opts.filterRules, "+ "+pc.poptGetOptArg())
+			opts.filterRules = append(opts.filterRules, FilterRule{
+				Rule:        pc.poptGetOptArg(),
+				Include:     true,
+				OldPrefixes: true,
+			})
 
 		case OPT_INCLUDE_FROM,
 			OPT_EXCLUDE_FROM:
-			return errNotYetImplemented
+			opts.filterRules = append(opts.filterRules, FilterRule{
+				Rule:        pc.poptGetOptArg(),
+				Include:     opt == OPT_INCLUDE_FROM,
+				OldPrefixes: true,
+				File:        true,
+			})
 
 		case 'a':
 			if opts.recurse == 0 {
@@ -1432,7 +1897,7 @@ func (pc *Context) ParseArguments(osenv *rsyncos.Env, args []string) error {
 			opts.verbose++
 
 		case 'y':
-			return errNotYetImplemented
+			opts.fuzzy_basis++
 
 		case 'q':
 			opts.quiet++
@@ -1441,7 +1906,17 @@ func (pc *Context) ParseArguments(osenv *rsyncos.Env, args []string) error {
 			opts.one_file_system++
 
 		case 'F':
-			return errNotYetImplemented
+			F_option_cnt++
+			switch F_option_cnt {
+			case 1:
+				opts.filterRules = append(opts.filterRules, FilterRule{
+					Rule: ": /.rsync-filter",
+				})
+			case 2:
+				opts.filterRules = append(opts.filterRules, FilterRule{
+					Rule: "- .rsync-filter",
+				})
+			}
 
 		case 'P':
 			opts.do_progress = 1
@@ -1472,23 +1947,59 @@ func (pc *Context) ParseArguments(osenv *rsyncos.Env, args []string) error {
 			return errNotYetImplemented
 
 		case OPT_BLOCK_SIZE:
-			return errNotYetImplemented
+			// We may not know the real protocol version at this point (for
+			// the client), but --protocol=29 allows a larger block size.
+			maxBlength := int64(rsync.MaxBlockSize(int32(opts.protocol_version)))
+			size, err := parseSizeArg(pc.poptGetOptArg(), 'b', "block-size", 0, maxBlength, false)
+			if err != nil {
+				return err
+			}
+			opts.block_size = int(size)
 
 		case OPT_MAX_SIZE, // (needs parse_size_arg)
-			OPT_MIN_SIZE,
-			OPT_BWLIMIT:
+			OPT_MIN_SIZE:
 			return errNotYetImplemented
 
+		case OPT_BWLIMIT:
+			bwlimit, err := ParseBwLimit(opts.bwlimit_arg)
+			if err != nil {
+				return err
+			}
+			opts.bwlimit = bwlimit
+
 		case OPT_APPEND:
-			return errNotYetImplemented
+			// The client sends --append twice for --append-verify.
+			if opts.am_server != 0 {
+				opts.append_mode++
+			} else {
+				opts.append_mode = 1
+			}
 
 		case OPT_LINK_DEST,
 			OPT_COPY_DEST,
 			OPT_COMPARE_DEST:
-			return errNotYetImplemented
+			destType := COMPARE_DEST
+			switch opt {
+			case OPT_COPY_DEST:
+				destType = COPY_DEST
+			case OPT_LINK_DEST:
+				destType = LINK_DEST
+			}
+			if opts.alt_dest_type != 0 && opts.alt_dest_type != destType {
+				return fmt.Errorf("You may not mix --compare-dest, --copy-dest, and --link-dest.")
+			}
+			opts.alt_dest_type = destType
+			if len(opts.basis_dirs) >= MAX_BASIS_DIRS {
+				return fmt.Errorf("ERROR: at most %d %s args may be specified", MAX_BASIS_DIRS, AltDestOption(destType))
+			}
+			// Like tridge rsync, we defer sanitizing this arg until we
+			// know what our destination directory is going to be.
+			opts.basis_dirs = append(opts.basis_dirs, pc.poptGetOptArg())
 
-		case OPT_CHMOD: // (needs parse_chmod):
-			return errNotYetImplemented
+		case OPT_CHMOD:
+			if err := opts.AddChmod(pc.poptGetOptArg()); err != nil {
+				return err
+			}
 
 		case OPT_INFO:
 			parseOutputWords(osenv, infoWords[:], opts.info[:], pc.poptGetOptArg(), USER_PRIORITY)
@@ -1496,17 +2007,60 @@ func (pc *Context) ParseArguments(osenv *rsyncos.Env, args []string) error {
 		case OPT_DEBUG:
 			parseOutputWords(osenv, debugWords[:], opts.debug[:], pc.poptGetOptArg(), USER_PRIORITY)
 
-		case OPT_USERMAP,
-			OPT_GROUPMAP,
-			OPT_CHOWN:
-			return errNotYetImplemented
+		case OPT_USERMAP:
+			if opts.usermap != "" {
+				if opts.usermap_via_chown {
+					return fmt.Errorf("--usermap conflicts with prior --chown.")
+				}
+				return fmt.Errorf("You can only specify --usermap once.")
+			}
+			opts.usermap = pc.poptGetOptArg()
+			opts.usermap_via_chown = false
+			opts.preserve_uid = 1
+
+		case OPT_GROUPMAP:
+			if opts.groupmap != "" {
+				if opts.groupmap_via_chown {
+					return fmt.Errorf("--groupmap conflicts with prior --chown.")
+				}
+				return fmt.Errorf("You can only specify --groupmap once.")
+			}
+			opts.groupmap = pc.poptGetOptArg()
+			opts.groupmap_via_chown = false
+			opts.preserve_gid = 1
+
+		case OPT_CHOWN:
+			user, group, _ := strings.Cut(pc.poptGetOptArg(), ":")
+			if user != "" {
+				if opts.usermap != "" {
+					if !opts.usermap_via_chown {
+						return fmt.Errorf("--chown conflicts with prior --usermap.")
+					}
+					return fmt.Errorf("You can only specify a user-affecting --chown once.")
+				}
+				opts.usermap = "*:" + user
+				opts.usermap_via_chown = true
+				opts.preserve_uid = 1
+			}
+			if group != "" {
+				if opts.groupmap != "" {
+					if !opts.groupmap_via_chown {
+						return fmt.Errorf("--chown conflicts with prior --groupmap.")
+					}
+					return fmt.Errorf("You can only specify a group-affecting --chown once.")
+				}
+				opts.groupmap = "*:" + group
+				opts.groupmap_via_chown = true
+				opts.preserve_gid = 1
+			}
 
 		case OPT_HELP:
 			fmt.Println(opts.Help()) // tridge rsync prints help to stdout
 			os.Exit(0)               // exit with code 0 for compatibility with tridge rsync
 
 		case 'A':
-			return fmt.Errorf("ACLs are not supported by gokrazy/rsync")
+			opts.preserve_acls = 1
+			opts.preserve_perms = 1
 
 		case 'X':
 			opts.preserve_xattrs++
@@ -1540,6 +2094,42 @@ func (pc *Context) ParseArguments(osenv *rsyncos.Env, args []string) error {
 		os.Exit(1)
 	}
 
+	if opts.files_from != "" {
+		if opts.recurse == 1 { // preserve recurse == 2
+			opts.recurse = 0
+		}
+		if opts.xfer_dirs < 0 {
+			opts.xfer_dirs = 1
+		}
+		if opts.files_from == "-" && opts.am_server != 0 {
+			opts.filesfrom_remote = 1 // reading from socket
+		}
+	}
+
+	// rsync/options.c: a non-zero --compress-level implies --compress, a
+	// level of 0 turns compression off (see CompressionLevel).
+	if opts.do_compression_level != math.MinInt32 {
+		if opts.do_compression_level == 0 {
+			opts.do_compression = 0
+		} else if opts.do_compression == 0 {
+			opts.do_compression = 1
+		}
+	}
+
+	if opts.protocol_version < rsync.MinProtocolVersion ||
+		opts.protocol_version > rsync.ProtocolVersion {
+		return fmt.Errorf("--protocol must be between %d and %d", rsync.MinProtocolVersion, rsync.ProtocolVersion)
+	}
+
+	if cc := opts.checksum_choice; strings.EqualFold(cc, "auto") || strings.EqualFold(cc, "auto,auto") {
+		opts.checksum_choice = "" // negotiate
+	} else if cc != "" {
+		// verify the names early
+		if _, err := rsyncchecksum.ParseChoice(int32(opts.protocol_version), cc); err != nil {
+			return err
+		}
+	}
+
 	if opts.recurse != 0 {
 		opts.xfer_dirs = 1
 	}
@@ -1551,6 +2141,24 @@ func (pc *Context) ParseArguments(osenv *rsyncos.Env, args []string) error {
 		}
 	}
 
+	if opts.delete_before+min(opts.delete_during, 1)+opts.delete_after > 1 {
+		return fmt.Errorf("You may not combine multiple --delete-WHEN options.")
+	}
+	if opts.delete_before != 0 || opts.delete_during != 0 || opts.delete_after != 0 {
+		opts.delete_mode = 1
+	} else if opts.delete_mode != 0 || opts.delete_excluded != 0 {
+		// Only choose between before and during once the protocol version is
+		// known, see SetDeleteTiming.
+		opts.delete_mode = 1
+	}
+	if opts.xfer_dirs == 0 && opts.delete_mode != 0 {
+		return fmt.Errorf("--delete does not work without --recursive (-r) or --dirs (-d).")
+	}
+	if opts.max_delete < 0 && opts.max_delete != math.MinInt32 {
+		// Negative numbers are treated as "no deletions".
+		opts.max_delete = 0
+	}
+
 	if opts.relative_paths < 0 {
 		if opts.files_from != "" {
 			opts.relative_paths = 1
@@ -1578,9 +2186,89 @@ func (pc *Context) ParseArguments(osenv *rsyncos.Env, args []string) error {
 	if opts.backup_dir != "" {
 		opts.make_backups = 1 // --backup-dir implies --backup
 	}
+	if strings.Contains(opts.backup_suffix, "/") {
+		return fmt.Errorf("--suffix cannot contain slashes: %s", opts.backup_suffix)
+	}
+
+	if opts.fuzzy_basis > 1 {
+		// -yy searches the destination directory and all alternate basis
+		// directories.
+		opts.fuzzy_basis = len(opts.basis_dirs) + 1
+	}
+
+	if opts.preallocate_files != 0 && opts.am_sender == 0 && runtime.GOOS != "linux" {
+		where := "Client"
+		if opts.am_server != 0 {
+			where = "Server"
+		}
+		return fmt.Errorf("preallocation is not supported on this %s", where)
+	}
+
+	if opts.preserve_acls != 0 && runtime.GOOS != "linux" {
+		where := "client"
+		if opts.am_server != 0 {
+			where = "server"
+		}
+		return fmt.Errorf("ACLs are not supported on this %s", where)
+	}
+
+	if opts.preserve_xattrs != 0 && runtime.GOOS != "linux" {
+		where := "client"
+		if opts.am_server != 0 {
+			where = "server"
+		}
+		return fmt.Errorf("extended attributes are not supported on this %s", where)
+	}
+
+	if opts.append_mode != 0 {
+		if opts.whole_file > 0 {
+			return fmt.Errorf("--append cannot be used with --whole-file")
+		}
+		opts.inplace = 1 // --append implies --inplace
+	}
+
+	if opts.inplace != 0 {
+		if opts.partial_dir != "" {
+			mode := "inplace"
+			if opts.append_mode != 0 {
+				mode = "append"
+			}
+			return fmt.Errorf("--%s cannot be used with --partial-dir", mode)
+		}
+		// The destination file itself is the partial file.
+		opts.keep_partial = 0
+	} else {
+		if opts.keep_partial != 0 && opts.partial_dir == "" && opts.am_server == 0 {
+			opts.partial_dir = os.Getenv("RSYNC_PARTIAL_DIR")
+		}
+		if opts.partial_dir != "" {
+			opts.partial_dir = path.Clean(opts.partial_dir)
+			if opts.partial_dir == "." {
+				opts.partial_dir = ""
+			}
+			opts.keep_partial = 1
+		}
+	}
+
+	if opts.stdout_format != "" {
+		if opts.am_server != 0 && logFormatHas(opts.stdout_format, 'I') {
+			opts.stdout_format_has_i = 2
+		} else if logFormatHas(opts.stdout_format, 'i') {
+			opts.stdout_format_has_i = opts.itemize_changes | 1
+		}
+		if !logFormatHas(opts.stdout_format, 'b') &&
+			!logFormatHas(opts.stdout_format, 'c') &&
+			!logFormatHas(opts.stdout_format, 'C') {
+			opts.log_before_transfer = opts.am_server == 0
+		}
+	} else if opts.itemize_changes != 0 {
+		opts.stdout_format = "%i %n%L"
+		opts.stdout_format_has_i = opts.itemize_changes
+		opts.log_before_transfer = opts.am_server == 0
+	}
 
 	if opts.do_progress != 0 && opts.am_server == 0 {
-		if opts.info[INFO_NAME] == 0 {
+		if !opts.log_before_transfer && opts.info[INFO_NAME] == 0 {
 			opts.info[INFO_NAME] = 1
 		}
 		opts.info[INFO_FLIST] = 2
@@ -1589,6 +2277,10 @@ func (pc *Context) ParseArguments(osenv *rsyncos.Env, args []string) error {
 
 	if opts.info[INFO_NAME] >= 1 && opts.stdout_format == "" {
 		opts.stdout_format = "%n%L"
+		opts.log_before_transfer = opts.am_server == 0
+	}
+	if opts.stdout_format_has_i != 0 || logFormatHas(opts.stdout_format, 'o') {
+		opts.stdout_format_has_o_or_i = true
 	}
 
 	return nil
@@ -7,6 +7,7 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/gokrazy/rsync"
 	"github.com/gokrazy/rsync/internal/rsyncostest"
 	"github.com/google/go-cmp/cmp"
 )
@@ -62,7 +63,7 @@ func discardKnownDifferences(lines []string) []string {
 		// TODO: document why ipv4/ipv6 have different values
 		ignore := strings.HasPrefix(line, "long=ipv4 ") ||
 			strings.HasPrefix(line, "long=ipv6 ") ||
-			// We implement protocol version 27 currently,
+			// We implement protocol version 31 currently,
 			// tridge rsync implements newer versions.
 			strings.HasPrefix(line, "long=protocol ") ||
 			// gokrazy-specific flags
@@ -232,3 +233,162 @@ func TestParseArgumentsRemaining(t *testing.T) {
 		})
 	}
 }
+
+func TestParseSizeArg(t *testing.T) {
+	for _, tt := range []struct {
+		arg     string
+		want    int64
+		wantErr string
+	}{
+		{arg: "700", want: 700},
+		{arg: "8k", want: 8 * 1024},
+		{arg: "8K", want: 8 * 1024},
+		{arg: "8kb", want: 8 * 1000},
+		{arg: "8KiB", want: 8 * 1024},
+		{arg: "1.5k", want: 1536},
+		{arg: "1m", want: 1 << 20},
+		{arg: "64k-1", want: 64*1024 - 1},
+		{arg: "64k+1", want: 64*1024 + 1},
+		{arg: "1g", wantErr: "--block-size value is too large: 1g (max=1048576)"},
+		{arg: "8x", wantErr: "--block-size value is invalid: 8x"},
+		{arg: "8kx", wantErr: "--block-size value is invalid: 8kx"},
+	} {
+		t.Run(tt.arg, func(t *testing.T) {
+			got, err := parseSizeArg(tt.arg, 'b', "block-size", 0, 1<<20, false)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("parseSizeArg(%q) = %v, want error %q", tt.arg, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("parseSizeArg(%q) = %d, want %d", tt.arg, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseBwLimit(t *testing.T) {
+	for _, tt := range []struct {
+		arg     string
+		want    int
+		wantErr string
+	}{
+		{arg: "0", want: 0},
+		{arg: "100", want: 100},
+		{arg: "1.5m", want: 1536},
+		{arg: "1MB", want: 977},
+		{arg: "1g", want: 1 << 20},
+		{arg: "512b", want: 1},
+		{arg: "100b", wantErr: "--bwlimit value is too small: 100b (min=512)"},
+		{arg: "fast", wantErr: "--bwlimit value is invalid: fast"},
+	} {
+		t.Run(tt.arg, func(t *testing.T) {
+			got, err := ParseBwLimit(tt.arg)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("ParseBwLimit(%q) = %v, want error %q", tt.arg, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("ParseBwLimit(%q) = %d, want %d", tt.arg, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStdoutFormat(t *testing.T) {
+	for _, tt := range []struct {
+		args       []string
+		wantFormat string
+		wantHasI   int
+		wantBefore bool
+		wantServer string // --log-format passed to a receiving server
+	}{
+		{args: nil},
+		{args: []string{"-v"}, wantFormat: "%n%L", wantBefore: true},
+		{args: []string{"--progress"}, wantFormat: "%n%L", wantBefore: true, wantServer: "--log-format=X"},
+		{args: []string{"-i"}, wantFormat: "%i %n%L", wantHasI: 1, wantBefore: true, wantServer: "--log-format=%i"},
+		{args: []string{"-ii"}, wantFormat: "%i %n%L", wantHasI: 2, wantBefore: true, wantServer: "--log-format=%i%I"},
+		{args: []string{"-i", "--no-i"}},
+		{args: []string{"--out-format=%o %n"}, wantFormat: "%o %n", wantBefore: true, wantServer: "--log-format=%o"},
+		{args: []string{"--out-format=%'-10i %n"}, wantFormat: "%'-10i %n", wantHasI: 1, wantBefore: true, wantServer: "--log-format=%i"},
+		{args: []string{"-v", "--out-format=%n %b"}, wantFormat: "%n %b"},
+	} {
+		t.Run(strings.Join(tt.args, " "), func(t *testing.T) {
+			osenv := rsyncostest.New(t)
+			pc := NewContext(NewOptions(osenv))
+			if err := pc.ParseArguments(osenv, tt.args); err != nil {
+				t.Fatalf("ParseArguments: %v", err)
+			}
+			opts := pc.Options
+			if got := opts.StdoutFormat(); got != tt.wantFormat {
+				t.Errorf("StdoutFormat() = %q, want %q", got, tt.wantFormat)
+			}
+			if got := opts.StdoutFormatHasI(); got != tt.wantHasI {
+				t.Errorf("StdoutFormatHasI() = %d, want %d", got, tt.wantHasI)
+			}
+			if got := opts.LogBeforeTransfer(); got != tt.wantBefore {
+				t.Errorf("LogBeforeTransfer() = %v, want %v", got, tt.wantBefore)
+			}
+			opts.SetSender()
+			var gotServer string
+			for _, arg := range opts.ServerOptions() {
+				if strings.HasPrefix(arg, "--log-format=") {
+					gotServer = arg
+				}
+			}
+			if gotServer != tt.wantServer {
+				t.Errorf("ServerOptions() contains %q, want %q", gotServer, tt.wantServer)
+			}
+		})
+	}
+}
+
+func TestParseChmod(t *testing.T) {
+	const (
+		dir  = rsync.S_IFDIR
+		file = rsync.S_IFREG
+	)
+	for _, tt := range []struct {
+		modestr string
+		mode    uint32
+		want    uint32
+	}{
+		{modestr: "644", mode: file | 0755, want: file | 0644},
+		{modestr: "D755,F644", mode: dir | 0700, want: dir | 0755},
+		{modestr: "D755,F644", mode: file | 0600, want: file | 0644},
+		{modestr: "D755,F644,ug+w", mode: file | 0600, want: file | 0664},
+		{modestr: "go-w", mode: file | 0666, want: file | 0644},
+		{modestr: "u+s,g+s", mode: file | 0755, want: file | 06755},
+		{modestr: "o+t", mode: dir | 0777, want: dir | 01777},
+		{modestr: "a=rX", mode: file | 0600, want: file | 0444},
+		{modestr: "a=rX", mode: file | 0700, want: file | 0555},
+		{modestr: "a=rX", mode: dir | 0700, want: dir | 0555},
+		{modestr: "Fo=", mode: dir | 0777, want: dir | 0777},
+		{modestr: "Fo=", mode: file | 0777, want: file | 0770},
+	} {
+		t.Run(tt.modestr, func(t *testing.T) {
+			rules, err := ParseChmod(tt.modestr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := TweakMode(tt.mode, rules); got != tt.want {
+				t.Errorf("TweakMode(%#o, %q) = %#o, want %#o", tt.mode, tt.modestr, got, tt.want)
+			}
+		})
+	}
+
+	for _, modestr := range []string{"", "u", "u+q", "D", "DF644", "644,", "u=rw,,o=r", "8", "u644", "77777"} {
+		if _, err := ParseChmod(modestr); err == nil {
+			t.Errorf("ParseChmod(%q) unexpectedly succeeded", modestr)
+		}
+	}
+}
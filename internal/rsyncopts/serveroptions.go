@@ -1,5 +1,10 @@
 package rsyncopts
 
+import (
+	"fmt"
+	"math"
+)
+
 func (o *Options) CommandOptions(path string, paths ...string) []string {
 	return append(o.ServerOptions(), append([]string{".", path}, paths...)...)
 }
@@ -31,9 +36,10 @@ func (o *Options) ServerOptions() []string {
 		argstr += "v"
 	}
 
-	// /* the -q option is intentionally left out */
-	// if (make_backups)
-	// 	argstr[x++] = 'b';
+	// the -q option is intentionally left out
+	if o.MakeBackups() {
+		argstr += "b"
+	}
 	if o.UpdateOnly() {
 		argstr += "u"
 	}
@@ -43,17 +49,20 @@ func (o *Options) ServerOptions() []string {
 	if o.PreserveLinks() {
 		argstr += "l"
 	}
-	// if (copy_links)
-	// 	argstr[x++] = 'L';
+	if o.copy_links != 0 {
+		argstr += "L"
+	}
 
-	// if (whole_file > 0)
-	// 	argstr[x++] = 'W';
-	// /* We don't need to send --no-whole-file, because it's the
-	//  * default for remote transfers, and in any case old versions
-	//  * of rsync will not understand it. */
+	if o.whole_file > 0 {
+		argstr += "W"
+	}
+	// We don't need to send --no-whole-file, because it's the default for
+	// remote transfers, and in any case old versions of rsync will not
+	// understand it.
 
-	// if (preserve_hard_links)
-	// 	argstr[x++] = 'H';
+	if o.PreserveHardLinks() {
+		argstr += "H"
+	}
 	if o.PreserveUid() {
 		argstr += "o"
 	}
@@ -69,9 +78,26 @@ func (o *Options) ServerOptions() []string {
 	if o.PreservePerms() {
 		argstr += "p"
 	}
+	if o.PreserveACLs() {
+		argstr += "A"
+	}
+	if o.preserve_xattrs != 0 {
+		argstr += "X"
+		if o.preserve_xattrs > 1 {
+			argstr += "X"
+		}
+	}
 	if o.Recurse() {
 		argstr += "r"
 	}
+	// The receiver needs --dirs to delete, even if it is only implied.
+	dirsImplied := 0
+	if o.Recurse() || !o.DeleteMode() || !o.Sender() {
+		dirsImplied = 1
+	}
+	if o.xfer_dirs > dirsImplied {
+		argstr += "d"
+	}
 	if o.AlwaysChecksum() {
 		argstr += "c"
 	}
@@ -84,10 +110,29 @@ func (o *Options) ServerOptions() []string {
 	// 	argstr[x++] = 'R';
 	// if (one_file_system)
 	// 	argstr[x++] = 'x';
-	// if (sparse_files)
-	// 	argstr[x++] = 'S';
-	// if (do_compression)
-	// 	argstr[x++] = 'z';
+	if o.Sender() && o.fuzzy_basis != 0 {
+		// -yy also searches the alternate basis directories.
+		argstr += "y"
+		if o.fuzzy_basis > 1 {
+			argstr += "y"
+		}
+	}
+	if o.SparseFiles() {
+		argstr += "S"
+	}
+	if o.Compress() {
+		argstr += "z"
+	}
+
+	// We make use of the -e option to let the server know about any
+	// pre-release protocol version && some behavior flags.
+	argstr += "e."
+	if o.AllowIncRecurse() {
+		argstr += "i"
+	}
+	argstr += "x" // avoid the xattr optimization, see rsync.CF_AVOID_XATTR_OPTIM
+	argstr += "C" // support checksum seed order fix
+	argstr += "v" // use varint for flist flags & negotiate checksum/compression
 
 	// /* this is a complete hack - blame Rusty
 
@@ -102,17 +147,16 @@ func (o *Options) ServerOptions() []string {
 		sargv = append(sargv, argstr)
 	}
 
-	// if (block_size) {
-	// 	if (asprintf(&arg, "-B%u", block_size) < 0)
-	// 		goto oom;
-	// 	args[ac++] = arg;
-	// }
+	if o.block_size != 0 {
+		sargv = append(sargv, fmt.Sprintf("-B%d", o.block_size))
+	}
 
-	// if (max_delete && am_sender) {
-	// 	if (asprintf(&arg, "--max-delete=%d", max_delete) < 0)
-	// 		goto oom;
-	// 	args[ac++] = arg;
-	// }
+	if o.max_delete > 0 && o.Sender() {
+		sargv = append(sargv, fmt.Sprintf("--max-delete=%d", o.max_delete))
+	} else if o.max_delete == 0 && o.Sender() {
+		// An old receiver would treat --max-delete=0 as unlimited.
+		sargv = append(sargv, "--max-delete=-1")
+	}
 
 	// if (batch_prefix) {
 	// 	char *r_or_w = write_batch ? "write" : "read";
@@ -121,35 +165,61 @@ func (o *Options) ServerOptions() []string {
 	// 	args[ac++] = arg;
 	// }
 
-	// if (io_timeout) {
-	// 	if (asprintf(&arg, "--timeout=%d", io_timeout) < 0)
-	// 		goto oom;
-	// 	args[ac++] = arg;
-	// }
+	if o.io_timeout != 0 {
+		sargv = append(sargv, fmt.Sprintf("--timeout=%d", o.io_timeout))
+	}
 
-	// if (bwlimit) {
-	// 	if (asprintf(&arg, "--bwlimit=%d", bwlimit) < 0)
-	// 		goto oom;
-	// 	args[ac++] = arg;
-	// }
+	if o.bwlimit != 0 {
+		sargv = append(sargv, fmt.Sprintf("--bwlimit=%d", o.bwlimit))
+	}
 
-	// if (backup_dir) {
-	// 	args[ac++] = "--backup-dir";
-	// 	args[ac++] = backup_dir;
-	// }
+	// The server side doesn't use our log-format, but in certain
+	// circumstances they need to know a little about the option.
+	if o.stdout_format != "" && o.Sender() {
+		// Use --log-format, not --out-format, for compatibility.
+		switch {
+		case o.stdout_format_has_i > 1:
+			sargv = append(sargv, "--log-format=%i%I")
+		case o.stdout_format_has_i != 0:
+			sargv = append(sargv, "--log-format=%i")
+		case o.stdout_format_has_o_or_i:
+			sargv = append(sargv, "--log-format=%o")
+		case o.verbose == 0:
+			sargv = append(sargv, "--log-format=X")
+		}
+	}
 
-	// /* Only send --suffix if it specifies a non-default value. */
-	// if (strcmp(backup_suffix, backup_dir ? "" : BACKUP_SUFFIX) != 0) {
-	// 	/* We use the following syntax to avoid weirdness with '~'. */
-	// 	if (asprintf(&arg, "--suffix=%s", backup_suffix) < 0)
-	// 		goto oom;
-	// 	args[ac++] = arg;
-	// }
+	if o.backup_dir != "" {
+		sargv = append(sargv, "--backup-dir", o.backup_dir)
+	}
 
-	// if (delete_excluded)
-	// 	args[ac++] = "--delete-excluded";
-	// else if (delete_mode)
-	// 	args[ac++] = "--delete";
+	// Only send --suffix if it specifies a non-default value.
+	defaultSuffix := "~"
+	if o.backup_dir != "" {
+		defaultSuffix = ""
+	}
+	if o.backup_suffix != defaultSuffix {
+		// We use the following syntax to avoid weirdness with '~'.
+		sargv = append(sargv, "--suffix="+o.backup_suffix)
+	}
+
+	if o.Sender() {
+		switch {
+		case o.delete_before != 0:
+			sargv = append(sargv, "--delete-before")
+		case o.delete_during == 2:
+			sargv = append(sargv, "--delete-delay")
+		case o.delete_during != 0:
+			sargv = append(sargv, "--delete-during")
+		case o.delete_after != 0:
+			sargv = append(sargv, "--delete-after")
+		case o.delete_mode != 0 && o.delete_excluded == 0:
+			sargv = append(sargv, "--delete")
+		}
+		if o.delete_excluded != 0 {
+			sargv = append(sargv, "--delete-excluded")
+		}
+	}
 
 	// if (size_only)
 	// 	args[ac++] = "--size-only";
@@ -160,26 +230,40 @@ func (o *Options) ServerOptions() []string {
 	// 	args[ac++] = arg;
 	// }
 
-	// if (keep_partial)
-	// 	args[ac++] = "--partial";
+	if o.partial_dir != "" && o.Sender() {
+		sargv = append(sargv, "--partial-dir", o.partial_dir)
+	} else if o.keep_partial != 0 && o.Sender() {
+		sargv = append(sargv, "--partial")
+	}
 
 	// if (force_delete)
 	// 	args[ac++] = "--force";
 
-	// if (delete_after)
-	// 	args[ac++] = "--delete-after";
+	if o.ignore_errors != 0 {
+		sargv = append(sargv, "--ignore-errors")
+	}
 
-	// if (ignore_errors)
-	// 	args[ac++] = "--ignore-errors";
+	if o.copy_unsafe_links != 0 {
+		sargv = append(sargv, "--copy-unsafe-links")
+	}
 
-	// if (copy_unsafe_links)
-	// 	args[ac++] = "--copy-unsafe-links";
+	if o.safe_symlinks != 0 {
+		sargv = append(sargv, "--safe-links")
+	}
 
-	// if (safe_symlinks)
-	// 	args[ac++] = "--safe-links";
+	if o.numeric_ids != 0 {
+		sargv = append(sargv, "--numeric-ids")
+	}
 
-	// if (numeric_ids)
-	// 	args[ac++] = "--numeric-ids";
+	if o.Sender() {
+		// Only the receiver maps ids.
+		if o.usermap != "" {
+			sargv = append(sargv, "--usermap="+o.usermap)
+		}
+		if o.groupmap != "" {
+			sargv = append(sargv, "--groupmap="+o.groupmap)
+		}
+	}
 
 	// if (only_existing && am_sender)
 	// 	args[ac++] = "--existing";
@@ -192,26 +276,49 @@ func (o *Options) ServerOptions() []string {
 	// 	args[ac++] = tmpdir;
 	// }
 
-	// if (compare_dest && am_sender) {
-	// 	/* the server only needs this option if it is not the sender,
-	// 	 *   and it may be an older version that doesn't know this
-	// 	 *   option, so don't send it if client is the sender.
-	// 	 */
-	// 	args[ac++] = link_dest ? "--link-dest" : "--compare-dest";
-	// 	args[ac++] = compare_dest;
-	// }
+	if o.Sender() {
+		// The server only needs these options if it is not the sender.
+		for _, dir := range o.basis_dirs {
+			sargv = append(sargv, AltDestOption(o.alt_dest_type), dir)
+		}
+	}
 
-	// if (files_from && (!am_sender || remote_filesfrom_file)) {
-	// 	if (remote_filesfrom_file) {
-	// 		args[ac++] = "--files-from";
-	// 		args[ac++] = remote_filesfrom_file;
-	// 		if (eol_nulls)
-	// 			args[ac++] = "--from0";
-	// 	} else {
-	// 		args[ac++] = "--files-from=-";
-	// 		args[ac++] = "--from0";
-	// 	}
-	// }
+	if o.append_mode != 0 {
+		if o.append_mode > 1 {
+			sargv = append(sargv, "--append")
+		}
+		sargv = append(sargv, "--append")
+	} else if o.inplace != 0 {
+		sargv = append(sargv, "--inplace")
+	}
+
+	if o.preallocate_files != 0 && o.Sender() {
+		sargv = append(sargv, "--preallocate")
+	}
+
+	if o.checksum_choice != "" {
+		sargv = append(sargv, "--checksum-choice="+o.checksum_choice)
+	}
+
+	if o.Compress() && o.do_compression_level != math.MinInt32 {
+		sargv = append(sargv, fmt.Sprintf("--compress-level=%d", o.do_compression_level))
+	}
+
+	// Only the sender needs --skip-compress.
+	if o.skip_compress != "" && !o.Sender() {
+		sargv = append(sargv, "--skip-compress="+o.skip_compress)
+	}
+
+	if o.files_from != "" && (!o.Sender() || o.filesfrom_remote != 0) {
+		if o.filesfrom_remote != 0 {
+			sargv = append(sargv, "--files-from", o.files_from)
+			if o.eol_nulls != 0 {
+				sargv = append(sargv, "--from0")
+			}
+		} else {
+			sargv = append(sargv, "--files-from=-", "--from0")
+		}
+	}
 
 	return sargv
 }
@@ -6,12 +6,15 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"math/rand/v2"
 	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
 	"syscall"
@@ -205,6 +208,176 @@ func Run(tb testing.TB, args ...string) *rsyncstats.TransferStats {
 	return result.Stats
 }
 
+// UnrestrictedCommand returns a command for args which logs to tb and which
+// does not restrict the process with landlock: each restriction is stacked,
+// and the number of stacked rulesets is limited, so test binaries running
+// many transfers would eventually fail.
+func UnrestrictedCommand(tb testing.TB, args ...string) *rsynccmd.Cmd {
+	cmd := rsynccmd.Command(args[0], args[1:]...)
+	cmd.Stdout = testlogger.New(tb)
+	cmd.Stderr = testlogger.New(tb)
+	cmd.DontRestrict = true
+	return cmd
+}
+
+// RunUnrestricted is like Run, but does not restrict the process with landlock
+// (see UnrestrictedCommand) and returns the error instead of failing the test.
+func RunUnrestricted(tb testing.TB, args ...string) (*rsyncstats.TransferStats, error) {
+	result, err := UnrestrictedCommand(tb, args...).Run(tb.Context())
+	if err != nil {
+		return nil, err
+	}
+	return result.Stats, nil
+}
+
+// WriteFiles creates the files (by slash-separated name relative to dir, with
+// their content) and all required parent directories.
+func WriteFiles(tb testing.TB, dir string, files map[string]string) {
+	tb.Helper()
+	for name, content := range files {
+		fn := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			tb.Fatal(err)
+		}
+		if err := os.WriteFile(fn, []byte(content), 0644); err != nil {
+			tb.Fatal(err)
+		}
+	}
+}
+
+// Chtimes sets the access and modification times of the files fns to mtime.
+func Chtimes(tb testing.TB, mtime time.Time, fns ...string) {
+	tb.Helper()
+	for _, fn := range fns {
+		if err := os.Chtimes(fn, mtime, mtime); err != nil {
+			tb.Fatal(err)
+		}
+	}
+}
+
+// ListFiles returns the sorted names of all files below dir (directories are
+// implied by the file names).
+func ListFiles(tb testing.TB, dir string) []string {
+	tb.Helper()
+	var files []string
+	for rel := range ReadFiles(tb, dir) {
+		files = append(files, rel)
+	}
+	sort.Strings(files)
+	return files
+}
+
+// ReadFiles returns the contents of all files below dir, keyed by name.
+func ReadFiles(tb testing.TB, dir string) map[string]string {
+	tb.Helper()
+	files := make(map[string]string)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		files[rel] = string(b)
+		return nil
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return files
+}
+
+// CheckFile verifies that the file fn has the content want.
+func CheckFile(tb testing.TB, fn string, want []byte) {
+	tb.Helper()
+	got, err := os.ReadFile(fn)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		tb.Errorf("%s: unexpected content (%d bytes, want %d bytes)", fn, len(got), len(want))
+	}
+}
+
+// RandomBytes returns n bytes of (incompressible) content, which is the same
+// for each seed.
+func RandomBytes(seed uint64, n int) []byte {
+	b := make([]byte, n)
+	rnd := rand.New(rand.NewPCG(seed, seed))
+	for i := range b {
+		b[i] = byte(rnd.Uint32())
+	}
+	return b
+}
+
+// Transfer modes, see TransferArgs.
+const (
+	Local = "local"
+	Pull  = "pull"
+	Push  = "push"
+)
+
+// Modes are all transfer modes, RemoteModes are the modes which start a
+// server.
+var (
+	Modes       = []string{Local, Pull, Push}
+	RemoteModes = []string{Pull, Push}
+)
+
+// TransferArgs returns the source and destination arguments which sync the
+// directory source into the directory dest, either locally (Local), by pulling
+// from a server serving source (Pull) or by pushing to a server serving the
+// parent directory of dest (Push).
+func TransferArgs(t *testing.T, mode, source, dest string) (src, dst string) {
+	t.Helper()
+	src, dst = source+"/", dest+"/"
+	switch mode {
+	case Local:
+	case Pull:
+		// start a server to sync from
+		srv := New(t, InteropModule(source))
+		src = "rsync://localhost:" + srv.Port + "/interop/"
+	case Push:
+		// start a server to sync to
+		srv := New(t, WritableInteropModule(filepath.Dir(dest)))
+		dst = "rsync://localhost:" + srv.Port + "/interop/" + filepath.Base(dest) + "/"
+	default:
+		t.Fatalf("unknown transfer mode %q", mode)
+	}
+	return src, dst
+}
+
+// Transfer runs gokr-rsync with args to sync the directory source into the
+// directory dest (see TransferArgs), without restricting the process with
+// landlock (see UnrestrictedCommand).
+func Transfer(t *testing.T, mode, source, dest string, args ...string) (*rsyncstats.TransferStats, error) {
+	t.Helper()
+	src, dst := TransferArgs(t, mode, source, dest)
+	return RunUnrestricted(t, append(append([]string{"gokr-rsync"}, args...), src, dst)...)
+}
+
+// TransferOutput is like Transfer, but fails the test on error and returns the
+// lines which gokr-rsync printed to stdout.
+func TransferOutput(t *testing.T, mode, source, dest string, args ...string) []string {
+	t.Helper()
+	src, dst := TransferArgs(t, mode, source, dest)
+	var stdout strings.Builder
+	cmd := UnrestrictedCommand(t, append(append([]string{"gokr-rsync"}, args...), src, dst)...)
+	cmd.Stdout = &stdout
+	if _, err := cmd.Run(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(stdout.String(), "\n"), "\n")
+}
+
 func Output(tb testing.TB, args ...string) (stdout []byte, stderr []byte) {
 	tb.Helper()
 	var stdoutb, stderrb bytes.Buffer
@@ -0,0 +1,86 @@
+package rsyncwire
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// BwLimitWriter limits the bandwidth of writes to W to a rate in KiB/s, like
+// tridge rsync’s --bwlimit: bytes written accumulate as debt, which is paid
+// off by sleeping once it exceeds 1/10th of a second.
+//
+// rsync/io.c:sleep_for_bwlimit
+type BwLimitWriter struct {
+	W io.Writer
+
+	rate     int64 // KiB/s
+	writeMax int
+
+	mu           sync.Mutex
+	prior        time.Time
+	totalWritten int64
+}
+
+// NewBwLimitWriter returns a writer which limits writes to w to the specified
+// rate in KiB/s.
+func NewBwLimitWriter(w io.Writer, rate int) *BwLimitWriter {
+	// rsync/io.c:io_set_sock_fds: write at most 1/8th of a second worth of
+	// data at once so that the sleeps stay short.
+	writeMax := rate * 128
+	if writeMax < 512 {
+		writeMax = 512
+	}
+	return &BwLimitWriter{
+		W:        w,
+		rate:     int64(rate),
+		writeMax: writeMax,
+	}
+}
+
+func (w *BwLimitWriter) Write(p []byte) (n int, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > w.writeMax {
+			chunk = chunk[:w.writeMax]
+		}
+		written, err := w.W.Write(chunk)
+		n += written
+		w.sleep(written)
+		if err != nil {
+			return n, err
+		}
+		p = p[written:]
+	}
+	return n, nil
+}
+
+const oneSec = int64(time.Second / time.Microsecond)
+
+// sleep must be called with w.mu held.
+func (w *BwLimitWriter) sleep(bytesWritten int) {
+	w.totalWritten += int64(bytesWritten)
+
+	start := time.Now()
+	if !w.prior.IsZero() {
+		elapsed := start.Sub(w.prior).Microseconds()
+		w.totalWritten -= elapsed * w.rate / (oneSec / 1024)
+		if w.totalWritten < 0 {
+			w.totalWritten = 0
+		}
+	}
+
+	sleepUsec := w.totalWritten * (oneSec / 1024) / w.rate
+	if sleepUsec < oneSec/10 {
+		w.prior = start
+		return
+	}
+
+	time.Sleep(time.Duration(sleepUsec) * time.Microsecond)
+
+	w.prior = time.Now()
+	elapsed := w.prior.Sub(start).Microseconds()
+	w.totalWritten = (sleepUsec - elapsed) * w.rate / (oneSec / 1024)
+}
@@ -0,0 +1,355 @@
+package rsyncwire
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Protocol 30 introduced variable-length integer encodings: the number of
+// extra bytes which follow is encoded in the high bits of the first byte.
+//
+// rsync/io.c:int_byte_extra
+var intByteExtra = [64]byte{
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, // (00 - 3F)/4
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, // (40 - 7F)/4
+	1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, // (80 - BF)/4
+	2, 2, 2, 2, 2, 2, 2, 2, 3, 3, 3, 3, 4, 4, 5, 6, // (C0 - FF)/4
+}
+
+// rsync/io.c:write_varint
+func appendVarint(dst []byte, x int32) []byte {
+	var b [5]byte
+	binary.LittleEndian.PutUint32(b[1:], uint32(x))
+	cnt := 4
+	for cnt > 1 && b[cnt] == 0 {
+		cnt--
+	}
+	bit := byte(1) << (7 - cnt + 1)
+	if b[cnt] >= bit {
+		cnt++
+		b[0] = ^(bit - 1)
+	} else if cnt > 1 {
+		b[0] = b[cnt] | ^(bit*2 - 1)
+	} else {
+		b[0] = b[cnt]
+	}
+	return append(dst, b[:cnt]...)
+}
+
+// rsync/io.c:write_varlong
+func appendVarlong(dst []byte, x int64, minBytes int) []byte {
+	var b [9]byte
+	binary.LittleEndian.PutUint64(b[1:], uint64(x))
+	cnt := 8
+	for cnt > minBytes && b[cnt] == 0 {
+		cnt--
+	}
+	bit := byte(1) << (7 - cnt + minBytes)
+	if b[cnt] >= bit {
+		cnt++
+		b[0] = ^(bit - 1)
+	} else if cnt > minBytes {
+		b[0] = b[cnt] | ^(bit*2 - 1)
+	} else {
+		b[0] = b[cnt]
+	}
+	return append(dst, b[:cnt]...)
+}
+
+// rsync/io.c:write_longint
+func appendLongint(dst []byte, x int64) []byte {
+	// send as a 32-bit integer if possible
+	if x <= 0x7FFFFFFF && x >= 0 {
+		return binary.LittleEndian.AppendUint32(dst, uint32(x))
+	}
+	// otherwise, send -1 followed by the 64-bit integer
+	dst = binary.LittleEndian.AppendUint32(dst, 0xFFFFFFFF)
+	return binary.LittleEndian.AppendUint64(dst, uint64(x))
+}
+
+func (b *Buffer) WriteShortInt(data uint16) {
+	binary.Write(&b.buf, binary.LittleEndian, data)
+}
+
+func (b *Buffer) WriteVarint(data int32) {
+	b.buf.Write(appendVarint(nil, data))
+}
+
+func (b *Buffer) WriteVarlong(data int64, minBytes int) {
+	b.buf.Write(appendVarlong(nil, data, minBytes))
+}
+
+// WriteVarint30 writes data as varint for protocol 30 and newer, and as 32-bit
+// integer for older protocols.
+//
+// rsync/io.h:write_varint30
+func (b *Buffer) WriteVarint30(protocol int32, data int32) {
+	if protocol < 30 {
+		b.WriteInt32(data)
+		return
+	}
+	b.WriteVarint(data)
+}
+
+// WriteVarlong30 writes data as varlong for protocol 30 and newer, and as
+// longint for older protocols.
+//
+// rsync/io.h:write_varlong30
+func (b *Buffer) WriteVarlong30(protocol int32, data int64, minBytes int) {
+	if protocol < 30 {
+		b.WriteInt64(data)
+		return
+	}
+	b.WriteVarlong(data, minBytes)
+}
+
+func (c *Conn) WriteShortInt(data uint16) error {
+	return binary.Write(c.Writer, binary.LittleEndian, data)
+}
+
+func (c *Conn) WriteVarint(data int32) error {
+	_, err := c.Writer.Write(appendVarint(nil, data))
+	return err
+}
+
+func (c *Conn) WriteVarlong(data int64, minBytes int) error {
+	_, err := c.Writer.Write(appendVarlong(nil, data, minBytes))
+	return err
+}
+
+// rsync/io.h:write_varint30
+func (c *Conn) WriteVarint30(protocol int32, data int32) error {
+	if protocol < 30 {
+		return c.WriteInt32(data)
+	}
+	return c.WriteVarint(data)
+}
+
+// rsync/io.h:write_varlong30
+func (c *Conn) WriteVarlong30(protocol int32, data int64, minBytes int) error {
+	if protocol < 30 {
+		_, err := c.Writer.Write(appendLongint(nil, data))
+		return err
+	}
+	return c.WriteVarlong(data, minBytes)
+}
+
+func (c *Conn) ReadShortInt() (uint16, error) {
+	var buf [2]byte
+	if _, err := io.ReadFull(c.Reader, buf[:]); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint16(buf[:]), nil
+}
+
+// rsync/io.c:read_varint
+func (c *Conn) ReadVarint() (int32, error) {
+	ch, err := c.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	var b [5]byte
+	extra := int(intByteExtra[ch/4])
+	if extra > 0 {
+		bit := byte(1) << (8 - extra)
+		if extra >= len(b) {
+			return 0, fmt.Errorf("overflow in read_varint")
+		}
+		if _, err := io.ReadFull(c.Reader, b[:extra]); err != nil {
+			return 0, err
+		}
+		b[extra] = ch & (bit - 1)
+	} else {
+		b[0] = ch
+	}
+	return int32(binary.LittleEndian.Uint32(b[:4])), nil
+}
+
+// rsync/io.c:read_varlong
+func (c *Conn) ReadVarlong(minBytes int) (int64, error) {
+	var b2 [8]byte
+	if _, err := io.ReadFull(c.Reader, b2[:minBytes]); err != nil {
+		return 0, err
+	}
+	var b [9]byte
+	copy(b[:], b2[1:minBytes])
+	extra := int(intByteExtra[b2[0]/4])
+	if extra > 0 {
+		bit := byte(1) << (8 - extra)
+		if minBytes+extra > len(b) {
+			return 0, fmt.Errorf("overflow in read_varlong")
+		}
+		if _, err := io.ReadFull(c.Reader, b[minBytes-1:minBytes-1+extra]); err != nil {
+			return 0, err
+		}
+		b[minBytes+extra-1] = b2[0] & (bit - 1)
+	} else {
+		b[minBytes-1] = b2[0]
+	}
+	return int64(binary.LittleEndian.Uint64(b[:8])), nil
+}
+
+// rsync/io.h:read_varint30
+func (c *Conn) ReadVarint30(protocol int32) (int32, error) {
+	if protocol < 30 {
+		return c.ReadInt32()
+	}
+	return c.ReadVarint()
+}
+
+// rsync/io.h:read_varlong30
+func (c *Conn) ReadVarlong30(protocol int32, minBytes int) (int64, error) {
+	if protocol < 30 {
+		return c.ReadInt64()
+	}
+	return c.ReadVarlong(minBytes)
+}
+
+// WriteNdx writes a file list index. Protocol 30 and newer transmit the
+// difference to the previously sent index, which usually fits into one byte.
+//
+// rsync/io.c:write_ndx
+func (c *Conn) WriteNdx(protocol int32, ndx int32) error {
+	if protocol < 30 {
+		return c.WriteInt32(ndx)
+	}
+	// Send NDX_DONE as a single-byte 0 with no side effects. Send negative
+	// nums as a positive after sending a leading 0xFF.
+	b := make([]byte, 0, 6)
+	var diff int32
+	if ndx >= 0 {
+		diff = ndx - c.ndxOut.prevPositive()
+		c.ndxOut.positive = ndx + 1
+	} else if ndx == -1 { // NDX_DONE
+		return c.WriteByte(0)
+	} else {
+		b = append(b, 0xFF)
+		ndx = -ndx
+		diff = ndx - c.ndxOut.prevNegative()
+		c.ndxOut.negative = ndx
+	}
+	// A diff of 1 - 253 is sent as a one-byte diff; a diff of 254 - 32767 or
+	// 0 is sent as a 0xFE + a two-byte diff; otherwise we send 0xFE & all 4
+	// bytes of the (non-negative) num with the high-bit set.
+	switch {
+	case diff < 0xFE && diff > 0:
+		b = append(b, byte(diff))
+	case diff < 0 || diff > 0x7FFF:
+		b = append(b, 0xFE, byte(ndx>>24)|0x80, byte(ndx), byte(ndx>>8), byte(ndx>>16))
+	default:
+		b = append(b, 0xFE, byte(diff>>8), byte(diff))
+	}
+	_, err := c.Writer.Write(b)
+	return err
+}
+
+// ReadNdx reads a file list index written by WriteNdx.
+//
+// rsync/io.c:read_ndx
+func (c *Conn) ReadNdx(protocol int32) (int32, error) {
+	if protocol < 30 {
+		return c.ReadInt32()
+	}
+	var b [4]byte
+	if _, err := io.ReadFull(c.Reader, b[:1]); err != nil {
+		return 0, err
+	}
+	negative := false
+	if b[0] == 0xFF {
+		if _, err := io.ReadFull(c.Reader, b[:1]); err != nil {
+			return 0, err
+		}
+		negative = true
+	} else if b[0] == 0 {
+		return -1, nil // NDX_DONE
+	}
+	prev := c.ndxIn.prevPositive()
+	if negative {
+		prev = c.ndxIn.prevNegative()
+	}
+	var num int32
+	if b[0] == 0xFE {
+		if _, err := io.ReadFull(c.Reader, b[:2]); err != nil {
+			return 0, err
+		}
+		if b[0]&0x80 != 0 {
+			b[3] = b[0] &^ 0x80
+			b[0] = b[1]
+			if _, err := io.ReadFull(c.Reader, b[1:3]); err != nil {
+				return 0, err
+			}
+			num = int32(binary.LittleEndian.Uint32(b[:]))
+		} else {
+			num = int32(b[0])<<8 + int32(b[1]) + prev
+		}
+	} else {
+		num = int32(b[0]) + prev
+	}
+	if negative {
+		c.ndxIn.negative = num
+		return -num, nil
+	}
+	c.ndxIn.positive = num + 1
+	return num, nil
+}
+
+// ndxState holds the previously transferred file list indexes of one
+// direction. The zero value corresponds to the initial state of
+// rsync/io.c:write_ndx (prev_positive = -1, prev_negative = 1).
+type ndxState struct {
+	positive int32 // previous positive index + 1
+	negative int32 // previous negative index (0: none yet)
+}
+
+func (s *ndxState) prevPositive() int32 { return s.positive - 1 }
+
+func (s *ndxState) prevNegative() int32 {
+	if s.negative == 0 {
+		return 1
+	}
+	return s.negative
+}
+
+// WriteVstring writes a string of up to 0x7fff bytes, prefixed by its length
+// in one byte (or two bytes, if the length exceeds 0x7f).
+//
+// rsync/io.c:write_vstring
+func (b *Buffer) WriteVstring(data string) {
+	if len(data) > 0x7f {
+		b.WriteByte(byte(len(data)/0x100 + 0x80))
+	}
+	b.WriteByte(byte(len(data)))
+	b.WriteString(data)
+}
+
+// rsync/io.c:write_vstring
+func (c *Conn) WriteVstring(data string) error {
+	if len(data) > 0x7fff {
+		return fmt.Errorf("attempting to send over-long vstring (%d > %d)", len(data), 0x7fff)
+	}
+	var b Buffer
+	b.WriteVstring(data)
+	return c.WriteString(b.String())
+}
+
+// rsync/io.c:read_vstring
+func (c *Conn) ReadVstring() (string, error) {
+	l, err := c.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	length := int(l)
+	if length&0x80 != 0 {
+		lo, err := c.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		length = (length&^0x80)*0x100 + int(lo)
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(c.Reader, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
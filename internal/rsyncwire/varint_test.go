@@ -0,0 +1,172 @@
+package rsyncwire_test
+
+import (
+	"bytes"
+	"math"
+	"testing"
+
+	"github.com/gokrazy/rsync/internal/rsyncwire"
+)
+
+func TestVarint(t *testing.T) {
+	for _, tt := range []struct {
+		val  int32
+		want []byte
+	}{
+		{0, []byte{0x00}},
+		{1, []byte{0x01}},
+		{127, []byte{0x7f}},
+		{128, []byte{0x80, 0x80}},
+		{0x3fff, []byte{0xbf, 0xff}},
+		{0x4000, []byte{0xc0, 0x00, 0x40}},
+		{1000000, []byte{0xcf, 0x40, 0x42}},
+		{-1, []byte{0xf0, 0xff, 0xff, 0xff, 0xff}},
+		{math.MaxInt32, []byte{0xf0, 0xff, 0xff, 0xff, 0x7f}},
+	} {
+		var buf bytes.Buffer
+		c := &rsyncwire.Conn{Writer: &buf, Reader: &buf}
+		if err := c.WriteVarint(tt.val); err != nil {
+			t.Fatal(err)
+		}
+		if got := buf.Bytes(); !bytes.Equal(got, tt.want) {
+			t.Errorf("WriteVarint(%d) = %x, want %x", tt.val, got, tt.want)
+		}
+		got, err := c.ReadVarint()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.val {
+			t.Errorf("ReadVarint() = %d, want %d", got, tt.val)
+		}
+	}
+}
+
+func TestVarlong(t *testing.T) {
+	for _, tt := range []struct {
+		val      int64
+		minBytes int
+		want     []byte
+	}{
+		{0, 3, []byte{0x00, 0x00, 0x00}},
+		{0x12345678, 4, []byte{0x12, 0x78, 0x56, 0x34}},
+		{0x812345678, 4, []byte{0x88, 0x78, 0x56, 0x34, 0x12}},
+		{1 << 40, 3, []byte{0xe1, 0x00, 0x00, 0x00, 0x00, 0x00}},
+		{-1, 3, []byte{0xfc, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{math.MaxInt64, 4, []byte{0xf8, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f}},
+	} {
+		var buf bytes.Buffer
+		c := &rsyncwire.Conn{Writer: &buf, Reader: &buf}
+		if err := c.WriteVarlong(tt.val, tt.minBytes); err != nil {
+			t.Fatal(err)
+		}
+		if got := buf.Bytes(); !bytes.Equal(got, tt.want) {
+			t.Errorf("WriteVarlong(%d, %d) = %x, want %x", tt.val, tt.minBytes, got, tt.want)
+		}
+		got, err := c.ReadVarlong(tt.minBytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.val {
+			t.Errorf("ReadVarlong(%d) = %d, want %d", tt.minBytes, got, tt.val)
+		}
+	}
+}
+
+func TestVarint30(t *testing.T) {
+	for _, protocol := range []int32{27, 29, 30} {
+		var buf bytes.Buffer
+		c := &rsyncwire.Conn{Writer: &buf, Reader: &buf}
+		var b rsyncwire.Buffer
+		b.WriteVarint30(protocol, 4711)
+		b.WriteVarlong30(protocol, 1<<33, 3)
+		if err := c.WriteString(b.String()); err != nil {
+			t.Fatal(err)
+		}
+		i, err := c.ReadVarint30(protocol)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l, err := c.ReadVarlong30(protocol, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i != 4711 || l != 1<<33 {
+			t.Errorf("protocol %d: got %d, %d, want 4711, %d", protocol, i, l, int64(1<<33))
+		}
+		if buf.Len() != 0 {
+			t.Errorf("protocol %d: %d bytes left over", protocol, buf.Len())
+		}
+	}
+}
+
+func TestNdx(t *testing.T) {
+	ndxs := []int32{0, 1, 2, 5, 300, 299, 100000, -101, -1, -102, 7, -2, -1}
+	var buf bytes.Buffer
+	w := &rsyncwire.Conn{Writer: &buf}
+	for _, ndx := range ndxs {
+		if err := w.WriteNdx(30, ndx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []byte{
+		0x01,             // 0
+		0x01,             // 1
+		0x01,             // 2
+		0x03,             // 5
+		0xfe, 0x01, 0x27, // 300
+		0xfe, 0x80, 0x2b, 0x01, 0x00, // 299
+		0xfe, 0x80, 0xa0, 0x86, 0x01, // 100000
+		0xff, 0x64, // -101
+		0x00,       // -1 (NDX_DONE)
+		0xff, 0x01, // -102
+		0xfe, 0x80, 0x07, 0x00, 0x00, // 7
+		0xff, 0xfe, 0x80, 0x02, 0x00, 0x00, // -2
+		0x00, // -1 (NDX_DONE)
+	}
+	if got := buf.Bytes(); !bytes.Equal(got, want) {
+		t.Errorf("WriteNdx: got %x, want %x", got, want)
+	}
+	r := &rsyncwire.Conn{Reader: &buf}
+	for _, want := range ndxs {
+		got, err := r.ReadNdx(30)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("ReadNdx() = %d, want %d", got, want)
+		}
+	}
+}
+
+func TestVstring(t *testing.T) {
+	for _, tt := range []struct {
+		val     string
+		wantLen []byte
+	}{
+		{"", []byte{0x00}},
+		{"xxh128 xxh3 xxh64 md5 md4", []byte{0x19}},
+		{string(make([]byte, 0x80)), []byte{0x80, 0x80}},
+		{string(make([]byte, 0x7fff)), []byte{0xff, 0xff}},
+	} {
+		var buf bytes.Buffer
+		c := &rsyncwire.Conn{Writer: &buf, Reader: &buf}
+		if err := c.WriteVstring(tt.val); err != nil {
+			t.Fatal(err)
+		}
+		if got := buf.Bytes()[:len(tt.wantLen)]; !bytes.Equal(got, tt.wantLen) {
+			t.Errorf("WriteVstring(len %d): length prefix = %x, want %x", len(tt.val), got, tt.wantLen)
+		}
+		got, err := c.ReadVstring()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.val {
+			t.Errorf("ReadVstring() = %q, want %q", got, tt.val)
+		}
+	}
+
+	c := &rsyncwire.Conn{Writer: &bytes.Buffer{}}
+	if err := c.WriteVstring(string(make([]byte, 0x8000))); err == nil {
+		t.Errorf("WriteVstring(len 0x8000) unexpectedly succeeded")
+	}
+}
@@ -9,10 +9,19 @@ import (
 	"github.com/gokrazy/rsync/internal/rsyncos"
 )
 
+// Multiplexed message tags.
+//
+// rsync/rsync.h:enum msgcode
 const (
-	MsgData  uint8 = 0
-	MsgInfo  uint8 = 2
-	MsgError uint8 = 1
+	MsgData     uint8 = 0   // raw data on the multiplexed stream
+	MsgError    uint8 = 1   // MSG_ERROR_XFER
+	MsgInfo     uint8 = 2   // remote logging
+	MsgErrorLog uint8 = 3   // MSG_ERROR: protocol-30 remote logging
+	MsgWarning  uint8 = 4   // protocol-30 remote logging
+	MsgIOError  uint8 = 22  // the sending side had an I/O error
+	MsgNoop     uint8 = 42  // a do-nothing message (legacy protocol-30 only)
+	MsgDeleted  uint8 = 101 // successfully deleted a file on receiving side
+	MsgNoSend   uint8 = 102 // sender failed to open a file we wanted
 )
 
 const mplexBase = 7
@@ -38,6 +47,15 @@ func (w *MultiplexWriter) WriteMsg(tag uint8, p []byte) (n int, err error) {
 type MultiplexReader struct {
 	Env    *rsyncos.Env
 	Reader io.Reader
+
+	// IOError, if non-nil, is called with the flags of each MSG_IO_ERROR
+	// message, which protocol 30 senders use to report I/O errors.
+	IOError func(flags int32)
+
+	// Deleted, if non-nil, is called with the name of each MSG_DELETED
+	// message, which protocol 29 receivers use to report deletions to the
+	// client for logging.
+	Deleted func(name string, isDir bool)
 }
 
 // rsync.h defines IO_BUFFER_SIZE as 32 * 1024, but gokr-rsyncd increases it to
@@ -70,26 +88,55 @@ func (w *MultiplexReader) ReadMsg() (tag uint8, p []byte, err error) {
 }
 
 func (w *MultiplexReader) Read(p []byte) (n int, err error) {
-	tag, payload, err := w.ReadMsg()
-	if err != nil {
-		return 0, err
-	}
-	switch tag {
-	case MsgError:
-		return 0, fmt.Errorf("%s", payload)
-	case MsgInfo:
-		w.Env.Logf("info: %s", payload)
-		// io.ReadFull will call Read again
-		return 0, nil
-	case MsgData:
-		// continues below
-	default:
-		return 0, fmt.Errorf("unexpected tag: got %v, want %v", tag, MsgData)
-	}
-	if len(p) < len(payload) {
-		panic(fmt.Sprintf("not enough buffer space! %d < %d", len(p), len(payload)))
+	for {
+		tag, payload, err := w.ReadMsg()
+		if err != nil {
+			return 0, err
+		}
+		switch tag {
+		case MsgError:
+			return 0, fmt.Errorf("%s", payload)
+		case MsgInfo:
+			w.Env.Logf("info: %s", payload)
+			continue
+		case MsgErrorLog:
+			w.Env.Logf("error: %s", payload)
+			continue
+		case MsgWarning:
+			w.Env.Logf("warning: %s", payload)
+			continue
+		case MsgIOError:
+			if len(payload) != 4 {
+				return 0, fmt.Errorf("invalid MSG_IO_ERROR length: %d", len(payload))
+			}
+			if w.IOError != nil {
+				w.IOError(int32(binary.LittleEndian.Uint32(payload)))
+			}
+			continue
+		case MsgDeleted:
+			if w.Deleted != nil {
+				// Directory names are sent with a trailing NUL.
+				name, isDir := bytes.CutSuffix(payload, []byte{0})
+				w.Deleted(string(name), isDir)
+			}
+			continue
+		case MsgNoop, MsgNoSend:
+			// The receiver notices missing files by their absence from the
+			// data stream.
+			continue
+		case MsgData:
+			// continues below
+		default:
+			return 0, fmt.Errorf("unexpected tag: got %v, want %v", tag, MsgData)
+		}
+		if len(payload) == 0 {
+			continue
+		}
+		if len(p) < len(payload) {
+			panic(fmt.Sprintf("not enough buffer space! %d < %d", len(p), len(payload)))
+		}
+		return copy(p, payload), nil
 	}
-	return copy(p, payload), nil
 }
 
 type Buffer struct {
@@ -97,8 +144,8 @@ type Buffer struct {
 	buf bytes.Buffer
 }
 
-func (b *Buffer) WriteByte(data byte) {
-	binary.Write(&b.buf, binary.LittleEndian, data)
+func (b *Buffer) WriteByte(data byte) error {
+	return b.buf.WriteByte(data)
 }
 
 func (b *Buffer) WriteInt32(data int32) {
@@ -131,6 +178,9 @@ func (b *Buffer) Reset() {
 type Conn struct {
 	Writer io.Writer
 	Reader io.Reader
+
+	// state of the file list index delta encoding (protocol >= 30)
+	ndxIn, ndxOut ndxState
 }
 
 func (c *Conn) WriteByte(data byte) error {
@@ -158,6 +208,31 @@ func (c *Conn) WriteString(data string) error {
 	return err
 }
 
+type msgWriter interface {
+	WriteMsg(tag uint8, p []byte) (n int, err error)
+}
+
+// WriteMsg sends a message other than data (e.g. MsgIOError) on a
+// multiplexed connection.
+func (c *Conn) WriteMsg(tag uint8, p []byte) error {
+	mw, ok := c.Writer.(msgWriter)
+	if !ok {
+		return fmt.Errorf("BUG: cannot send message %d: connection is not multiplexed", tag)
+	}
+	_, err := mw.WriteMsg(tag, p)
+	return err
+}
+
+// WriteMsgInt32 sends a message with a 4-byte integer payload, like
+// MSG_IO_ERROR or MSG_NO_SEND.
+//
+// rsync/io.c:send_msg_int
+func (c *Conn) WriteMsgInt32(tag uint8, data int32) error {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], uint32(data))
+	return c.WriteMsg(tag, buf[:])
+}
+
 func (c *Conn) ReadByte() (byte, error) {
 	var buf [1]byte
 	if _, err := io.ReadFull(c.Reader, buf[:]); err != nil {
@@ -216,6 +291,16 @@ func (w *CountingWriter) Write(p []byte) (n int, err error) {
 	return n, err
 }
 
+func (w *CountingWriter) WriteMsg(tag uint8, p []byte) (n int, err error) {
+	mw, ok := w.W.(msgWriter)
+	if !ok {
+		return 0, fmt.Errorf("BUG: cannot send message %d: connection is not multiplexed", tag)
+	}
+	n, err = mw.WriteMsg(tag, p)
+	w.BytesWritten += int64(n)
+	return n, err
+}
+
 func CounterPair(r io.Reader, w io.Writer) (*CountingReader, *CountingWriter) {
 	crd := &CountingReader{R: r}
 	cwr := &CountingWriter{W: w}
@@ -0,0 +1,167 @@
+package sender
+
+import (
+	"fmt"
+	"io/fs"
+	"strings"
+
+	"github.com/gokrazy/rsync"
+	"github.com/gokrazy/rsync/internal/rsynccommon"
+)
+
+// getACLs returns the access ACL of the file path with mode (nil for
+// symlinks, which have none), condensed for sending, and the default ACL of
+// directories (nil for other files).
+//
+// rsync/acls.c:get_acl
+func (s *scopedWalker) getACLs(path string, mode fs.FileMode) (access, def *rsynccommon.ACL, _ error) {
+	opts := s.st.Opts // for convenience
+	switch {
+	case mode&fs.ModeSymlink != 0:
+		return nil, nil, nil
+	case mode&(fs.ModeNamedPipe|fs.ModeSocket) != 0 && !opts.PreserveSpecials(),
+		mode&fs.ModeDevice != 0 && !opts.PreserveDevices():
+		return rsynccommon.EmptyACL(), nil, nil
+	}
+	xattrs, err := s.source.Xattrs(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	perm := uint32(mode.Perm())
+	if value, ok := xattrs[rsynccommon.ACLAccessXattr]; ok {
+		access, err = rsynccommon.ParsePosixACL(value)
+		if err != nil {
+			return nil, nil, fmt.Errorf("get_acl: %s: %v", path, err)
+		}
+	} else {
+		// Without an ACL, the permission bits are the ACL.
+		access = rsynccommon.FakeACL(perm)
+	}
+	// Avoid sending values that can be inferred from other data.
+	access.StripPerms(perm)
+	if !mode.IsDir() {
+		return access, nil, nil
+	}
+	def = rsynccommon.EmptyACL()
+	if value, ok := xattrs[rsynccommon.ACLDefaultXattr]; ok {
+		def, err = rsynccommon.ParsePosixACL(value)
+		if err != nil {
+			return nil, nil, fmt.Errorf("get_acl: %s: %v", path, err)
+		}
+	}
+	return access, def, nil
+}
+
+// aclKey identifies the entries of acl, see Transfer.accessACLIndex.
+func aclKey(acl *rsynccommon.ACL) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d %d %d %d", acl.UserObj, acl.GroupObj, acl.MaskObj, acl.OtherObj)
+	for _, n := range acl.Names {
+		fmt.Fprintf(&b, " %t:%d:%d", n.IsUser, n.ID, n.Access)
+	}
+	return b.String()
+}
+
+// encodeACLs encodes the access ACL and (for directories) the default ACL of
+// a file list entry into s.fec.
+//
+// rsync/acls.c:send_acl
+func (s *scopedWalker) encodeACLs(access, def *rsynccommon.ACL) {
+	s.encodeACL(access, &s.st.accessACLIndex)
+	if def != nil {
+		s.encodeACL(def, &s.st.defaultACLIndex)
+	}
+}
+
+// encodeACL encodes acl into s.fec: an index into the ACLs (of the same type)
+// sent so far if the same ACL was sent before, the ACL itself otherwise.
+//
+// rsync/acls.c:send_rsync_acl
+func (s *scopedWalker) encodeACL(acl *rsynccommon.ACL, index *map[string]int32) {
+	key := aclKey(acl)
+	if ndx, ok := (*index)[key]; ok {
+		s.fec.WriteVarint(ndx + 1)
+		return
+	}
+	if *index == nil {
+		*index = make(map[string]int32)
+	}
+	(*index)[key] = int32(len(*index))
+
+	s.fec.WriteVarint(0) // literal ACL data follows
+	var flags byte
+	if acl.UserObj != rsynccommon.NoACLEntry {
+		flags |= rsync.XMIT_USER_OBJ
+	}
+	if acl.GroupObj != rsynccommon.NoACLEntry {
+		flags |= rsync.XMIT_GROUP_OBJ
+	}
+	if acl.MaskObj != rsynccommon.NoACLEntry {
+		flags |= rsync.XMIT_MASK_OBJ
+	}
+	if acl.OtherObj != rsynccommon.NoACLEntry {
+		flags |= rsync.XMIT_OTHER_OBJ
+	}
+	if len(acl.Names) > 0 {
+		flags |= rsync.XMIT_NAME_LIST
+	}
+	s.fec.WriteByte(flags)
+	if flags&rsync.XMIT_USER_OBJ != 0 {
+		s.fec.WriteVarint(int32(acl.UserObj))
+	}
+	if flags&rsync.XMIT_GROUP_OBJ != 0 {
+		s.fec.WriteVarint(int32(acl.GroupObj))
+	}
+	if flags&rsync.XMIT_MASK_OBJ != 0 {
+		s.fec.WriteVarint(int32(acl.MaskObj))
+	}
+	if flags&rsync.XMIT_OTHER_OBJ != 0 {
+		s.fec.WriteVarint(int32(acl.OtherObj))
+	}
+	if flags&rsync.XMIT_NAME_LIST != 0 {
+		s.encodeACLNames(acl.Names)
+	}
+}
+
+// encodeACLNames encodes the named entries of an ACL into s.fec. Their ids are
+// added to the uid and gid lists, or, with incremental recursion, followed by
+// their names on first use.
+//
+// rsync/acls.c:send_ida_entries
+func (s *scopedWalker) encodeACLNames(names []rsynccommon.ACLName) {
+	s.fec.WriteVarint(int32(len(names)))
+	for _, n := range names {
+		// The permissions are shifted to make room for the flags.
+		xbits := uint32(n.Access) << 2
+		var name string
+		var added bool
+		if n.IsUser {
+			xbits |= rsync.XFLAG_NAME_IS_USER
+			name, added = s.addUid(int32(n.ID))
+		} else {
+			name, added = s.addGid(int32(n.ID))
+		}
+		s.fec.WriteVarint(int32(n.ID))
+		if added && s.st.incRecurse() {
+			s.fec.WriteVarint(int32(xbits | rsync.XFLAG_NAME_FOLLOWS))
+			s.fec.WriteByte(byte(len(name)))
+			s.fec.WriteString(name)
+		} else {
+			s.fec.WriteVarint(int32(xbits))
+		}
+	}
+}
+
+// sendsIdLists reports whether the uid and gid lists follow the file list,
+// which also contain the ids of named ACL entries. With incremental
+// recursion, names are sent along with the file list entries instead (see
+// XMIT_USER_NAME_FOLLOWS), and with --numeric-ids, no names are sent.
+//
+// rsync/uidlist.c:send_id_lists
+func (st *Transfer) sendsIdLists() (uids, gids bool) {
+	if st.incRecurse() || st.Opts.NumericIds() {
+		return false, false
+	}
+	return st.Opts.PreserveUid() || st.Opts.PreserveACLs(),
+		st.Opts.PreserveGid() || st.Opts.PreserveACLs()
+}
@@ -2,51 +2,63 @@ package sender
 
 import (
 	"fmt"
-	"sort"
+	"time"
 
+	"github.com/gokrazy/rsync"
+	"github.com/gokrazy/rsync/internal/filter"
+	"github.com/gokrazy/rsync/internal/rsynccommon"
 	"github.com/gokrazy/rsync/internal/rsyncopts"
 	"github.com/gokrazy/rsync/internal/rsyncstats"
 	"github.com/gokrazy/rsync/internal/rsyncwire"
 )
 
 // rsync/main.c:handle_stats
-func (st *Transfer) handleStats(crd *rsyncwire.CountingReader, cwr *rsyncwire.CountingWriter, fileList *fileList) error {
+func (st *Transfer) handleStats(crd *rsyncwire.CountingReader, cwr *rsyncwire.CountingWriter, totalSize int64, flistBuildtime time.Duration) error {
 	if !st.Opts.Server() || !st.Opts.Sender() {
 		return nil
 	}
 
 	// send statistics:
 	// total bytes read (from network connection)
-	if err := st.Conn.WriteInt64(crd.BytesRead); err != nil {
+	if err := st.Conn.WriteVarlong30(st.Protocol, crd.BytesRead, 3); err != nil {
 		return err
 	}
 	// total bytes written (to network connection)
-	if err := st.Conn.WriteInt64(cwr.BytesWritten); err != nil {
+	if err := st.Conn.WriteVarlong30(st.Protocol, cwr.BytesWritten, 3); err != nil {
 		return err
 	}
 	// total size of files
-	if err := st.Conn.WriteInt64(fileList.TotalSize); err != nil {
+	if err := st.Conn.WriteVarlong30(st.Protocol, totalSize, 3); err != nil {
 		return err
 	}
+	if st.Protocol >= 29 {
+		// file list generation time (in milliseconds)
+		if err := st.Conn.WriteVarlong30(st.Protocol, flistBuildtime.Milliseconds(), 3); err != nil {
+			return err
+		}
+		// file list transfer time: our file list is sent while it is
+		// generated, so there is no separate transfer time.
+		if err := st.Conn.WriteVarlong30(st.Protocol, 0, 3); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
 // rsync/main.c:client_run am_sender
-func (st *Transfer) Do(crd *rsyncwire.CountingReader, cwr *rsyncwire.CountingWriter, modPath string, paths []string, exclusionList *filterRuleList) (*rsyncstats.TransferStats, error) {
-	if exclusionList == nil {
-		exclusionList = &filterRuleList{}
-	}
-
+func (st *Transfer) Do(crd *rsyncwire.CountingReader, cwr *rsyncwire.CountingWriter, modPath string, paths []string, exclusionList *filter.List) (*rsyncstats.TransferStats, error) {
 	// “Update exchange” as per
 	// https://github.com/kristapsdz/openrsync/blob/master/rsync.5
 
 	// send file list
 	st.Logger.Printf("SendFileList(modPath=%q, paths=%q)", modPath, paths)
+	flistStart := time.Now()
 	fileList, err := st.SendFileList(modPath, paths, exclusionList)
 	if err != nil {
 		return nil, err
 	}
 	defer fileList.Close()
+	flistBuildtime := time.Since(flistStart)
 
 	if st.Opts.DebugGTE(rsyncopts.DEBUG_FLIST, 3) {
 		st.Logger.Printf("file list sent")
@@ -55,33 +67,44 @@ func (st *Transfer) Do(crd *rsyncwire.CountingReader, cwr *rsyncwire.CountingWri
 	// Sort the file list. The client sorts, so we need to sort, too (in the
 	// same way!), otherwise our indices do not match what the client will
 	// request.
-	sort.Slice(fileList.Files, func(i, j int) bool {
-		return fileList.Files[i].Wpath < fileList.Files[j].Wpath
-	})
+	sortFileList(fileList)
+	st.flists = append(st.flists[:0], fileList)
+	if st.incRecurse() {
+		st.addDirsToTree(fileList)
+	}
 
-	if err := st.SendFiles(fileList); err != nil {
+	if err := st.SendFiles(); err != nil {
 		return nil, err
 	}
 
-	if err := st.handleStats(crd, cwr, fileList); err != nil {
+	totalSize := fileList.TotalSize + st.extraSize
+	if err := st.handleStats(crd, cwr, totalSize, flistBuildtime); err != nil {
 		return nil, err
 	}
 
 	if st.Opts.DebugGTE(rsyncopts.DEBUG_PROTO, 1) {
-		st.Logger.Printf("reading final int32")
+		st.Logger.Printf("reading final goodbye")
 	}
 
-	finish, err := st.Conn.ReadInt32()
+	// rsync/main.c:read_final_goodbye
+	finish, _, err := rsynccommon.ReadNdxAndAttrs(st.Conn, st.Protocol)
 	if err != nil {
 		return nil, err
 	}
-	if finish != -1 {
-		return nil, fmt.Errorf("protocol error: expected final -1, got %d", finish)
+	if finish != rsync.NDX_DONE {
+		return nil, fmt.Errorf("protocol error: expected final NDX_DONE, got %d", finish)
+	}
+	if st.Protocol >= 31 {
+		// Protocol 31 echoes the goodbye, so that the receiver knows that
+		// the sender has received everything.
+		if err := st.Conn.WriteNdx(st.Protocol, rsync.NDX_DONE); err != nil {
+			return nil, err
+		}
 	}
 
 	return &rsyncstats.TransferStats{
 		Read:    crd.BytesRead,
 		Written: cwr.BytesWritten,
-		Size:    fileList.TotalSize,
+		Size:    totalSize,
 	}, nil
 }
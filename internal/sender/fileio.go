@@ -16,6 +16,10 @@ type mapStruct struct {
 	defWindowSize int64 // default window size
 	f             File  // file handle (fs.File + io.Seeker)
 	err           error // first read error
+
+	// skipHoles zero-fills holes (see nextData) instead of reading them
+	// (--sparse).
+	skipHoles bool
 }
 
 const alignBoundary = 1024
@@ -64,6 +68,12 @@ func (ms *mapStruct) ptr(offset int64, l int32) ([]byte, error) {
 	}
 	if windowSize < len+alignFudge {
 		windowSize = alignedLength(len + alignFudge)
+		// Unlike rsync/fileio.c:map_ptr, do not read beyond the end of the
+		// file: the default window can be smaller than the literal data
+		// which hashSearch accumulates (chunkSize is larger than in rsync).
+		if end := ms.fileSize - windowStart; end >= len+alignFudge {
+			windowSize = min(windowSize, end)
+		}
 	}
 	if windowSize > ms.pSize {
 		win := make([]byte, windowSize)
@@ -97,12 +107,27 @@ func (ms *mapStruct) ptr(offset int64, l int32) ([]byte, error) {
 	ms.pLen = windowSize
 	//log.Printf("-> reading %d bytes from %d into buffer at offset=%d", readSize, readStart, readOffset)
 	for readSize > 0 {
+		if ms.skipHoles {
+			next, ok := nextData(ms.f, ms.pFdOffset)
+			if !ok {
+				ms.skipHoles = false
+			} else if next > ms.pFdOffset {
+				hole := min(next-ms.pFdOffset, readSize)
+				clear(ms.window[readOffset : readOffset+hole])
+				ms.pFdOffset += hole
+				readOffset += hole
+				readSize -= hole
+				if _, err := ms.f.Seek(ms.pFdOffset, io.SeekStart); err != nil {
+					return nil, fmt.Errorf("seek error: %v", err)
+				}
+				continue
+			}
+		}
 		n, err := ms.f.Read(ms.window[readOffset : readOffset+readSize])
 		if err != nil {
 			ms.err = err
 			// TODO: zero the buffer, file has changed mid-transfer
 			return nil, fmt.Errorf("file has changed mid-transfer")
-			break
 		}
 		ms.pFdOffset += int64(n)
 		readOffset += int64(n)
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin
+
+package sender
+
+import "io"
+
+func nextData(io.Seeker, int64) (next int64, ok bool) {
+	return 0, false
+}
@@ -0,0 +1,26 @@
+//go:build linux || darwin
+
+package sender
+
+import (
+	"errors"
+	"io"
+	"math"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// nextData returns the offset of the first data at or after offset in f, or
+// math.MaxInt64 if only a hole follows. ok is false if f cannot report holes.
+// nextData moves the file offset of f.
+func nextData(f io.Seeker, offset int64) (next int64, ok bool) {
+	next, err := f.Seek(offset, unix.SEEK_DATA)
+	if err != nil {
+		if errors.Is(err, syscall.ENXIO) {
+			return math.MaxInt64, true
+		}
+		return 0, false
+	}
+	return next, true
+}
@@ -0,0 +1,182 @@
+package sender
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ReadFilesFrom reads the names of a --files-from list from r.
+//
+// When remote is true, r is the connection to the remote side, which forwards
+// the list as NUL-terminated names and marks the end of the list with an empty
+// name. Otherwise, r is a local file, in which names are terminated by
+// newlines (or NUL bytes if eolNulls is true), empty lines are skipped and
+// lines starting with ‘#’ or ‘;’ are comments.
+//
+// The returned names are cleaned and relative to the transfer directory.
+//
+// rsync/io.c:read_line
+func ReadFilesFrom(r io.Reader, eolNulls, remote bool) ([]string, error) {
+	if remote {
+		eolNulls = true
+	}
+	br, ok := r.(io.ByteReader)
+	if !ok && !remote {
+		// When reading from the connection, we must not read past the end
+		// of the list, so only buffer local files.
+		br = bufio.NewReader(r)
+	}
+	if br == nil {
+		br = &byteReader{r: r}
+	}
+	var names []string
+	var line []byte
+	for {
+		ch, err := br.ReadByte()
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		eof := err == io.EOF
+		if eof && remote {
+			return nil, fmt.Errorf("reading files-from list: %v", io.ErrUnexpectedEOF)
+		}
+		eol := ch == '\n' || ch == '\r'
+		if eolNulls {
+			eol = ch == 0
+		}
+		if !eof && !eol {
+			line = append(line, ch)
+			continue
+		}
+		if remote && len(line) == 0 {
+			return names, nil // end of list
+		}
+		if len(line) > 0 && (remote || (line[0] != '#' && line[0] != ';')) {
+			names = append(names, cleanFilesFromName(string(line)))
+		}
+		line = line[:0]
+		if eof {
+			return names, nil
+		}
+	}
+}
+
+// cleanFilesFromName turns name into a path relative to the transfer
+// directory, which never refers to anything outside of it.
+//
+// rsync/util1.c:clean_fname
+func cleanFilesFromName(name string) string {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name == "" {
+		return "."
+	}
+	return name
+}
+
+type byteReader struct {
+	r   io.Reader
+	buf [1]byte
+}
+
+func (b *byteReader) ReadByte() (byte, error) {
+	if _, err := io.ReadFull(b.r, b.buf[:]); err != nil {
+		return 0, err
+	}
+	return b.buf[0], nil
+}
+
+// openFilesFromDir sets up s.source to refer to the requested directory,
+// which all names of the --files-from list are relative to.
+func (s *scopedWalker) openFilesFromDir() error {
+	dir := strings.TrimPrefix(path.Clean("/"+s.requested), "/")
+	if s.source != nil {
+		if dir == "" {
+			return nil
+		}
+		sub, err := subFSSource(s.source, dir)
+		if err != nil {
+			return err
+		}
+		s.source = sub
+		return nil
+	}
+	if s.local {
+		// The client sends local paths, which need no confinement.
+		source, err := s.openDir(s.requested)
+		if err != nil {
+			return err
+		}
+		s.source = source
+		s.fileList.Sources = append(s.fileList.Sources, s.source)
+		return nil
+	}
+	root, err := os.OpenRoot(s.localDir)
+	if err == nil && dir != "" {
+		var sub *os.Root
+		sub, err = root.OpenRoot(filepath.FromSlash(dir))
+		root.Close()
+		root = sub
+	}
+	if err != nil {
+		return err
+	}
+	s.source = newOSRootSource(root)
+	s.fileList.Sources = append(s.fileList.Sources, s.source)
+	return nil
+}
+
+// walkFilesFrom adds the names of the --files-from list (and their implied
+// parent directories) to the file list. Directories are only recursed into
+// with --recursive.
+//
+// rsync/flist.c:send_file_list (filesfrom_fd != -1)
+func (s *scopedWalker) walkFilesFrom(names []string) error {
+	if err := s.openFilesFromDir(); err != nil {
+		s.st.Logger.Printf("  open files-from directory %q: %v", s.requested, err)
+		s.ioError(err)
+		return nil
+	}
+
+	open := func(name string) (io.ReadCloser, error) {
+		return s.source.Open(name)
+	}
+	s.filters = s.excl.NewScope(open, s.filterRoot, s.filterRoot)
+	defer s.filters.Close()
+	if err := s.filters.EnterDir("."); err != nil {
+		return err
+	}
+
+	s.sent = make(map[string]bool)
+	s.impliedDirs = make(map[string]bool)
+	for _, name := range names {
+		// rsync/flist.c:send_implied_dirs
+		for idx := strings.IndexByte(name, '/'); idx > -1; {
+			dir := name[:idx]
+			s.impliedDirs[dir] = true
+			info, err := fs.Lstat(s.source.FS(), dir)
+			if err != nil {
+				s.ioError(err)
+				break
+			}
+			if err := s.walkFn(dir, fs.FileInfoToDirEntry(info), nil); err != nil && err != filepath.SkipDir {
+				return err
+			}
+			next := strings.IndexByte(name[idx+1:], '/')
+			if next == -1 {
+				break
+			}
+			idx += 1 + next
+		}
+		s.root = name // a top-level directory of the transfer
+		if err := fs.WalkDir(s.source.FS(), name, s.walkFn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
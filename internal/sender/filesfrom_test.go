@@ -0,0 +1,48 @@
+package sender
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestReadFilesFrom(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		input    string
+		eolNulls bool
+		remote   bool
+		want     []string
+	}{
+		{
+			name:  "lines",
+			input: "# comment\r\na\n\n; comment\nb/c\n/d/../e\n../../f",
+			want:  []string{"a", "b/c", "e", "f"},
+		},
+
+		{
+			name:     "from0",
+			input:    "a\nb\x00#c\x00\x00.\x00",
+			eolNulls: true,
+			want:     []string{"a\nb", "."},
+		},
+
+		{
+			name:   "remote",
+			input:  "#a\x00b\x00\x00trailing",
+			remote: true,
+			want:   []string{"#a", "b"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ReadFilesFrom(strings.NewReader(tt.input), tt.eolNulls, tt.remote)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("ReadFilesFrom: unexpected names: diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -1,17 +1,22 @@
 package sender
 
 import (
+	"fmt"
+	"io"
 	"io/fs"
 	"os"
 	"os/user"
+	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/gokrazy/rsync"
-	"github.com/gokrazy/rsync/internal/rsyncchecksum"
+	"github.com/gokrazy/rsync/internal/filter"
+	"github.com/gokrazy/rsync/internal/rsynccommon"
 	"github.com/gokrazy/rsync/internal/rsyncopts"
 	"github.com/gokrazy/rsync/internal/rsyncwire"
 )
@@ -21,6 +26,19 @@ type file struct {
 	path    string
 	Wpath   string
 	regular bool
+	dir     bool
+
+	// walker is set for directories whose contents are sent in a separate
+	// file list with incremental recursion (see sendExtraFileList).
+	walker *scopedWalker
+
+	// acl and defACL are the access ACL and the default ACL (directories
+	// only) of the file (with --acls).
+	acl    *rsynccommon.ACL
+	defACL *rsynccommon.ACL
+
+	// xattrs are the extended attributes of the file (with --xattrs).
+	xattrs *xattrList
 
 	// fields below are used by the receiver (TODO: unify)
 	Name       string
@@ -33,10 +51,53 @@ type file struct {
 	Rdev       int32
 }
 
+// logFile returns f as logged by rsynccommon.ItemLog.
+func (f *file) logFile() rsynccommon.LogFile {
+	return rsynccommon.LogFile{
+		Name:       f.Name,
+		Path:       f.path,
+		Mode:       f.Mode,
+		Length:     f.Length,
+		ModTime:    f.ModTime,
+		LinkTarget: f.LinkTarget,
+	}
+}
+
+type devIno struct {
+	dev, ino int64
+}
+
 type fileList struct {
 	TotalSize int64
 	Files     []file
 	Sources   []FileSource
+
+	// ndxStart is the file list index of Files[0]. With incremental
+	// recursion, all file lists share one index space, in which the index
+	// before ndxStart refers to the directory whose contents the list holds.
+	ndxStart int32
+}
+
+// fileForIndex returns the file with the specified file list index, or nil
+// if the index refers to the parent directory of a file list.
+//
+// rsync/rsync.c:flist_for_ndx
+func (st *Transfer) fileForIndex(ndx int32) (*file, error) {
+	// find the last file list starting at or before ndx+1 (the index of
+	// its parent directory)
+	i := sort.Search(len(st.flists), func(i int) bool {
+		return st.flists[i].ndxStart > ndx+1
+	}) - 1
+	if i >= 0 {
+		fl := st.flists[i]
+		if ndx == fl.ndxStart-1 && st.incRecurse() {
+			return nil, nil
+		}
+		if idx := int(ndx - fl.ndxStart); idx >= 0 && idx < len(fl.Files) {
+			return &fl.Files[idx], nil
+		}
+	}
+	return nil, fmt.Errorf("protocol error: invalid file index %d", ndx)
 }
 
 // A fileList must not be used after calling Close().
@@ -72,46 +133,144 @@ type scopedWalker struct {
 	ioError   func(err error)
 	conn      *rsyncwire.Conn
 	fec       *rsyncwire.Buffer
-	excl      *filterRuleList
+	excl      *filter.List
+	filters   *filter.Scope
 	uidMap    map[int32]string
 	gidMap    map[int32]string
+	hlinks    map[devIno]int32 // first file list index of hard link groups
 	fileList  *fileList
 	source    FileSource
 	localDir  string
 	requested string
 	strip     string
+
+	// filterRoot is the absolute path of localDir which filter rules are
+	// matched against. For daemons, the path is relative to the module root.
+	filterRoot string
+
+	// root is the walked name within source, see walk.
+	root string
+
+	// local is set when localDir is a path sent by the client (or the
+	// remote shell user) instead of a daemon module, whose symlinks are
+	// followed anywhere in the file system (see openDir).
+	local bool
+
+	// sent and impliedDirs are only used with --files-from, where the same
+	// name can be reached more than once.
+	sent        map[string]bool
+	impliedDirs map[string]bool
 }
 
 func (s *scopedWalker) walk() error {
 	if s.source == nil {
-		root, err := os.OpenRoot(s.localDir)
+		source, err := s.openDir(s.localDir)
 		if err != nil {
-			s.st.Logger.Printf("  OpenRoot(localDir=%q): %v", s.localDir, err)
+			s.st.Logger.Printf("  open(localDir=%q): %v", s.localDir, err)
 			s.ioError(err)
 			return nil
 		}
-		s.source = newOSRootSource(root)
+		s.source = source
 		s.fileList.Sources = append(s.fileList.Sources, s.source)
 	}
 
+	s.newScope()
+	defer s.filters.Close()
+
 	rootname := s.requested
 	// fs.WalkDir(root.FS(), …) does not accept absolute paths,
 	// so make them relative by prepending a .
 	if strings.HasPrefix(rootname, "/") {
 		rootname = "." + rootname
 	}
-	if err := fs.WalkDir(s.source.FS(), filepath.Clean(rootname), s.walkFn); err != nil {
+	s.root = filepath.Clean(rootname)
+	if err := fs.WalkDir(s.source.FS(), s.root, s.walkFn); err != nil {
 		return err
 	}
 	return nil
 }
 
+// openDir returns the source for the directory dir. Daemon modules confine
+// symlinks to the module, but local paths are resolved in the file system
+// when --copy-links or --copy-unsafe-links follow symlinks, whose referents
+// can be outside of the source.
+func (s *scopedWalker) openDir(dir string) (FileSource, error) {
+	if s.local && (s.st.Opts.CopyLinks() || s.st.Opts.CopyUnsafeLinks()) {
+		return openOSDirSource(dir)
+	}
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return nil, err
+	}
+	return newOSRootSource(root), nil
+}
+
+func (s *scopedWalker) newScope() {
+	open := func(name string) (io.ReadCloser, error) {
+		return s.source.Open(name)
+	}
+	currDir := path.Join(s.filterRoot, s.strip)
+	s.filters = s.excl.NewScope(open, s.filterRoot, currDir)
+}
+
+// isDotDir reports whether path is the root of a transfer whose contents (as
+// opposed to the directory itself) were requested, e.g. “src/”.
+func (s *scopedWalker) isDotDir(path string) bool {
+	return path == "." || path+"/" == s.strip
+}
+
+// resume sets up a new filter scope for sending the contents of dir, by
+// entering all parent directories of dir within the walked tree.
+func (s *scopedWalker) resume(dir string) error {
+	s.newScope()
+	var parents []string
+	for p := path.Dir(dir); ; p = path.Dir(p) {
+		if s.root != "." && p != s.root && !strings.HasPrefix(p, s.root+"/") {
+			break
+		}
+		parents = append(parents, p)
+		if p == s.root {
+			break
+		}
+	}
+	for i := len(parents) - 1; i >= 0; i-- {
+		s.filters.Visit(parents[i])
+		if err := s.filters.EnterDir(parents[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendDirectory sends the entries of dir (but not dir itself) in the file
+// list of the walker.
+//
+// rsync/flist.c:send_directory
+func (s *scopedWalker) sendDirectory(dir string) error {
+	s.filters.Visit(dir)
+	if err := s.filters.EnterDir(dir); err != nil {
+		return err
+	}
+	entries, err := fs.ReadDir(s.source.FS(), dir)
+	if err != nil {
+		// set the I/O error flag, but send the entries which were read
+		s.ioError(err)
+	}
+	for _, e := range entries {
+		if err := s.walkFn(path.Join(dir, e.Name()), e, nil); err != nil && err != filepath.SkipDir {
+			return err
+		}
+	}
+	return nil
+}
+
 func (s *scopedWalker) walkFn(path string, d fs.DirEntry, err error) error {
 	logger := s.st.Logger // for convenience
 	opts := s.st.Opts     // for convenience
 	if opts.DebugGTE(rsyncopts.DEBUG_FLIST, 1) {
 		logger.Printf("filepath.WalkFn(path=%s)", path)
 	}
+	s.filters.Visit(path)
 	var info fs.FileInfo
 	if err == nil {
 		info, err = d.Info()
@@ -122,6 +281,26 @@ func (s *scopedWalker) walkFn(path string, d fs.DirEntry, err error) error {
 		return nil
 	}
 
+	// linkTarget is the target of a symlink which is sent as such.
+	var linkTarget string
+	if info.Mode().Type() == fs.ModeSymlink {
+		info, linkTarget, err = s.readlinkStat(path, info)
+		if err != nil {
+			// set the I/O error flag, and skip the file
+			s.ioError(err)
+			return nil
+		}
+		if info.IsDir() {
+			if s.symlinkLoops(path, info) {
+				logger.Printf("skipping symlink loop %s", path)
+				return nil
+			}
+			// fs.WalkDir does not descend into symlinks, so walk the
+			// directory the symlink refers to (which is sent as path).
+			return fs.WalkDir(s.source.FS(), path, s.walkFn)
+		}
+	}
+
 	if opts.DebugGTE(rsyncopts.DEBUG_FLIST, 1) {
 		logger.Printf("isDir=%v, xferDirs=%v", info.Mode().IsDir(), opts.XferDirs())
 	}
@@ -131,7 +310,7 @@ func (s *scopedWalker) walkFn(path string, d fs.DirEntry, err error) error {
 	}
 
 	// Only ever transmit long names, like openrsync
-	flags := byte(rsync.XMIT_LONG_NAME)
+	flags := uint16(rsync.XMIT_LONG_NAME)
 
 	name := path
 	if s.strip != "" {
@@ -140,35 +319,222 @@ func (s *scopedWalker) walkFn(path string, d fs.DirEntry, err error) error {
 	if opts.DebugGTE(rsyncopts.DEBUG_FLIST, 1) {
 		logger.Printf("Trim(path=%q) = %q", path, name)
 	}
-	if path == "." {
-		flags |= rsync.XMIT_TOP_DIR
+	// The transfer root itself is never subject to filter rules, and
+	// neither are the directories implied by --files-from names.
+	dotDir := s.isDotDir(path)
+	isRoot := dotDir || s.impliedDirs[path]
+
+	// The receiver deletes extraneous files only in directories whose
+	// contents are sent (content dirs), and scopes deletion to the
+	// top-level directories of the transfer.
+	if info.Mode().IsDir() && (opts.Recurse() || dotDir) && !s.impliedDirs[path] {
+		if dotDir || path == s.root {
+			flags |= rsync.XMIT_TOP_DIR
+		}
+	} else if info.Mode().IsDir() && s.st.Protocol >= 30 {
+		flags |= rsync.XMIT_NO_CONTENT_DIR
 	}
 	// st.logger.Printf("flags for %q: %v", name, flags)
+	if !isRoot && s.excl.Excluded(name, info.Mode().IsDir(), filter.SenderSide) {
+		if opts.DebugGTE(rsyncopts.DEBUG_FILTER, 1) {
+			logger.Printf("excluding %q", name)
+		}
+		if info.Mode().IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	}
+	// The file mode is computed up front: --chmod changes the permissions
+	// which the ACLs are relative to.
+	mode := int32(info.Mode() & os.ModePerm)
+	isDev := false
+	isSpecial := false
+	if info.Mode().IsDir() {
+		mode |= rsync.S_IFDIR
+	} else if info.Mode().IsRegular() {
+		mode |= rsync.S_IFREG
+	} else if info.Mode().Type()&os.ModeSymlink != 0 {
+		// Without --links, the receiver skips symlinks.
+		mode |= rsync.S_IFLNK
+	}
 
-	if s.excl.matches(name) {
-		return filepath.SkipDir
+	if info.Mode().Type()&os.ModeCharDevice != 0 {
+		mode |= rsync.S_IFCHR
+		isDev = true
+	} else if info.Mode().Type()&os.ModeDevice != 0 {
+		mode |= rsync.S_IFBLK
+		isDev = true
+	}
+
+	if info.Mode().Type()&os.ModeNamedPipe != 0 {
+		mode |= rsync.S_IFIFO
+		isSpecial = true
+	}
+
+	if info.Mode().Type()&os.ModeSocket != 0 {
+		mode |= rsync.S_IFSOCK
+		isSpecial = true
+	}
+
+	// --chmod applies to all files but symlinks (rsync/flist.c:make_file).
+	if chmod := opts.ChmodModes(); len(chmod) > 0 && mode&rsync.S_IFMT != rsync.S_IFLNK {
+		mode = int32(rsyncopts.TweakMode(uint32(mode), chmod))
+	}
+	// perm is the mode of the file with the permissions as sent.
+	perm := info.Mode().Type() | fs.FileMode(mode)&fs.ModePerm
+
+	var access, def *rsynccommon.ACL
+	if opts.PreserveACLs() {
+		var err error
+		access, def, err = s.getACLs(path, perm)
+		if err != nil {
+			// set the I/O error flag, and skip the file
+			s.ioError(err)
+			if info.Mode().IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+	}
+	var xattrs *xattrList
+	if opts.PreserveXattrs() > 0 {
+		var err error
+		xattrs, err = s.getXattrs(path, info.Mode())
+		if err != nil {
+			// set the I/O error flag, and skip the file
+			s.ioError(err)
+			if info.Mode().IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+	}
+
+	// With incremental recursion, the contents of directories are sent in
+	// separate file lists, with the exception of dot dirs, whose contents
+	// are part of the initial file list.
+	contentsLater := info.Mode().IsDir() && s.st.incRecurse() && !dotDir
+	if info.Mode().IsDir() && !contentsLater {
+		if err := s.filters.EnterDir(path); err != nil {
+			return err
+		}
+	}
+
+	if s.sent != nil {
+		if s.sent[name] {
+			// Already in the file list, e.g. as an implied directory.
+			if info.Mode().IsDir() && !opts.Recurse() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		s.sent[name] = true
 	}
 
-	s.fileList.Files = append(s.fileList.Files, file{
+	f := file{
 		source:  s.source,
 		path:    path,
 		regular: info.Mode().IsRegular(),
+		dir:     info.Mode().IsDir(),
 		Wpath:   name,
+		Name:    name,
 		Length:  info.Size(),
-	})
+		ModTime: info.ModTime(),
+		acl:     access,
+		defACL:  def,
+		xattrs:  xattrs,
+	}
+	if contentsLater {
+		f.walker = s
+	}
+	s.fileList.Files = append(s.fileList.Files, f)
+	// fe is updated with the attributes below, for logging (see logFile).
+	fe := &s.fileList.Files[len(s.fileList.Files)-1]
+	protocol := s.st.Protocol
+
+	// Protocol versions >= 28 only transmit hard link data for files which
+	// are in fact hard linked. Protocol 30 refers to the first file of a
+	// hard link group by its index instead of transmitting dev and inode.
+	firstHlinkNdx := int32(-1)
+	var dev, ino int64
+	if opts.PreserveHardLinks() && protocol >= 28 && !info.Mode().IsDir() {
+		if nlink, ok := nlinkFromFileInfo(info); ok && nlink > 1 {
+			dev, ino, _ = devInoFromFileInfo(info)
+			flags |= rsync.XMIT_HLINKED
+			if protocol >= 30 {
+				key := devIno{dev, ino}
+				if first, ok := s.hlinks[key]; ok {
+					firstHlinkNdx = first
+				} else {
+					s.hlinks[key] = s.fileList.ndxStart + int32(len(s.fileList.Files)-1)
+					flags |= rsync.XMIT_HLINK_FIRST
+				}
+			}
+		}
+	}
+
+	// The attributes of hard linked files are only sent for the first file
+	// of the group, unless the first file is in an earlier file list (which
+	// the receiver might have freed already).
+	sendAttrs := firstHlinkNdx < s.fileList.ndxStart
+
+	var uid, gid int32
+	var userName, groupName string
+	if opts.PreserveUid() && sendAttrs {
+		var ok bool
+		uid, ok = uidFromFileInfo(info)
+		if ok {
+			if name, added := s.addUid(uid); added && s.st.incRecurse() {
+				// With incremental recursion, there is no uid list after
+				// the file list: names follow the first use of each uid.
+				userName = name
+				flags |= rsync.XMIT_USER_NAME_FOLLOWS
+			}
+		}
+	}
+	if opts.PreserveGid() && sendAttrs {
+		var ok bool
+		gid, ok = gidFromFileInfo(info)
+		if ok {
+			if name, added := s.addGid(gid); added && s.st.incRecurse() {
+				groupName = name
+				flags |= rsync.XMIT_GROUP_NAME_FOLLOWS
+			}
+		}
+	}
+
+	if protocol >= 31 && sendAttrs && info.ModTime().Nanosecond() != 0 {
+		flags |= rsync.XMIT_MOD_NSEC
+	}
 
 	s.fec.Reset()
 
 	// 1.   status byte (integer)
-	s.fec.WriteByte(flags)
+	if s.st.varintFlags() {
+		s.fec.WriteVarint(int32(flags))
+	} else if protocol >= 28 && flags&0xFF00 != 0 {
+		flags |= rsync.XMIT_EXTENDED_FLAGS
+		s.fec.WriteShortInt(flags)
+	} else {
+		s.fec.WriteByte(byte(flags))
+	}
 
 	// 2.   inherited filename length (optional, byte)
 	// 3.   filename length (integer or byte)
-	s.fec.WriteInt32(int32(len(name)))
+	s.fec.WriteVarint30(protocol, int32(len(name)))
 
 	// 4.   file (byte array)
 	s.fec.WriteString(name)
 
+	if firstHlinkNdx >= 0 {
+		s.fec.WriteVarint(firstHlinkNdx)
+		if !sendAttrs {
+			// All other attributes are those of the first file in the group.
+			s.fileList.TotalSize += info.Size()
+			return s.writeEntry(path, info)
+		}
+	}
+
 	// 5.   file length (long)
 	size := info.Size()
 	if info.Mode().IsDir() {
@@ -177,122 +543,163 @@ func (s *scopedWalker) walkFn(path string, d fs.DirEntry, err error) error {
 		// system type.
 		size = 4096
 	}
-	s.fec.WriteInt64(size)
+	s.fec.WriteVarlong30(protocol, size, 3)
 
 	s.fileList.TotalSize += size
 
 	// 6.   file modification time (optional, integer)
-	// TODO: this will overflow in 2038! :(
-	s.fec.WriteInt32(int32(info.ModTime().Unix()))
-
-	// 7.   file mode (optional, mode_t, integer)
-	mode := int32(info.Mode() & os.ModePerm)
-	isDev := false
-	isSpecial := false
-	if info.Mode().IsDir() {
-		mode |= rsync.S_IFDIR
-	} else if info.Mode().IsRegular() {
-		mode |= rsync.S_IFREG
-	} else if info.Mode().Type()&os.ModeSymlink != 0 {
-		mode |= rsync.S_IFLNK
-		// TODO: skip symlink if PreserveSymlinks is not set
+	if protocol >= 30 {
+		s.fec.WriteVarlong(info.ModTime().Unix(), 4)
+	} else {
+		// TODO: this will overflow in 2038! :(
+		s.fec.WriteInt32(int32(info.ModTime().Unix()))
 	}
-
-	if info.Mode().Type()&os.ModeCharDevice != 0 {
-		mode |= rsync.S_IFCHR
-		isDev = true
-	} else if info.Mode().Type()&os.ModeDevice != 0 {
-		mode |= rsync.S_IFBLK
-		isDev = true
-	}
-
-	if info.Mode().Type()&os.ModeNamedPipe != 0 {
-		mode |= rsync.S_IFIFO
-		isSpecial = true
-	}
-
-	if info.Mode().Type()&os.ModeSocket != 0 {
-		mode |= rsync.S_IFSOCK
-		isSpecial = true
+	if flags&rsync.XMIT_MOD_NSEC != 0 {
+		// 6a.  if protocol >= 31, nanoseconds of the modification time
+		s.fec.WriteVarint(int32(info.ModTime().Nanosecond()))
 	}
 
+	// 7.   file mode (optional, mode_t, integer)
 	s.fec.WriteInt32(mode)
+	fe.Mode = mode
 
 	if opts.PreserveUid() {
-		uid, ok := uidFromFileInfo(info)
-		if ok {
-			if _, ok := s.uidMap[uid]; !ok && uid != 0 {
-				u, err := user.LookupId(strconv.Itoa(int(uid)))
-				if err != nil {
-					lookupOnce.Do(func() {
-						logger.Printf("lookup(%d) = %v", uid, err)
-					})
-				} else {
-					s.uidMap[uid] = u.Username
-				}
-			}
-		}
 		// 8.   if -o, the user id (integer)
-		s.fec.WriteInt32(uid)
+		s.fec.WriteVarint30(protocol, uid)
+		if flags&rsync.XMIT_USER_NAME_FOLLOWS != 0 {
+			s.fec.WriteByte(byte(len(userName)))
+			s.fec.WriteString(userName)
+		}
 	}
 
 	if opts.PreserveGid() {
-		gid, ok := gidFromFileInfo(info)
-		if ok {
-			if _, ok := s.gidMap[gid]; !ok && gid != 0 {
-				g, err := user.LookupGroupId(strconv.Itoa(int(gid)))
-				if err != nil {
-					lookupGroupOnce.Do(func() {
-						logger.Printf("lookupgroup(%d) = %v", gid, err)
-					})
-				} else {
-					s.gidMap[gid] = g.Name
-				}
-			}
-		}
 		// 9.   if -g, the group id (integer)
-		s.fec.WriteInt32(gid)
+		s.fec.WriteVarint30(protocol, gid)
+		if flags&rsync.XMIT_GROUP_NAME_FOLLOWS != 0 {
+			s.fec.WriteByte(byte(len(groupName)))
+			s.fec.WriteString(groupName)
+		}
 	}
 
 	if (opts.PreserveDevices() && isDev) ||
 		(opts.PreserveSpecials() && isSpecial) {
 		// 10.  if a special file and -D, the device “rdev” type (integer)
-		rdev, _ := rdevFromFileInfo(info)
-		s.fec.WriteInt32(rdev)
+		if protocol < 28 {
+			rdev, _ := rdevFromFileInfo(info)
+			s.fec.WriteInt32(rdev)
+		} else {
+			major, minor, _ := rdevMajorMinorFromFileInfo(info)
+			s.fec.WriteVarint30(protocol, int32(major))
+			if protocol >= 30 {
+				s.fec.WriteVarint(int32(minor))
+			} else {
+				s.fec.WriteInt32(int32(minor))
+			}
+		}
 	}
 
 	if opts.PreserveLinks() && info.Mode().Type()&os.ModeSymlink != 0 {
 		// 11.  if a symbolic link and -l, the link target's length (integer)
 		// 12.  if a symbolic link and -l, the link target (byte array)
 
-		target, err := s.source.Readlink(path)
-		if err != nil {
-			return err // TODO
+		s.fec.WriteVarint30(protocol, int32(len(linkTarget)))
+		s.fec.WriteString(linkTarget)
+		fe.LinkTarget = linkTarget
+	}
+
+	if opts.PreserveHardLinks() && protocol < 28 && info.Mode().IsRegular() {
+		// Protocol versions < 28 transmit the device and inode number of
+		// all regular files, the receiver determines the hard link groups.
+		dev, ino, ok := devInoFromFileInfo(info)
+		if !ok {
+			// Without inode numbers (e.g. for fs.FS sources), make every
+			// file its own group by using a number unique to this list.
+			dev, ino = 0, int64(len(s.fileList.Files))
 		}
-		s.fec.WriteInt32(int32(len(target)))
-		s.fec.WriteString(target)
+		// 13.  if a regular file and -H, the device (long)
+		// 14.  if a regular file and -H, the inode (long)
+		s.fec.WriteInt64(dev)
+		s.fec.WriteInt64(ino)
+	} else if flags&rsync.XMIT_HLINKED != 0 && protocol < 30 {
+		s.fec.WriteInt64(dev)
+		s.fec.WriteInt64(ino)
 	}
 
-	if opts.AlwaysChecksum() {
-		var emptyChecksum [rsyncchecksum.Size]byte
-		checksum := emptyChecksum[:]
+	if opts.AlwaysChecksum() && (info.Mode().IsRegular() || protocol < 28) {
+		checksum := make([]byte, s.st.Checksums.File.Size())
 		if info.Mode().IsRegular() {
 			f, err := s.source.Open(path)
 			if err != nil {
 				return err
 			}
-			checksum, err = rsyncchecksum.ReaderChecksum(f)
+			checksum, err = s.st.Checksums.File.ReaderChecksum(f)
 			f.Close()
 			if err != nil {
 				return err
 			}
 		} else {
-			// send empty md4 checksum
+			// send empty checksum
 		}
 		s.fec.WriteString(string(checksum))
 	}
 
-	s.conn.WriteString(s.fec.String())
+	return s.writeEntry(path, info)
+}
+
+// addUid looks up the name of uid for the uid list. It returns the name and
+// true if uid was not in the list before. With --numeric-ids, no names are
+// sent.
+//
+// rsync/uidlist.c:add_uid
+func (s *scopedWalker) addUid(uid int32) (string, bool) {
+	if s.st.Opts.NumericIds() {
+		return "", false
+	}
+	if _, ok := s.uidMap[uid]; ok || uid == 0 {
+		return "", false
+	}
+	u, err := user.LookupId(strconv.Itoa(int(uid)))
+	if err != nil {
+		lookupOnce.Do(func() {
+			s.st.Logger.Printf("lookup(%d) = %v", uid, err)
+		})
+		return "", false
+	}
+	s.uidMap[uid] = u.Username
+	return u.Username, true
+}
+
+// rsync/uidlist.c:add_gid
+func (s *scopedWalker) addGid(gid int32) (string, bool) {
+	if s.st.Opts.NumericIds() {
+		return "", false
+	}
+	if _, ok := s.gidMap[gid]; ok || gid == 0 {
+		return "", false
+	}
+	g, err := user.LookupGroupId(strconv.Itoa(int(gid)))
+	if err != nil {
+		lookupGroupOnce.Do(func() {
+			s.st.Logger.Printf("lookupgroup(%d) = %v", gid, err)
+		})
+		return "", false
+	}
+	s.gidMap[gid] = g.Name
+	return g.Name, true
+}
+
+// writeEntry sends the file list entry encoded in s.fec.
+func (s *scopedWalker) writeEntry(path string, info fs.FileInfo) error {
+	f := &s.fileList.Files[len(s.fileList.Files)-1]
+	if s.st.Opts.PreserveACLs() && f.acl != nil {
+		s.encodeACLs(f.acl, f.defACL)
+	}
+	if s.st.Opts.PreserveXattrs() > 0 {
+		s.st.encodeXattrs(s.fec, f.xattrs)
+	}
+	if err := s.conn.WriteString(s.fec.String()); err != nil {
+		return err
+	}
 
 	// The status byte may consist of the following bits and determines which of the optional fields are transmitted.
 
@@ -306,7 +713,12 @@ func (s *scopedWalker) walkFn(path string, d fs.DirEntry, err error) error {
 
 	// If the status byte is zero, the file-list has terminated.
 
-	if info.Mode().IsDir() && !opts.Recurse() {
+	if info.Mode().IsDir() && !s.st.Opts.Recurse() && !s.isDotDir(path) {
+		// With --dirs, only the contents of dot dirs are sent.
+		return filepath.SkipDir
+	}
+	if s.fileList.Files[len(s.fileList.Files)-1].walker != nil {
+		// The directory contents are sent in a separate file list.
 		return filepath.SkipDir
 	}
 
@@ -314,12 +726,13 @@ func (s *scopedWalker) walkFn(path string, d fs.DirEntry, err error) error {
 }
 
 // rsync/flist.c:send_file_list
-func (st *Transfer) SendFileList(localDir string, paths []string, excl *filterRuleList) (*fileList, error) {
+func (st *Transfer) SendFileList(localDir string, paths []string, excl *filter.List) (*fileList, error) {
 	var fileList fileList
 	fec := &rsyncwire.Buffer{}
 
 	uidMap := make(map[int32]string)
 	gidMap := make(map[int32]string)
+	hlinks := make(map[devIno]int32)
 
 	// TODO: flush in between to keep the pipes filled when traversal takes long
 
@@ -330,19 +743,54 @@ func (st *Transfer) SendFileList(localDir string, paths []string, excl *filterRu
 	if st.Opts.DebugGTE(rsyncopts.DEBUG_FLIST, 1) {
 		st.Logger.Printf("sendFileList()")
 	}
-	ioErrors := int32(0)
-
 	ioError := func(err error) {
 		if os.IsNotExist(err) {
 			st.Logger.Printf("file vanished: %v", err)
 		} else {
 			st.Logger.Printf("lstat: %v", err)
 		}
-		ioErrors = 1
+		st.ioErrors = 1
+	}
+
+	if st.incRecurse() {
+		// Index 0 refers to the (non-existent) parent directory of the
+		// initial file list.
+		fileList.ndxStart = 1
+	}
+
+	if st.Opts.FilesFrom() != "" && len(paths) != 1 {
+		return nil, fmt.Errorf("--files-from requires exactly one source directory, got %q", paths)
 	}
 
 	for _, requested := range paths {
+		if st.Opts.FilesFrom() != "" {
+			// All names of the --files-from list are relative to the
+			// requested directory, regardless of a trailing slash.
+			sw := &scopedWalker{
+				st:        st,
+				conn:      st.Conn,
+				fec:       fec,
+				excl:      excl,
+				uidMap:    uidMap,
+				gidMap:    gidMap,
+				hlinks:    hlinks,
+				fileList:  &fileList,
+				source:    st.Source,
+				ioError:   ioError,
+				localDir:  localDir,
+				requested: requested,
+				local:     localDir == "/",
+
+				filterRoot: requested,
+			}
+			if err := sw.walkFilesFrom(st.FilesFrom); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
 		local := localDir
+		filterRoot := ""
 		if local == "/" {
 			// Implicit module (/) and absolute requested path (/tmp/foo/),
 			// turn the path into the local directory and request /.
@@ -353,6 +801,7 @@ func (st *Transfer) SendFileList(localDir string, paths []string, excl *filterRu
 				local = filepath.Dir(requested)
 				requested = filepath.Base(requested)
 			}
+			filterRoot = local
 		}
 
 		if st.Opts.DebugGTE(rsyncopts.DEBUG_FLIST, 1) {
@@ -372,12 +821,16 @@ func (st *Transfer) SendFileList(localDir string, paths []string, excl *filterRu
 			excl:      excl,
 			uidMap:    uidMap,
 			gidMap:    gidMap,
+			hlinks:    hlinks,
 			fileList:  &fileList,
 			source:    st.Source,
 			ioError:   ioError,
 			localDir:  local,
 			requested: requested,
 			strip:     strip,
+			local:     localDir == "/",
+
+			filterRoot: filterRoot,
 		}
 		if err := sw.walk(); err != nil {
 			return nil, err
@@ -388,30 +841,32 @@ func (st *Transfer) SendFileList(localDir string, paths []string, excl *filterRu
 		st.Logger.Printf("%d files to consider", len(fileList.Files))
 	}
 
-	fec.Reset()
-
-	const endOfFileList = 0
-	fec.WriteByte(endOfFileList)
+	if err := st.endFileList(fec); err != nil {
+		return nil, err
+	}
 
 	const endOfSet = 0
-	if st.Opts.PreserveUid() {
+	sendUids, sendGids := st.sendsIdLists()
+	if sendUids {
 		for uid, name := range uidMap {
-			fec.WriteInt32(uid)
+			fec.WriteVarint30(st.Protocol, uid)
 			fec.WriteByte(byte(len(name)))
 			fec.WriteString(name)
 		}
-		fec.WriteInt32(endOfSet)
+		fec.WriteVarint30(st.Protocol, endOfSet)
 	}
-	if st.Opts.PreserveGid() {
+	if sendGids {
 		for gid, name := range gidMap {
-			fec.WriteInt32(gid)
+			fec.WriteVarint30(st.Protocol, gid)
 			fec.WriteByte(byte(len(name)))
 			fec.WriteString(name)
 		}
-		fec.WriteInt32(endOfSet)
+		fec.WriteVarint30(st.Protocol, endOfSet)
 	}
 
-	fec.WriteInt32(ioErrors)
+	if st.Protocol < 30 {
+		fec.WriteInt32(st.ioErrors)
+	}
 
 	if err := st.Conn.WriteString(fec.String()); err != nil {
 		return nil, err
@@ -419,3 +874,155 @@ func (st *Transfer) SendFileList(localDir string, paths []string, excl *filterRu
 
 	return &fileList, nil
 }
+
+// endFileList resets fec and encodes the end of a file list into it.
+func (st *Transfer) endFileList(fec *rsyncwire.Buffer) error {
+	if st.ioErrors != 0 && st.Protocol == 30 && !st.varintFlags() {
+		// Protocol 30 sends the I/O error flag in a message instead of after
+		// the file list. rsync sends the message after the uid/gid lists,
+		// but sending it before the end of the list makes sure that the
+		// receiver knows about the error before it deletes any files.
+		if err := st.Conn.WriteMsgInt32(rsyncwire.MsgIOError, st.ioErrors); err != nil {
+			return err
+		}
+	}
+
+	fec.Reset()
+
+	const endOfFileList = 0
+	if st.varintFlags() {
+		fec.WriteVarint(endOfFileList)
+		fec.WriteVarint(st.ioErrors)
+	} else if st.ioErrors != 0 && st.Protocol >= 31 {
+		// Protocol 31 ends the file list with a special flags value,
+		// followed by the I/O error flag.
+		fec.WriteShortInt(rsync.XMIT_EXTENDED_FLAGS | rsync.XMIT_IO_ERROR_ENDLIST)
+		fec.WriteVarint(st.ioErrors)
+	} else {
+		fec.WriteByte(endOfFileList)
+	}
+	return nil
+}
+
+// sortFileList sorts the file list like the receiver does, so that file list
+// indexes refer to the same files on both sides.
+func sortFileList(fl *fileList) {
+	sort.Slice(fl.Files, func(i, j int) bool {
+		return fl.Files[i].Wpath < fl.Files[j].Wpath
+	})
+}
+
+// minFileCntLookahead is the number of files which the sender keeps sending
+// in extra file lists ahead of the file list the generator is working on.
+//
+// rsync/rsync.h:MIN_FILECNT_LOOKAHEAD
+const minFileCntLookahead = 1000
+
+// pendingDir is a directory whose contents were not sent yet.
+type pendingDir struct {
+	ndx    int32 // index into the receiver’s list of directories
+	path   string
+	walker *scopedWalker
+}
+
+// addDirsToTree registers the directories of the (sorted) file list fl, in
+// the order in which the receiver numbers them, and queues the directories
+// whose contents are sent in an extra file list.
+//
+// rsync/flist.c:add_dirs_to_tree
+func (st *Transfer) addDirsToTree(fl *fileList) {
+	var pending []pendingDir
+	for _, f := range fl.Files {
+		if !f.dir {
+			continue
+		}
+		if f.walker != nil {
+			pending = append(pending, pendingDir{
+				ndx:    st.numDirs,
+				path:   f.path,
+				walker: f.walker,
+			})
+		}
+		st.numDirs++
+	}
+	// Push in reverse order, so that the directories are popped (and their
+	// subdirectories pushed on top) in depth-first order.
+	for i := len(pending) - 1; i >= 0; i-- {
+		st.dirStack = append(st.dirStack, pending[i])
+	}
+}
+
+// sendExtraFileLists sends the contents of pending directories in extra file
+// lists until the receiver has at least minFiles files to work on (not
+// counting the file list which the generator is currently working on), or
+// until all file lists were sent, which is signaled with NDX_FLIST_EOF.
+//
+// rsync/flist.c:send_extra_file_list
+func (st *Transfer) sendExtraFileLists(minFiles int) error {
+	for !st.flistEOF {
+		cnt := 0
+		for _, fl := range st.flists[st.flistsDone+1:] {
+			cnt += len(fl.Files)
+		}
+		if cnt >= minFiles {
+			return nil
+		}
+
+		if len(st.dirStack) == 0 {
+			st.flistEOF = true
+			if st.activeWalker != nil {
+				st.activeWalker.filters.Close()
+			}
+			return st.Conn.WriteNdx(st.Protocol, rsync.NDX_FLIST_EOF)
+		}
+		dir := st.dirStack[len(st.dirStack)-1]
+		st.dirStack = st.dirStack[:len(st.dirStack)-1]
+		if err := st.sendExtraFileList(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendExtraFileList sends the contents of dir in a new file list.
+func (st *Transfer) sendExtraFileList(dir pendingDir) error {
+	last := st.flists[len(st.flists)-1]
+	fl := &fileList{
+		ndxStart: last.ndxStart + int32(len(last.Files)) + 1,
+	}
+	if st.Opts.DebugGTE(rsyncopts.DEBUG_FLIST, 1) {
+		st.Logger.Printf("sendExtraFileList(%q), ndxStart=%d", dir.path, fl.ndxStart)
+	}
+	w := dir.walker
+	if st.activeWalker != w {
+		// The walkers share the state of the filter list, so only one
+		// walker can have per-directory merge files in effect.
+		if st.activeWalker != nil {
+			st.activeWalker.filters.Close()
+		}
+		st.activeWalker = w
+		if err := w.resume(dir.path); err != nil {
+			return err
+		}
+	}
+	w.fileList = fl
+
+	if err := st.Conn.WriteNdx(st.Protocol, rsync.NDX_FLIST_OFFSET-dir.ndx); err != nil {
+		return err
+	}
+	if err := w.sendDirectory(dir.path); err != nil {
+		return err
+	}
+	if err := st.endFileList(w.fec); err != nil {
+		return err
+	}
+	if err := st.Conn.WriteString(w.fec.String()); err != nil {
+		return err
+	}
+
+	sortFileList(fl)
+	st.flists = append(st.flists, fl)
+	st.extraSize += fl.TotalSize
+	st.addDirsToTree(fl)
+	return nil
+}
@@ -2,14 +2,13 @@ package sender
 
 import (
 	"bytes"
-	"encoding/binary"
 	"fmt"
 	"hash"
 
 	"github.com/gokrazy/rsync"
 	"github.com/gokrazy/rsync/internal/rsyncchecksum"
+	"github.com/gokrazy/rsync/internal/rsynccommon"
 	"github.com/gokrazy/rsync/internal/rsyncopts"
-	"github.com/mmcloughlin/md4"
 )
 
 type target struct {
@@ -17,8 +16,16 @@ type target struct {
 	tag   uint16
 }
 
+// hashSearch sends the file as a sequence of literal data and matched blocks
+// of the receiver's basis file.
+//
+// With updatingBasis, the receiver overwrites its basis file while reading
+// matched blocks from it (--inplace): a block which the receiver already
+// overwrote (before offset) can only be used if it is unchanged in the same
+// spot.
+//
 // rsync/match.c:hash_search
-func (st *Transfer) hashSearch(targets []target, tagTable map[uint16]int, head rsync.SumHead, fileIndex int32, fl file) error {
+func (st *Transfer) hashSearch(targets []target, tagTable map[uint16]int, head rsync.SumHead, fileIndex int32, attrs rsynccommon.ItemAttrs, fl file, updatingBasis bool) error {
 	st.Logger.Printf("hashSearch(path=%s, len(sums)=%d)", fl.path, len(head.Sums))
 	f, err := fl.source.Open(fl.path)
 	if err != nil {
@@ -33,8 +40,9 @@ func (st *Transfer) hashSearch(targets []target, tagTable map[uint16]int, head r
 
 	readSize := max(3*head.BlockLength, 256*1024)
 	ms := mapFile(f, fi.Size(), readSize, head.BlockLength)
+	ms.skipHoles = st.Opts.SparseFiles()
 
-	if err := st.Conn.WriteInt32(fileIndex); err != nil {
+	if err := st.writeNdxAndAttrs(fileIndex, attrs, &fl); err != nil {
 		return err
 	}
 
@@ -42,15 +50,10 @@ func (st *Transfer) hashSearch(targets []target, tagTable map[uint16]int, head r
 		return err
 	}
 
-	if !st.Opts.Server() &&
-		st.Opts.InfoGTE(rsyncopts.INFO_NAME, 1) &&
-		st.Opts.InfoGTE(rsyncopts.INFO_PROGRESS, 1) {
-		fmt.Fprintln(st.Env.Stdout, fl.path)
-	}
+	st.Items.BeginTransfer(fl.logFile(), attrs.Flags)
 
 	// sum_init()
-	h := md4.New()
-	binary.Write(h, binary.LittleEndian, st.Seed)
+	h := st.Checksums.Xfer.New(st.Seed)
 
 	// The following quotes are citations from
 	// https://www.samba.org/~tridge/phd_thesis.pdf, section 3.2.6 The
@@ -89,6 +92,16 @@ func (st *Transfer) hashSearch(targets []target, tagTable map[uint16]int, head r
 		return err
 	}
 
+	// in-place state: sameOffset marks blocks which match in the same spot,
+	// alignedOffset and alignedIdx track the block boundary at or after
+	// offset (the generator's blocks start at BlockLength boundaries).
+	var sameOffset []bool
+	if updatingBasis {
+		sameOffset = make([]bool, len(head.Sums))
+	}
+	var alignedOffset int64
+	var alignedIdx int32
+
 	tagHits := 0
 Outer:
 	for {
@@ -119,6 +132,12 @@ Outer:
 					continue
 				}
 
+				// in-place: ensure the block's offset is either >= our
+				// offset or that the data didn't move.
+				if updatingBasis && head.Sums[i].Offset < offset && !sameOffset[i] {
+					continue
+				}
+
 				// st.logger.Printf("potential match at %d target=%d %d sum=%08x", offset, j, i, sum)
 
 				if !doneCsum2 {
@@ -126,7 +145,7 @@ Outer:
 					if err != nil {
 						return err
 					}
-					sum2 = rsyncchecksum.Checksum2(st.Seed, buf[:])
+					sum2 = st.Checksums.Xfer.Checksum2(st.Seed, st.properSeedOrder(), buf[:])
 					doneCsum2 = true
 				}
 
@@ -136,6 +155,28 @@ Outer:
 					continue
 				}
 
+				// When updating in-place, the best possible match is one
+				// with an identical offset, which the receiver does not need
+				// to write at all.
+				if updatingBasis {
+					for alignedOffset < offset {
+						alignedOffset += int64(head.BlockLength)
+						alignedIdx++
+					}
+					if offset == alignedOffset && alignedIdx < head.ChecksumCount {
+						aligned := head.Sums[alignedIdx]
+						if i != alignedIdx &&
+							sum == aligned.Sum1 &&
+							l == aligned.Len &&
+							bytes.Equal(sum2[:head.ChecksumLength], aligned.Sum2[:head.ChecksumLength]) {
+							i = alignedIdx
+						}
+						if i == alignedIdx {
+							sameOffset[i] = true
+						}
+					}
+				}
+
 				// TODO(optimization): tridge rsync locates adjacent matches
 				// here for better run-length encoding, but I’m not sure where
 				// (if at all) we currently use run-length encoding:
@@ -242,14 +283,12 @@ func (st *Transfer) matched(h hash.Hash, ms *mapStruct, head rsync.SumHead, offs
 	// 	st.logger.Printf("transmit accumulated at offset=%d", offset)
 	// }
 
-	/* FIXME: this is not used
 	l := int64(0)
 	if !transmitAccumulated {
 		l = head.Sums[i].Len
 	}
-	*/
 
-	if err := st.sendToken(ms, i, st.lastMatch, n); err != nil {
+	if err := st.sendToken(ms, i, st.lastMatch, n, l); err != nil {
 		return fmt.Errorf("sendToken: %v", err)
 	}
 	// TODO: data_transfer += n;
@@ -280,3 +319,65 @@ func (st *Transfer) matched(h hash.Hash, ms *mapStruct, head rsync.SumHead, offs
 
 	return nil
 }
+
+// sendAppended sends the data after the first head.FileLength() bytes, which
+// the receiver already has (--append). With appendVerify, the whole-file
+// checksum includes the data which is not sent.
+//
+// rsync/match.c:match_sums (append_mode)
+func (st *Transfer) sendAppended(head rsync.SumHead, fileIndex int32, attrs rsynccommon.ItemAttrs, fl file) error {
+	f, err := fl.source.Open(fl.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if err := st.writeNdxAndAttrs(fileIndex, attrs, &fl); err != nil {
+		return err
+	}
+
+	if err := head.WriteTo(st.Conn); err != nil {
+		return err
+	}
+
+	st.Items.BeginTransfer(fl.logFile(), attrs.Flags)
+
+	h := st.Checksums.Xfer.New(st.Seed)
+	ms := mapFile(f, fi.Size(), chunkSize, 0)
+	ms.skipHoles = st.Opts.SparseFiles()
+	// The file might have shrunk since the generator compared sizes.
+	flength := min(head.FileLength(), fi.Size())
+	if st.appendVerify() {
+		for j := int64(0); j < flength; j += chunkSize {
+			n := min(int64(chunkSize), flength-j)
+			chunk, err := ms.ptr(j, int32(n))
+			if err != nil {
+				return err
+			}
+			h.Write(chunk)
+		}
+	}
+	st.lastMatch = flength
+
+	// by doing this in pieces we avoid too many seeks
+	for j := st.lastMatch + chunkSize; j < fi.Size(); j += chunkSize {
+		if err := st.matched(h, ms, head, j, -2); err != nil {
+			return err
+		}
+	}
+	if err := st.matched(h, ms, head, fi.Size(), -1); err != nil {
+		return err
+	}
+
+	if st.Opts.InfoGTE(rsyncopts.INFO_PROGRESS, 1) {
+		st.Progress.Show(uint64(fi.Size()), true)
+	}
+
+	_, err = st.Conn.Writer.Write(h.Sum(nil))
+	return err
+}
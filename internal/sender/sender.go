@@ -1,8 +1,8 @@
 package sender
 
 import (
-	"encoding/binary"
 	"fmt"
+	"hash"
 	"io"
 	"os"
 	"sort"
@@ -11,41 +11,89 @@ import (
 	"github.com/gokrazy/rsync/internal/rsyncchecksum"
 	"github.com/gokrazy/rsync/internal/rsynccommon"
 	"github.com/gokrazy/rsync/internal/rsyncopts"
-	"github.com/mmcloughlin/md4"
+	"github.com/gokrazy/rsync/internal/rsyncwire"
 	"golang.org/x/sync/errgroup"
 )
 
+// SendFiles sends the files which the generator requests from the file lists
+// in st.flists.
+//
 // rsync/sender.c:send_files()
-func (st *Transfer) SendFiles(fileList *fileList) error {
+func (st *Transfer) SendFiles() error {
+	// Protocol 29 added a phase in which the generator re-requests files
+	// whose whole-file checksum did not match.
+	maxPhase := 1
+	if st.Protocol >= 29 {
+		maxPhase = 2
+	}
 	phase := 0
 	for {
+		if st.incRecurse() {
+			if err := st.sendExtraFileLists(minFileCntLookahead); err != nil {
+				return err
+			}
+		}
+
 		// receive data about receiver’s copy of the file list contents (not
 		// ordered)
 		// see (*rsync.Receiver).Generator()
-		fileIndex, err := st.Conn.ReadInt32()
+		fileIndex, attrs, err := rsynccommon.ReadNdxAndAttrs(st.Conn, st.Protocol)
 		if err != nil {
 			return err
 		}
-		if fileIndex == -1 {
-			if phase == 0 {
-				phase++
-				// acknowledge phase change by sending -1
-				if err := st.Conn.WriteInt32(-1); err != nil {
-					return err
+		if fileIndex == rsync.NDX_DONE {
+			if st.incRecurse() && st.flistsDone < len(st.flists) {
+				// The generator finished a file list.
+				st.flistsDone++
+				if st.flistsDone < len(st.flists) {
+					if err := st.Conn.WriteNdx(st.Protocol, rsync.NDX_DONE); err != nil {
+						return err
+					}
+					continue
 				}
-				continue
 			}
-			break
+			phase++
+			if phase > maxPhase {
+				break
+			}
+			st.redoing = true
+			// acknowledge phase change by sending NDX_DONE
+			if err := st.Conn.WriteNdx(st.Protocol, rsync.NDX_DONE); err != nil {
+				return err
+			}
+			continue
+		}
+		if fileIndex < 0 {
+			return fmt.Errorf("protocol error: invalid file index %d", fileIndex)
+		}
+		f, err := st.fileForIndex(fileIndex)
+		if err != nil {
+			return err
+		}
+		if f == nil && attrs.Flags&rsync.ITEM_TRANSFER != 0 {
+			return fmt.Errorf("protocol error: cannot transfer directory index %d", fileIndex)
+		}
+		if st.xattrRequestFollows(attrs) {
+			if err := st.recvXattrRequest(f); err != nil {
+				return err
+			}
 		}
 
-		if st.Opts.DryRun() {
-			if err := st.Conn.WriteInt32(fileIndex); err != nil {
+		if attrs.Flags&rsync.ITEM_TRANSFER == 0 || st.Opts.DryRun() {
+			switch {
+			case attrs.Flags&rsync.ITEM_TRANSFER != 0:
+				st.Items.LogItem(f.logFile(), attrs.Flags, "")
+			case f != nil:
+				st.Items.MaybeLogItem(f.logFile(), attrs.Flags, attrs.Xname)
+			}
+			// Echo the item back to the receiver for logging.
+			if err := st.writeNdxAndAttrs(fileIndex, attrs, f); err != nil {
 				return err
 			}
 			continue
 		}
 
-		fl := fileList.Files[fileIndex]
+		fl := *f
 		st.Progress.Reset(uint64(fl.Length))
 
 		head, err := st.receiveSums()
@@ -83,31 +131,41 @@ func (st *Transfer) SendFiles(fileList *fileList) error {
 		}
 
 		st.lastMatch = 0
-		if len(head.Sums) == 0 {
+		st.setCompression(fl.path)
+		switch {
+		case st.appendMode() > 0 && head.ChecksumCount > 0:
+			err = st.sendAppended(head, fileIndex, attrs, fl)
+		case len(head.Sums) == 0:
 			// fast path: send the whole file
-			err = st.sendFile(fileIndex, fl)
-		} else {
-			err = st.hashSearch(targets, tagTable, head, fileIndex, fl)
+			err = st.sendFile(fileIndex, attrs, head, fl)
+		default:
+			err = st.hashSearch(targets, tagTable, head, fileIndex, attrs, fl, st.updatingBasisFile(attrs))
 		}
 		if err != nil {
 			if _, ok := err.(*os.PathError); ok {
 				// OpenFile() failed. Log the error (server side only) and
-				// proceed. Only starting with protocol 30, an I/O error flag is
-				// sent after the file transfer phase.
+				// proceed. Only starting with protocol 30, the receiver is
+				// told that the file will not be sent.
 				if os.IsNotExist(err) {
 					st.Logger.Printf("file has vanished: %s", fl.path)
 				} else {
 					st.Logger.Printf("sendFiles: %v", err)
 				}
+				if st.Protocol >= 30 {
+					if err := st.Conn.WriteMsgInt32(rsyncwire.MsgNoSend, fileIndex); err != nil {
+						return err
+					}
+				}
 				continue
 			} else {
 				return err
 			}
 		}
+		st.Items.EndTransfer(fl.logFile(), attrs.Flags)
 	}
 
 	// phase done
-	if err := st.Conn.WriteInt32(-1); err != nil {
+	if err := st.Conn.WriteNdx(st.Protocol, rsync.NDX_DONE); err != nil {
 		return err
 	}
 
@@ -117,9 +175,16 @@ func (st *Transfer) SendFiles(fileList *fileList) error {
 // rsync/sender.c:receive_sums()
 func (st *Transfer) receiveSums() (rsync.SumHead, error) {
 	var head rsync.SumHead
-	if err := head.ReadFrom(st.Conn); err != nil {
+	if err := head.ReadFrom(st.Conn, st.Protocol); err != nil {
 		return head, err
 	}
+	if max := st.Checksums.Xfer.Size(); int(head.ChecksumLength) > max {
+		return head, fmt.Errorf("invalid checksum length %d [%s]", head.ChecksumLength, st.Checksums.Xfer)
+	}
+	if st.appendMode() > 0 {
+		// The generator sends no sums, see rsync.SumHead.FileLength.
+		return head, nil
+	}
 	var offset int64
 	head.Sums = make([]rsync.SumBuf, int(head.ChecksumCount))
 	for i := int32(0); i < head.ChecksumCount; i++ {
@@ -150,7 +215,7 @@ func (st *Transfer) receiveSums() (rsync.SumHead, error) {
 	return head, nil
 }
 
-func (st *Transfer) sendFile(fileIndex int32, fl file) error {
+func (st *Transfer) sendFile(fileIndex int32, attrs rsynccommon.ItemAttrs, head rsync.SumHead, fl file) error {
 	// rsync/rsync.h defines chunkSize as 32 * 1024, but increasing it to 256K
 	// increases throughput with “tridge” rsync as client by 50 Mbit/s.
 	const chunkSize = 256 * 1024
@@ -166,25 +231,20 @@ func (st *Transfer) sendFile(fileIndex int32, fl file) error {
 		return err
 	}
 
-	if err := st.Conn.WriteInt32(fileIndex); err != nil {
+	if err := st.writeNdxAndAttrs(fileIndex, attrs, &fl); err != nil {
 		return err
 	}
 
-	sh := rsynccommon.SumSizesSqroot(fi.Size())
-	if err := sh.WriteTo(st.Conn); err != nil {
+	// Like tridge rsync, echo the sum head which the generator sent.
+	if err := head.WriteTo(st.Conn); err != nil {
 		return err
 	}
 
-	if !st.Opts.Server() &&
-		st.Opts.InfoGTE(rsyncopts.INFO_NAME, 1) &&
-		st.Opts.InfoGTE(rsyncopts.INFO_PROGRESS, 1) {
-		fmt.Fprintln(st.Env.Stdout, fl.path)
-	}
+	st.Items.BeginTransfer(fl.logFile(), attrs.Flags)
 
-	h := md4.New()
-	binary.Write(h, binary.LittleEndian, st.Seed)
+	h := st.Checksums.Xfer.New(st.Seed)
 
-	// Calculate the md4 hash in a goroutine.
+	// Calculate the whole-file checksum in a goroutine.
 	//
 	// This allows an rsync connection to benefit from more than 1 core!
 	//
@@ -205,6 +265,22 @@ func (st *Transfer) sendFile(fileIndex int32, fl file) error {
 		return nil
 	})
 
+	if st.Opts.Compress() {
+		// The literal data of a compressed transfer is sent as deflated
+		// tokens, which end with an END_FLAG instead of a 0 chunk size.
+		//
+		// rsync/match.c:match_sums (!s->count)
+		ms := mapFile(f, fi.Size(), chunkSize, 0)
+		ms.skipHoles = st.Opts.SparseFiles()
+		if err := st.sendToken(ms, -1, 0, fi.Size(), 0); err != nil {
+			return err
+		}
+		if st.Opts.InfoGTE(rsyncopts.INFO_PROGRESS, 1) {
+			st.Progress.Show(uint64(fi.Size()), true)
+		}
+		return st.sendFileSum(&eg, h)
+	}
+
 	offset := 0
 	buf := make([]byte, chunkSize)
 	for {
@@ -237,7 +313,12 @@ func (st *Transfer) sendFile(fileIndex int32, fl file) error {
 		return err
 	}
 
-	// whole file long checksum (16 bytes)
+	return st.sendFileSum(&eg, h)
+}
+
+// sendFileSum sends the whole file long checksum (16 bytes) once eg (which
+// calculates the checksum) is done.
+func (st *Transfer) sendFileSum(eg *errgroup.Group, h hash.Hash) error {
 	if err := eg.Wait(); err != nil {
 		return err
 	}
@@ -5,6 +5,11 @@ import (
 	"io"
 	"io/fs"
 	"os"
+	"path"
+	"path/filepath"
+	"syscall"
+
+	"github.com/gokrazy/rsync/internal/xattr"
 )
 
 // FileSource is the interface which the gokrazy rsync sender uses
@@ -20,9 +25,29 @@ type FileSource interface {
 	// Readlink reads a symlink target. Needs fs.ReadLinkFS.
 	Readlink(name string) (string, error)
 
+	// Stat returns the file info of a file, following symlinks (for
+	// --copy-links), which must not leave the source of a daemon module.
+	Stat(name string) (fs.FileInfo, error)
+
+	// Xattrs returns the extended attributes of a file (without following
+	// symlinks). Sources without extended attributes return none.
+	Xattrs(name string) (map[string][]byte, error)
+
 	Close() error
 }
 
+// XattrFS is the interface implemented by a file system which provides the
+// extended attributes of its files for --xattrs. With --acls, the ACLs of its
+// files are taken from the system.posix_acl_access and
+// system.posix_acl_default attributes (in the Linux format).
+type XattrFS interface {
+	fs.FS
+
+	// Xattrs returns the extended attributes of the named file, without
+	// following symlinks.
+	Xattrs(name string) (map[string][]byte, error)
+}
+
 type File interface {
 	fs.File
 	io.Seeker
@@ -36,14 +61,76 @@ func newOSRootSource(root *os.Root) FileSource {
 	return &osRootSource{root: root}
 }
 
-func (s *osRootSource) FS() fs.FS                            { return s.root.FS() }
-func (s *osRootSource) Open(name string) (File, error)       { return s.root.Open(name) }
-func (s *osRootSource) Readlink(name string) (string, error) { return s.root.Readlink(name) }
-func (s *osRootSource) Close() error                         { return s.root.Close() }
+func (s *osRootSource) FS() fs.FS                             { return s.root.FS() }
+func (s *osRootSource) Open(name string) (File, error)        { return s.root.Open(name) }
+func (s *osRootSource) Readlink(name string) (string, error)  { return s.root.Readlink(name) }
+func (s *osRootSource) Stat(name string) (fs.FileInfo, error) { return s.root.Stat(name) }
+func (s *osRootSource) Close() error                          { return s.root.Close() }
+
+func (s *osRootSource) Xattrs(name string) (map[string][]byte, error) {
+	x := xattr.InRoot(s.root, name)
+	names, err := x.List()
+	if err != nil {
+		return nil, err
+	}
+	xattrs := make(map[string][]byte, len(names))
+	for _, attr := range names {
+		value, err := x.Get(attr)
+		if err != nil {
+			return nil, err
+		}
+		xattrs[attr] = value
+	}
+	return xattrs, nil
+}
+
+// osDirSource is a FileSource for a local directory, in which symlinks are
+// followed wherever they point to (unlike within an *os.Root).
+type osDirSource struct {
+	dir string
+}
+
+func openOSDirSource(dir string) (FileSource, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, &fs.PathError{Op: "open", Path: dir, Err: syscall.ENOTDIR}
+	}
+	return &osDirSource{dir: dir}, nil
+}
+
+func (s *osDirSource) path(name string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(name))
+}
+
+func (s *osDirSource) FS() fs.FS                             { return os.DirFS(s.dir) }
+func (s *osDirSource) Open(name string) (File, error)        { return os.Open(s.path(name)) }
+func (s *osDirSource) Readlink(name string) (string, error)  { return os.Readlink(s.path(name)) }
+func (s *osDirSource) Stat(name string) (fs.FileInfo, error) { return os.Stat(s.path(name)) }
+func (s *osDirSource) Close() error                          { return nil }
+
+func (s *osDirSource) Xattrs(name string) (map[string][]byte, error) {
+	// The parent directory might only be reachable through symlinks which
+	// leave dir, so it becomes the root.
+	fn := s.path(name)
+	root, err := os.OpenRoot(filepath.Dir(fn))
+	if err != nil {
+		return nil, err
+	}
+	defer root.Close()
+	return newOSRootSource(root).Xattrs(filepath.Base(fn))
+}
 
 // fsSource wraps an fs.FS to implement FileSource.
 type fsSource struct {
 	fsys fs.FS
+
+	// xattrFS provides the extended attributes of the files in fsys, which
+	// is xattrDir within xattrFS (see subFSSource).
+	xattrFS  XattrFS
+	xattrDir string
 }
 
 // NewFSSource creates a FileSource from an fs.FS.
@@ -53,8 +140,26 @@ type fsSource struct {
 //
 // The fs.FS should implement ReadLinkFS,
 // otherwise working with symlinks will fail.
+//
+// The fs.FS can implement XattrFS to provide extended attributes.
 func NewFSSource(fsys fs.FS) FileSource {
-	return &fsSource{fsys: fsys}
+	s := &fsSource{fsys: fsys}
+	s.xattrFS, _ = fsys.(XattrFS)
+	return s
+}
+
+// subFSSource returns a FileSource for the subdirectory dir of s.
+func subFSSource(s FileSource, dir string) (FileSource, error) {
+	sub, err := fs.Sub(s.FS(), dir)
+	if err != nil {
+		return nil, err
+	}
+	subSource := &fsSource{fsys: sub}
+	if fss, ok := s.(*fsSource); ok && fss.xattrFS != nil {
+		subSource.xattrFS = fss.xattrFS
+		subSource.xattrDir = path.Join(fss.xattrDir, dir)
+	}
+	return subSource, nil
 }
 
 func (s *fsSource) FS() fs.FS { return s.fsys }
@@ -79,4 +184,18 @@ func (s *fsSource) Readlink(name string) (string, error) {
 	return "", fmt.Errorf("readlink %s: fs.FS does not implement fs.ReadLinkFS", name)
 }
 
+func (s *fsSource) Stat(name string) (fs.FileInfo, error) {
+	return fs.Stat(s.fsys, name)
+}
+
+func (s *fsSource) Xattrs(name string) (map[string][]byte, error) {
+	if s.xattrFS == nil {
+		return nil, nil
+	}
+	if s.xattrDir != "" {
+		name = path.Join(s.xattrDir, name)
+	}
+	return s.xattrFS.Xattrs(name)
+}
+
 func (s *fsSource) Close() error { return nil }
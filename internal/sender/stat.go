@@ -15,3 +15,15 @@ func gidFromFileInfo(fs.FileInfo) (int32, bool) {
 func rdevFromFileInfo(fs.FileInfo) (int32, bool) {
 	return 0, false
 }
+
+func devInoFromFileInfo(fs.FileInfo) (dev, ino int64, _ bool) {
+	return 0, 0, false
+}
+
+func rdevMajorMinorFromFileInfo(fs.FileInfo) (major, minor uint32, _ bool) {
+	return 0, 0, false
+}
+
+func nlinkFromFileInfo(fs.FileInfo) (uint64, bool) {
+	return 0, false
+}
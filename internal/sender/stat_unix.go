@@ -5,6 +5,8 @@ package sender
 import (
 	"io/fs"
 	"syscall"
+
+	"golang.org/x/sys/unix"
 )
 
 func uidFromFileInfo(info fs.FileInfo) (int32, bool) {
@@ -30,3 +32,27 @@ func rdevFromFileInfo(info fs.FileInfo) (int32, bool) {
 	}
 	return int32(st.Rdev), true
 }
+
+func devInoFromFileInfo(info fs.FileInfo) (dev, ino int64, _ bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return int64(st.Dev), int64(st.Ino), true
+}
+
+func rdevMajorMinorFromFileInfo(info fs.FileInfo) (major, minor uint32, _ bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return unix.Major(uint64(st.Rdev)), unix.Minor(uint64(st.Rdev)), true
+}
+
+func nlinkFromFileInfo(info fs.FileInfo) (uint64, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return uint64(st.Nlink), true
+}
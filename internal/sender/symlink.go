@@ -0,0 +1,76 @@
+package sender
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+
+	"github.com/gokrazy/rsync"
+	"github.com/gokrazy/rsync/internal/rsynccommon"
+	"github.com/gokrazy/rsync/internal/rsyncopts"
+)
+
+// readlinkStat returns the file info to send for the symlink path (whose
+// info is that of the symlink itself) and its target. With --copy-links, and
+// with --copy-unsafe-links for symlinks pointing outside of the transfer, the
+// file which the symlink refers to is sent instead, provided that it is within
+// the module for daemon modules (see scopedWalker.openDir). Symlinks without a
+// referent are reported as I/O errors.
+//
+// rsync/flist.c:readlink_stat
+func (s *scopedWalker) readlinkStat(path string, info fs.FileInfo) (fs.FileInfo, string, error) {
+	opts := s.st.Opts // for convenience
+	if opts.CopyLinks() {
+		return s.followSymlink(path)
+	}
+	if !opts.PreserveLinks() && !opts.CopyUnsafeLinks() {
+		// The target is not sent.
+		return info, "", nil
+	}
+	target, err := s.source.Readlink(path)
+	if err != nil {
+		return nil, "", err
+	}
+	// The symlink's safety margin is its depth within the transfer.
+	name := strings.TrimPrefix(path, s.strip)
+	if opts.CopyUnsafeLinks() && rsynccommon.UnsafeSymlink(target, name) {
+		if opts.InfoGTE(rsyncopts.INFO_SYMSAFE, 1) {
+			s.st.Logger.Printf("copying unsafe symlink %q -> %q", path, target)
+		}
+		return s.followSymlink(path)
+	}
+	if opts.MungeLinks() && len(target) > len(rsync.SYMLINK_PREFIX) {
+		// Unmunge the symlink, which the receiver munges again.
+		target = strings.TrimPrefix(target, rsync.SYMLINK_PREFIX)
+	}
+	return info, target, nil
+}
+
+func (s *scopedWalker) followSymlink(path string) (fs.FileInfo, string, error) {
+	info, err := s.source.Stat(path)
+	if err != nil {
+		return nil, "", fmt.Errorf("symlink has no referent: %v", err)
+	}
+	return info, "", nil
+}
+
+// symlinkLoops reports whether the directory info, which the symlink path
+// refers to, contains path (by device and inode number), in which case
+// following the symlink would recurse forever.
+func (s *scopedWalker) symlinkLoops(name string, info fs.FileInfo) bool {
+	dev, ino, ok := devInoFromFileInfo(info)
+	if !ok {
+		return false
+	}
+	for dir := path.Dir(name); ; dir = path.Dir(dir) {
+		if parent, err := s.source.Stat(dir); err == nil {
+			if pdev, pino, _ := devInoFromFileInfo(parent); pdev == dev && pino == ino {
+				return true
+			}
+		}
+		if dir == "." || dir == "/" {
+			return false
+		}
+	}
+}
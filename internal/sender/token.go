@@ -1,5 +1,13 @@
 package sender
 
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"path"
+	"strings"
+)
+
 // rsync/token.c:simple_send_token
 func (st *Transfer) simpleSendToken(ms *mapStruct, token int32, offset int64, n int64) error {
 	if n > 0 {
@@ -31,7 +39,263 @@ func (st *Transfer) simpleSendToken(ms *mapStruct, token int32, offset int64, n
 }
 
 // rsync/token.c:send_token
-func (st *Transfer) sendToken(ms *mapStruct, i int32, offset int64, n int64) error {
-	// TODO(compression): send deflated token
+func (st *Transfer) sendToken(ms *mapStruct, i int32, offset int64, n int64, toklen int64) error {
+	if st.Opts.Compress() {
+		return st.sendDeflatedToken(ms, i, offset, n, toklen)
+	}
 	return st.simpleSendToken(ms, i, offset, n)
 }
+
+// Flags of the deflated token stream.
+//
+// rsync/token.c
+const (
+	endFlag      = 0    // that's all folks
+	tokenLong    = 0x20 // followed by 32-bit token number
+	tokenrunLong = 0x21 // ditto with 16-bit run count
+	deflatedData = 0x40 // + 6-bit high len, then low len byte
+	tokenRel     = 0x80 // + 6-bit relative token number
+	tokenrunRel  = 0xc0 // ditto with 16-bit run count
+
+	maxDataCount = 16383 // fit 14 bit count into 2 bytes with flags
+
+	// The deflate window size: data which the receiver has seen within the
+	// last windowSize bytes can be referenced by the compressor.
+	windowSize = 32 * 1024
+)
+
+// syncMarker is the end of a Z_SYNC_FLUSH (an empty stored block), which is
+// not transmitted. The receiver re-inserts it.
+var syncMarker = []byte{0, 0, 0xff, 0xff}
+
+// tokenDeflater holds the state of the deflated token stream, which spans all
+// tokens of one file.
+type tokenDeflater struct {
+	lastToken    int32
+	runStart     int32
+	lastRunEnd   int32
+	flushPending bool
+
+	level int
+	fw    *flate.Writer
+	obuf  bytes.Buffer // compressed data which was not yet sent
+	// history contains the last windowSize bytes of data that the compressor
+	// (and hence the receiver’s decompressor) has seen: literal data as well
+	// as matched blocks.
+	history []byte
+	// primed is set when matched block data was added to history, which
+	// the compressor needs to start over from.
+	primed bool
+}
+
+func (d *tokenDeflater) see(data []byte) {
+	if len(data) >= windowSize {
+		d.history = append(d.history[:0], data[len(data)-windowSize:]...)
+		return
+	}
+	if len(d.history)+len(data) > windowSize {
+		drop := len(d.history) + len(data) - windowSize
+		d.history = append(d.history[:0], d.history[drop:]...)
+	}
+	d.history = append(d.history, data...)
+}
+
+// compress feeds data into the compressor. Unlike zlib, compress/flate cannot
+// add data to the history of a running compressor (Z_INSERT_ONLY), so after
+// matched blocks were seen, a new compressor is started with the history as
+// preset dictionary. This is compatible with the receiver: the previous run
+// of compressed data ended in a sync flush, so the new compressor’s output
+// starts at a block boundary within the same stream.
+func (d *tokenDeflater) compress(data []byte) error {
+	if d.fw == nil || d.primed {
+		fw, err := flate.NewWriterDict(&d.obuf, d.level, d.history)
+		if err != nil {
+			return err
+		}
+		d.fw = fw
+		d.primed = false
+	}
+	d.see(data)
+	_, err := d.fw.Write(data)
+	return err
+}
+
+// sendDeflated sends the compressed data in d.obuf. Unless all is true, the
+// last (incomplete) frame is kept in the buffer.
+func (st *Transfer) sendDeflated(all bool) error {
+	d := st.deflater
+	for d.obuf.Len() >= maxDataCount || (all && d.obuf.Len() > 0) {
+		n := min(d.obuf.Len(), maxDataCount)
+		hdr := []byte{byte(deflatedData + (n >> 8)), byte(n)}
+		if _, err := st.Conn.Writer.Write(hdr); err != nil {
+			return err
+		}
+		if _, err := st.Conn.Writer.Write(d.obuf.Next(n)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Send a deflated token.
+//
+// rsync/token.c:send_deflated_token
+func (st *Transfer) sendDeflatedToken(ms *mapStruct, token int32, offset int64, nb int64, toklen int64) error {
+	if st.deflater == nil {
+		st.deflater = &tokenDeflater{lastToken: -1}
+	}
+	d := st.deflater
+	switch {
+	case d.lastToken == -1:
+		// initialization (start of a file)
+		d.fw = nil
+		d.obuf.Reset()
+		d.history = d.history[:0]
+		d.primed = false
+		d.level = st.compressionLevel
+		d.lastRunEnd = 0
+		d.runStart = token
+		d.flushPending = false
+
+	case d.lastToken == -2:
+		d.runStart = token
+
+	case nb != 0 || token != d.lastToken+1 || token >= d.runStart+65536:
+		// output previous run
+		r := d.runStart - d.lastRunEnd
+		n := d.lastToken - d.runStart
+		if r >= 0 && r <= 63 {
+			flag := byte(tokenrunRel)
+			if n == 0 {
+				flag = tokenRel
+			}
+			if err := st.Conn.WriteByte(flag + byte(r)); err != nil {
+				return err
+			}
+		} else {
+			flag := byte(tokenrunLong)
+			if n == 0 {
+				flag = tokenLong
+			}
+			if err := st.Conn.WriteByte(flag); err != nil {
+				return err
+			}
+			if err := st.Conn.WriteInt32(d.runStart); err != nil {
+				return err
+			}
+		}
+		if n != 0 {
+			if _, err := st.Conn.Writer.Write([]byte{byte(n), byte(n >> 8)}); err != nil {
+				return err
+			}
+		}
+		d.lastRunEnd = d.lastToken
+		d.runStart = token
+	}
+
+	d.lastToken = token
+
+	if nb != 0 || d.flushPending {
+		// deflate the data starting at offset
+		for nb > 0 {
+			n := min(int64(chunkSize), nb)
+			chunk, err := ms.ptr(offset, int32(n))
+			if err != nil {
+				return err
+			}
+			if err := d.compress(chunk); err != nil {
+				return err
+			}
+			nb -= n
+			offset += n
+			if err := st.sendDeflated(false); err != nil {
+				return err
+			}
+		}
+		if token != -2 {
+			if err := d.fw.Flush(); err != nil {
+				return err
+			}
+			// Trim off the last 4 bytes of output when flushing (they are
+			// just 0, 0, ff, ff).
+			if !bytes.HasSuffix(d.obuf.Bytes(), syncMarker) {
+				return fmt.Errorf("BUG: deflate flush did not end in a sync marker")
+			}
+			d.obuf.Truncate(d.obuf.Len() - len(syncMarker))
+		}
+		if err := st.sendDeflated(true); err != nil {
+			return err
+		}
+		d.flushPending = token == -2
+	}
+
+	if token == -1 {
+		// end of file - clean up
+		return st.Conn.WriteByte(endFlag)
+	}
+	if token != -2 {
+		// Add the data in the current block to the compressor's history.
+		for toklen > 0 {
+			// Break up long sections in the same way that the receiver’s
+			// see_deflate_token() does.
+			n1 := min(toklen, 0xffff)
+			toklen -= n1
+			chunk, err := ms.ptr(offset, int32(n1))
+			if err != nil {
+				return err
+			}
+			d.see(chunk)
+			if st.Protocol >= 31 {
+				// Newer protocols avoid a data-duplicating bug.
+				offset += n1
+			}
+		}
+		d.primed = true
+	}
+	return nil
+}
+
+// defaultDontCompress lists the suffixes of files which are usually already
+// compressed, and are hence sent with compression level 0.
+//
+// rsync/loadparm.c:default_dont_compress
+const defaultDontCompress = "3g2/3gp/7z/aac/ace/apk/avi/bz2/deb/dmg/ear/f4v/flac/flv/gpg/gz/iso/jar/jpeg/jpg/lrz/lz/lz4/lzma/lzo/m1a/m1v/m2a/m2ts/m2v/m4a/m4b/m4p/m4r/m4v/mka/mkv/mov/mp1/mp2/mp3/mp4/mpa/mpeg/mpg/mpv/mts/odb/odf/odg/odi/odm/odp/ods/odt/oga/ogg/ogm/ogv/ogx/opus/otg/oth/otp/ots/ott/oxt/png/qt/rar/rpm/rz/rzip/spx/squashfs/sxc/sxd/sxg/sxm/sxw/sz/tbz/tbz2/tgz/tlz/ts/txz/tzo/vob/webm/webp/wim/wma/wmv/xz/z/zip/zst"
+
+// skipCompress reports whether the file name matches one of the suffixes of
+// the --skip-compress list (case-insensitive, with support for [] character
+// classes).
+//
+// rsync/token.c:set_compression
+func skipCompress(list, fn string) bool {
+	suffix := path.Ext(path.Base(fn))
+	if suffix == "" {
+		return false
+	}
+	suffix = strings.ToLower(suffix[1:])
+	for pattern := range strings.SplitSeq(strings.ToLower(list), "/") {
+		if pattern == "" {
+			continue
+		}
+		if match, _ := path.Match(pattern, suffix); match {
+			return true
+		}
+	}
+	return false
+}
+
+// setCompression sets the compression level for the next file to send.
+//
+// rsync/token.c:set_compression
+func (st *Transfer) setCompression(fn string) {
+	if !st.Opts.Compress() {
+		return
+	}
+	st.compressionLevel = st.Opts.CompressionLevel()
+	list := st.Opts.SkipCompress()
+	if list == "" {
+		list = defaultDontCompress
+	}
+	if skipCompress(list, fn) {
+		st.compressionLevel = flate.NoCompression
+	}
+}
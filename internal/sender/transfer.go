@@ -3,8 +3,11 @@ package sender
 import (
 	"io"
 
+	"github.com/gokrazy/rsync"
 	"github.com/gokrazy/rsync/internal/log"
 	"github.com/gokrazy/rsync/internal/progress"
+	"github.com/gokrazy/rsync/internal/rsyncchecksum"
+	"github.com/gokrazy/rsync/internal/rsynccommon"
 	"github.com/gokrazy/rsync/internal/rsyncopts"
 	"github.com/gokrazy/rsync/internal/rsyncos"
 	"github.com/gokrazy/rsync/internal/rsyncwire"
@@ -41,10 +44,117 @@ type Transfer struct {
 	Progress progress.Printer
 	Source   FileSource // for modules specifying a fs.FS
 
+	// Items logs the transferred and changed files (--out-format,
+	// --itemize-changes).
+	Items *rsynccommon.ItemLog
+
+	// FilesFrom lists the names to transfer when the --files-from option
+	// is set (see ReadFilesFrom).
+	FilesFrom []string
+
 	// state
-	Conn      *rsyncwire.Conn
-	Seed      int32
+	Conn *rsyncwire.Conn
+	Seed int32
+	// Protocol is the negotiated protocol version.
+	Protocol int32
+	// CompatFlags are the rsync.CF_* flags sent by the server (protocol >= 30).
+	CompatFlags int32
+	// Checksums are the negotiated checksum algorithms.
+	Checksums rsyncchecksum.Choice
 	lastMatch int64
+
+	// redoing is set once the generator requests the files which failed
+	// verification again, which are transferred without --append.
+	redoing bool
+
+	// compression state, see sendDeflatedToken
+	compressionLevel int
+	deflater         *tokenDeflater
+
+	// xattrIndex maps the extended attribute lists sent so far (see
+	// xattrList.key) to their index, by which the receiver refers to them.
+	xattrIndex map[string]int32
+
+	// accessACLIndex and defaultACLIndex map the ACLs sent so far (see
+	// aclKey) to their index, by which the receiver refers to them.
+	accessACLIndex  map[string]int32
+	defaultACLIndex map[string]int32
+
+	// ioErrors is set when reading the source fails, and is transmitted at
+	// the end of the file list.
+	ioErrors int32
+
+	// flists are the file lists sent so far. The generator has finished
+	// the first flistsDone lists.
+	flists     []*fileList
+	flistsDone int
+
+	// incremental recursion state, see sendExtraFileLists
+	dirStack     []pendingDir
+	numDirs      int32
+	flistEOF     bool
+	activeWalker *scopedWalker
+	extraSize    int64 // total size of the extra file lists
 }
 
 //func (rt *Transfer) listOnly() bool { return rt.Dest == "" }
+
+// properSeedOrder reports whether the checksum seed is hashed before the
+// data (see rsyncchecksum.Type.Checksum2).
+// IOErrors returns the I/O error flags (rsync.IOERR_*) of reading the source,
+// which the sender transmits to the receiver.
+func (st *Transfer) IOErrors() int32 {
+	return st.ioErrors
+}
+
+func (st *Transfer) properSeedOrder() bool {
+	return st.CompatFlags&rsync.CF_CHKSUM_SEED_FIX != 0
+}
+
+// incRecurse reports whether the file list is sent incrementally, one file
+// list per directory.
+func (st *Transfer) incRecurse() bool {
+	return st.CompatFlags&rsync.CF_INC_RECURSE != 0
+}
+
+// varintFlags reports whether the file list flags are transferred as varint,
+// which also terminates the file list with the I/O error flag.
+func (st *Transfer) varintFlags() bool {
+	return st.CompatFlags&rsync.CF_VARINT_FLIST_FLAGS != 0
+}
+
+// appendMode returns the --append mode (see rsyncopts.Options.AppendMode) of
+// the current phase.
+func (st *Transfer) appendMode() int {
+	if st.redoing {
+		return 0
+	}
+	return st.Opts.AppendMode()
+}
+
+// appendVerify reports whether the data which the receiver already has is
+// included in the whole-file checksum: with --append-verify, and with --append
+// for protocol versions < 30.
+//
+// rsync/compat.c:setup_protocol
+func (st *Transfer) appendVerify() bool {
+	mode := st.appendMode()
+	return mode > 1 || (mode == 1 && st.Protocol < 30)
+}
+
+// updatingBasisFile reports whether the receiver writes the file in place
+// while reading matched blocks from it (--inplace), i.e. the generator did
+// not use a different basis file.
+//
+// rsync/sender.c:send_files
+func (st *Transfer) updatingBasisFile(attrs rsynccommon.ItemAttrs) bool {
+	if !st.Opts.Inplace() {
+		return false
+	}
+	if st.Protocol < 29 {
+		// The generator uses a backup copy as basis with --backup.
+		return !st.Opts.MakeBackups()
+	}
+	return attrs.Flags&rsync.ITEM_BASIS_TYPE_FOLLOWS == 0 ||
+		attrs.FnamecmpType == rsync.FNAMECMP_FNAME
+}
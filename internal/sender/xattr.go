@@ -0,0 +1,220 @@
+package sender
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io/fs"
+	"slices"
+	"strings"
+
+	"github.com/gokrazy/rsync/internal/rsynccommon"
+	"github.com/gokrazy/rsync/internal/rsyncwire"
+)
+
+// xattrItem is an extended attribute in the file list.
+type xattrItem struct {
+	name   string
+	length int
+	value  []byte // only if length <= rsynccommon.MaxFullXattrDatum
+	sum    [md5.Size]byte
+
+	// todo is set when the receiver requested the (abbreviated) value.
+	todo bool
+}
+
+// abbreviated reports whether only the checksum of the value is sent in the
+// file list.
+func (it *xattrItem) abbreviated() bool {
+	return it.length > rsynccommon.MaxFullXattrDatum
+}
+
+// xattrList is the list of extended attributes of one or more files, sorted
+// by name.
+type xattrList struct {
+	items []xattrItem
+}
+
+// key identifies the contents of the list, see Transfer.xattrIndex.
+func (xal *xattrList) key() string {
+	var b strings.Builder
+	for _, it := range xal.items {
+		fmt.Fprintf(&b, "%s\x00%d\x00", it.name, it.length)
+		if it.abbreviated() {
+			b.Write(it.sum[:])
+		} else {
+			b.Write(it.value)
+		}
+	}
+	return b.String()
+}
+
+// getXattrs returns the extended attributes of the file path with mode, or
+// nil if the extended attributes of such files are not preserved.
+//
+// rsync/xattrs.c:get_xattr
+func (s *scopedWalker) getXattrs(path string, mode fs.FileMode) (*xattrList, error) {
+	opts := s.st.Opts // for convenience
+	switch {
+	case mode.IsRegular(), mode.IsDir():
+		// Everyone supports this.
+	case mode&fs.ModeSymlink != 0:
+		if !opts.PreserveLinks() {
+			return nil, nil
+		}
+	case mode&(fs.ModeNamedPipe|fs.ModeSocket) != 0:
+		if !opts.PreserveSpecials() {
+			return nil, nil
+		}
+	case mode&fs.ModeDevice != 0:
+		if !opts.PreserveDevices() {
+			return nil, nil
+		}
+	}
+	xattrs, err := s.source.Xattrs(path)
+	if err != nil {
+		return nil, err
+	}
+	xal := &xattrList{}
+	for name, value := range xattrs {
+		// Unlike the receiver, the sender reads all namespaces it can.
+		if rsynccommon.SkipXattr(name, opts.PreserveXattrs(), false) {
+			continue
+		}
+		it := xattrItem{
+			name:   name,
+			length: len(value),
+		}
+		if it.abbreviated() {
+			it.sum = rsynccommon.XattrSum(value)
+		} else {
+			it.value = value
+		}
+		xal.items = append(xal.items, it)
+	}
+	slices.SortFunc(xal.items, func(a, b xattrItem) int {
+		return strings.Compare(a.name, b.name)
+	})
+	return xal, nil
+}
+
+// encodeXattrs encodes the extended attributes xal of a file list entry into
+// fec: an index into the lists sent so far if the same list was sent before,
+// the list itself otherwise.
+//
+// rsync/xattrs.c:send_xattr
+func (st *Transfer) encodeXattrs(fec *rsyncwire.Buffer, xal *xattrList) {
+	if xal == nil {
+		xal = &xattrList{}
+	}
+	key := xal.key()
+	if ndx, ok := st.xattrIndex[key]; ok {
+		fec.WriteVarint(ndx + 1)
+		return
+	}
+	if st.xattrIndex == nil {
+		st.xattrIndex = make(map[string]int32)
+	}
+	st.xattrIndex[key] = int32(len(st.xattrIndex))
+
+	fec.WriteVarint(0)
+	fec.WriteVarint(int32(len(xal.items)))
+	for _, it := range xal.items {
+		fec.WriteVarint(int32(len(it.name) + 1)) // including the NUL byte
+		fec.WriteVarint(int32(it.length))
+		fec.WriteString(it.name)
+		fec.WriteByte(0)
+		if it.abbreviated() {
+			fec.WriteString(string(it.sum[:]))
+		} else {
+			fec.WriteString(string(it.value))
+		}
+	}
+}
+
+// recvXattrRequest reads which abbreviated extended attribute values of f
+// the receiver requests.
+//
+// rsync/xattrs.c:recv_xattr_request
+func (st *Transfer) recvXattrRequest(f *file) error {
+	var num int32
+	for {
+		rel, err := st.Conn.ReadVarint()
+		if err != nil {
+			return err
+		}
+		if rel == 0 {
+			break
+		}
+		num += rel
+		// The receiver refers to the items by their (1-based) position.
+		if f == nil || f.xattrs == nil || num < 1 || int(num) > len(f.xattrs.items) {
+			return fmt.Errorf("could not find xattr #%d for file index", num)
+		}
+		it := &f.xattrs.items[num-1]
+		if !it.abbreviated() {
+			return fmt.Errorf("internal abbrev error on %s (%s, len=%d)", f.Name, it.name, it.length)
+		}
+		it.todo = true
+	}
+	return nil
+}
+
+// sendXattrRequest sends the requested extended attribute values of f (see
+// recvXattrRequest), which are read again.
+//
+// rsync/xattrs.c:send_xattr_request
+func (st *Transfer) sendXattrRequest(f *file) error {
+	var buf rsyncwire.Buffer
+	if f != nil && f.xattrs != nil {
+		var values map[string][]byte
+		var prior int
+		for idx := range f.xattrs.items {
+			it := &f.xattrs.items[idx]
+			if !it.todo {
+				continue
+			}
+			it.todo = false
+			num := idx + 1
+			buf.WriteVarint(int32(num - prior))
+			prior = num
+			if values == nil {
+				var err error
+				values, err = f.source.Xattrs(f.path)
+				if err != nil {
+					st.Logger.Printf("failed to re-read xattrs for %s: %v", f.path, err)
+					values = map[string][]byte{}
+				}
+			}
+			value, ok := values[it.name]
+			if !ok {
+				st.Logger.Printf("failed to re-read xattr %s for %s", it.name, f.path)
+			}
+			buf.WriteVarint(int32(len(value))) // the length might have changed!
+			buf.WriteString(string(value))
+		}
+	}
+	buf.WriteByte(0) // end the list
+	return st.Conn.WriteString(buf.String())
+}
+
+// writeNdxAndAttrs writes the file list index and item attributes of f,
+// followed by the extended attribute values which the receiver requested.
+//
+// rsync/sender.c:write_ndx_and_attrs
+func (st *Transfer) writeNdxAndAttrs(fileIndex int32, attrs rsynccommon.ItemAttrs, f *file) error {
+	if err := rsynccommon.WriteNdxAndAttrs(st.Conn, st.Protocol, fileIndex, attrs); err != nil {
+		return err
+	}
+	if !st.xattrRequestFollows(attrs) {
+		return nil
+	}
+	return st.sendXattrRequest(f)
+}
+
+// xattrRequestFollows reports whether the abbreviated extended attribute
+// values are exchanged for an item with attrs.
+func (st *Transfer) xattrRequestFollows(attrs rsynccommon.ItemAttrs) bool {
+	return st.Opts.PreserveXattrs() > 0 &&
+		!st.Opts.DryRun() &&
+		rsynccommon.XattrRequestFollows(st.Protocol, st.CompatFlags, attrs)
+}
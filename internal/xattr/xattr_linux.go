@@ -0,0 +1,155 @@
+// Package xattr reads and writes the extended attributes of files, without
+// following symlinks.
+package xattr
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrNoAttr is returned (wrapped) by Get and Remove if the file has no
+// extended attribute of the given name.
+var ErrNoAttr error = unix.ENODATA
+
+// File is a file whose extended attributes are accessed: either a name
+// within a root (e.g. for symlinks, which cannot be opened), or an open file.
+type File struct {
+	root *os.Root
+	name string
+	f    *os.File
+}
+
+// InRoot returns the file name within root.
+func InRoot(root *os.Root, name string) File {
+	return File{root: root, name: name}
+}
+
+// OfFile returns the open file f.
+func OfFile(f *os.File) File {
+	return File{f: f, name: f.Name()}
+}
+
+// do calls fn with the file descriptor of the open file, or with a path
+// which refers to the file name within the root.
+func (x File) do(fn func(path string, fd int) error) error {
+	if x.f != nil {
+		return fn("", int(x.f.Fd()))
+	}
+	dir, err := x.root.Open(filepath.Dir(x.name))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	// The parent dir is safely resolved through *os.Root, so we skip path
+	// resolution by constructing a path from a known-safe prefix
+	// (/proc/self/fd/<parent-dir-fd>) and a basename (not a path!). The
+	// l*xattr functions do not follow the basename if it is a symlink.
+	//
+	// Not using filepath.Join, which would clean away a basename of ".".
+	return fn("/proc/self/fd/"+strconv.Itoa(int(dir.Fd()))+"/"+filepath.Base(x.name), -1)
+}
+
+// sized calls get with a buffer large enough for its result: get returns the
+// required size when called with an empty buffer.
+func sized(get func([]byte) (int, error)) ([]byte, error) {
+	for {
+		n, err := get(nil)
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, n)
+		if n == 0 {
+			return buf, nil
+		}
+		n, err = get(buf)
+		if err == unix.ERANGE {
+			continue // grew in the meantime
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+}
+
+// List returns the names of the extended attributes of the file. File
+// systems without extended attributes have none.
+func (x File) List() ([]string, error) {
+	var list []byte
+	err := x.do(func(path string, fd int) error {
+		var err error
+		list, err = sized(func(buf []byte) (int, error) {
+			if fd >= 0 {
+				return unix.Flistxattr(fd, buf)
+			}
+			return unix.Llistxattr(path, buf)
+		})
+		return err
+	})
+	if err == unix.ENOTSUP {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, &os.PathError{Op: "listxattr", Path: x.name, Err: err}
+	}
+	var names []string
+	for len(list) > 0 {
+		name, rest, _ := bytes.Cut(list, []byte{0})
+		if len(name) > 0 {
+			names = append(names, string(name))
+		}
+		list = rest
+	}
+	return names, nil
+}
+
+// Get returns the value of the extended attribute attr of the file.
+func (x File) Get(attr string) ([]byte, error) {
+	var value []byte
+	err := x.do(func(path string, fd int) error {
+		var err error
+		value, err = sized(func(buf []byte) (int, error) {
+			if fd >= 0 {
+				return unix.Fgetxattr(fd, attr, buf)
+			}
+			return unix.Lgetxattr(path, attr, buf)
+		})
+		return err
+	})
+	if err != nil {
+		return nil, &os.PathError{Op: "getxattr " + attr, Path: x.name, Err: err}
+	}
+	return value, nil
+}
+
+// Set sets the extended attribute attr of the file to value.
+func (x File) Set(attr string, value []byte) error {
+	err := x.do(func(path string, fd int) error {
+		if fd >= 0 {
+			return unix.Fsetxattr(fd, attr, value, 0)
+		}
+		return unix.Lsetxattr(path, attr, value, 0)
+	})
+	if err != nil {
+		return &os.PathError{Op: "setxattr " + attr, Path: x.name, Err: err}
+	}
+	return nil
+}
+
+// Remove removes the extended attribute attr of the file.
+func (x File) Remove(attr string) error {
+	err := x.do(func(path string, fd int) error {
+		if fd >= 0 {
+			return unix.Fremovexattr(fd, attr)
+		}
+		return unix.Lremovexattr(path, attr)
+	})
+	if err != nil {
+		return &os.PathError{Op: "removexattr " + attr, Path: x.name, Err: err}
+	}
+	return nil
+}
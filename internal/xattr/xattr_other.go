@@ -0,0 +1,50 @@
+//go:build !linux
+
+package xattr
+
+import (
+	"errors"
+	"os"
+)
+
+// ErrNoAttr is returned (wrapped) by Get and Remove if the file has no
+// extended attribute of the given name.
+var ErrNoAttr = errors.New("no such extended attribute")
+
+// File is a file whose extended attributes are accessed: either a name
+// within a root (e.g. for symlinks, which cannot be opened), or an open file.
+type File struct {
+	root *os.Root
+	name string
+	f    *os.File
+}
+
+// InRoot returns the file name within root.
+func InRoot(root *os.Root, name string) File {
+	return File{root: root, name: name}
+}
+
+// OfFile returns the open file f.
+func OfFile(f *os.File) File {
+	return File{f: f, name: f.Name()}
+}
+
+// List returns the names of the extended attributes of the file.
+func (x File) List() ([]string, error) {
+	return nil, &os.PathError{Op: "listxattr", Path: x.name, Err: errors.ErrUnsupported}
+}
+
+// Get returns the value of the extended attribute attr of the file.
+func (x File) Get(attr string) ([]byte, error) {
+	return nil, &os.PathError{Op: "getxattr " + attr, Path: x.name, Err: errors.ErrUnsupported}
+}
+
+// Set sets the extended attribute attr of the file to value.
+func (x File) Set(attr string, value []byte) error {
+	return &os.PathError{Op: "setxattr " + attr, Path: x.name, Err: errors.ErrUnsupported}
+}
+
+// Remove removes the extended attribute attr of the file.
+func (x File) Remove(attr string) error {
+	return &os.PathError{Op: "removexattr " + attr, Path: x.name, Err: errors.ErrUnsupported}
+}
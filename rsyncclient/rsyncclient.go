@@ -9,8 +9,10 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"time"
 
 	"github.com/gokrazy/rsync/internal/maincmd"
+	"github.com/gokrazy/rsync/internal/rsynccommon"
 	"github.com/gokrazy/rsync/internal/rsyncopts"
 	"github.com/gokrazy/rsync/internal/rsyncos"
 	"github.com/gokrazy/rsync/internal/rsyncstats"
@@ -120,14 +122,32 @@ type Result struct {
 // custom RPC protocol. In that case, you will need to transport the
 // [Client.ServerCommandOptions] to the server and then arrange for two
 // [io.ReadWriter] connections between client and server.
+//
+// Once ctx is cancelled (or the --timeout expires), Run closes conn (if it
+// implements [io.Closer]) and returns ctx.Err() (or a
+// [github.com/gokrazy/rsync.ExitError] with code RERR_TIMEOUT). Run does not
+// use conn anymore once it returned. If conn does not implement [io.Closer], a
+// read or write which is blocked in conn cannot be interrupted, and Run only
+// returns once it completes.
 func (c *Client) Run(ctx context.Context, conn io.ReadWriter, paths []string) (*Result, error) {
-	stats, err := maincmd.ClientRun(c.osenv, c.opts, conn, paths, c.negotiate)
+	wd := c.watch(ctx, conn)
+	defer wd.Stop()
+	return c.run(wd, paths)
+}
+
+func (c *Client) run(wd *rsynccommon.Watchdog, paths []string) (*Result, error) {
+	stats, err := maincmd.ClientRun(c.osenv, c.opts, wd, paths, c.negotiate)
 	if err != nil {
-		return nil, err
+		return nil, wd.Err(err)
 	}
 	return &Result{Stats: stats}, nil
 }
 
+func (c *Client) watch(ctx context.Context, conn io.ReadWriter) *rsynccommon.Watchdog {
+	timeout := time.Duration(c.opts.IOTimeoutSeconds()) * time.Second
+	return rsynccommon.NewWatchdog(ctx, conn, conn, timeout)
+}
+
 // RunDaemon starts one run of the rsync daemon protocol, meaning it performs
 // the daemon protocol inband exchange (to negotiate the protocol version and
 // select an rsync module) and then calls [Client.Run].
@@ -136,13 +156,15 @@ func (c *Client) Run(ctx context.Context, conn io.ReadWriter, paths []string) (*
 // establish the connection yourself, e.g. via the [golang.org/x/crypto/ssh]
 // package.
 func (c *Client) RunDaemon(ctx context.Context, conn io.ReadWriter, remotePath string, paths []string) (*Result, error) {
-	done, err := maincmd.StartInbandExchange(c.osenv, c.opts, conn, remotePath)
+	wd := c.watch(ctx, conn)
+	defer wd.Stop()
+	done, err := maincmd.StartInbandExchange(c.osenv, c.opts, wd, remotePath)
 	if err != nil {
-		return nil, err
+		return nil, wd.Err(err)
 	}
 	if done { // Server sent EXIT
 		return &Result{Stats: &rsyncstats.TransferStats{}}, nil
 	}
 	c.negotiate = false // done as part of the inband exchange
-	return c.Run(ctx, conn, paths)
+	return c.run(wd, paths)
 }
@@ -3,13 +3,16 @@ package rsyncclient_test
 import (
 	"bytes"
 	"context"
+	"errors"
 	"io"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/gokrazy/rsync/internal/rsyncopts"
 	"github.com/gokrazy/rsync/internal/rsyncos"
@@ -341,3 +344,115 @@ func TestClientServerCommandSender(t *testing.T) {
 	// Ensure an error would be displayed, if any.
 	wg.Wait()
 }
+
+// stallingReader stalls once it read more than limit bytes, until release is
+// closed. It reports reads after done was set.
+type stallingReader struct {
+	t       *testing.T
+	r       io.Reader
+	limit   int
+	read    int
+	stalled chan struct{}
+	release chan struct{}
+	done    atomic.Bool
+}
+
+func (s *stallingReader) Read(p []byte) (int, error) {
+	if s.done.Load() {
+		s.t.Errorf("Read after Run returned")
+	}
+	if s.read > s.limit && s.stalled != nil {
+		close(s.stalled)
+		s.stalled = nil
+		<-s.release
+	}
+	n, err := s.r.Read(p)
+	s.read += n
+	return n, err
+}
+
+// like TestClientServerCommand, but cancelling the transfer while the client
+// is blocked reading from a connection which does not implement io.Closer.
+func TestClientCancel(t *testing.T) {
+	t.Parallel()
+
+	stderr := testlogger.New(t)
+	tmp := t.TempDir()
+
+	src := filepath.Join(tmp, "src") + "/"
+	dest := filepath.Join(tmp, "dest")
+	if err := os.MkdirAll(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "large"), rsynctest.RandomBytes(1, 4<<20), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := rsyncclient.New([]string{"-a"}, rsyncclient.WithStderr(stderr), rsyncclient.DontRestrict())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rsync, err := rsyncd.NewServer(nil, rsyncd.WithStderr(stderr), rsyncd.DontRestrict())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// stdin from the view of the rsync server
+	stdinrd, stdinwr := io.Pipe()
+	stdoutrd, stdoutwr := io.Pipe()
+	conn := rsyncd.NewConnection(stdinrd, stdoutwr, "<io.Pipe>")
+	osenv := rsyncostest.New(t)
+	pc := rsyncopts.NewContext(rsyncopts.NewOptions(osenv))
+	if err := pc.ParseArguments(osenv, client.ServerCommandOptions(src)); err != nil {
+		t.Fatalf("parsing server args: %v", err)
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		// Fails once the connection is closed below.
+		rsync.InternalHandleConn(t.Context(), conn, nil, pc)
+	}()
+	defer wg.Wait()
+	defer stdinrd.Close()
+	defer stdoutwr.Close()
+
+	rd := &stallingReader{
+		t:       t,
+		r:       stdoutrd,
+		limit:   64 << 10,
+		stalled: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	stalled := rd.stalled
+	rw := &readWriter{
+		Reader: rd,
+		Writer: stdinwr,
+	}
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	errc := make(chan error, 1)
+	go func() {
+		_, err := client.Run(ctx, rw, []string{dest})
+		rd.done.Store(true)
+		errc <- err
+	}()
+
+	<-stalled
+	cancel()
+	// rw does not implement io.Closer, so Run cannot interrupt the blocked
+	// read (and possibly a blocked write) and waits for them.
+	select {
+	case err := <-errc:
+		t.Fatalf("Run returned while a read was blocked: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	// Close the server end of the connection, which makes all blocked reads
+	// and writes return.
+	stdinrd.Close()
+	stdoutwr.Close()
+	close(rd.release)
+	if err := <-errc; !errors.Is(err, context.Canceled) {
+		t.Fatalf("unexpected error: got %v, want %v", err, context.Canceled)
+	}
+}
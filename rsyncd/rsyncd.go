@@ -18,21 +18,68 @@ import (
 	"time"
 
 	"github.com/gokrazy/rsync"
+	"github.com/gokrazy/rsync/internal/filter"
 	"github.com/gokrazy/rsync/internal/log"
 	"github.com/gokrazy/rsync/internal/progress"
 	"github.com/gokrazy/rsync/internal/receiver"
+	"github.com/gokrazy/rsync/internal/rsyncchecksum"
+	"github.com/gokrazy/rsync/internal/rsynccommon"
 	"github.com/gokrazy/rsync/internal/rsyncopts"
 	"github.com/gokrazy/rsync/internal/rsyncos"
 	"github.com/gokrazy/rsync/internal/rsyncwire"
 	"github.com/gokrazy/rsync/internal/sender"
 )
 
+// Module is a directory (Path) or file system (FS) served by the rsync
+// daemon. FS can provide the extended attributes of its files (--xattrs) by
+// implementing an Xattrs(name string) (map[string][]byte, error) method, which
+// must not follow symlinks. Their POSIX ACLs (--acls) are taken from the
+// system.posix_acl_access and system.posix_acl_default attributes.
 type Module struct {
 	Name     string   `toml:"name"`
 	Path     string   `toml:"path"` // If empty, FS must be non-nil
 	FS       fs.FS    `toml:"-"`    // If set, serve from this instead of Path
 	ACL      []string `toml:"acl"`
 	Writable bool     `toml:"writable"` // Must be false if FS is set
+
+	// BwLimit is the maximum socket I/O bandwidth (e.g. "1M", see rsync
+	// --bwlimit) of transfers from or to this module. Clients can lower, but
+	// not raise it.
+	BwLimit string `toml:"bwlimit"`
+
+	// IncomingChmod and OutgoingChmod are --chmod rules (e.g. "D755,F644")
+	// which apply to files received into and sent from this module.
+	IncomingChmod string `toml:"incoming_chmod"`
+	OutgoingChmod string `toml:"outgoing_chmod"`
+
+	// MungeLinks makes symlinks received into this module unusable by
+	// prefixing their targets with "/rsyncd-munged/", which is removed again
+	// when sending them (see rsync --munge-links).
+	MungeLinks bool `toml:"munge_links"`
+}
+
+// bwLimit returns the bandwidth limit of the module in KiB/s, or 0 for no
+// limit.
+func (mod *Module) bwLimit() int {
+	if mod == nil || mod.BwLimit == "" {
+		return 0
+	}
+	// The limit was already validated by validateModule.
+	limit, _ := rsyncopts.ParseBwLimit(mod.BwLimit)
+	return limit
+}
+
+// chmod returns the --chmod rules of the module for files which the server
+// sends (sender) or receives.
+func (mod *Module) chmod(sender bool) string {
+	switch {
+	case mod == nil:
+		return ""
+	case sender:
+		return mod.OutgoingChmod
+	default:
+		return mod.IncomingChmod
+	}
 }
 
 // Option specifies the server options.
@@ -66,6 +113,15 @@ func DontRestrict() Option {
 	})
 }
 
+// WithBwLimit specifies the maximum socket I/O bandwidth in KiB/s for all
+// connections (see rsync --daemon --bwlimit). Clients can lower, but not raise
+// it.
+func WithBwLimit(bwlimit int) Option {
+	return serverOptionFunc(func(s *Server) {
+		s.bwlimit = bwlimit
+	})
+}
+
 func NewServer(modules []Module, opts ...Option) (*Server, error) {
 	for _, mod := range modules {
 		if err := validateModule(mod); err != nil {
@@ -109,6 +165,7 @@ type Server struct {
 	stderr       io.Writer
 	logger       log.Logger
 	dontRestrict bool
+	bwlimit      int
 
 	modules []Module
 }
@@ -184,16 +241,22 @@ func checkACL(acls []string, remoteAddr string) error {
 	return nil
 }
 
-// FIXME: context cancellation not yet implemented
+// HandleDaemonConn serves one rsync daemon protocol connection. Once ctx is
+// cancelled, the connection is closed and HandleDaemonConn returns ctx.Err().
 func (s *Server) HandleDaemonConn(ctx context.Context, conn *Conn) (err error) {
-	_ = ctx // not implemented. what would be the best thing to do? wrap conn's reader part with cancelable reader?
+	defer conn.watch(ctx)()
+	defer func() {
+		if err != nil {
+			err = conn.wd.Err(err)
+		}
+	}()
 
 	const terminationCommand = "@RSYNCD: OK\n"
 	cwr := conn.cwr
 	rd := conn.rd
 	// send server greeting
 
-	fmt.Fprintf(cwr, "@RSYNCD: %d\n", rsync.ProtocolVersion)
+	fmt.Fprintf(cwr, "@RSYNCD: %d.0\n", rsync.ProtocolVersion)
 
 	// read client greeting
 	clientGreeting, err := rd.ReadString('\n')
@@ -203,7 +266,23 @@ func (s *Server) HandleDaemonConn(ctx context.Context, conn *Conn) (err error) {
 	if !strings.HasPrefix(clientGreeting, "@RSYNCD: ") {
 		return fmt.Errorf("invalid client greeting: got %q", clientGreeting)
 	}
-	// TODO: protocol negotiation
+	clientGreeting = strings.TrimSpace(strings.TrimPrefix(clientGreeting, "@RSYNCD: "))
+	var remoteProtocol, remoteSub int32
+	n, _ := fmt.Sscanf(clientGreeting, "%d.%d", &remoteProtocol, &remoteSub)
+	if n < 1 {
+		io.WriteString(cwr, "@ERROR: protocol startup error\n")
+		return fmt.Errorf("invalid client greeting: got %q", clientGreeting)
+	}
+	if n < 2 && remoteProtocol >= 30 {
+		fmt.Fprintf(cwr, "@ERROR: your client omitted the subprotocol value: %s\n", clientGreeting)
+		return fmt.Errorf("client omitted the subprotocol value: %q", clientGreeting)
+	}
+	protocol := rsynccommon.NegotiateProtocol(rsync.ProtocolVersion, remoteProtocol, remoteSub)
+	if protocol < rsync.MinProtocolVersion {
+		fmt.Fprintf(cwr, "@ERROR: protocol version mismatch: client protocol %d too old\n", remoteProtocol)
+		return fmt.Errorf("client protocol %d too old", remoteProtocol)
+	}
+	s.logger.Printf("client %v protocol %d, negotiated protocol %d", conn.name, remoteProtocol, protocol)
 
 	// read requested module(s), if any
 	requestedModule, err := rd.ReadString('\n')
@@ -258,6 +337,12 @@ func (s *Server) HandleDaemonConn(ctx context.Context, conn *Conn) (err error) {
 			Writer: cwr,
 		}
 
+		if protocol >= 30 {
+			// compat flags
+			if err := c.WriteVarint(0); err != nil {
+				return err
+			}
+		}
 		const errorSeed = 0xee
 		if err := c.WriteInt32(errorSeed); err != nil {
 			return err
@@ -299,7 +384,7 @@ func (s *Server) HandleDaemonConn(ctx context.Context, conn *Conn) (err error) {
 
 	s.logger.Printf("trimmed paths: %q", pc.RemainingArgs[1:])
 
-	return s.handleConn(ctx, conn, &module, pc, false)
+	return s.handleConn(ctx, conn, &module, pc, protocol)
 }
 
 type Conn struct {
@@ -307,6 +392,20 @@ type Conn struct {
 	crd  *rsyncwire.CountingReader
 	cwr  *rsyncwire.CountingWriter
 	rd   *bufio.Reader
+	wd   *rsynccommon.Watchdog
+}
+
+// watch aborts the connection once ctx is done (or the I/O timeout set on
+// c.wd expires) and returns a function to stop watching. Nested calls share
+// the Watchdog of the outermost call.
+func (c *Conn) watch(ctx context.Context) (stop func()) {
+	if c.wd != nil {
+		return func() {}
+	}
+	c.wd = rsynccommon.NewWatchdog(ctx, c.crd.R, c.cwr.W, 0)
+	c.crd.R = c.wd
+	c.cwr.W = c.wd
+	return c.wd.Stop
 }
 
 func NewConnection(r io.Reader, w io.Writer, name string) *Conn {
@@ -322,7 +421,7 @@ func NewConnection(r io.Reader, w io.Writer, name string) *Conn {
 
 // This method is only exported until we refactor; use HandleConnArgs() instead
 func (s *Server) InternalHandleConn(ctx context.Context, conn *Conn, module *Module, pc *rsyncopts.Context) error {
-	return s.handleConn(ctx, conn, module, pc, true /* negotiate */)
+	return s.handleConn(ctx, conn, module, pc, 0 /* negotiate */)
 }
 
 func (s *Server) HandleConnArgs(ctx context.Context, conn *Conn, module *Module, args []string) error {
@@ -331,17 +430,50 @@ func (s *Server) HandleConnArgs(ctx context.Context, conn *Conn, module *Module,
 	if err := pc.ParseArguments(osenv, args); err != nil {
 		return fmt.Errorf("parsing server args: %v", err)
 	}
-	return s.handleConn(ctx, conn, module, pc, true /* negotiate */)
+	return s.handleConn(ctx, conn, module, pc, 0 /* negotiate */)
+}
+
+// session is the state which the server and the client negotiate when
+// starting a transfer.
+type session struct {
+	seed        int32
+	protocol    int32
+	compatFlags int32
+	checksums   rsyncchecksum.Choice
+
+	// mrd is the demultiplexer of the data sent by the client, which only
+	// multiplexes starting with protocol 30 (nil otherwise).
+	mrd *rsyncwire.MultiplexReader
+	// filesFromReader and filesFromWriter transfer a forwarded --files-from
+	// list, which protocols < 31 send without multiplexing.
+	filesFromReader io.Reader
+	filesFromWriter io.Writer
+
+	// abort aborts the connection, see rsynccommon.Watchdog.Abort.
+	abort func(error)
 }
 
 // handleConn is equivalent to rsync/main.c:start_server
-func (s *Server) handleConn(ctx context.Context, conn *Conn, module *Module, pc *rsyncopts.Context, negotiate bool) (err error) {
+//
+// protocol is the protocol version negotiated in the rsync daemon greeting, or
+// 0 if the protocol versions are exchanged on conn (remote shell connections).
+func (s *Server) handleConn(ctx context.Context, conn *Conn, module *Module, pc *rsyncopts.Context, protocol int32) (err error) {
+	defer conn.watch(ctx)()
+	defer func() {
+		if err != nil {
+			err = conn.wd.Err(err)
+		}
+	}()
 	rd := conn.rd
 	crd := conn.crd
 	cwr := conn.cwr
 	opts := pc.Options
 	paths := pc.RemainingArgs[1:]
 
+	if timeout := opts.IOTimeoutSeconds(); timeout > 0 {
+		conn.wd.SetTimeout(time.Duration(timeout) * time.Second)
+	}
+
 	// “SHOULD be unique to each connection” as per
 	// https://github.com/JohannesBuchner/Jarsync/blob/master/jarsync/rsync.txt
 	//
@@ -349,12 +481,35 @@ func (s *Server) handleConn(ctx context.Context, conn *Conn, module *Module, pc
 	// matter. The goal is to have a checksum seed each time.
 	sessionChecksumSeed := int32(time.Now().Unix()) ^ (int32(os.Getpid()) << 6)
 
+	// rsync/clientserver.c:rsync_module: the client can only lower the
+	// bandwidth limit of the daemon and the module.
+	for _, limit := range []int{s.bwlimit, module.bwLimit()} {
+		if limit > 0 && (opts.BwLimit() == 0 || opts.BwLimit() > limit) {
+			opts.SetBwLimit(limit)
+		}
+	}
+	if bwlimit := opts.BwLimit(); bwlimit > 0 {
+		cwr.W = rsyncwire.NewBwLimitWriter(cwr.W, bwlimit)
+	}
+
+	// rsync/clientserver.c:rsync_module: the client applies its own --chmod
+	// (which is not sent to the server), the server the rules of the module.
+	if spec := module.chmod(opts.Sender()); spec != "" {
+		if err := opts.AddChmod(spec); err != nil {
+			return err
+		}
+	}
+	// rsync/clientserver.c:rsync_module: "munge symlinks"
+	if module != nil && module.MungeLinks {
+		opts.SetMungeLinks()
+	}
+
 	c := &rsyncwire.Conn{
 		Reader: rd,
 		Writer: cwr,
 	}
 
-	if negotiate {
+	if protocol == 0 {
 		remoteProtocol, err := c.ReadInt32()
 		if err != nil {
 			return err
@@ -362,17 +517,64 @@ func (s *Server) handleConn(ctx context.Context, conn *Conn, module *Module, pc
 		if opts.DebugGTE(rsyncopts.DEBUG_PROTO, 1) {
 			s.logger.Printf("remote protocol: %d", remoteProtocol)
 		}
-		if err := c.WriteInt32(rsync.ProtocolVersion); err != nil {
+		if err := c.WriteInt32(opts.ProtocolVersion()); err != nil {
+			return err
+		}
+		protocol = min(opts.ProtocolVersion(), remoteProtocol)
+		if protocol < rsync.MinProtocolVersion {
+			return fmt.Errorf("protocol version mismatch: remote protocol %d too old", remoteProtocol)
+		}
+	}
+
+	// rsync/compat.c:setup_protocol
+	opts.SetDeleteTiming(protocol)
+	if err := opts.CheckProtocol(protocol); err != nil {
+		return err
+	}
+	var compatFlags int32
+	if protocol >= 30 {
+		// The client sends its capabilities in the -e option.
+		clientInfo := opts.ShellCommand()
+		if opts.AllowIncRecurse() && strings.Contains(clientInfo, "i") {
+			compatFlags |= rsync.CF_INC_RECURSE
+		}
+		if strings.Contains(clientInfo, "x") {
+			compatFlags |= rsync.CF_AVOID_XATTR_OPTIM
+		}
+		if strings.Contains(clientInfo, "C") {
+			compatFlags |= rsync.CF_CHKSUM_SEED_FIX
+		}
+		if strings.Contains(clientInfo, "v") {
+			compatFlags |= rsync.CF_VARINT_FLIST_FLAGS
+		}
+		if err := c.WriteVarint(compatFlags); err != nil {
 			return err
 		}
 	}
 
+	checksums, err := rsynccommon.NegotiateChecksums(c, opts, protocol, compatFlags)
+	if err != nil {
+		return err
+	}
+	if opts.DebugGTE(rsyncopts.DEBUG_NSTR, 3) {
+		s.logger.Printf("Server checksum: %s", checksums.Xfer)
+	}
+
 	if err := c.WriteInt32(sessionChecksumSeed); err != nil {
 		return err
 	}
 
-	// Switch to multiplexing protocol, but only for server-side transmissions.
-	// Transmissions received from the client are not multiplexed.
+	sess := session{
+		seed:            sessionChecksumSeed,
+		protocol:        protocol,
+		compatFlags:     compatFlags,
+		checksums:       checksums,
+		filesFromReader: rd,
+		filesFromWriter: cwr,
+		abort:           conn.wd.Abort,
+	}
+
+	// Switch to multiplexing protocol for server-side transmissions.
 	mpx := &rsyncwire.MultiplexWriter{Writer: c.Writer}
 	// Update cwr to track the multiplexed writer,
 	// but copy the number of bytes written.
@@ -382,6 +584,20 @@ func (s *Server) handleConn(ctx context.Context, conn *Conn, module *Module, pc
 	}
 	c.Writer = cwr
 
+	if protocol >= 30 {
+		// Starting with protocol 30, the client multiplexes, too
+		// (need_messages_from_generator).
+		sess.mrd = &rsyncwire.MultiplexReader{
+			Env:    &rsyncos.Env{Stderr: s.stderr},
+			Reader: rd,
+		}
+		c.Reader = bufio.NewReaderSize(sess.mrd, 256*1024)
+	}
+	if protocol >= 31 {
+		sess.filesFromReader = c.Reader
+		sess.filesFromWriter = c.Writer
+	}
+
 	if opts.Sender() {
 		// If returning an error, send the error to the client for display, too:
 		defer func() {
@@ -390,7 +606,7 @@ func (s *Server) handleConn(ctx context.Context, conn *Conn, module *Module, pc
 			}
 		}()
 
-		return s.handleConnSender(module, crd, cwr, paths, opts, false, c, sessionChecksumSeed)
+		return s.handleConnSender(module, crd, cwr, paths, opts, false, c, sess)
 	}
 
 	// If returning an error, send the error to the client for display, too:
@@ -399,11 +615,11 @@ func (s *Server) handleConn(ctx context.Context, conn *Conn, module *Module, pc
 			mpx.WriteMsg(rsyncwire.MsgError, fmt.Appendf(nil, "gokr-rsync [receiver]: %v\n", err))
 		}
 	}()
-	return s.handleConnReceiver(module, crd, cwr, paths, opts, false, c, sessionChecksumSeed)
+	return s.handleConnReceiver(module, crd, cwr, paths, opts, false, c, sess)
 }
 
 // handleConnReceiver is equivalent to rsync/main.c:do_server_recv
-func (s *Server) handleConnReceiver(module *Module, crd *rsyncwire.CountingReader, cwr *rsyncwire.CountingWriter, paths []string, opts *rsyncopts.Options, negotiate bool, c *rsyncwire.Conn, sessionChecksumSeed int32) (err error) {
+func (s *Server) handleConnReceiver(module *Module, crd *rsyncwire.CountingReader, cwr *rsyncwire.CountingWriter, paths []string, opts *rsyncopts.Options, negotiate bool, c *rsyncwire.Conn, sess session) (err error) {
 	var destPath string
 	implicitModule := module == nil
 	if implicitModule {
@@ -427,23 +643,58 @@ func (s *Server) handleConnReceiver(module *Module, crd *rsyncwire.CountingReade
 
 	rt := &receiver.Transfer{
 		Logger: s.logger,
+		Abort:  sess.abort,
 		Opts: &receiver.TransferOpts{
 			DryRun:   opts.DryRun(),
 			Server:   opts.Server(),
 			Verbose:  opts.Verbose(),
 			Progress: opts.Progress(),
 
-			DeleteMode:       opts.DeleteMode(),
-			PreserveGid:      opts.PreserveGid(),
-			PreserveUid:      opts.PreserveUid(),
-			PreserveLinks:    opts.PreserveLinks(),
-			PreservePerms:    opts.PreservePerms(),
-			PreserveDevices:  opts.PreserveDevices(),
-			PreserveSpecials: opts.PreserveSpecials(),
-			PreserveTimes:    opts.PreserveMTimes(),
-			// TODO: PreserveHardlinks: opts.PreserveHardlinks,
-			IgnoreTimes:    opts.IgnoreTimes(),
-			AlwaysChecksum: opts.AlwaysChecksum(),
+			Recurse: opts.Recurse(),
+
+			DeleteMode:   opts.DeleteMode(),
+			DeleteBefore: opts.DeleteBefore(),
+			DeleteDuring: opts.DeleteDuring() == 1,
+			DeleteDelay:  opts.DeleteDuring() == 2,
+			DeleteAfter:  opts.DeleteAfter(),
+			IgnoreErrors: opts.IgnoreErrors(),
+			MaxDelete:    opts.MaxDelete(),
+
+			MakeBackups:  opts.MakeBackups(),
+			BackupDir:    opts.BackupDir(),
+			BackupSuffix: opts.BackupSuffix(),
+			KeepPartial:  opts.KeepPartial(),
+			PartialDir:   opts.PartialDir(),
+			Inplace:      opts.Inplace(),
+			AppendMode:   opts.AppendMode(),
+			Sparse:       opts.SparseFiles(),
+			Preallocate:  opts.PreallocateFiles(),
+			BasisDirs:    opts.BasisDirs(),
+			AltDestType:  opts.AltDestType(),
+			FuzzyBasis:   opts.FuzzyBasis(),
+			WholeFile:    opts.WholeFile(),
+			BlockSize:    opts.BlockSize(),
+
+			PreserveGid:       opts.PreserveGid(),
+			PreserveUid:       opts.PreserveUid(),
+			PreserveLinks:     opts.PreserveLinks(),
+			PreservePerms:     opts.PreservePerms(),
+			PreserveDevices:   opts.PreserveDevices(),
+			PreserveSpecials:  opts.PreserveSpecials(),
+			PreserveTimes:     opts.PreserveMTimes(),
+			PreserveHardlinks: opts.PreserveHardLinks(),
+			IgnoreTimes:       opts.IgnoreTimes(),
+			AlwaysChecksum:    opts.AlwaysChecksum(),
+			Compress:          opts.Compress(),
+
+			PreserveACLs:   opts.PreserveACLs(),
+			PreserveXattrs: opts.PreserveXattrs(),
+			ChmodModes:     opts.ChmodModes(),
+			SafeLinks:      opts.SafeLinks(),
+			MungeLinks:     opts.MungeLinks(),
+			NumericIds:     opts.NumericIds(),
+			UserMap:        opts.UserMap(),
+			GroupMap:       opts.GroupMap(),
 
 			InfoGTE:  opts.InfoGTE,
 			DebugGTE: opts.DebugGTE,
@@ -452,9 +703,16 @@ func (s *Server) handleConnReceiver(module *Module, crd *rsyncwire.CountingReade
 		Env: &rsyncos.Env{
 			Stderr: s.stderr,
 		},
-		Conn:     c,
-		Seed:     sessionChecksumSeed,
-		Progress: progress.NewPrinter(io.Discard, time.Now),
+		Conn:        c,
+		Seed:        sess.seed,
+		Protocol:    sess.protocol,
+		CompatFlags: sess.compatFlags,
+		Checksums:   sess.checksums,
+		Progress:    progress.NewPrinter(io.Discard, time.Now),
+		Items:       rsynccommon.NewItemLog(opts, io.Discard, nil),
+	}
+	if sess.mrd != nil {
+		sess.mrd.IOError = func(flags int32) { rt.IOErrors.Or(flags) }
 	}
 	if err := os.MkdirAll(rt.Dest, 0755); err != nil {
 		return fmt.Errorf("MkdirAll(dest=%s): %v", rt.Dest, err)
@@ -464,6 +722,8 @@ func (s *Server) handleConnReceiver(module *Module, crd *rsyncwire.CountingReade
 		return fmt.Errorf("OpenRoot(dest=%s): %v", rt.Dest, err)
 	}
 	defer rt.DestRoot.Close()
+	moduleRoot := rt.DestRoot
+	destDir := "."
 
 	if !implicitModule {
 		if len(paths) > 1 {
@@ -494,23 +754,50 @@ func (s *Server) handleConnReceiver(module *Module, crd *rsyncwire.CountingReade
 				rt.Dest = filepath.Join(rt.Dest, name)
 			}
 			rt.DestRoot = subRoot
+			destDir = subdir
 			if opts.Verbose() {
 				s.logger.Printf("opened subdirectory %q", rt.Dest)
 			}
 		}
 	}
 
-	if opts.PreserveHardLinks() {
-		return fmt.Errorf("support for hard links not yet implemented")
+	if err := rt.ResolveDirs(); err != nil {
+		return err
+	}
+	if err := rt.ParseIdMaps(); err != nil {
+		return err
+	}
+	if implicitModule {
+		// Like in tridge rsync, alternate basis directories of a
+		// non-daemon server can be anywhere.
+		moduleRoot = nil
+	}
+	if err := rt.OpenBasisDirs(moduleRoot, destDir); err != nil {
+		return err
 	}
+	defer rt.CloseBasisDirs()
 
-	if opts.DeleteMode() {
+	if opts.ReceiverWantsFilterList(sess.protocol) {
 		// receive the exclusion list (openrsync’s is always empty)
-		exclusionList, err := sender.RecvFilterList(c)
+		exclusionList, err := filter.RecvFilterList(c, sess.protocol)
 		if err != nil {
 			return err
 		}
-		s.logger.Printf("exclusion list read (entries: %d)", len(exclusionList.Filters))
+		s.logger.Printf("exclusion list read (entries: %d)", exclusionList.Len())
+		rt.FilterList = exclusionList
+	}
+
+	if ff := opts.FilesFrom(); ff != "" && !opts.FilesFromRemote() {
+		// The client (sender) asked us to forward a --files-from list
+		// stored on our side.
+		f, err := openFilesFrom(module, implicitModule, ff)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if err := receiver.ForwardFilesFrom(sess.filesFromWriter, f, opts.EOLNulls()); err != nil {
+			return err
+		}
 	}
 
 	// receive file list
@@ -531,12 +818,13 @@ func (s *Server) handleConnReceiver(module *Module, crd *rsyncwire.CountingReade
 	if opts.InfoGTE(rsyncopts.INFO_STATS, 1) {
 		s.logger.Printf("stats: %+v", stats)
 	}
-	return nil
+	return rt.ExitError()
 }
 
 // handleConnSender is equivalent to rsync/main.c:do_server_sender
-func (s *Server) handleConnSender(module *Module, crd *rsyncwire.CountingReader, cwr *rsyncwire.CountingWriter, paths []string, opts *rsyncopts.Options, negotiate bool, c *rsyncwire.Conn, sessionChecksumSeed int32) (err error) {
-	if module == nil {
+func (s *Server) handleConnSender(module *Module, crd *rsyncwire.CountingReader, cwr *rsyncwire.CountingWriter, paths []string, opts *rsyncopts.Options, negotiate bool, c *rsyncwire.Conn, sess session) (err error) {
+	implicitModule := module == nil
+	if implicitModule {
 		module = &Module{
 			Name: "implicit",
 			Path: "/",
@@ -544,14 +832,18 @@ func (s *Server) handleConnSender(module *Module, crd *rsyncwire.CountingReader,
 	}
 
 	st := &sender.Transfer{
-		Logger: s.logger,
-		Opts:   opts,
-		Conn:   c,
-		Seed:   sessionChecksumSeed,
+		Logger:      s.logger,
+		Opts:        opts,
+		Conn:        c,
+		Seed:        sess.seed,
+		Protocol:    sess.protocol,
+		CompatFlags: sess.compatFlags,
+		Checksums:   sess.checksums,
 		Env: &rsyncos.Env{
 			Stderr: s.stderr,
 		},
 		Progress: progress.NewPrinter(io.Discard, time.Now),
+		Items:    rsynccommon.NewItemLog(opts, io.Discard, nil),
 	}
 	// receive the exclusion list (openrsync’s is always empty)
 
@@ -559,11 +851,28 @@ func (s *Server) handleConnSender(module *Module, crd *rsyncwire.CountingReader,
 		st.Source = sender.NewFSSource(module.FS)
 	}
 
-	exclusionList, err := sender.RecvFilterList(st.Conn)
+	exclusionList, err := filter.RecvFilterList(st.Conn, sess.protocol)
 	if err != nil {
 		return err
 	}
-	st.Logger.Printf("exclusion list read (entries: %d)", len(exclusionList.Filters))
+	st.Logger.Printf("exclusion list read (entries: %d)", exclusionList.Len())
+
+	if ff := opts.FilesFrom(); ff != "" {
+		// The client forwards its list.
+		r := sess.filesFromReader
+		if !opts.FilesFromRemote() {
+			f, err := openFilesFrom(module, implicitModule, ff)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			r = f
+		}
+		st.FilesFrom, err = sender.ReadFilesFrom(r, opts.EOLNulls(), opts.FilesFromRemote())
+		if err != nil {
+			return err
+		}
+	}
 
 	stats, err := st.Do(crd, cwr, module.Path, paths, exclusionList)
 	if err != nil {
@@ -575,6 +884,25 @@ func (s *Server) handleConnSender(module *Module, crd *rsyncwire.CountingReader,
 	return nil
 }
 
+// openFilesFrom opens the --files-from file which the client specified. The
+// name is relative to the module root, unless the module is implicit (remote
+// shell connections).
+func openFilesFrom(module *Module, implicitModule bool, name string) (io.ReadCloser, error) {
+	if implicitModule {
+		return os.Open(name)
+	}
+	rel := strings.TrimPrefix(filepath.Clean("/"+name), "/")
+	if module.FS != nil {
+		return module.FS.Open(rel)
+	}
+	root, err := os.OpenRoot(module.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer root.Close()
+	return root.Open(rel)
+}
+
 func (s *Server) Serve(ctx context.Context, ln net.Listener) error {
 	go func() {
 		<-ctx.Done()
@@ -619,6 +947,22 @@ func validateModule(mod Module) error {
 			return fmt.Errorf("module %q has empty path", mod.Name)
 		}
 	}
+	if mod.BwLimit != "" {
+		if _, err := rsyncopts.ParseBwLimit(mod.BwLimit); err != nil {
+			return fmt.Errorf("module %q: %v", mod.Name, err)
+		}
+	}
+	for _, spec := range []struct{ setting, modestr string }{
+		{"incoming chmod", mod.IncomingChmod},
+		{"outgoing chmod", mod.OutgoingChmod},
+	} {
+		if spec.modestr == "" {
+			continue
+		}
+		if _, err := rsyncopts.ParseChmod(spec.modestr); err != nil {
+			return fmt.Errorf("module %q: invalid %q setting: %s", mod.Name, spec.setting, spec.modestr)
+		}
+	}
 
 	return nil
 }
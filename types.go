@@ -35,9 +35,18 @@ type SumHead struct {
 	Sums []SumBuf
 }
 
-func (sh *SumHead) ReadFrom(c *rsyncwire.Conn) error {
-	// TODO(protocol>=30): update maxBlockLen
-	const maxBlockLen = 1 << 29 // see rsync.h:OLD_MAX_BLOCK_SIZE
+// MaxBlockSize returns the maximum block length which the specified protocol
+// version allows.
+func MaxBlockSize(protocol int32) int32 {
+	if protocol < 30 {
+		return 1 << 29 // see rsync.h:OLD_MAX_BLOCK_SIZE
+	}
+	return 1 << 17 // see rsync.h:MAX_BLOCK_SIZE
+}
+
+// rsync/io.c:read_sum_head
+func (sh *SumHead) ReadFrom(c *rsyncwire.Conn, protocol int32) error {
+	maxBlockLen := MaxBlockSize(protocol)
 
 	var err error
 	sh.ChecksumCount, err = c.ReadInt32()
@@ -60,8 +69,7 @@ func (sh *SumHead) ReadFrom(c *rsyncwire.Conn) error {
 	if err != nil {
 		return err
 	}
-	// TODO(protocol>=27): update max sh.ChecksumLength check
-	if sh.ChecksumLength < 0 || sh.ChecksumLength > 16 {
+	if sh.ChecksumLength < 0 || sh.ChecksumLength > 16 { // see rsync.h:SUM_LENGTH
 		return fmt.Errorf("invalid checksum length %d", sh.ChecksumLength)
 	}
 
@@ -84,3 +92,14 @@ func (sh *SumHead) WriteTo(c *rsyncwire.Conn) error {
 	buf.WriteInt32(sh.RemainderLength)
 	return c.WriteString(buf.String())
 }
+
+// FileLength returns the length of the basis file which the sums describe.
+// With --append, the generator sends only the SumHead (without sums) to tell
+// the sender how much data the receiver already has.
+func (sh *SumHead) FileLength() int64 {
+	l := int64(sh.ChecksumCount) * int64(sh.BlockLength)
+	if sh.RemainderLength != 0 {
+		l -= int64(sh.BlockLength - sh.RemainderLength)
+	}
+	return l
+}